@@ -26,11 +26,6 @@ var (
 	DITTO_CONTENT_PREFIX   string
 	DB_URL_DITTO           string
 	GCLOUD_PROJECT         string
-	PRICE_ID_TOKENS_1B     string
-	PRICE_ID_TOKENS_11B    string
-	PRICE_ID_TOKENS_30B    string
-	PRICE_ID_TOKENS_100B   string
-	PRICE_ID_TOKENS_150B   string
 	SEARCH_ENGINE_ID       string
 )
 
@@ -118,11 +113,6 @@ func Load() error {
 		{&DITTO_CONTENT_PREFIX, "DITTO_CONTENT_PREFIX"},
 		{&DB_URL_DITTO, "DB_URL_DITTO"},
 		{&GCLOUD_PROJECT, "GCLOUD_PROJECT"},
-		{&PRICE_ID_TOKENS_1B, "PRICE_ID_TOKENS_1B"},
-		{&PRICE_ID_TOKENS_11B, "PRICE_ID_TOKENS_11B"},
-		{&PRICE_ID_TOKENS_30B, "PRICE_ID_TOKENS_30B"},
-		{&PRICE_ID_TOKENS_100B, "PRICE_ID_TOKENS_100B"},
-		{&PRICE_ID_TOKENS_150B, "PRICE_ID_TOKENS_150B"},
 		{&SEARCH_ENGINE_ID, "SEARCH_ENGINE_ID"},
 	}
 	if err := lookupEnvs(envs); err != nil {
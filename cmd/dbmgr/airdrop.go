@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/users"
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
+)
+
+// - MARK: Airdrops
+
+type AirdropCommand struct {
+	Action string
+	Policy users.AirdropPolicy
+	// UID and Amount are the user and amount of an override.
+	UID    string
+	Amount int64
+}
+
+const airdropUsage = `usage: dbmgr [-env <environment>] airdrop <command> [args]
+
+commands:
+  create [flags] <name>          create an airdrop campaign
+  list                           list airdrop campaigns and how much they dropped
+  override <name> <uid> <amount> set a user's amount for a campaign, 0 to exclude them
+`
+
+// Parse parses the airdrop subcommand and its arguments.
+func (c *AirdropCommand) Parse(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, airdropUsage)
+		os.Exit(1)
+	}
+	c.Action = args[0]
+	args = args[1:]
+	switch c.Action {
+	case "create":
+		return c.parseCreate(args)
+	case "list":
+		return nil
+	case "override":
+		if len(args) != 3 {
+			return errors.New("usage: dbmgr airdrop override <name> <uid> <amount>")
+		}
+		c.Policy.Name, c.UID = args[0], args[1]
+		amount, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid amount: %w", err)
+		}
+		c.Amount = amount
+		return nil
+	default:
+		return fmt.Errorf("unknown airdrop command: %s", c.Action)
+	}
+}
+
+func (c *AirdropCommand) parseCreate(args []string) error {
+	var kind, platforms, starts, ends string
+	createFlags := flag.NewFlagSet("airdrop create", flag.ExitOnError)
+	createFlags.Usage = func() {
+		fmt.Fprint(os.Stderr, "usage: dbmgr [-env <environment>] airdrop create [flags] <name>\n")
+		createFlags.PrintDefaults()
+	}
+	createFlags.StringVar(&kind, "kind", string(users.AirdropOnce), "initial, recurring or once")
+	createFlags.Int64Var(&c.Policy.Amount, "amount", 0, "tokens to drop")
+	createFlags.DurationVar(&c.Policy.Period, "period", 24*time.Hour, "how often a recurring airdrop drops")
+	createFlags.BoolVar(&c.Policy.RequireEmail, "require-email", true, "only drop to users with an email")
+	createFlags.BoolVar(&c.Policy.RequireVerifiedEmail, "require-verified-email", false, "only drop to users with a verified email")
+	createFlags.StringVar(&platforms, "platforms", "", "comma separated platforms, such as web,ios (default all)")
+	createFlags.StringVar(&starts, "starts", "", "when the campaign starts, as RFC3339 or YYYY-MM-DD in UTC (default now)")
+	createFlags.StringVar(&ends, "ends", "", "when the campaign ends, as RFC3339 or YYYY-MM-DD in UTC (default never)")
+	createFlags.Parse(args)
+	if createFlags.NArg() != 1 {
+		createFlags.Usage()
+		os.Exit(1)
+	}
+	c.Policy.Name = createFlags.Arg(0)
+	c.Policy.Kind = users.AirdropKind(kind)
+	if c.Policy.Kind != users.AirdropRecurring {
+		c.Policy.Period = 0
+	}
+	if platforms != "" {
+		for _, name := range strings.Split(platforms, ",") {
+			platform, err := users.ParsePlatform(strings.TrimSpace(name))
+			if err != nil {
+				return err
+			}
+			c.Policy.Platforms = append(c.Policy.Platforms, platform)
+		}
+	}
+	var err error
+	if c.Policy.StartsAt, err = parseDateFlag(starts); err != nil {
+		return fmt.Errorf("invalid starts: %w", err)
+	}
+	if c.Policy.EndsAt, err = parseDateFlag(ends); err != nil {
+		return fmt.Errorf("invalid ends: %w", err)
+	}
+	return c.Policy.Validate()
+}
+
+// parseDateFlag parses an optional RFC3339 or YYYY-MM-DD flag, in UTC.
+func parseDateFlag(s string) (sql.NullTime, error) {
+	if s == "" {
+		return sql.NullTime{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, s)
+	}
+	if err != nil {
+		return sql.NullTime{}, err
+	}
+	return sql.NullTime{Time: t, Valid: true}, nil
+}
+
+// Handle runs the airdrop subcommand.
+func (c *AirdropCommand) Handle(ctx context.Context) error {
+	switch c.Action {
+	case "create":
+		if err := c.Policy.Insert(ctx, db.D); err != nil {
+			return err
+		}
+		slog.Info("created airdrop campaign", "id", c.Policy.ID, "name", c.Policy.Name,
+			"kind", c.Policy.Kind, "amount", numfmt.LargeNumber(c.Policy.Amount))
+	case "list":
+		policies, err := users.ListAirdropPolicies(ctx, db.D)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, p := range policies {
+			attrs := []any{
+				"id", p.ID,
+				"kind", p.Kind,
+				"amount", numfmt.LargeNumber(p.Amount),
+				"live", p.Live(now),
+				"grants", p.Grants,
+				"granted", numfmt.LargeNumber(p.Granted),
+			}
+			if p.Kind == users.AirdropRecurring {
+				attrs = append(attrs, "period", p.Period)
+			}
+			if p.RequireEmail {
+				attrs = append(attrs, "requireEmail", true)
+			}
+			if p.RequireVerifiedEmail {
+				attrs = append(attrs, "requireVerifiedEmail", true)
+			}
+			if len(p.Platforms) > 0 {
+				attrs = append(attrs, "platforms", p.Platforms)
+			}
+			if p.StartsAt.Valid {
+				attrs = append(attrs, "starts", p.StartsAt.Time.Format(time.RFC3339))
+			}
+			if p.EndsAt.Valid {
+				attrs = append(attrs, "ends", p.EndsAt.Time.Format(time.RFC3339))
+			}
+			slog.Info(p.Name, attrs...)
+		}
+	case "override":
+		if err := users.SetAirdropOverride(ctx, db.D, c.Policy.Name, c.UID, c.Amount); err != nil {
+			return err
+		}
+		slog.Info("set airdrop override", "name", c.Policy.Name, "uid", c.UID, "amount", numfmt.LargeNumber(c.Amount))
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -41,6 +43,13 @@ const (
 	ModeSyncBalance
 	ModeSetBalance
 	ModeGetConvs
+	ModeAirdrop
+	ModePromo
+	ModeReconcile
+	ModePlan
+	ModeStripe
+	ModePackages
+	ModePurchases
 )
 
 func main() {
@@ -99,6 +108,13 @@ func main() {
 	var version string
 	var userBalance int64
 	var firebaseFlags fireditto.Command
+	var airdropCmd AirdropCommand
+	var promoCmd PromoCommand
+	var planCmd PlanCommand
+	var stripeCmd StripeCommand
+	var packagesCmd PackagesCommand
+	var purchasesCmd PurchasesCommand
+	var fixDrift bool
 	var force bool
 	switch subcommand {
 	case "migrate":
@@ -188,6 +204,48 @@ func main() {
 		}
 		userID = getConvsFlags.Arg(0)
 
+	case "airdrop":
+		if err := airdropCmd.Parse(globalFlags.Args()[1:]); err != nil {
+			log.Fatalf("invalid airdrop command: %s", err)
+		}
+		mode = ModeAirdrop
+
+	case "promo":
+		if err := promoCmd.Parse(globalFlags.Args()[1:]); err != nil {
+			log.Fatalf("invalid promo command: %s", err)
+		}
+		mode = ModePromo
+
+	case "plan":
+		if err := planCmd.Parse(globalFlags.Args()[1:]); err != nil {
+			log.Fatalf("invalid plan command: %s", err)
+		}
+		mode = ModePlan
+
+	case "stripe":
+		if err := stripeCmd.Parse(globalFlags.Args()[1:]); err != nil {
+			log.Fatalf("invalid stripe command: %s", err)
+		}
+		mode = ModeStripe
+
+	case "packages":
+		if err := packagesCmd.Parse(globalFlags.Args()[1:]); err != nil {
+			log.Fatalf("invalid packages command: %s", err)
+		}
+		mode = ModePackages
+
+	case "purchases":
+		if err := purchasesCmd.Parse(globalFlags.Args()[1:]); err != nil {
+			log.Fatalf("invalid purchases command: %s", err)
+		}
+		mode = ModePurchases
+
+	case "reconcile":
+		mode = ModeReconcile
+		reconcileFlags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+		reconcileFlags.BoolVar(&fixDrift, "fix", false, "reset drifted balances to the sum of their ledger entries")
+		reconcileFlags.Parse(globalFlags.Args()[1:])
+
 	default:
 		log.Fatalf("unknown command: %s", subcommand)
 	}
@@ -228,6 +286,34 @@ func main() {
 		if err := setBalance(ctx, userID, userBalance); err != nil {
 			log.Fatalf("failed to set balance: %s", err)
 		}
+	case ModeAirdrop:
+		if err := airdropCmd.Handle(ctx); err != nil {
+			log.Fatalf("failed to handle airdrop: %s", err)
+		}
+	case ModePromo:
+		if err := promoCmd.Handle(ctx); err != nil {
+			log.Fatalf("failed to handle promo: %s", err)
+		}
+	case ModeReconcile:
+		if err := reconcile(ctx, fixDrift); err != nil {
+			log.Fatalf("failed to reconcile: %s", err)
+		}
+	case ModePlan:
+		if err := planCmd.Handle(ctx); err != nil {
+			log.Fatalf("failed to handle plan: %s", err)
+		}
+	case ModeStripe:
+		if err := stripeCmd.Handle(ctx); err != nil {
+			log.Fatalf("failed to handle stripe: %s", err)
+		}
+	case ModePackages:
+		if err := packagesCmd.Handle(ctx); err != nil {
+			log.Fatalf("failed to handle packages: %s", err)
+		}
+	case ModePurchases:
+		if err := purchasesCmd.Handle(ctx); err != nil {
+			log.Fatalf("failed to handle purchases: %s", err)
+		}
 	}
 }
 
@@ -545,6 +631,9 @@ func migrate(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("error reading migration version folders: %w", err)
 	}
+	slices.SortFunc(versionFolders, func(a, b string) int {
+		return compareVersions(filepath.Base(a), filepath.Base(b))
+	})
 
 	for _, versionFolder := range versionFolders {
 		files, err := filepath.Glob(filepath.Join(versionFolder, "*.sql"))
@@ -615,10 +704,12 @@ func rollback(ctx context.Context, version string) error {
 	if err != nil {
 		return fmt.Errorf("error reading rollback files: %w", err)
 	}
-	slices.Reverse(rollbackFiles)
+	slices.SortFunc(rollbackFiles, func(a, b string) int {
+		return compareVersions(strings.TrimSuffix(filepath.Base(b), ".sql"), strings.TrimSuffix(filepath.Base(a), ".sql"))
+	})
 	for _, file := range rollbackFiles {
 		fileVersion := strings.TrimSuffix(filepath.Base(file), ".sql")
-		if fileVersion <= version {
+		if compareVersions(fileVersion, version) <= 0 {
 			break // Stop rolling back once we reach the target version
 		}
 		if err := applyRollback(ctx, file); err != nil {
@@ -673,6 +764,27 @@ func applyRollback(ctx context.Context, file string) error {
 	return nil
 }
 
+// compareVersions compares versions such as v0.0.2 and v0.0.12 numerically,
+// so that v0.0.12 comes after v0.0.2.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		if aerr != nil || berr != nil {
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+			continue
+		}
+		if an != bn {
+			return cmp.Compare(an, bn)
+		}
+	}
+	return cmp.Compare(len(as), len(bs))
+}
+
 // splitSQLStatements splits a SQL script into individual statements,
 // respecting SQL strings and comments
 func splitSQLStatements(script string) []string {
@@ -733,27 +845,55 @@ func getLatestVersion(ctx context.Context) (string, error) {
 func setBalance(ctx context.Context, uid string, balance int64) error {
 	slog.Info("setting user balance", "uid", uid, "balance", numfmt.LargeNumber(balance))
 
-	result, err := db.D.ExecContext(ctx,
-		"UPDATE users SET balance = ? WHERE uid = ?",
-		balance, uid)
-	if err != nil {
-		return fmt.Errorf("error updating balance: %w", err)
+	var userID int64
+	err := db.D.QueryRowContext(ctx, "SELECT id FROM users WHERE uid = ?", uid).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user found with uid: %s", uid)
 	}
-
-	rows, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("error getting rows affected: %w", err)
+		return fmt.Errorf("error getting user: %w", err)
 	}
-	if rows == 0 {
-		return fmt.Errorf("no user found with uid: %s", uid)
+	delta, err := db.SetBalance(ctx, db.D, userID, balance, "dbmgr setbal")
+	if err != nil {
+		return fmt.Errorf("error updating balance: %w", err)
 	}
 
 	slog.Info("successfully set balance",
 		"uid", uid,
+		"change", numfmt.LargeNumber(delta),
 		"new_balance", numfmt.LargeNumber(balance))
 	return nil
 }
 
+// - MARK: Reconcile
+
+func reconcile(ctx context.Context, fix bool) error {
+	slog.Info("reconciling balances with the ledger", "fix", fix)
+	rec, err := db.Reconcile(ctx)
+	if err != nil {
+		return err
+	}
+	for _, u := range rec.Unbalanced {
+		slog.Warn("unbalanced transfer", "type", u.Type, "reference", u.ReferenceID, "sum", numfmt.LargeNumber(u.Sum))
+	}
+	for _, d := range rec.Drifts {
+		slog.Warn("balance drift",
+			"uid", d.UID,
+			"balance", numfmt.LargeNumber(d.Balance),
+			"ledger", numfmt.LargeNumber(d.Ledger),
+			"drift", numfmt.LargeNumber(d.Balance-d.Ledger))
+		if !fix {
+			continue
+		}
+		if err := db.ResetBalance(ctx, d.UserID); err != nil {
+			return err
+		}
+		slog.Info("reset balance to ledger", "uid", d.UID, "balance", numfmt.LargeNumber(d.Ledger))
+	}
+	slog.Info("reconciled balances", "drifted", len(rec.Drifts), "unbalanced", len(rec.Unbalanced))
+	return nil
+}
+
 func truncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
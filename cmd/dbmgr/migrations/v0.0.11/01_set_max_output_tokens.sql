@@ -0,0 +1,23 @@
+-- Per-model output limits, used to validate maxOutputTokens on prompts
+UPDATE services SET max_output_tokens = 4096
+WHERE name IN ('claude-3-haiku', 'claude-3-haiku@20240307');
+
+UPDATE services SET max_output_tokens = 8192
+WHERE name IN (
+    'claude-3-5-haiku', 'claude-3-5-haiku@20241022',
+    'claude-3-5-sonnet', 'claude-3-5-sonnet@20240620',
+    'claude-3-5-sonnet-v2', 'claude-3-5-sonnet-v2@20241022',
+    'gemini-1.5-flash', 'gemini-1.5-pro',
+    'mistral-nemo', 'mistral-large',
+    'meta/llama-3.3-70b-instruct-maas',
+    'llama3.1-8b', 'llama-3.3-70b'
+);
+
+UPDATE services SET max_output_tokens = 16384
+WHERE name IN ('gpt-4o', 'gpt-4o-2024-11-20', 'gpt-4o-mini', 'gpt-4o-mini-2024-07-18');
+
+UPDATE services SET max_output_tokens = 32768
+WHERE name IN ('o1-preview', 'o1-preview-2024-09-12');
+
+UPDATE services SET max_output_tokens = 65536
+WHERE name IN ('o1-mini', 'o1-mini-2024-09-12');
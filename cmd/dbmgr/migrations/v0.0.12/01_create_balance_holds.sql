@@ -0,0 +1,64 @@
+-- Holds reserve the most a prompt could cost before the model is called.
+-- A hold is active until it is released, either when its receipt settles it
+-- or by the handler if the prompt fails, or until it expires.
+CREATE TABLE IF NOT EXISTS balance_holds (
+  id INTEGER PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  service_id INTEGER NOT NULL,
+  amount INTEGER NOT NULL,
+  -- The actual cost, set when a receipt settles the hold
+  settled_amount INTEGER,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  expires_at DATETIME NOT NULL,
+  released_at DATETIME,
+  FOREIGN KEY (user_id) REFERENCES users(id),
+  FOREIGN KEY (service_id) REFERENCES services(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_balance_holds_user_released ON balance_holds(user_id, released_at);
+
+ALTER TABLE receipts ADD COLUMN hold_id INTEGER;
+
+DROP TRIGGER IF EXISTS after_insert_receipts;
+
+CREATE TRIGGER after_insert_receipts
+AFTER INSERT ON receipts
+FOR EACH ROW
+BEGIN
+    -- Calculate the ditto_token_cost and update the newly inserted row
+    UPDATE receipts
+    SET ditto_token_cost = (
+        SELECT MAX(1, ROUND(
+            (COALESCE(base_cost_per_call, 0) * tpu.count +
+             COALESCE(base_cost_per_million_tokens * (NEW.total_tokens / 1000000.0), 0) * tpu.count +
+             COALESCE(base_cost_per_million_input_tokens * (NEW.input_tokens / 1000000.0), 0) * tpu.count +
+             COALESCE(base_cost_per_million_output_tokens * (NEW.output_tokens / 1000000.0), 0) * tpu.count +
+             COALESCE(base_cost_per_image * NEW.num_images, 0) * tpu.count +
+             COALESCE(base_cost_per_search * NEW.num_searches, 0) * tpu.count +
+             COALESCE(base_cost_per_second * NEW.call_duration_seconds, 0) * tpu.count +
+             COALESCE(base_cost_per_gb_processed * (NEW.data_processed_bytes / 1073741824.0), 0) * tpu.count +
+             COALESCE(base_cost_per_gb_stored * (NEW.data_stored_bytes / 1073741824.0), 0) * tpu.count
+            ) * (1 + profit_margin_percentage / 100.0)
+        ))
+        FROM services, tokens_per_unit AS tpu
+        WHERE services.id = NEW.service_id AND tpu.name = 'dollar'
+    )
+    WHERE id = NEW.id;
+    -- Update the user's balance
+    UPDATE users
+    SET balance = balance - (
+        SELECT ditto_token_cost
+        FROM receipts
+        WHERE id = NEW.id
+    )
+    WHERE id = NEW.user_id;
+    -- Settle the hold the receipt was charged against, releasing the remainder
+    UPDATE balance_holds
+    SET settled_amount = (
+        SELECT ditto_token_cost
+        FROM receipts
+        WHERE id = NEW.id
+    ),
+        released_at = CURRENT_TIMESTAMP
+    WHERE id = NEW.hold_id AND released_at IS NULL;
+END;
@@ -0,0 +1,19 @@
+-- Every receipt has a unique key, so retrying an insert never charges twice.
+-- Receipts from before this migration have no key; NULLs do not conflict.
+ALTER TABLE receipts ADD COLUMN idempotency_key TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_receipts_idempotency_key ON receipts(idempotency_key);
+
+-- Receipts whose insert failed, retried with backoff until they are recorded
+CREATE TABLE IF NOT EXISTS receipt_retries (
+  id INTEGER PRIMARY KEY,
+  idempotency_key TEXT NOT NULL UNIQUE,
+  -- The db.Receipt as JSON
+  receipt JSON NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  last_error TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  next_attempt_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_receipt_retries_next_attempt ON receipt_retries(next_attempt_at);
@@ -0,0 +1,14 @@
+-- Spending caps set by users, in Ditto tokens. A NULL cap is no limit.
+-- Daily and monthly spend is summed from receipts since the start of the
+-- UTC day or month, using idx_receipts_user_timestamp.
+CREATE TABLE IF NOT EXISTS user_limits (
+  user_id INTEGER PRIMARY KEY,
+  daily_limit INTEGER,
+  monthly_limit INTEGER,
+  per_request_limit INTEGER,
+  -- The percentage of a daily or monthly cap at which the user is alerted
+  alert_percentage INTEGER NOT NULL DEFAULT 80,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
@@ -0,0 +1,57 @@
+-- Airdrop campaigns, evaluated whenever a user checks their balance.
+-- An initial policy drops once, when the user is created.
+-- A recurring policy drops once every period_seconds.
+-- A once policy drops the first time an eligible user checks their balance.
+CREATE TABLE IF NOT EXISTS airdrop_policies (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE,
+  kind TEXT NOT NULL CHECK (kind IN ('initial', 'recurring', 'once')),
+  amount INTEGER NOT NULL,
+  period_seconds INTEGER NOT NULL DEFAULT 0,
+  require_email BOOLEAN NOT NULL DEFAULT 1,
+  require_verified_email BOOLEAN NOT NULL DEFAULT 0,
+  -- Comma separated users.Platform values, or NULL for every platform
+  platforms TEXT,
+  starts_at DATETIME,
+  ends_at DATETIME,
+  is_active BOOLEAN NOT NULL DEFAULT 1,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Per-user amounts, replacing the policy's amount. An amount of 0 excludes the user.
+CREATE TABLE IF NOT EXISTS airdrop_policy_overrides (
+  policy_id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL,
+  amount INTEGER NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (policy_id, user_id),
+  FOREIGN KEY (policy_id) REFERENCES airdrop_policies(id),
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_airdrop_policy_overrides_user_id ON airdrop_policy_overrides(user_id);
+
+-- Every airdrop, by policy. A recurring policy's period starts at its last grant.
+CREATE TABLE IF NOT EXISTS airdrop_grants (
+  id INTEGER PRIMARY KEY,
+  policy_id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL,
+  amount INTEGER NOT NULL,
+  granted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (policy_id) REFERENCES airdrop_policies(id),
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_airdrop_grants_user_policy ON airdrop_grants(user_id, policy_id, granted_at);
+
+-- The airdrops that were hard coded before.
+INSERT OR IGNORE INTO airdrop_policies (name, kind, amount, period_seconds)
+VALUES
+  ('initial', 'initial', 250000000, 0),
+  ('daily', 'recurring', 20000000, 86400);
+
+-- Carry over each user's last daily airdrop, so no one gets a second one today.
+INSERT INTO airdrop_grants (policy_id, user_id, amount, granted_at)
+SELECT p.id, u.id, 0, u.last_airdrop_at
+FROM users u, airdrop_policies p
+WHERE p.name = 'daily' AND u.last_airdrop_at IS NOT NULL;
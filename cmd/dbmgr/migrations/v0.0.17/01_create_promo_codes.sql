@@ -0,0 +1,58 @@
+-- Codes that grant tokens when redeemed, once per user.
+-- A promo code grants tokens to whoever redeems it.
+-- A referral code belongs to a user, and grants tokens to both them and whoever redeems it.
+CREATE TABLE IF NOT EXISTS promo_codes (
+  id INTEGER PRIMARY KEY,
+  code TEXT NOT NULL UNIQUE COLLATE NOCASE,
+  kind TEXT NOT NULL DEFAULT 'promo' CHECK (kind IN ('promo', 'referral')),
+  tokens INTEGER NOT NULL,
+  -- The owner of a referral code, and the tokens they get for each redemption
+  referrer_id INTEGER,
+  referrer_tokens INTEGER NOT NULL DEFAULT 0,
+  -- NULL for unlimited redemptions
+  max_redemptions INTEGER,
+  redemptions INTEGER NOT NULL DEFAULT 0,
+  expires_at DATETIME,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (referrer_id) REFERENCES users(id)
+);
+
+-- Each user has at most one referral code.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_promo_codes_referrer_id ON promo_codes(referrer_id) WHERE referrer_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS promo_redemptions (
+  id INTEGER PRIMARY KEY,
+  code_id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL,
+  kind TEXT NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (code_id, user_id),
+  FOREIGN KEY (code_id) REFERENCES promo_codes(id),
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Each user can be referred only once.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_promo_redemptions_referral ON promo_redemptions(user_id) WHERE kind = 'referral';
+
+-- Tokens granted for free, next to the tokens bought in purchases.
+CREATE TABLE IF NOT EXISTS token_grants (
+  id INTEGER PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  tokens INTEGER NOT NULL,
+  reason TEXT NOT NULL CHECK (reason IN ('promo', 'referral', 'referrer')),
+  redemption_id INTEGER,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES users(id),
+  FOREIGN KEY (redemption_id) REFERENCES promo_redemptions(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_token_grants_user_id ON token_grants(user_id);
+
+CREATE TRIGGER IF NOT EXISTS after_insert_token_grants
+AFTER INSERT ON token_grants
+FOR EACH ROW
+BEGIN
+    UPDATE users
+    SET balance = balance + NEW.tokens
+    WHERE id = NEW.user_id;
+END;
@@ -0,0 +1,134 @@
+-- A double-entry ledger of Ditto tokens. Every transfer is a pair of entries,
+-- identified by its type and reference_id, whose amounts sum to zero:
+-- one in the user's account, and one in the system account of its type,
+-- which the tokens came from or went to. The reference_id is the ID of the
+-- purchase, receipt, airdrop grant or token grant, or a random ID for admin changes.
+-- users.balance is the sum of the user's entries. It is updated by a trigger
+-- when an entry is posted, and dbmgr reconcile reports any drift.
+CREATE TABLE IF NOT EXISTS ledger_entries (
+  id INTEGER PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  account TEXT NOT NULL CHECK (account IN ('user', 'system')),
+  type TEXT NOT NULL CHECK (type IN ('purchase', 'airdrop', 'usage', 'admin', 'refund', 'promo')),
+  reference_id TEXT NOT NULL,
+  -- Positive amounts credit the account, negative amounts debit it
+  amount INTEGER NOT NULL,
+  memo TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (type, reference_id, account),
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_user_account ON ledger_entries(user_id, account);
+
+-- Open the ledger with each user's balance, before the trigger below would add it again.
+INSERT INTO ledger_entries (user_id, account, type, reference_id, amount, memo)
+SELECT id, 'user', 'admin', 'opening:' || id, balance, 'opening balance'
+FROM users WHERE balance != 0;
+
+INSERT INTO ledger_entries (user_id, account, type, reference_id, amount, memo)
+SELECT id, 'system', 'admin', 'opening:' || id, -balance, 'opening balance'
+FROM users WHERE balance != 0;
+
+CREATE TRIGGER IF NOT EXISTS after_insert_ledger_entries
+AFTER INSERT ON ledger_entries
+FOR EACH ROW
+WHEN NEW.account = 'user'
+BEGIN
+    UPDATE users
+    SET balance = balance + NEW.amount
+    WHERE id = NEW.user_id;
+END;
+
+-- Purchases, token grants, airdrops and receipts post to the ledger instead of updating the balance.
+DROP TRIGGER IF EXISTS after_insert_purchases;
+
+CREATE TRIGGER IF NOT EXISTS after_insert_purchases
+AFTER INSERT ON purchases
+FOR EACH ROW
+BEGIN
+    INSERT INTO ledger_entries (user_id, account, type, reference_id, amount)
+    VALUES
+        (NEW.user_id, 'user', 'purchase', CAST(NEW.id AS TEXT), NEW.tokens),
+        (NEW.user_id, 'system', 'purchase', CAST(NEW.id AS TEXT), -NEW.tokens);
+END;
+
+DROP TRIGGER IF EXISTS after_insert_token_grants;
+
+CREATE TRIGGER IF NOT EXISTS after_insert_token_grants
+AFTER INSERT ON token_grants
+FOR EACH ROW
+BEGIN
+    INSERT INTO ledger_entries (user_id, account, type, reference_id, amount, memo)
+    VALUES
+        (NEW.user_id, 'user', 'promo', CAST(NEW.id AS TEXT), NEW.tokens, NEW.reason),
+        (NEW.user_id, 'system', 'promo', CAST(NEW.id AS TEXT), -NEW.tokens, NEW.reason);
+END;
+
+CREATE TRIGGER IF NOT EXISTS after_insert_airdrop_grants
+AFTER INSERT ON airdrop_grants
+FOR EACH ROW
+WHEN NEW.amount != 0
+BEGIN
+    INSERT INTO ledger_entries (user_id, account, type, reference_id, amount)
+    VALUES
+        (NEW.user_id, 'user', 'airdrop', CAST(NEW.id AS TEXT), NEW.amount),
+        (NEW.user_id, 'system', 'airdrop', CAST(NEW.id AS TEXT), -NEW.amount);
+END;
+
+-- Receipts priced by the server.
+CREATE TRIGGER IF NOT EXISTS after_insert_receipts_ledger
+AFTER INSERT ON receipts
+FOR EACH ROW
+WHEN NEW.ditto_token_cost IS NOT NULL
+BEGIN
+    INSERT INTO ledger_entries (user_id, account, type, reference_id, amount)
+    VALUES
+        (NEW.user_id, 'user', 'usage', CAST(NEW.id AS TEXT), -NEW.ditto_token_cost),
+        (NEW.user_id, 'system', 'usage', CAST(NEW.id AS TEXT), NEW.ditto_token_cost);
+END;
+
+-- Receipts priced by this trigger, such as those inserted by older servers.
+DROP TRIGGER IF EXISTS after_insert_receipts;
+
+CREATE TRIGGER after_insert_receipts
+AFTER INSERT ON receipts
+FOR EACH ROW
+WHEN NEW.ditto_token_cost IS NULL
+BEGIN
+    -- Calculate the ditto_token_cost and update the newly inserted row
+    UPDATE receipts
+    SET ditto_token_cost = (
+        SELECT MAX(1, ROUND(
+            (COALESCE(base_cost_per_call, 0) * tpu.count +
+             COALESCE(base_cost_per_million_tokens * (NEW.total_tokens / 1000000.0), 0) * tpu.count +
+             COALESCE(base_cost_per_million_input_tokens * (NEW.input_tokens / 1000000.0), 0) * tpu.count +
+             COALESCE(base_cost_per_million_output_tokens * (NEW.output_tokens / 1000000.0), 0) * tpu.count +
+             COALESCE(base_cost_per_image * NEW.num_images, 0) * tpu.count +
+             COALESCE(base_cost_per_search * NEW.num_searches, 0) * tpu.count +
+             COALESCE(base_cost_per_second * NEW.call_duration_seconds, 0) * tpu.count +
+             COALESCE(base_cost_per_gb_processed * (NEW.data_processed_bytes / 1073741824.0), 0) * tpu.count +
+             COALESCE(base_cost_per_gb_stored * (NEW.data_stored_bytes / 1073741824.0), 0) * tpu.count
+            ) * (1 + profit_margin_percentage / 100.0)
+        ))
+        FROM services, tokens_per_unit AS tpu
+        WHERE services.id = NEW.service_id AND tpu.name = 'dollar'
+    )
+    WHERE id = NEW.id;
+    -- Debit the user's balance through the ledger
+    INSERT INTO ledger_entries (user_id, account, type, reference_id, amount)
+    SELECT NEW.user_id, 'user', 'usage', CAST(NEW.id AS TEXT), -ditto_token_cost
+    FROM receipts WHERE id = NEW.id;
+    INSERT INTO ledger_entries (user_id, account, type, reference_id, amount)
+    SELECT NEW.user_id, 'system', 'usage', CAST(NEW.id AS TEXT), ditto_token_cost
+    FROM receipts WHERE id = NEW.id;
+    -- Settle the hold the receipt was charged against, releasing the remainder
+    UPDATE balance_holds
+    SET settled_amount = (
+        SELECT ditto_token_cost
+        FROM receipts
+        WHERE id = NEW.id
+    ),
+        released_at = CURRENT_TIMESTAMP
+    WHERE id = NEW.hold_id AND released_at IS NULL;
+END;
@@ -0,0 +1,32 @@
+-- Monthly plans, sold as Stripe subscriptions.
+-- Each paid billing period grants the plan's monthly tokens.
+CREATE TABLE IF NOT EXISTS subscription_plans (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE,
+  stripe_price_id TEXT NOT NULL UNIQUE,
+  monthly_tokens INTEGER NOT NULL CHECK (monthly_tokens > 0),
+  is_active BOOLEAN NOT NULL DEFAULT 1,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A user's Stripe subscription, kept in sync by the webhook.
+-- status is the Stripe subscription status, such as active, past_due or canceled.
+CREATE TABLE IF NOT EXISTS subscriptions (
+  id INTEGER PRIMARY KEY,
+  stripe_subscription_id TEXT NOT NULL UNIQUE,
+  user_id INTEGER NOT NULL,
+  plan_id INTEGER NOT NULL,
+  status TEXT NOT NULL,
+  current_period_end DATETIME,
+  cancel_at_period_end BOOLEAN NOT NULL DEFAULT 0,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES users(id),
+  FOREIGN KEY (plan_id) REFERENCES subscription_plans(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_user_id ON subscriptions(user_id);
+
+-- A monthly allowance is a purchase whose payment_id is the paid invoice,
+-- so it is posted to the ledger like any other purchase.
+ALTER TABLE purchases ADD COLUMN subscription_id INTEGER REFERENCES subscriptions(id);
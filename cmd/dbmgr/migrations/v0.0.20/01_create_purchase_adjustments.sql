@@ -0,0 +1,41 @@
+-- Purchases reversed by a Stripe refund or dispute, kept for audit.
+-- tokens is negative when tokens are taken back, and positive when we win
+-- a dispute and the tokens are restored.
+-- A reversal may leave the balance negative, which flags the adjustment.
+CREATE TABLE IF NOT EXISTS purchase_adjustments (
+  id INTEGER PRIMARY KEY,
+  purchase_id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL,
+  kind TEXT NOT NULL CHECK (kind IN ('refund', 'dispute', 'dispute_won')),
+  -- The charge and total refunded for refunds, or the dispute, so a retried event is not applied twice
+  reference_id TEXT NOT NULL,
+  cents INTEGER NOT NULL,
+  tokens INTEGER NOT NULL,
+  balance_after INTEGER NOT NULL,
+  flagged BOOLEAN NOT NULL DEFAULT 0,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (kind, reference_id),
+  FOREIGN KEY (purchase_id) REFERENCES purchases(id),
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_purchase_adjustments_purchase_id ON purchase_adjustments(purchase_id);
+
+CREATE INDEX IF NOT EXISTS idx_purchase_adjustments_flagged ON purchase_adjustments(user_id) WHERE flagged;
+
+CREATE TRIGGER IF NOT EXISTS after_insert_purchase_adjustments
+AFTER INSERT ON purchase_adjustments
+FOR EACH ROW
+WHEN NEW.tokens != 0
+BEGIN
+    INSERT INTO ledger_entries (user_id, account, type, reference_id, amount, memo)
+    VALUES
+        (NEW.user_id, 'user', 'refund', CAST(NEW.id AS TEXT), NEW.tokens, NEW.kind),
+        (NEW.user_id, 'system', 'refund', CAST(NEW.id AS TEXT), -NEW.tokens, NEW.kind);
+END;
+
+-- Refunds and disputes name the payment intent. For a one-time purchase it is
+-- the payment_id, but a monthly allowance is paid by its invoice's payment intent.
+ALTER TABLE purchases ADD COLUMN payment_intent_id TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_purchases_payment_intent_id ON purchases(payment_intent_id);
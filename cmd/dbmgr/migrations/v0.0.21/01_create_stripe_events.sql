@@ -0,0 +1,16 @@
+-- Stripe webhook events, so that each is processed once however often Stripe delivers it.
+-- An event is claimed as processing, then marked succeeded or failed.
+-- Failed events are processed again when Stripe retries them, or by dbmgr stripe replay.
+CREATE TABLE IF NOT EXISTS stripe_events (
+  id TEXT PRIMARY KEY,
+  type TEXT NOT NULL,
+  -- The verified event as delivered
+  payload JSON NOT NULL,
+  status TEXT NOT NULL DEFAULT 'processing' CHECK (status IN ('processing', 'succeeded', 'failed')),
+  attempts INTEGER NOT NULL DEFAULT 1,
+  last_error TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_stripe_events_status ON stripe_events(status);
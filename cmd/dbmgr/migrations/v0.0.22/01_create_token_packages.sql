@@ -0,0 +1,16 @@
+-- Token packages sold in the store, each a one-time Stripe price.
+-- tokens is what a purchase credits, including bonus_percent over the base rate.
+-- Amounts no package matches are bought as that many of the cheapest active
+-- package, and credited at its rate. Run dbmgr packages seed to add the defaults.
+CREATE TABLE IF NOT EXISTS token_packages (
+  id INTEGER PRIMARY KEY,
+  stripe_price_id TEXT NOT NULL,
+  usd INTEGER NOT NULL CHECK (usd > 0),
+  tokens INTEGER NOT NULL CHECK (tokens > 0),
+  bonus_percent INTEGER NOT NULL DEFAULT 0,
+  is_active BOOLEAN NOT NULL DEFAULT 1,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- To change a package, deactivate it and create another for the same amount.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_token_packages_active_usd ON token_packages(usd) WHERE is_active;
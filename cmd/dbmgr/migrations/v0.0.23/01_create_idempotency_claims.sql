@@ -0,0 +1,15 @@
+-- A request with an Idempotency-Key claims it before the model is called,
+-- so that concurrent duplicates are refused instead of all being served.
+-- A claim expires if its request never finishes, so the client can retry it.
+CREATE TABLE IF NOT EXISTS idempotency_claims (
+  idempotency_key TEXT PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  -- NULL once the request's receipt is saved, after which the claim is kept
+  expires_at DATETIME,
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Receipts that fail too many times are no longer retried,
+-- and are kept for an operator to resolve.
+ALTER TABLE receipt_retries ADD COLUMN dead_at DATETIME;
@@ -0,0 +1,17 @@
+-- The owner of a referral code is rewarded when a user who redeemed it first
+-- pays, rather than when it is redeemed, so throwaway accounts cannot farm
+-- referral rewards. Each redemption rewards its referrer at most once.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_token_grants_referrer ON token_grants(redemption_id) WHERE reason = 'referrer';
+
+CREATE TRIGGER IF NOT EXISTS after_insert_purchases_referrer
+AFTER INSERT ON purchases
+FOR EACH ROW
+WHEN NEW.cents > 0
+BEGIN
+    INSERT OR IGNORE INTO token_grants (user_id, tokens, reason, redemption_id)
+    SELECT promo_codes.referrer_id, promo_codes.referrer_tokens, 'referrer', promo_redemptions.id
+    FROM promo_redemptions
+    JOIN promo_codes ON promo_codes.id = promo_redemptions.code_id
+    WHERE promo_redemptions.user_id = NEW.user_id AND promo_redemptions.kind = 'referral'
+        AND promo_codes.referrer_id IS NOT NULL AND promo_codes.referrer_tokens > 0;
+END;
@@ -0,0 +1,33 @@
+-- Token packages are the single source of what the store sells. A package
+-- without a Stripe price is checked out at usd dollars, so the packages sold
+-- before they were stored in the database are seeded here.
+CREATE TABLE IF NOT EXISTS token_packages_new (
+  id INTEGER PRIMARY KEY,
+  stripe_price_id TEXT,
+  usd INTEGER NOT NULL CHECK (usd > 0),
+  tokens INTEGER NOT NULL CHECK (tokens > 0),
+  bonus_percent INTEGER NOT NULL DEFAULT 0,
+  is_active BOOLEAN NOT NULL DEFAULT 1,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO token_packages_new (id, stripe_price_id, usd, tokens, bonus_percent, is_active, created_at)
+SELECT id, stripe_price_id, usd, tokens, bonus_percent, is_active, created_at
+FROM token_packages;
+
+DROP TABLE token_packages;
+
+ALTER TABLE token_packages_new RENAME TO token_packages;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_token_packages_active_usd ON token_packages(usd) WHERE is_active;
+
+INSERT INTO token_packages (usd, tokens, bonus_percent)
+SELECT column1, column2, column3
+FROM (VALUES
+  (1, 1000000000, 0),
+  (10, 11000000000, 10),
+  (25, 30000000000, 20),
+  (75, 100000000000, 33),
+  (100, 150000000000, 50)
+)
+WHERE NOT EXISTS (SELECT 1 FROM token_packages);
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
+)
+
+// - MARK: Token Packages
+
+type PackagesCommand struct {
+	Action  string
+	Package db.TokenPackage
+}
+
+const packagesUsage = `usage: dbmgr [-env <environment>] packages <command> [args]
+
+commands:
+  create [flags]  create a token package
+  deactivate <id> stop selling a token package
+  list            list token packages
+`
+
+// Parse parses the packages subcommand and its arguments.
+func (c *PackagesCommand) Parse(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, packagesUsage)
+		os.Exit(1)
+	}
+	c.Action = args[0]
+	args = args[1:]
+	switch c.Action {
+	case "create":
+		createFlags := flag.NewFlagSet("packages create", flag.ExitOnError)
+		createFlags.StringVar(&c.Package.StripePriceID, "price", "", "ID of the one-time Stripe price, if not checked out at -usd")
+		createFlags.Int64Var(&c.Package.USD, "usd", 0, "price in dollars")
+		createFlags.Int64Var(&c.Package.Tokens, "tokens", 0, "tokens credited, including the bonus")
+		createFlags.Int64Var(&c.Package.BonusPercent, "bonus", 0, "bonus percent over the base rate, shown in the store")
+		createFlags.Parse(args)
+		return nil
+	case "deactivate":
+		if len(args) != 1 {
+			return errors.New("usage: dbmgr packages deactivate <id>")
+		}
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid id: %w", err)
+		}
+		c.Package.ID = id
+		return nil
+	case "list":
+		return nil
+	default:
+		return fmt.Errorf("unknown packages command: %s", c.Action)
+	}
+}
+
+// Handle runs the packages subcommand.
+func (c *PackagesCommand) Handle(ctx context.Context) error {
+	switch c.Action {
+	case "create":
+		if err := c.Package.Insert(ctx); err != nil {
+			return err
+		}
+		slog.Info("created token package", "id", c.Package.ID, "usd", c.Package.USD,
+			"tokens", numfmt.LargeNumber(c.Package.Tokens))
+	case "deactivate":
+		if err := db.DeactivatePackage(ctx, c.Package.ID); err != nil {
+			return err
+		}
+		slog.Info("deactivated token package", "id", c.Package.ID)
+	case "list":
+		packages, err := db.ListPackages(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range packages {
+			slog.Info(fmt.Sprintf("$%d", p.USD),
+				"id", p.ID,
+				"price", p.StripePriceID,
+				"tokens", numfmt.LargeNumber(p.Tokens),
+				"bonus", p.BonusPercent,
+				"active", p.IsActive,
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
+)
+
+// - MARK: Subscription Plans
+
+type PlanCommand struct {
+	Action string
+	Plan   db.SubscriptionPlan
+}
+
+const planUsage = `usage: dbmgr [-env <environment>] plan <command> [args]
+
+commands:
+  create [flags] <name> create a subscription plan for a monthly Stripe price
+  list                  list subscription plans and their subscribers
+`
+
+// Parse parses the plan subcommand and its arguments.
+func (c *PlanCommand) Parse(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, planUsage)
+		os.Exit(1)
+	}
+	c.Action = args[0]
+	args = args[1:]
+	switch c.Action {
+	case "create":
+		createFlags := flag.NewFlagSet("plan create", flag.ExitOnError)
+		createFlags.Usage = func() {
+			fmt.Fprint(os.Stderr, "usage: dbmgr [-env <environment>] plan create [flags] <name>\n")
+			createFlags.PrintDefaults()
+		}
+		createFlags.StringVar(&c.Plan.StripePriceID, "price", "", "ID of the monthly recurring Stripe price")
+		createFlags.Int64Var(&c.Plan.MonthlyTokens, "tokens", 0, "tokens granted each paid month")
+		createFlags.Parse(args)
+		if createFlags.NArg() != 1 {
+			createFlags.Usage()
+			os.Exit(1)
+		}
+		c.Plan.Name = createFlags.Arg(0)
+		return nil
+	case "list":
+		return nil
+	default:
+		return fmt.Errorf("unknown plan command: %s", c.Action)
+	}
+}
+
+// Handle runs the plan subcommand.
+func (c *PlanCommand) Handle(ctx context.Context) error {
+	switch c.Action {
+	case "create":
+		if err := c.Plan.Insert(ctx); err != nil {
+			return err
+		}
+		slog.Info("created subscription plan", "id", c.Plan.ID, "name", c.Plan.Name,
+			"price", c.Plan.StripePriceID, "tokens", numfmt.LargeNumber(c.Plan.MonthlyTokens))
+	case "list":
+		plans, err := db.ListSubscriptionPlans(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range plans {
+			slog.Info(p.Name,
+				"id", p.ID,
+				"price", p.StripePriceID,
+				"tokens", numfmt.LargeNumber(p.MonthlyTokens),
+				"active", p.IsActive,
+				"subscribers", p.Subscribers,
+			)
+		}
+	}
+	return nil
+}
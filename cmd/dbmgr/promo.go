@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
+)
+
+// - MARK: Promo Codes
+
+type PromoCommand struct {
+	Action string
+	Code   db.PromoCode
+}
+
+const promoUsage = `usage: dbmgr [-env <environment>] promo <command> [args]
+
+commands:
+  create [flags] <code> create a promo code
+  list                  list promo codes and their redemptions
+`
+
+// Parse parses the promo subcommand and its arguments.
+func (c *PromoCommand) Parse(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, promoUsage)
+		os.Exit(1)
+	}
+	c.Action = args[0]
+	args = args[1:]
+	switch c.Action {
+	case "create":
+		return c.parseCreate(args)
+	case "list":
+		return nil
+	default:
+		return fmt.Errorf("unknown promo command: %s", c.Action)
+	}
+}
+
+func (c *PromoCommand) parseCreate(args []string) error {
+	var maxRedemptions int64
+	var expires string
+	createFlags := flag.NewFlagSet("promo create", flag.ExitOnError)
+	createFlags.Usage = func() {
+		fmt.Fprint(os.Stderr, "usage: dbmgr [-env <environment>] promo create [flags] <code>\n")
+		createFlags.PrintDefaults()
+	}
+	createFlags.Int64Var(&c.Code.Tokens, "tokens", 0, "tokens granted to each user who redeems the code")
+	createFlags.Int64Var(&maxRedemptions, "max", 0, "most users who can redeem the code (default unlimited)")
+	createFlags.StringVar(&expires, "expires", "", "when the code expires, as RFC3339 or YYYY-MM-DD in UTC (default never)")
+	createFlags.Parse(args)
+	if createFlags.NArg() != 1 {
+		createFlags.Usage()
+		os.Exit(1)
+	}
+	c.Code.Code = createFlags.Arg(0)
+	c.Code.Kind = db.PromoKindPromo
+	if maxRedemptions > 0 {
+		c.Code.MaxRedemptions = sql.NullInt64{Int64: maxRedemptions, Valid: true}
+	}
+	var err error
+	if c.Code.ExpiresAt, err = parseDateFlag(expires); err != nil {
+		return fmt.Errorf("invalid expires: %w", err)
+	}
+	return nil
+}
+
+// Handle runs the promo subcommand.
+func (c *PromoCommand) Handle(ctx context.Context) error {
+	switch c.Action {
+	case "create":
+		if err := c.Code.Insert(ctx); err != nil {
+			return err
+		}
+		slog.Info("created promo code", "id", c.Code.ID, "code", c.Code.Code,
+			"tokens", numfmt.LargeNumber(c.Code.Tokens))
+	case "list":
+		codes, err := db.ListPromoCodes(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range codes {
+			attrs := []any{
+				"id", p.ID,
+				"tokens", numfmt.LargeNumber(p.Tokens),
+				"redemptions", p.Redemptions,
+			}
+			if p.MaxRedemptions.Valid {
+				attrs = append(attrs, "max", p.MaxRedemptions.Int64)
+			}
+			if p.ExpiresAt.Valid {
+				attrs = append(attrs, "expires", p.ExpiresAt.Time.Format(time.RFC3339))
+			}
+			slog.Info(p.Code, attrs...)
+		}
+	}
+	return nil
+}
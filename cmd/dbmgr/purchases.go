@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
+)
+
+// - MARK: Purchases
+
+type PurchasesCommand struct {
+	Email string
+}
+
+const purchasesUsage = `usage: dbmgr [-env <environment>] purchases <email>
+
+lists the purchases of the users with the given email, newest first
+`
+
+// Parse parses the purchases subcommand and its arguments.
+func (c *PurchasesCommand) Parse(args []string) error {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, purchasesUsage)
+		os.Exit(1)
+	}
+	c.Email = args[0]
+	return nil
+}
+
+// Handle runs the purchases subcommand.
+func (c *PurchasesCommand) Handle(ctx context.Context) error {
+	userIDs, err := c.userIDs(ctx)
+	if err != nil {
+		return err
+	}
+	if len(userIDs) == 0 {
+		return fmt.Errorf("no user with email %s", c.Email)
+	}
+	for _, userID := range userIDs {
+		var count int
+		var cursor string
+		for {
+			purchases, next, err := db.GetPurchases(ctx, userID, 500, cursor)
+			if err != nil {
+				return err
+			}
+			for _, p := range purchases {
+				attrs := []any{
+					"user", userID,
+					"id", p.ID,
+					"usd", numfmt.USD(float64(p.Cents) / 100),
+					"tokens", numfmt.LargeNumber(p.Tokens),
+					"payment", p.PaymentID,
+				}
+				if p.SubscriptionID.Valid {
+					attrs = append(attrs, "subscription", p.SubscriptionID.Int64)
+				}
+				if p.RefundedCents > 0 || p.ReversedTokens != 0 {
+					attrs = append(attrs,
+						"refunded", numfmt.USD(float64(p.RefundedCents)/100),
+						"reversed", numfmt.LargeNumber(p.ReversedTokens))
+				}
+				slog.Info(p.CreatedAt.Format(time.RFC3339), attrs...)
+			}
+			count += len(purchases)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		slog.Info("listed purchases", "user", userID, "count", count)
+	}
+	return nil
+}
+
+// userIDs returns the IDs of the users with the email.
+// Emails are not unique, so more than one user may have it.
+func (c *PurchasesCommand) userIDs(ctx context.Context) ([]int64, error) {
+	rows, err := db.D.QueryContext(ctx, "SELECT id FROM users WHERE email = ? ORDER BY id", c.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
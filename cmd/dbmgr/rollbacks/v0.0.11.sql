@@ -0,0 +1 @@
+UPDATE services SET max_output_tokens = NULL WHERE service_type = 'prompt';
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_receipt_retries_next_attempt;
+
+DROP TABLE IF EXISTS receipt_retries;
+
+DROP INDEX IF EXISTS idx_receipts_idempotency_key;
+
+ALTER TABLE receipts DROP COLUMN idempotency_key;
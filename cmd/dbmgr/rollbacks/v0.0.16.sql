@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_airdrop_grants_user_policy;
+
+DROP TABLE IF EXISTS airdrop_grants;
+
+DROP INDEX IF EXISTS idx_airdrop_policy_overrides_user_id;
+
+DROP TABLE IF EXISTS airdrop_policy_overrides;
+
+DROP TABLE IF EXISTS airdrop_policies;
@@ -0,0 +1,13 @@
+DROP TRIGGER IF EXISTS after_insert_token_grants;
+
+DROP INDEX IF EXISTS idx_token_grants_user_id;
+
+DROP TABLE IF EXISTS token_grants;
+
+DROP INDEX IF EXISTS idx_promo_redemptions_referral;
+
+DROP TABLE IF EXISTS promo_redemptions;
+
+DROP INDEX IF EXISTS idx_promo_codes_referrer_id;
+
+DROP TABLE IF EXISTS promo_codes;
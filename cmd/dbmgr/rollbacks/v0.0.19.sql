@@ -0,0 +1,7 @@
+ALTER TABLE purchases DROP COLUMN subscription_id;
+
+DROP INDEX IF EXISTS idx_subscriptions_user_id;
+
+DROP TABLE IF EXISTS subscriptions;
+
+DROP TABLE IF EXISTS subscription_plans;
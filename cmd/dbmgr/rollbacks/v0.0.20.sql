@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS idx_purchases_payment_intent_id;
+
+ALTER TABLE purchases DROP COLUMN payment_intent_id;
+
+DROP TRIGGER IF EXISTS after_insert_purchase_adjustments;
+
+DROP INDEX IF EXISTS idx_purchase_adjustments_flagged;
+
+DROP INDEX IF EXISTS idx_purchase_adjustments_purchase_id;
+
+DROP TABLE IF EXISTS purchase_adjustments;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_stripe_events_status;
+
+DROP TABLE IF EXISTS stripe_events;
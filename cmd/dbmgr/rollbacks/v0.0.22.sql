@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_token_packages_active_usd;
+
+DROP TABLE IF EXISTS token_packages;
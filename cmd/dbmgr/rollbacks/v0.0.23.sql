@@ -0,0 +1,3 @@
+ALTER TABLE receipt_retries DROP COLUMN dead_at;
+
+DROP TABLE IF EXISTS idempotency_claims;
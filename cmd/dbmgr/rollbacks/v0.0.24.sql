@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS after_insert_purchases_referrer;
+
+DROP INDEX IF EXISTS idx_token_grants_referrer;
@@ -0,0 +1,21 @@
+DELETE FROM token_packages WHERE stripe_price_id IS NULL;
+
+CREATE TABLE IF NOT EXISTS token_packages_old (
+  id INTEGER PRIMARY KEY,
+  stripe_price_id TEXT NOT NULL,
+  usd INTEGER NOT NULL CHECK (usd > 0),
+  tokens INTEGER NOT NULL CHECK (tokens > 0),
+  bonus_percent INTEGER NOT NULL DEFAULT 0,
+  is_active BOOLEAN NOT NULL DEFAULT 1,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO token_packages_old (id, stripe_price_id, usd, tokens, bonus_percent, is_active, created_at)
+SELECT id, stripe_price_id, usd, tokens, bonus_percent, is_active, created_at
+FROM token_packages;
+
+DROP TABLE token_packages;
+
+ALTER TABLE token_packages_old RENAME TO token_packages;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_token_packages_active_usd ON token_packages(usd) WHERE is_active;
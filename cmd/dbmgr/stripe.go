@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/stripe"
+)
+
+// - MARK: Stripe Events
+
+type StripeCommand struct {
+	Action string
+	Status db.StripeEventStatus
+	// EventIDs are the events to replay, or every failed event if empty.
+	EventIDs []string
+}
+
+const stripeUsage = `usage: dbmgr [-env <environment>] stripe <command> [args]
+
+commands:
+  list [-status <status>]  list webhook events, failed ones by default
+  replay [event IDs]       process failed webhook events again, all of them by default
+`
+
+// Parse parses the stripe subcommand and its arguments.
+func (c *StripeCommand) Parse(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, stripeUsage)
+		os.Exit(1)
+	}
+	c.Action = args[0]
+	args = args[1:]
+	switch c.Action {
+	case "list":
+		var status string
+		listFlags := flag.NewFlagSet("stripe list", flag.ExitOnError)
+		listFlags.StringVar(&status, "status", string(db.StripeEventFailed), "processing, succeeded or failed")
+		listFlags.Parse(args)
+		c.Status = db.StripeEventStatus(status)
+		switch c.Status {
+		case db.StripeEventProcessing, db.StripeEventSucceeded, db.StripeEventFailed:
+			return nil
+		default:
+			return fmt.Errorf("unknown status: %s", status)
+		}
+	case "replay":
+		c.EventIDs = args
+		return nil
+	default:
+		return fmt.Errorf("unknown stripe command: %s", c.Action)
+	}
+}
+
+// Handle runs the stripe subcommand.
+func (c *StripeCommand) Handle(ctx context.Context) error {
+	switch c.Action {
+	case "list":
+		events, err := db.ListStripeEvents(ctx, c.Status)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			attrs := []any{
+				"type", e.Type,
+				"status", e.Status,
+				"attempts", e.Attempts,
+				"created", e.CreatedAt.Format(time.RFC3339),
+			}
+			if e.LastError.Valid {
+				attrs = append(attrs, "error", e.LastError.String)
+			}
+			slog.Info(e.ID, attrs...)
+		}
+	case "replay":
+		var events []db.StripeEvent
+		if len(c.EventIDs) == 0 {
+			var err error
+			events, err = db.ListStripeEvents(ctx, db.StripeEventFailed)
+			if err != nil {
+				return err
+			}
+		}
+		for _, id := range c.EventIDs {
+			e, err := db.GetStripeEvent(ctx, id)
+			if err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+		var failed int
+		for _, e := range events {
+			if err := stripe.ReplayEvent(ctx, e); err != nil {
+				slog.Error("failed to replay event", "id", e.ID, "type", e.Type, "error", err)
+				failed++
+				continue
+			}
+			slog.Info("replayed event", "id", e.ID, "type", e.Type)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d events failed", failed, len(events))
+		}
+		slog.Info("replayed events", "count", len(events))
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
@@ -13,25 +14,25 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/ditto-assistant/backend/cfg/envs"
 	"github.com/ditto-assistant/backend/cfg/secr"
 	apiv1 "github.com/ditto-assistant/backend/pkg/api/v1"
 	apiv2 "github.com/ditto-assistant/backend/pkg/api/v2"
 	"github.com/ditto-assistant/backend/pkg/core"
 	"github.com/ditto-assistant/backend/pkg/middleware"
+	"github.com/ditto-assistant/backend/pkg/pricing"
 	"github.com/ditto-assistant/backend/pkg/services/db"
 	"github.com/ditto-assistant/backend/pkg/services/db/users"
 	"github.com/ditto-assistant/backend/pkg/services/llm"
-	"github.com/ditto-assistant/backend/pkg/services/llm/cerebras"
-	"github.com/ditto-assistant/backend/pkg/services/llm/claude"
-	"github.com/ditto-assistant/backend/pkg/services/llm/gemini"
 	"github.com/ditto-assistant/backend/pkg/services/llm/llama"
-	"github.com/ditto-assistant/backend/pkg/services/llm/mistral"
 	"github.com/ditto-assistant/backend/pkg/services/llm/openai/dalle"
-	"github.com/ditto-assistant/backend/pkg/services/llm/openai/gpt"
+	"github.com/ditto-assistant/backend/pkg/services/llm/providers"
+	"github.com/ditto-assistant/backend/pkg/services/pubsub"
 	"github.com/ditto-assistant/backend/pkg/services/search"
 	"github.com/ditto-assistant/backend/pkg/services/search/brave"
 	"github.com/ditto-assistant/backend/pkg/services/search/google"
 	"github.com/ditto-assistant/backend/pkg/services/stripe"
+	"github.com/ditto-assistant/backend/pkg/utils/img"
 	"github.com/ditto-assistant/backend/types/rq"
 	"github.com/ditto-assistant/backend/types/ty"
 )
@@ -41,11 +42,13 @@ func main() {
 	bgCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	var shutdownWG sync.WaitGroup
+	// Background work, such as saving receipts, finishes before the database closes.
+	var backgroundWG sync.WaitGroup
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT)
 	sdCtx := ty.ShutdownContext{
 		Background:       bgCtx,
-		WaitGroup:        &shutdownWG,
+		WaitGroup:        &backgroundWG,
 		ShutdownDuration: 30 * time.Second,
 	}
 	coreSvc, err := core.NewClient(bgCtx)
@@ -55,20 +58,49 @@ func main() {
 	if err := db.Setup(bgCtx, &shutdownWG, db.ModeCloud); err != nil {
 		log.Fatalf("failed to initialize database: %s", err)
 	}
+	img.ContentBucket = coreSvc.FileStorage
+	db.Price = pricing.Cost
+	go db.RetryReceipts(bgCtx)
+	go users.InvalidateOnChange(bgCtx, pubsub.Balances)
+	// Receipts are recorded in a local outbox first, so billing survives a
+	// database outage. Outside local development, DITTO_OUTBOX_PATH must be
+	// on a volume that outlives the instance, so that pending receipts are
+	// replayed at the next startup.
+	outboxPath := os.Getenv("DITTO_OUTBOX_PATH")
+	if outboxPath == "" {
+		if envs.DITTO_ENV != envs.EnvLocal {
+			log.Fatalf("DITTO_OUTBOX_PATH must be set in %s", envs.DITTO_ENV)
+		}
+		outboxPath = "outbox.db"
+	}
+	outbox, err := db.OpenOutbox(outboxPath)
+	if err != nil {
+		log.Fatalf("failed to open receipt outbox: %s", err)
+	}
+	db.ReceiptOutbox = outbox
+	go outbox.Run(bgCtx)
 
 	mux := http.NewServeMux()
 	searchClient := search.NewClient(
-		search.WithService(brave.NewService(sdCtx, coreSvc.Secr)),
+		search.WithService(brave.NewService(coreSvc.Secr)),
 		search.WithService(google.NewService(sdCtx, coreSvc.Secr)),
 	)
-	dalleClient := dalle.NewClient(secr.OPENAI_DALLE_API_KEY.String(), llm.HttpClient)
+	images := dalle.NewGenerator(
+		dalle.NewClient(secr.OPENAI_DALLE_API_KEY.String(), llm.HttpClient),
+		coreSvc.FileStorage,
+		sdCtx,
+	)
 	apiv1.NewService(sdCtx, coreSvc, apiv1.ServiceClients{
 		SearchClient: searchClient,
-		Dalle:        dalleClient,
+		Dalle:        images,
 	}).Routes(mux)
 	stripe.NewClient(coreSvc.Secr, coreSvc.Auth).Routes(mux)
-	apiv2.NewService(coreSvc, sdCtx).Routes(mux)
-	cerebrasClient := cerebras.NewService(&sdCtx, coreSvc.Secr)
+	llmProviders := providers.NewDefault(&sdCtx, coreSvc.Secr)
+	apiv2.NewService(coreSvc, sdCtx, apiv2.ServiceClients{
+		Providers:    llmProviders,
+		SearchClient: searchClient,
+		Dalle:        images,
+	}).Routes(mux)
 
 	// - MARK: prompt
 	mux.HandleFunc("POST /v1/prompt", func(w http.ResponseWriter, r *http.Request) {
@@ -96,87 +128,103 @@ func main() {
 		}
 		slog := slog.With("action", "prompt", "userID", bod.UserID, "model", bod.Model, "email", user.Email.String)
 		// llama32 is free
-		if user.Balance <= 0 && bod.Model != llm.ModelLlama32 {
-			slog.Error("user balance is 0", "balance", user.Balance)
-			http.Error(w, fmt.Sprintf("user balance is: %d", user.Balance), http.StatusPaymentRequired)
-			return
-		}
-		bod.Model, err = llama.ModelCompat(bod.Model, bod.ImageURL)
+		free := bod.Model == llm.ModelLlama32
+		bod.Model, err = llama.ModelCompat(bod.Model, bod.HasImages())
 		if err != nil {
 			slog.Error("invalid llama model", "error", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		var rsp llm.StreamResponse
-		switch bod.Model {
-		case
-			llm.ModelClaude3Haiku, llm.ModelClaude3Haiku_20240307,
-			llm.ModelClaude35Sonnet, llm.ModelClaude35Sonnet_20240620,
-			llm.ModelClaude35SonnetV2, llm.ModelClaude35SonnetV2_20241022,
-			llm.ModelClaude35Haiku, llm.ModelClaude35Haiku_20241022:
-			err = claude.Prompt(ctx, bod, &rsp)
+		// A retried request with the same Idempotency-Key is not served twice.
+		idempotencyKey := db.ClientIdempotencyKey(user.ID, r.Header.Get("Idempotency-Key"))
+		if idempotencyKey != "" {
+			exists, err := db.ReceiptExists(ctx, idempotencyKey)
 			if err != nil {
-				slog.Error("failed to prompt Claude", "error", err)
+				slog.Error("failed to check idempotency key", "error", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-		case llm.ModelGemini15Flash:
-			m := gemini.ModelGemini15Flash
-			err = m.Prompt(ctx, bod, &rsp)
-			if err != nil {
-				slog.Error("failed to prompt "+m.PrettyStr(), "error", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if exists {
+				http.Error(w, "request with this Idempotency-Key was already processed", http.StatusConflict)
 				return
 			}
-		case llm.ModelGemini15Pro:
-			m := gemini.ModelGemini15Pro
-			err = m.Prompt(ctx, bod, &rsp)
+		}
+		// Concurrent requests with the same key are refused until this one fails.
+		claim, err := db.ClaimIdempotencyKey(ctx, user.ID, idempotencyKey)
+		if errors.Is(err, db.ErrDuplicateRequest) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to claim idempotency key", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var hold db.Hold
+		release := func() {
+			ctx := context.WithoutCancel(ctx)
+			if err := hold.Release(ctx); err != nil {
+				slog.Error("failed to release balance hold", "error", err)
+			}
+			if err := claim.Release(ctx); err != nil {
+				slog.Error("failed to release idempotency claim", "error", err)
+			}
+		}
+		if !free {
+			hold, err = db.HoldPrompt(ctx, user.ID, bod)
 			if err != nil {
-				slog.Error("failed to prompt "+m.PrettyStr(), "error", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				release()
+			}
+			if errors.Is(err, db.ErrInsufficientBalance) {
+				slog.Info("insufficient balance", "balance", user.Balance, "error", err)
+				http.Error(w, err.Error(), http.StatusPaymentRequired)
 				return
 			}
-		case llm.ModelMistralNemo, llm.ModelMistralLarge:
-			err = mistral.Prompt(ctx, bod, &rsp)
-			if err != nil {
-				slog.Error("failed to prompt "+bod.Model.String(), "error", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if errors.Is(err, db.ErrLimitExceeded) {
+				slog.Info("spending limit exceeded", "error", err)
+				http.Error(w, err.Error(), http.StatusPaymentRequired)
 				return
 			}
-		case llm.ModelLlama33_70bInstruct:
-			err = llama.Prompt(ctx, bod, &rsp)
 			if err != nil {
-				slog.Error("failed to prompt "+bod.Model.String(), "error", err)
+				slog.Error("failed to place balance hold", "error", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-		case
-			llm.ModelO1Mini, llm.ModelO1Mini_20240912,
-			llm.ModelO1Preview, llm.ModelO1Preview_20240912,
-			llm.ModelGPT4oMini, llm.ModelGPT4oMini_20240718,
-			llm.ModelGPT4o, llm.ModelGPT4o_1120:
-			err = gpt.Prompt(ctx, bod, &rsp)
-			if err != nil {
-				slog.Error("failed to prompt "+bod.Model.String(), "error", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		var rsp llm.StreamResponse
+		err = llmProviders.Prompt(ctx, bod, &rsp)
+		if err != nil {
+			release()
+			if providers.IsBadRequest(err) {
+				slog.Info("invalid prompt request", "error", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-		case llm.ModelCerebrasLlama8B, llm.ModelCerebrasLlama70B:
-			err = cerebrasClient.Prompt(ctx, bod, &rsp)
-			if err != nil {
-				slog.Error("failed to prompt "+bod.Model.String(), "error", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			slog.Error("failed to prompt "+bod.Model.String(), "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// A fallback model may cost more than the model the hold was placed for.
+		if err := hold.Reestimate(ctx, bod, rsp.Model); err != nil {
+			release()
+			go func() {
+				for range rsp.Text {
+				}
+			}()
+			if errors.Is(err, db.ErrInsufficientBalance) {
+				slog.Info("insufficient balance for fallback", "servedBy", rsp.Model, "error", err)
+				http.Error(w, err.Error(), http.StatusPaymentRequired)
 				return
 			}
-		default:
-			slog.Info("unsupported model", "model", bod.Model)
-			http.Error(w, fmt.Sprintf("unsupported model: %s", bod.Model), http.StatusBadRequest)
+			slog.Error("failed to re-estimate balance hold", "servedBy", rsp.Model, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		for token := range rsp.Text {
 			if token.Err != nil {
 				slog.Error("failed to stream token", "error", token.Err)
+				release()
 				http.Error(w, token.Err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -184,15 +232,24 @@ func main() {
 		}
 
 		sdCtx.Run(func(ctx context.Context) {
-			slog.Debug("receipt", "input_tokens", rsp.InputTokens, "output_tokens", rsp.OutputTokens)
+			slog.Debug("receipt", "served_by", rsp.Model, "input_tokens", rsp.InputTokens, "output_tokens", rsp.OutputTokens)
 			receipt := db.Receipt{
 				UserID:       user.ID,
 				InputTokens:  int64(rsp.InputTokens),
 				OutputTokens: int64(rsp.OutputTokens),
-				ServiceName:  bod.Model,
+				ServiceName:  rsp.Model,
+				HoldID:       hold.ID,
+				// Empty unless sent by the client, for Save to generate one.
+				IdempotencyKey: idempotencyKey,
 			}
-			if err := receipt.Insert(ctx); err != nil {
+			if err := receipt.Save(ctx); err != nil {
+				// The receipt could not be queued either, so nothing will settle the hold.
 				slog.Error("failed to insert receipt", "error", err)
+				release()
+				return
+			}
+			if err := claim.Complete(ctx); err != nil {
+				slog.Error("failed to complete idempotency claim", "error", err)
 			}
 		})
 	})
@@ -202,18 +259,66 @@ func main() {
 		Addr:    ":3400",
 		Handler: handler,
 	}
+	// The admin server is only reachable from the instance itself.
+	adminAddr := os.Getenv("DITTO_ADMIN_ADDR")
+	if adminAddr == "" {
+		adminAddr = "localhost:3401"
+	}
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("GET /outbox/stats", outbox.HandleStats)
+	adminServer := &http.Server{
+		Addr:    adminAddr,
+		Handler: adminMux,
+	}
+	go func() {
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("admin server error", "error", err)
+		}
+	}()
+	// ListenAndServe returns as soon as shutdown starts, so serverDone is
+	// closed once in-flight handlers have finished and can no longer start
+	// background work.
+	serverDone := make(chan struct{})
 	go func() {
+		defer close(serverDone)
 		select {
 		case sig := <-sigChan:
 			slog.Info("Received SIG; shutting down", "signal", sig)
-			server.Shutdown(bgCtx)
+			ctx, cancel := context.WithTimeout(bgCtx, sdCtx.ShutdownDuration)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Error("failed to shut down server", "error", err)
+			}
+			if err := adminServer.Shutdown(ctx); err != nil {
+				slog.Error("failed to shut down admin server", "error", err)
+			}
 		}
 	}()
 	slog.Debug("Starting server", "addr", server.Addr)
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	<-serverDone
+	backgroundWG.Wait()
+	// Release holds left by prompts that never finished, such as during
+	// a previous shutdown, and flush receipts left in the outbox by
+	// background work, before the database closes.
+	sweepCtx, cancelSweep := context.WithTimeout(bgCtx, 5*time.Second)
+	if n, err := db.ReleaseExpiredHolds(sweepCtx); err != nil {
+		slog.Error("failed to release expired holds", "error", err)
+	} else if n > 0 {
+		slog.Info("released expired holds", "count", n)
+	}
+	if n, err := outbox.Replay(sweepCtx); err != nil {
+		slog.Error("failed to flush receipt outbox", "error", err)
+	} else if n > 0 {
+		slog.Info("flushed receipt outbox", "count", n)
+	}
+	cancelSweep()
 	cancel()
 	shutdownWG.Wait()
+	if err := outbox.Close(); err != nil {
+		slog.Error("failed to close receipt outbox", "error", err)
+	}
 	os.Exit(0)
 }
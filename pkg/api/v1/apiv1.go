@@ -1,9 +1,10 @@
 package api
 
 import (
-	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -23,7 +24,9 @@ import (
 	"github.com/ditto-assistant/backend/pkg/services/llm"
 	"github.com/ditto-assistant/backend/pkg/services/llm/openai"
 	"github.com/ditto-assistant/backend/pkg/services/llm/openai/dalle"
+	"github.com/ditto-assistant/backend/pkg/services/pubsub"
 	"github.com/ditto-assistant/backend/pkg/services/search"
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
 	"github.com/ditto-assistant/backend/types/rp"
 	"github.com/ditto-assistant/backend/types/rq"
 	"github.com/ditto-assistant/backend/types/ty"
@@ -32,6 +35,14 @@ import (
 
 func (s *Service) Routes(mux *http.ServeMux) {
 	mux.HandleFunc("GET /v1/balance", s.Balance)
+	mux.HandleFunc("GET /v1/balance/stream", s.BalanceStream)
+	mux.HandleFunc("GET /v1/usage", s.Usage)
+	mux.HandleFunc("GET /v1/limits", s.GetLimits)
+	mux.HandleFunc("PUT /v1/limits", s.PutLimits)
+	mux.HandleFunc("DELETE /v1/limits", s.DeleteLimits)
+	mux.HandleFunc("POST /v1/redeem", s.Redeem)
+	mux.HandleFunc("GET /v1/referral", s.Referral)
+	mux.HandleFunc("GET /v1/packages", s.Packages)
 	mux.HandleFunc("GET /v1/conversations", s.GetConversations)
 	mux.HandleFunc("POST /v1/google-search", s.WebSearch)
 	mux.HandleFunc("POST /v1/generate-image", s.GenerateImage)
@@ -52,12 +63,12 @@ type Service struct {
 	sc           *core.Client
 	searchClient *search.Client
 	urlCache     *mapcache.MapCache[string, string]
-	dalle        *dalle.Client
+	dalle        *dalle.Generator
 }
 
 type ServiceClients struct {
 	SearchClient *search.Client
-	Dalle        *dalle.Client
+	Dalle        *dalle.Generator
 }
 
 func NewService(sd ty.ShutdownContext, sc *core.Client, setup ServiceClients) *Service {
@@ -95,6 +106,7 @@ func (s *Service) Balance(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
+	bod.EmailVerified = tok.EmailVerified()
 	rsp, err := users.GetBalance(r, db.D, bod)
 	if err != nil {
 		slog.Error("failed to handle balance request", "uid", bod.UserID, "error", err)
@@ -105,6 +117,408 @@ func (s *Service) Balance(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(rsp)
 }
 
+// balanceKeepAlive is how often an idle balance stream sends a comment,
+// so proxies do not close it.
+const balanceKeepAlive = 30 * time.Second
+
+// BalanceStream sends the user's balance, then sends it again each time it changes.
+func (s *Service) BalanceStream(w http.ResponseWriter, r *http.Request) {
+	tok, err := s.sc.Auth.VerifyToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var bod rq.BalanceV1
+	if err := bod.FromQuery(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = tok.Check(bod.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	bod.EmailVerified = tok.EmailVerified()
+	ctx := r.Context()
+	rsp, err := users.GetBalance(r, db.D, bod)
+	if err != nil {
+		slog.Error("failed to handle balance request", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user := users.User{UID: bod.UserID}
+	if err := user.GetByUID(ctx, db.D); err != nil {
+		slog.Error("failed to get user", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := pubsub.Balances.Subscribe(user.ID)
+	defer unsubscribe()
+
+	// Set up SSE response headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.Error("Streaming not supported")
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	send := func(eventType string, data any) {
+		eventJSON, _ := json.Marshal(map[string]any{
+			"type": eventType,
+			"data": data,
+		})
+		fmt.Fprintf(w, "data: %s\n\n", eventJSON)
+		flusher.Flush()
+	}
+	send("balance", rsp)
+
+	keepAlive := time.NewTicker(balanceKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			rsp, err := users.Balance(ctx, db.D, user.ID)
+			if err != nil {
+				slog.Error("failed to get balance", "uid", bod.UserID, "reason", e.Reason, "error", err)
+				send("error", err.Error())
+				return
+			}
+			send("balance", rsp)
+		}
+	}
+}
+
+// - MARK: usage
+
+func (s *Service) Usage(w http.ResponseWriter, r *http.Request) {
+	tok, err := s.sc.Auth.VerifyToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var bod rq.UsageV1
+	if err := bod.FromQuery(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = tok.Check(bod.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	user := users.User{UID: bod.UserID}
+	if err := user.GetByUID(ctx, db.D); err != nil {
+		slog.Error("failed to get user", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rsp, err := db.GetUsage(ctx, user.ID, bod)
+	if err != nil {
+		slog.Error("failed to get usage", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rsp)
+}
+
+// - MARK: limits
+
+func (s *Service) GetLimits(w http.ResponseWriter, r *http.Request) {
+	tok, err := s.sc.Auth.VerifyToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var bod rq.LimitsV1
+	if err := bod.FromQuery(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = tok.Check(bod.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	s.writeLimits(w, r, bod.UserID)
+}
+
+func (s *Service) PutLimits(w http.ResponseWriter, r *http.Request) {
+	tok, err := s.sc.Auth.VerifyToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var bod rq.LimitsV1
+	if err := json.NewDecoder(r.Body).Decode(&bod); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bod.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = tok.Check(bod.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	user := users.User{UID: bod.UserID}
+	if err := user.GetByUID(ctx, db.D); err != nil {
+		slog.Error("failed to get user", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	limits := db.UserLimits{
+		UserID:          user.ID,
+		Daily:           nullInt64(bod.Daily),
+		Monthly:         nullInt64(bod.Monthly),
+		PerRequest:      nullInt64(bod.PerRequest),
+		AlertPercentage: db.DefaultAlertPercentage,
+	}
+	if bod.AlertPercentage != nil {
+		limits.AlertPercentage = *bod.AlertPercentage
+	}
+	if err := limits.Save(ctx); err != nil {
+		slog.Error("failed to save limits", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeLimits(w, r, bod.UserID)
+}
+
+func (s *Service) DeleteLimits(w http.ResponseWriter, r *http.Request) {
+	tok, err := s.sc.Auth.VerifyToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var bod rq.LimitsV1
+	if err := bod.FromQuery(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = tok.Check(bod.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	user := users.User{UID: bod.UserID}
+	if err := user.GetByUID(ctx, db.D); err != nil {
+		slog.Error("failed to get user", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := db.DeleteUserLimits(ctx, user.ID); err != nil {
+		slog.Error("failed to delete limits", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeLimits writes the user's limits and their spend against them.
+func (s *Service) writeLimits(w http.ResponseWriter, r *http.Request, uid string) {
+	ctx := r.Context()
+	user := users.User{UID: uid}
+	if err := user.GetByUID(ctx, db.D); err != nil {
+		slog.Error("failed to get user", "uid", uid, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	limits, err := db.GetUserLimits(ctx, user.ID)
+	if err != nil {
+		slog.Error("failed to get limits", "uid", uid, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	spend, err := db.GetSpend(ctx, user.ID, time.Now())
+	if err != nil {
+		slog.Error("failed to get spend", "uid", uid, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rsp := rp.LimitsV1{
+		Daily:           int64Ptr(limits.Daily),
+		Monthly:         int64Ptr(limits.Monthly),
+		PerRequest:      int64Ptr(limits.PerRequest),
+		AlertPercentage: limits.AlertPercentage,
+		SpentToday:      spend.Today,
+		SpentThisMonth:  spend.ThisMonth,
+		Alerts:          limits.Alerts(spend),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rsp)
+}
+
+func nullInt64(n *int64) sql.NullInt64 {
+	if n == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *n, Valid: true}
+}
+
+func int64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// holdReceipt holds the estimated cost of the receipt until the receipt
+// settles it, writing a 402 with the reason if the user's balance or
+// spending limits cannot cover it.
+// It reports whether the request may continue.
+func holdReceipt(w http.ResponseWriter, r *http.Request, receipt db.Receipt) (db.Hold, bool) {
+	hold, err := db.HoldReceipt(r.Context(), receipt)
+	if errors.Is(err, db.ErrLimitExceeded) || errors.Is(err, db.ErrInsufficientBalance) {
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return db.Hold{}, false
+	}
+	if err != nil {
+		slog.Error("failed to place balance hold", "userID", receipt.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return db.Hold{}, false
+	}
+	return hold, true
+}
+
+// - MARK: redeem
+
+func (s *Service) Redeem(w http.ResponseWriter, r *http.Request) {
+	tok, err := s.sc.Auth.VerifyToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var bod rq.RedeemV1
+	if err := json.NewDecoder(r.Body).Decode(&bod); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bod.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = tok.Check(bod.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	user := users.User{UID: bod.UserID}
+	if err := user.GetByUID(ctx, db.D); err != nil {
+		slog.Error("failed to get user", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redemption, err := db.RedeemPromoCode(ctx, user.ID, bod.Code)
+	if errors.Is(err, db.ErrPromoCodeNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, db.ErrCannotRedeem) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to redeem code", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("redeemed code", "uid", bod.UserID, "kind", redemption.Kind, "tokens", redemption.Tokens)
+	rsp, err := users.Balance(ctx, db.D, user.ID)
+	if err != nil {
+		slog.Error("failed to get balance", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rsp.RedeemedRaw = redemption.Tokens
+	rsp.Redeemed = numfmt.LargeNumber(redemption.Tokens)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rsp)
+}
+
+func (s *Service) Referral(w http.ResponseWriter, r *http.Request) {
+	tok, err := s.sc.Auth.VerifyToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var bod rq.ReferralV1
+	if err := bod.FromQuery(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = tok.Check(bod.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	user := users.User{UID: bod.UserID}
+	if err := user.GetByUID(ctx, db.D); err != nil {
+		slog.Error("failed to get user", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	code, err := db.GetReferralCode(ctx, user.ID)
+	if err != nil {
+		slog.Error("failed to get referral code", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rp.ReferralV1{
+		Code:           code.Code,
+		Tokens:         numfmt.LargeNumber(code.Tokens),
+		ReferrerTokens: numfmt.LargeNumber(code.ReferrerTokens),
+		Referrals:      code.Redemptions,
+	})
+}
+
+// - MARK: packages
+
+// Packages lists the token packages for sale. It needs no sign in, so the store
+// can be shown before it.
+func (s *Service) Packages(w http.ResponseWriter, r *http.Request) {
+	packages, err := db.ActivePackages(r.Context())
+	if err != nil {
+		slog.Error("failed to get token packages", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rsp := make([]rp.PackageV1, 0, len(packages))
+	for _, p := range packages {
+		rsp = append(rsp, rp.PackageV1{
+			ID:           p.ID,
+			USD:          p.USD,
+			TokensRaw:    p.Tokens,
+			Tokens:       numfmt.LargeNumber(p.Tokens),
+			BonusPercent: p.BonusPercent,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rsp)
+}
+
 // - MARK: web-search
 
 func (s *Service) WebSearch(w http.ResponseWriter, r *http.Request) {
@@ -141,13 +555,20 @@ func (s *Service) WebSearch(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("user balance is: %d", user.Balance), http.StatusPaymentRequired)
 		return
 	}
+	// Google is the most expensive search engine that may serve the search.
+	hold, ok := holdReceipt(w, r, db.Receipt{UserID: user.ID, ServiceName: llm.SearchEngineGoogle, NumSearches: 1})
+	if !ok {
+		return
+	}
 	searchRequest := search.Request{
 		User:       user,
 		Query:      bod.Query,
 		NumResults: bod.NumResults,
+		HoldID:     hold.ID,
 	}
 	search, err := s.searchClient.Search(ctx, searchRequest)
 	if err != nil {
+		hold.ReleaseLogged(ctx)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -188,59 +609,17 @@ func (s *Service) GenerateImage(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, envs.DALLE_E_DUMMY_LINK)
 		return
 	}
-	url, err := s.dalle.Prompt(ctx, &bod)
+	url, _, err := s.dalle.Generate(ctx, user, &bod)
+	if errors.Is(err, db.ErrLimitExceeded) || errors.Is(err, db.ErrInsufficientBalance) {
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return
+	}
 	if err != nil {
 		slog.Error("failed to generate image", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	fmt.Fprint(w, url)
-
-	s.sd.Run(func(ctx context.Context) {
-		slog.Debug("image receipt", "url", url)
-		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-		if err != nil {
-			slog.Error("failed to create image request", "error", err)
-			return
-		}
-		imgResp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			slog.Error("failed to download image", "error", err)
-			return
-		}
-		defer imgResp.Body.Close()
-		imgData, err := io.ReadAll(imgResp.Body)
-		if err != nil {
-			slog.Error("failed to read image data", "error", err)
-			return
-		}
-		urlParts := strings.Split(url, "?")
-		if len(urlParts) == 0 {
-			slog.Error("failed to get filename from URL", "url", url)
-			return
-		}
-		filename := strings.TrimPrefix(urlParts[0], envs.DALL_E_PREFIX)
-		key := fmt.Sprintf("%s/generated-images/%s", bod.UserID, filename)
-		put, err := s.sc.FileStorage.S3.PutObject(&s3.PutObjectInput{
-			Bucket: bucketDittoContent,
-			Key:    aws.String(key),
-			Body:   bytes.NewReader(imgData),
-		})
-		if err != nil {
-			slog.Error("failed to copy to S3", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		slog.Debug("uploaded image to S3", "key", put.String())
-		receipt := db.Receipt{
-			UserID:      user.ID,
-			NumImages:   1,
-			ServiceName: bod.Model,
-		}
-		if err := receipt.Insert(ctx); err != nil {
-			slog.Error("failed to insert receipt", "error", err)
-		}
-	})
 }
 
 // - MARK: presign-url
@@ -501,7 +880,7 @@ func (s *Service) Embed(w http.ResponseWriter, r *http.Request) {
 			TotalTokens: tokens,
 			ServiceName: bod.Model,
 		}
-		if err := receipt.Insert(ctx); err != nil {
+		if err := receipt.Save(ctx); err != nil {
 			slog.Error("failed to insert receipt", "error", err)
 		}
 	})
@@ -601,7 +980,7 @@ func (s *Service) CreatePrompt(w http.ResponseWriter, r *http.Request) {
 			TotalTokens: tokens,
 			ServiceName: model,
 		}
-		if err := receipt.Insert(ctx); err != nil {
+		if err := receipt.Save(ctx); err != nil {
 			slog.Error("failed to insert receipt", "error", err)
 		}
 	})
@@ -659,7 +1038,7 @@ func (s *Service) SaveResponse(w http.ResponseWriter, r *http.Request) {
 			TotalTokens: tokens,
 			ServiceName: model,
 		}
-		if err := receipt.Insert(ctx); err != nil {
+		if err := receipt.Save(ctx); err != nil {
 			slog.Error("failed to insert receipt", "error", err)
 		}
 	})
@@ -3,20 +3,21 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 
 	"github.com/ditto-assistant/backend/pkg/core"
 	"github.com/ditto-assistant/backend/pkg/services/db"
 	"github.com/ditto-assistant/backend/pkg/services/db/users"
 	"github.com/ditto-assistant/backend/pkg/services/llm"
-	"github.com/ditto-assistant/backend/pkg/services/llm/cerebras"
-	"github.com/ditto-assistant/backend/pkg/services/llm/claude"
-	"github.com/ditto-assistant/backend/pkg/services/llm/gemini"
 	"github.com/ditto-assistant/backend/pkg/services/llm/llama"
-	"github.com/ditto-assistant/backend/pkg/services/llm/mistral"
-	"github.com/ditto-assistant/backend/pkg/services/llm/openai/gpt"
+	"github.com/ditto-assistant/backend/pkg/services/llm/openai/dalle"
+	"github.com/ditto-assistant/backend/pkg/services/llm/providers"
+	"github.com/ditto-assistant/backend/pkg/services/search"
+	"github.com/ditto-assistant/backend/types/rp"
 	"github.com/ditto-assistant/backend/types/rq"
 	"github.com/ditto-assistant/backend/types/ty"
 )
@@ -27,14 +28,26 @@ func (s *Service) Routes(mux *http.ServeMux) {
 }
 
 type Service struct {
-	cl *core.Client
-	sd ty.ShutdownContext
+	cl        *core.Client
+	sd        ty.ShutdownContext
+	providers *providers.Registry
+	search    *search.Client
+	dalle     *dalle.Generator
 }
 
-func NewService(cl *core.Client, sd ty.ShutdownContext) *Service {
+type ServiceClients struct {
+	Providers    *providers.Registry
+	SearchClient *search.Client
+	Dalle        *dalle.Generator
+}
+
+func NewService(cl *core.Client, sd ty.ShutdownContext, setup ServiceClients) *Service {
 	return &Service{
-		cl: cl,
-		sd: sd,
+		cl:        cl,
+		sd:        sd,
+		providers: setup.Providers,
+		search:    setup.SearchClient,
+		dalle:     setup.Dalle,
 	}
 }
 
@@ -102,83 +115,110 @@ func (s *Service) PromptV2(w http.ResponseWriter, r *http.Request) {
 	}
 	slog = slog.With("action", "prompt", "userID", bod.UserID, "model", bod.Model, "email", user.Email.String)
 	// llama32 is free
-	if user.Balance <= 0 && bod.Model != llm.ModelLlama32 {
-		slog.Error("user balance is 0", "balance", user.Balance)
-		http.Error(w, fmt.Sprintf("user balance is: %d", user.Balance), http.StatusPaymentRequired)
-		return
-	}
-	bod.Model, err = llama.ModelCompat(bod.Model, bod.ImageURL)
+	free := bod.Model == llm.ModelLlama32
+	bod.Model, err = llama.ModelCompat(bod.Model, bod.HasImages())
 	if err != nil {
 		slog.Error("invalid llama model", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	var rsp llm.StreamResponse
-	switch bod.Model {
-	case
-		llm.ModelClaude3Haiku, llm.ModelClaude3Haiku_20240307,
-		llm.ModelClaude35Sonnet, llm.ModelClaude35Sonnet_20240620,
-		llm.ModelClaude35SonnetV2, llm.ModelClaude35SonnetV2_20241022,
-		llm.ModelClaude35Haiku, llm.ModelClaude35Haiku_20241022:
-		err = claude.Prompt(ctx, bod, &rsp)
-		if err != nil {
-			slog.Error("failed to prompt Claude", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	if err := addServerTools(&bod); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// A retried request with the same Idempotency-Key is not served twice.
+	// Each step's receipt has its own key, derived from the request's.
+	idempotencyKey := db.ClientIdempotencyKey(user.ID, r.Header.Get("Idempotency-Key"))
+	stepKey := func(step int) string {
+		if idempotencyKey == "" {
+			return ""
 		}
-	case llm.ModelGemini15Flash:
-		m := gemini.ModelGemini15Flash
-		err = m.Prompt(ctx, bod, &rsp)
+		return fmt.Sprintf("%s:step:%d", idempotencyKey, step)
+	}
+	if idempotencyKey != "" {
+		exists, err := db.ReceiptExists(ctx, stepKey(1))
 		if err != nil {
-			slog.Error("failed to prompt "+m.PrettyStr(), "error", err)
+			slog.Error("failed to check idempotency key", "error", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-	case llm.ModelGemini15Pro:
-		m := gemini.ModelGemini15Pro
-		err = m.Prompt(ctx, bod, &rsp)
-		if err != nil {
-			slog.Error("failed to prompt "+m.PrettyStr(), "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if exists {
+			http.Error(w, "request with this Idempotency-Key was already processed", http.StatusConflict)
 			return
 		}
-	case llm.ModelMistralNemo, llm.ModelMistralLarge:
-		err = mistral.Prompt(ctx, bod, &rsp)
-		if err != nil {
-			slog.Error("failed to prompt "+bod.Model.String(), "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	// Concurrent requests with the same key are refused until this one fails.
+	// The claim is kept once the first step's receipt is saved.
+	claim, err := db.ClaimIdempotencyKey(ctx, user.ID, idempotencyKey)
+	if errors.Is(err, db.ErrDuplicateRequest) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to claim idempotency key", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Each model call reserves its maximum cost until its receipt settles it.
+	var hold db.Hold
+	placeHold := func() error {
+		if free {
+			return nil
+		}
+		hold, err = db.HoldPrompt(ctx, user.ID, bod)
+		return err
+	}
+	release := func() {
+		ctx := context.WithoutCancel(ctx)
+		if err := hold.Release(ctx); err != nil {
+			slog.Error("failed to release balance hold", "error", err)
+		}
+		if err := claim.Release(ctx); err != nil {
+			slog.Error("failed to release idempotency claim", "error", err)
+		}
+	}
+	if err := placeHold(); err != nil {
+		release()
+		if errors.Is(err, db.ErrInsufficientBalance) {
+			slog.Info("insufficient balance", "balance", user.Balance, "error", err)
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
 			return
 		}
-	case llm.ModelLlama33_70bInstruct:
-		err = llama.Prompt(ctx, bod, &rsp)
-		if err != nil {
-			slog.Error("failed to prompt "+llama.ModelLlama32.PrettyStr(), "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if errors.Is(err, db.ErrLimitExceeded) {
+			slog.Info("spending limit exceeded", "error", err)
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
 			return
 		}
-	case
-		llm.ModelO1Mini, llm.ModelO1Mini_20240912,
-		llm.ModelO1Preview, llm.ModelO1Preview_20240912,
-		llm.ModelGPT4oMini, llm.ModelGPT4oMini_20240718,
-		llm.ModelGPT4o, llm.ModelGPT4o_1120:
-		err = gpt.Prompt(ctx, bod, &rsp)
-		if err != nil {
-			slog.Error("failed to prompt "+bod.Model.String(), "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.Error("failed to place balance hold", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var rsp llm.StreamResponse
+	err = s.providers.Prompt(ctx, bod, &rsp)
+	if err != nil {
+		release()
+		if providers.IsBadRequest(err) {
+			slog.Info("invalid prompt request", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-	case llm.ModelCerebrasLlama8B, llm.ModelCerebrasLlama70B:
-		cerebrasClient := cerebras.NewService(&s.sd, s.cl.Secr)
-		err = cerebrasClient.Prompt(ctx, bod, &rsp)
-		if err != nil {
-			slog.Error("failed to prompt "+bod.Model.String(), "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.Error("failed to prompt "+bod.Model.String(), "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// A fallback model may cost more than the model the hold was placed for.
+	if err := hold.Reestimate(ctx, bod, rsp.Model); err != nil {
+		release()
+		drain(rsp)
+		if errors.Is(err, db.ErrInsufficientBalance) {
+			slog.Info("insufficient balance for fallback", "servedBy", rsp.Model, "error", err)
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
 			return
 		}
-	default:
-		slog.Info("unsupported model", "model", bod.Model)
-		http.Error(w, fmt.Sprintf("unsupported model: %s", bod.Model), http.StatusBadRequest)
+		slog.Error("failed to re-estimate balance hold", "servedBy", rsp.Model, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -192,49 +232,128 @@ func (s *Service) PromptV2(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		slog.Error("Streaming not supported")
+		release()
+		drain(rsp)
 		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
 		return
 	}
-
-	// Process and send tokens as SSE events
-	for token := range rsp.Text {
-		if token.Err != nil {
-			slog.Error("failed to stream token", "error", token.Err)
-			// Send error event
-			errEvent := map[string]string{
-				"type": "error",
-				"data": token.Err.Error(),
-			}
-			eventJSON, _ := json.Marshal(errEvent)
-			fmt.Fprintf(w, "data: %s\n\n", eventJSON)
-			flusher.Flush()
-			return
-		}
-
-		// Send text event
-		textEvent := map[string]string{
-			"type": "text",
-			"data": token.Ok,
-		}
-		eventJSON, _ := json.Marshal(textEvent)
+	send := func(eventType string, data any) {
+		eventJSON, _ := json.Marshal(map[string]any{
+			"type": eventType,
+			"data": data,
+		})
 		fmt.Fprintf(w, "data: %s\n\n", eventJSON)
 		flusher.Flush()
 	}
 
-	// Send done event
-	fmt.Fprintf(w, "data: {\"type\":\"done\"}\n\n")
-	flusher.Flush()
+	// Each step streams one model turn. If the model calls server tools,
+	// their results are sent back to it in the next step.
+	var usage rp.PromptUsageV2
+	servedBy := bod.Model
+	for step := 1; ; step++ {
+		// Tell the client when the serving model changes, such as to a fallback
+		if rsp.Model != servedBy {
+			slog.Warn("prompt served by fallback model", "servedBy", rsp.Model, "step", step)
+			send("fallback", rsp.Model.String())
+			servedBy = rsp.Model
+		}
+
+		// Process and send tokens as SSE events
+		var text strings.Builder
+		for token := range rsp.Text {
+			if token.Err != nil {
+				slog.Error("failed to stream token", "error", token.Err)
+				release()
+				send("error", token.Err.Error())
+				return
+			}
+			text.WriteString(token.Ok)
+			send("text", token.Ok)
+		}
 
-	s.sd.Run(func(ctx context.Context) {
-		slog.Debug("receipt", "input_tokens", rsp.InputTokens, "output_tokens", rsp.OutputTokens)
+		// The receipt is inserted before the done event so its cost can be reported.
+		// It must be recorded even if the client has disconnected.
+		slog.Debug("receipt", "step", step, "input_tokens", rsp.InputTokens, "output_tokens", rsp.OutputTokens)
 		receipt := db.Receipt{
-			UserID:       user.ID,
-			InputTokens:  int64(rsp.InputTokens),
-			OutputTokens: int64(rsp.OutputTokens),
-			ServiceName:  bod.Model,
+			UserID:         user.ID,
+			InputTokens:    int64(rsp.InputTokens),
+			OutputTokens:   int64(rsp.OutputTokens),
+			ServiceName:    rsp.Model,
+			HoldID:         hold.ID,
+			IdempotencyKey: stepKey(step),
 		}
-		if err := receipt.Insert(ctx); err != nil {
+		if err := receipt.Save(context.WithoutCancel(ctx)); err != nil {
+			// The receipt could not be queued either, so nothing will settle the hold.
 			slog.Error("failed to insert receipt", "error", err)
+			release()
+		} else if step == 1 {
+			if err := claim.Complete(context.WithoutCancel(ctx)); err != nil {
+				slog.Error("failed to complete idempotency claim", "error", err)
+			}
+		}
+		usage.FinishReason = rsp.FinishReason
+		usage.Model = rsp.Model
+		usage.InputTokens += rsp.InputTokens
+		usage.OutputTokens += rsp.OutputTokens
+		usage.Cost += receipt.DittoTokenCost
+
+		// Send a tool_call event for each tool the model asked to call.
+		// Server tools are run here; the client runs the rest.
+		var results []rq.ToolResult
+		clientCalls := 0
+		for _, call := range rsp.ToolCalls {
+			send("tool_call", call)
+			if !isServerTool(bod, call.Name) {
+				clientCalls++
+				continue
+			}
+			result, cost, err := s.runTool(ctx, user, call)
+			usage.ToolCost += cost
+			usage.Cost += cost
+			if err != nil {
+				send("tool_error", rp.ToolErrorV2{ToolCallID: call.ID, Name: call.Name, Error: err.Error()})
+			}
+			send("tool_result", result)
+			results = append(results, result)
+		}
+		if len(results) == 0 || clientCalls > 0 || step == maxToolSteps {
+			break
+		}
+
+		bod.Messages = append(bod.Conversation(),
+			rq.Message{Role: rq.RoleAssistant, Content: text.String(), ToolCalls: rsp.ToolCalls},
+			rq.Message{Role: rq.RoleUser, ToolResults: results},
+		)
+		bod.ClearFinalMessage()
+		if err := placeHold(); err != nil {
+			slog.Info("failed to place balance hold", "error", err, "step", step+1)
+			send("error", err.Error())
+			return
+		}
+		rsp = llm.StreamResponse{}
+		if err := s.providers.Prompt(ctx, bod, &rsp); err != nil {
+			release()
+			slog.Error("failed to prompt "+bod.Model.String(), "error", err, "step", step+1)
+			send("error", err.Error())
+			return
+		}
+		if err := hold.Reestimate(ctx, bod, rsp.Model); err != nil {
+			release()
+			drain(rsp)
+			slog.Info("failed to re-estimate balance hold", "servedBy", rsp.Model, "error", err, "step", step+1)
+			send("error", err.Error())
+			return
+		}
+	}
+
+	send("done", usage)
+}
+
+// drain discards the rest of a response that will not be sent,
+// so that its provider is not left blocked on it.
+func drain(rsp llm.StreamResponse) {
+	go func() {
+		for range rsp.Text {
 		}
-	})
+	}()
 }
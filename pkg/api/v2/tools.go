@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/users"
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/pkg/services/search"
+	"github.com/ditto-assistant/backend/types/rq"
+)
+
+// maxToolSteps is the most model turns a single prompt may take,
+// including the first, when the backend runs tools.
+const maxToolSteps = 5
+
+const (
+	ToolWebSearch     = "web_search"
+	ToolGenerateImage = "generate_image"
+)
+
+var serverTools = map[string]rq.Tool{
+	ToolWebSearch: {
+		Name:        ToolWebSearch,
+		Description: "Search the web for current information. Returns the top results as text.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"query": {"type": "string", "description": "The search query"},
+				"numResults": {"type": "integer", "description": "Number of results to return, 1 to 10"}
+			},
+			"required": ["query"]
+		}`),
+	},
+	ToolGenerateImage: {
+		Name:        ToolGenerateImage,
+		Description: "Generate an image from a text description. Returns the image URL.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"prompt": {"type": "string", "description": "A detailed description of the image"},
+				"shape": {"type": "string", "enum": ["square", "wide", "tall"]}
+			},
+			"required": ["prompt"]
+		}`),
+	},
+}
+
+// addServerTools adds the definitions of the requested server tools to the prompt.
+func addServerTools(prompt *rq.PromptV1) error {
+	for _, name := range prompt.ServerTools {
+		tool, ok := serverTools[name]
+		if !ok {
+			return fmt.Errorf("unknown server tool: %q", name)
+		}
+		if slices.ContainsFunc(prompt.Tools, func(t rq.Tool) bool { return t.Name == name }) {
+			return fmt.Errorf("tool %q is already defined", name)
+		}
+		prompt.Tools = append(prompt.Tools, tool)
+	}
+	return nil
+}
+
+// isServerTool reports whether the backend runs the tool for this prompt.
+func isServerTool(prompt rq.PromptV1, name string) bool {
+	return slices.Contains(prompt.ServerTools, name)
+}
+
+// runTool runs a server tool call and returns its result for the model,
+// and the Ditto tokens the user was charged for it.
+// Failures are reported to the model rather than ending the response,
+// and are also returned so the client can be told.
+// Each paid tool holds its cost before it runs, and its receipt settles the hold.
+func (s *Service) runTool(ctx context.Context, user users.User, call llm.ToolCall) (rq.ToolResult, int64, error) {
+	result := rq.ToolResult{ToolCallID: call.ID, Name: call.Name}
+	var cost int64
+	var err error
+	switch call.Name {
+	case ToolWebSearch:
+		result.Content, cost, err = s.webSearch(ctx, user, call.Arguments)
+	case ToolGenerateImage:
+		result.Content, cost, err = s.generateImage(ctx, user, call.Arguments)
+	default:
+		err = fmt.Errorf("unknown tool: %s", call.Name)
+	}
+	if err != nil {
+		slog.Warn("server tool failed", "tool", call.Name, "userID", user.UID, "error", err)
+		result.Content = "Error: " + err.Error()
+	}
+	return result, cost, err
+}
+
+func (s *Service) webSearch(ctx context.Context, user users.User, args json.RawMessage) (string, int64, error) {
+	var in struct {
+		Query      string `json:"query"`
+		NumResults int    `json:"numResults"`
+	}
+	if err := json.Unmarshal(args, &in); err != nil {
+		return "", 0, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if in.Query == "" {
+		return "", 0, errors.New("query is required")
+	}
+	if in.NumResults <= 0 || in.NumResults > 10 {
+		in.NumResults = 5
+	}
+	// Google is the most expensive search engine that may serve the search.
+	hold, err := db.HoldReceipt(ctx, db.Receipt{UserID: user.ID, ServiceName: llm.SearchEngineGoogle, NumSearches: 1})
+	if err != nil {
+		return "", 0, err
+	}
+	results, err := s.search.Search(ctx, search.Request{
+		User:       user,
+		Query:      in.Query,
+		NumResults: in.NumResults,
+		HoldID:     hold.ID,
+	})
+	if err != nil {
+		hold.ReleaseLogged(ctx)
+		return "", 0, err
+	}
+	// The search engine that served the search has settled the hold.
+	cost, err := hold.Settled(context.WithoutCancel(ctx))
+	if err != nil {
+		slog.Error("failed to get search cost", "holdID", hold.ID, "error", err)
+	}
+	var sb strings.Builder
+	if err := results.Text(&sb); err != nil {
+		return "", cost, err
+	}
+	return sb.String(), cost, nil
+}
+
+func (s *Service) generateImage(ctx context.Context, user users.User, args json.RawMessage) (string, int64, error) {
+	var in struct {
+		Prompt string `json:"prompt"`
+		Shape  string `json:"shape"`
+	}
+	if err := json.Unmarshal(args, &in); err != nil {
+		return "", 0, fmt.Errorf("invalid arguments: %w", err)
+	}
+	req := rq.GenerateImageV1{
+		UserID: user.UID,
+		Prompt: in.Prompt,
+		Model:  llm.ModelDalle3,
+		Size:   "1024x1024",
+	}
+	switch in.Shape {
+	case "wide":
+		req.Size = "1792x1024"
+	case "tall":
+		req.Size = "1024x1792"
+	}
+	return s.dalle.Generate(ctx, user, &req)
+}
@@ -0,0 +1,100 @@
+// Package pricing calculates the Ditto token cost of a receipt.
+package pricing
+
+import (
+	"math"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+)
+
+const (
+	tokensPerMillion = 1_000_000
+	bytesPerGB       = 1 << 30
+)
+
+// PeakHours is the daily window, in UTC, when a service's
+// peak hours multiplier applies. It starts at Start and ends before End.
+type PeakHours struct {
+	Start, End int
+	// Weekends is whether the window also applies on Saturday and Sunday.
+	Weekends bool
+}
+
+// DefaultPeakHours is the window Cost applies peak hours multipliers in.
+// It is empty, so no receipt is in peak hours,
+// until the window is stored with the services.
+var DefaultPeakHours PeakHours
+
+// Contains reports whether t is within the peak hours.
+// An empty window contains no time.
+// A window whose End is before its Start wraps past midnight,
+// and belongs to the day it starts on.
+func (p PeakHours) Contains(t time.Time) bool {
+	t = t.UTC()
+	hour := t.Hour()
+	day := t.Weekday()
+	switch {
+	case p.Start < p.End:
+		if hour < p.Start || hour >= p.End {
+			return false
+		}
+	case p.Start > p.End:
+		if hour < p.End {
+			day = t.AddDate(0, 0, -1).Weekday()
+		} else if hour < p.Start {
+			return false
+		}
+	default:
+		return false
+	}
+	return p.Weekends || (day != time.Saturday && day != time.Sunday)
+}
+
+// Cost returns the Ditto token cost of the receipt for the service,
+// using the DefaultPeakHours.
+func Cost(r db.Receipt, s db.Service, tokensPerDollar int64) int64 {
+	return DefaultPeakHours.Cost(r, s, tokensPerDollar)
+}
+
+// Cost returns the Ditto token cost of the receipt for the service.
+// The base cost of the usage is multiplied by the service's peak hours multiplier
+// if the receipt is in the peak hours, then marked up by the profit margin.
+// Receipts of at least the volume discount threshold in tokens are discounted,
+// but the price never falls below the base cost plus the minimum profit.
+// Every receipt costs at least one token.
+func (p PeakHours) Cost(r db.Receipt, s db.Service, tokensPerDollar int64) int64 {
+	base := s.BaseCostPerCall +
+		s.BaseCostPerMillionTokens*float64(r.TotalTokens)/tokensPerMillion +
+		s.BaseCostPerMillionInputTokens*float64(r.InputTokens)/tokensPerMillion +
+		s.BaseCostPerMillionOutputTokens*float64(r.OutputTokens)/tokensPerMillion +
+		s.BaseCostPerImage*float64(r.NumImages) +
+		s.BaseCostPerSearch*float64(r.NumSearches) +
+		s.BaseCostPerSecond*r.CallDurationSeconds +
+		s.BaseCostPerGBProcessed*float64(r.DataProcessedBytes)/bytesPerGB +
+		s.BaseCostPerGBStored*float64(r.DataStoredBytes)/bytesPerGB
+	timestamp := r.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	if s.PeakHoursMultiplier > 0 && p.Contains(timestamp) {
+		base *= s.PeakHoursMultiplier
+	}
+	price := base * (1 + s.ProfitMarginPercentage/100)
+	if s.VolumeDiscountThreshold > 0 && tokens(r) >= s.VolumeDiscountThreshold {
+		price *= 1 - s.VolumeDiscountPercentage/100
+	}
+	if base > 0 {
+		price = max(price, base+s.MinimumProfitAmount)
+	}
+	return max(1, int64(math.Round(price*float64(tokensPerDollar))))
+}
+
+// tokens returns the receipt's total tokens,
+// which callers often leave for the input and output tokens to imply.
+func tokens(r db.Receipt) int64 {
+	if r.TotalTokens > 0 {
+		return r.TotalTokens
+	}
+	return r.InputTokens + r.OutputTokens
+}
@@ -0,0 +1,212 @@
+package pricing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/dbtest"
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+)
+
+const tokensPerDollar = 1_000_000_000
+
+// usBusinessHours covers weekday business hours across the US,
+// 9 AM Eastern to 5 PM Pacific in standard time.
+var usBusinessHours = PeakHours{Start: 14, End: 1}
+
+var (
+	// Wednesday, before the peak hours start.
+	offPeak = time.Date(2025, time.January, 1, 10, 0, 0, 0, time.UTC)
+	// Wednesday afternoon.
+	peak = time.Date(2025, time.January, 1, 15, 0, 0, 0, time.UTC)
+)
+
+func promptService() db.Service {
+	return db.Service{
+		BaseCostPerMillionInputTokens:  3,
+		BaseCostPerMillionOutputTokens: 15,
+		ProfitMarginPercentage:         100,
+		MinimumProfitAmount:            0.0001,
+		PeakHoursMultiplier:            1.5,
+		VolumeDiscountThreshold:        1_000_000,
+		VolumeDiscountPercentage:       10,
+	}
+}
+
+func TestCost(t *testing.T) {
+	noMargin := promptService()
+	noMargin.ProfitMarginPercentage = 0
+	noPeak := promptService()
+	noPeak.PeakHoursMultiplier = 0
+	search := db.Service{
+		BaseCostPerSearch:      0.01,
+		ProfitMarginPercentage: 100,
+		MinimumProfitAmount:    0.0001,
+		PeakHoursMultiplier:    1.5,
+	}
+	tests := []struct {
+		name     string
+		receipt  db.Receipt
+		service  db.Service
+		expected int64
+	}{
+		{
+			name:     "off peak",
+			receipt:  db.Receipt{InputTokens: 1000, OutputTokens: 500, Timestamp: offPeak},
+			service:  promptService(),
+			expected: 21_000_000,
+		},
+		{
+			name:     "peak",
+			receipt:  db.Receipt{InputTokens: 1000, OutputTokens: 500, Timestamp: peak},
+			service:  promptService(),
+			expected: 31_500_000,
+		},
+		{
+			name:     "peak without multiplier",
+			receipt:  db.Receipt{InputTokens: 1000, OutputTokens: 500, Timestamp: peak},
+			service:  noPeak,
+			expected: 21_000_000,
+		},
+		{
+			name:     "volume discount",
+			receipt:  db.Receipt{InputTokens: 1_000_000, Timestamp: offPeak},
+			service:  promptService(),
+			expected: 5_400_000_000,
+		},
+		{
+			name:     "below volume threshold",
+			receipt:  db.Receipt{InputTokens: 999_999, Timestamp: offPeak},
+			service:  promptService(),
+			expected: 5_999_994_000,
+		},
+		{
+			name:     "minimum profit",
+			receipt:  db.Receipt{InputTokens: 1000, Timestamp: offPeak},
+			service:  noMargin,
+			expected: 3_100_000,
+		},
+		{
+			name:     "discount limited by minimum profit",
+			receipt:  db.Receipt{InputTokens: 1_000_000, Timestamp: offPeak},
+			service:  noMargin,
+			expected: 3_000_100_000,
+		},
+		{
+			name:     "search",
+			receipt:  db.Receipt{NumSearches: 1, Timestamp: offPeak},
+			service:  search,
+			expected: 20_000_000,
+		},
+		{
+			name:     "at least one token",
+			receipt:  db.Receipt{Timestamp: offPeak},
+			service:  promptService(),
+			expected: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cost := usBusinessHours.Cost(test.receipt, test.service, tokensPerDollar)
+			if cost != test.expected {
+				t.Errorf("Cost() = %d; expected %d", cost, test.expected)
+			}
+		})
+	}
+}
+
+func TestPeakHoursContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		peak     PeakHours
+		t        time.Time
+		expected bool
+	}{
+		{"before start", usBusinessHours, offPeak, false},
+		{"after start", usBusinessHours, peak, true},
+		{"at start", usBusinessHours, time.Date(2025, time.January, 1, 14, 0, 0, 0, time.UTC), true},
+		{"past midnight", usBusinessHours, time.Date(2025, time.January, 2, 0, 30, 0, 0, time.UTC), true},
+		{"at end", usBusinessHours, time.Date(2025, time.January, 2, 1, 0, 0, 0, time.UTC), false},
+		{"saturday", usBusinessHours, time.Date(2025, time.January, 4, 15, 0, 0, 0, time.UTC), false},
+		{"friday past midnight", usBusinessHours, time.Date(2025, time.January, 4, 0, 30, 0, 0, time.UTC), true},
+		{"sunday past midnight", usBusinessHours, time.Date(2025, time.January, 6, 0, 30, 0, 0, time.UTC), false},
+		{"weekends", PeakHours{Start: 14, End: 1, Weekends: true}, time.Date(2025, time.January, 4, 15, 0, 0, 0, time.UTC), true},
+		{"same day", PeakHours{Start: 9, End: 17}, time.Date(2025, time.January, 1, 16, 59, 0, 0, time.UTC), true},
+		{"same day after end", PeakHours{Start: 9, End: 17}, time.Date(2025, time.January, 1, 17, 0, 0, 0, time.UTC), false},
+		{"other time zone", usBusinessHours, time.Date(2025, time.January, 1, 10, 0, 0, 0, time.FixedZone("EST", -5*60*60)), true},
+		{"empty", PeakHours{}, peak, false},
+		{"default", DefaultPeakHours, peak, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.peak.Contains(test.t); got != test.expected {
+				t.Errorf("Contains(%s) = %t; expected %t", test.t, got, test.expected)
+			}
+		})
+	}
+}
+
+// TestCostMatchesTrigger prices a receipt for each seeded service with Cost
+// and with the receipt trigger, which has no peak hours.
+func TestCostMatchesTrigger(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	res, err := db.D.ExecContext(ctx, "INSERT INTO users (uid, balance) VALUES ('pricing', 1000000000000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var perDollar int64
+	err = db.D.QueryRowContext(ctx, "SELECT count FROM tokens_per_unit WHERE name = 'dollar'").Scan(&perDollar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.D.QueryContext(ctx, "SELECT name FROM services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if len(names) == 0 {
+		t.Fatal("no services are seeded")
+	}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			service := db.Service{Name: name}
+			if err := service.GetByName(ctx); err != nil {
+				t.Fatal(err)
+			}
+			receipt := db.Receipt{
+				UserID:       userID,
+				ServiceName:  llm.ServiceName(name),
+				Timestamp:    peak,
+				InputTokens:  10_000,
+				OutputTokens: 2_000,
+				TotalTokens:  12_000,
+				NumImages:    1,
+				NumSearches:  1,
+			}
+			expected := Cost(receipt, service, perDollar)
+			// Without a Price, the receipt trigger prices the receipt.
+			if err := receipt.Insert(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if receipt.DittoTokenCost != expected {
+				t.Errorf("trigger cost = %d; Cost() = %d", receipt.DittoTokenCost, expected)
+			}
+		})
+	}
+}
@@ -37,6 +37,12 @@ func (r *AuthToken) Check(uid string) error {
 	return nil
 }
 
+// EmailVerified reports whether the token's email address has been verified.
+func (r *AuthToken) EmailVerified() bool {
+	verified, _ := r.Claims["email_verified"].(bool)
+	return verified
+}
+
 func (a *Client) verifyToken(ctx context.Context, idToken string) (*AuthToken, error) {
 	if idToken == "" {
 		return nil, errors.New("authorization header is required but not provided")
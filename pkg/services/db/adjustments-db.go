@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/pubsub"
+)
+
+// ErrPurchaseNotFound is returned when no purchase was paid by a refunded or disputed payment.
+var ErrPurchaseNotFound = errors.New("purchase not found")
+
+type AdjustmentKind string
+
+const (
+	AdjustmentRefund     AdjustmentKind = "refund"
+	AdjustmentDispute    AdjustmentKind = "dispute"
+	AdjustmentDisputeWon AdjustmentKind = "dispute_won"
+)
+
+// Adjustment reverses some or all of the tokens of a purchase, or restores them.
+type Adjustment struct {
+	ID         int64
+	PurchaseID int64
+	UserID     int64
+	Kind       AdjustmentKind
+	// ReferenceID is the Stripe object that caused the adjustment.
+	// An adjustment with the same kind and reference is only applied once.
+	ReferenceID string
+	Cents       int64
+	// Tokens are negative when they are taken back from the user.
+	Tokens       int64
+	BalanceAfter int64
+	// Flagged is set when the adjustment left the user's balance negative.
+	Flagged   bool
+	CreatedAt time.Time
+}
+
+// adjustedPurchase is a purchase and the tokens adjustments have taken from it so far.
+type adjustedPurchase struct {
+	Purchase
+	// Refunded and RefundedTokens are the cents refunded and the tokens they took back.
+	Refunded, RefundedTokens int64
+	// Reversed is the tokens taken back by every adjustment, net of any restored.
+	Reversed int64
+}
+
+func getAdjustedPurchase(ctx context.Context, tx *sql.Tx, paymentIntentID string) (adjustedPurchase, error) {
+	var p adjustedPurchase
+	err := tx.QueryRowContext(ctx, `
+		SELECT purchases.id, purchases.payment_id, purchases.user_id, purchases.cents, purchases.tokens,
+			purchases.created_at,
+			COALESCE(SUM(purchase_adjustments.cents) FILTER (WHERE kind = 'refund'), 0),
+			COALESCE(-SUM(purchase_adjustments.tokens) FILTER (WHERE kind = 'refund'), 0),
+			COALESCE(-SUM(purchase_adjustments.tokens), 0)
+		FROM purchases
+		LEFT JOIN purchase_adjustments ON purchase_adjustments.purchase_id = purchases.id
+		WHERE purchases.payment_id = ? OR purchases.payment_intent_id = ?
+		GROUP BY purchases.id`, paymentIntentID, paymentIntentID).
+		Scan(&p.ID, &p.PaymentID, &p.UserID, &p.Cents, &p.Tokens, &p.CreatedAt,
+			&p.Refunded, &p.RefundedTokens, &p.Reversed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, fmt.Errorf("%w: payment %s", ErrPurchaseNotFound, paymentIntentID)
+	}
+	if err != nil {
+		return p, fmt.Errorf("failed to get purchase of payment %s: %w", paymentIntentID, err)
+	}
+	return p, nil
+}
+
+// tokensFor returns the purchase's tokens that the given cents paid for.
+func (p adjustedPurchase) tokensFor(cents int64) int64 {
+	if p.Cents <= 0 || cents >= p.Cents {
+		return p.Tokens
+	}
+	return p.Tokens * cents / p.Cents
+}
+
+// RefundPurchase takes back the tokens of the purchase paid by the payment intent,
+// in proportion to the cents refunded so far. Stripe reports the total refunded
+// with each refund, so only the tokens not yet taken back are reversed.
+// It returns false if there was nothing left to reverse.
+func RefundPurchase(ctx context.Context, paymentIntentID, chargeID string, refunded int64) (Adjustment, bool, error) {
+	return adjust(ctx, paymentIntentID, func(p adjustedPurchase) Adjustment {
+		return Adjustment{
+			Kind:        AdjustmentRefund,
+			ReferenceID: fmt.Sprintf("%s:%d", chargeID, refunded),
+			Cents:       refunded - p.Refunded,
+			Tokens:      -(p.tokensFor(refunded) - p.RefundedTokens),
+		}
+	})
+}
+
+// DisputePurchase takes back the tokens of the purchase paid by the payment intent,
+// in proportion to the cents disputed.
+// It returns false if the dispute was already applied, or there was nothing left to reverse.
+func DisputePurchase(ctx context.Context, paymentIntentID, disputeID string, cents int64) (Adjustment, bool, error) {
+	return adjust(ctx, paymentIntentID, func(p adjustedPurchase) Adjustment {
+		return Adjustment{
+			Kind:        AdjustmentDispute,
+			ReferenceID: disputeID,
+			Cents:       cents,
+			Tokens:      -p.tokensFor(cents),
+		}
+	})
+}
+
+// WinDispute restores the tokens that a dispute took back from the purchase paid by the payment intent.
+// It returns false if the dispute was already won, or never took any tokens.
+func WinDispute(ctx context.Context, paymentIntentID, disputeID string) (Adjustment, bool, error) {
+	var disputed Adjustment
+	err := D.QueryRowContext(ctx, `
+		SELECT cents, tokens FROM purchase_adjustments
+		WHERE kind = ? AND reference_id = ?`, AdjustmentDispute, disputeID).
+		Scan(&disputed.Cents, &disputed.Tokens)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Adjustment{}, false, nil
+	}
+	if err != nil {
+		return Adjustment{}, false, fmt.Errorf("failed to get dispute %s: %w", disputeID, err)
+	}
+	return adjust(ctx, paymentIntentID, func(p adjustedPurchase) Adjustment {
+		return Adjustment{
+			Kind:        AdjustmentDisputeWon,
+			ReferenceID: disputeID,
+			Cents:       -disputed.Cents,
+			Tokens:      -disputed.Tokens,
+		}
+	})
+}
+
+// adjust records the adjustment that next makes of the purchase paid by the payment intent.
+// Reversals are capped at the tokens not yet taken back. The user's balance may go negative.
+func adjust(ctx context.Context, paymentIntentID string, next func(adjustedPurchase) Adjustment) (Adjustment, bool, error) {
+	tx, err := D.BeginTx(ctx, nil)
+	if err != nil {
+		return Adjustment{}, false, fmt.Errorf("failed to begin adjustment: %w", err)
+	}
+	defer tx.Rollback()
+	p, err := getAdjustedPurchase(ctx, tx, paymentIntentID)
+	if err != nil {
+		return Adjustment{}, false, err
+	}
+	a := next(p)
+	a.PurchaseID = p.ID
+	a.UserID = p.UserID
+	if remaining := p.Tokens - p.Reversed; -a.Tokens > remaining {
+		a.Tokens = -remaining
+	}
+	// An older refund event can arrive after a newer one, leaving nothing to reverse.
+	if a.Tokens == 0 || a.Kind != AdjustmentDisputeWon && a.Tokens > 0 {
+		return a, false, nil
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO purchase_adjustments (purchase_id, user_id, kind, reference_id, cents, tokens, balance_after, flagged)
+		SELECT ?, ?, ?, ?, ?, ?, balance + ?, balance + ? < 0
+		FROM users WHERE id = ?
+		ON CONFLICT (kind, reference_id) DO NOTHING
+		RETURNING id, balance_after, flagged, created_at`,
+		a.PurchaseID, a.UserID, a.Kind, a.ReferenceID, a.Cents, a.Tokens, a.Tokens, a.Tokens, a.UserID).
+		Scan(&a.ID, &a.BalanceAfter, &a.Flagged, &a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, false, nil
+	}
+	if err != nil {
+		return Adjustment{}, false, fmt.Errorf("failed to record %s of purchase %d: %w", a.Kind, a.PurchaseID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Adjustment{}, false, fmt.Errorf("failed to commit adjustment: %w", err)
+	}
+	if a.Flagged {
+		slog.Warn("adjustment left balance negative",
+			"userID", a.UserID, "purchaseID", a.PurchaseID, "kind", a.Kind, "balance", a.BalanceAfter)
+	}
+	pubsub.PublishBalance(ctx, a.UserID, pubsub.ReasonRefund)
+	return a, true, nil
+}
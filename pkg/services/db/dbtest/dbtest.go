@@ -0,0 +1,86 @@
+// Package dbtest sets up a database for tests, migrated like production.
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	_ "github.com/tursodatabase/go-libsql"
+)
+
+// Setup opens a new database in a temporary directory, applies every
+// migration in cmd/dbmgr/migrations to it, and sets db.D to it until
+// the test ends. Tests that use it must not run in parallel.
+func Setup(t testing.TB) *sql.DB {
+	t.Helper()
+	d, err := sql.Open("libsql", "file:"+filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	// Each connection to a file database sees the same data,
+	// but one keeps writes from failing with "database is locked".
+	d.SetMaxOpenConns(1)
+	prev := db.D
+	db.D = d
+	t.Cleanup(func() {
+		db.D = prev
+		d.Close()
+	})
+	migrate(t, d)
+	return d
+}
+
+// migrate applies the migrations in version order,
+// splitting each file into statements as dbmgr does.
+func migrate(t testing.TB, d *sql.DB) {
+	t.Helper()
+	_, file, _, _ := runtime.Caller(0)
+	dir := filepath.Join(filepath.Dir(file), "..", "..", "..", "..", "cmd", "dbmgr", "migrations")
+	folders, err := filepath.Glob(filepath.Join(dir, "v*"))
+	if err != nil || len(folders) == 0 {
+		t.Fatalf("failed to find migrations in %s: %v", dir, err)
+	}
+	slices.SortFunc(folders, func(a, b string) int {
+		return slices.Compare(version(a), version(b))
+	})
+	ctx := context.Background()
+	for _, folder := range folders {
+		files, err := filepath.Glob(filepath.Join(folder, "*.sql"))
+		if err != nil {
+			t.Fatalf("failed to read migrations in %s: %v", folder, err)
+		}
+		for _, file := range files {
+			contents, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("failed to read migration %s: %v", file, err)
+			}
+			for _, stmt := range strings.Split(string(contents), ";\n\n") {
+				stmt = strings.TrimSpace(stmt)
+				if stmt == "" {
+					continue
+				}
+				if _, err := d.ExecContext(ctx, stmt); err != nil {
+					t.Fatalf("failed to apply migration %s: %v", file, err)
+				}
+			}
+		}
+	}
+}
+
+// version returns the numbers of a version folder such as v0.0.12.
+func version(folder string) []int {
+	parts := strings.Split(strings.TrimPrefix(filepath.Base(folder), "v"), ".")
+	nums := make([]int, len(parts))
+	for i, p := range parts {
+		nums[i], _ = strconv.Atoi(p)
+	}
+	return nums
+}
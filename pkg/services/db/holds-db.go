@@ -0,0 +1,294 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/types/rq"
+)
+
+// HoldTTL is how long a hold reserves a user's balance if it is never
+// settled or released, such as when the server stops mid-stream.
+const HoldTTL = 15 * time.Minute
+
+// defaultHoldOutputTokens is the output estimate for models without a
+// max_output_tokens limit in the services table.
+const defaultHoldOutputTokens = 8192
+
+// ErrInsufficientBalance is returned when a user's available balance,
+// after their active holds, cannot cover a new hold.
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// Hold reserves part of a user's balance while a prompt streams.
+// The receipt trigger settles it with the actual cost,
+// releasing the rest of the amount.
+type Hold struct {
+	ID          int64
+	UserID      int64
+	ServiceName llm.ServiceName
+	// Amount is the most the hold's prompt may cost, in Ditto tokens.
+	Amount int64
+}
+
+// HoldPrompt places a hold for the most the prompt could cost the user,
+// assuming it generates its maximum output.
+// It returns ErrLimitExceeded if that would exceed the user's spending limits.
+func HoldPrompt(ctx context.Context, userID int64, prompt rq.PromptV1) (Hold, error) {
+	amount, err := estimatePrompt(ctx, userID, prompt)
+	if err != nil {
+		return Hold{}, err
+	}
+	hold := Hold{UserID: userID, ServiceName: prompt.Model, Amount: amount}
+	if err := hold.Place(ctx); err != nil {
+		return Hold{}, err
+	}
+	return hold, nil
+}
+
+// HoldReceipt places a hold for the cost of the receipt, as EstimateCost
+// prices it, for a tool call whose receipt will settle it.
+// It returns ErrLimitExceeded if that would exceed the user's spending limits.
+func HoldReceipt(ctx context.Context, r Receipt) (Hold, error) {
+	amount, err := EstimateCost(ctx, r)
+	if err != nil {
+		return Hold{}, err
+	}
+	hold := Hold{UserID: r.UserID, ServiceName: r.ServiceName, Amount: amount}
+	if err := hold.Place(ctx); err != nil {
+		return Hold{}, err
+	}
+	return hold, nil
+}
+
+// estimatePrompt returns the most the prompt could cost the user on prompt.Model.
+// A prompt with a response schema may be retried until its response matches,
+// so it is estimated for every attempt.
+func estimatePrompt(ctx context.Context, userID int64, prompt rq.PromptV1) (int64, error) {
+	outputTokens := int64(prompt.MaxOutputTokens)
+	if outputTokens == 0 {
+		limit, err := MaxOutputTokens(ctx, prompt.Model)
+		if err != nil {
+			return 0, err
+		}
+		outputTokens = int64(limit)
+	}
+	if outputTokens == 0 {
+		outputTokens = defaultHoldOutputTokens
+	}
+	inputTokens := int64(prompt.EstimateInputTokens())
+	if len(prompt.ResponseSchema) > 0 {
+		// Each retry also resends the previous attempt's output.
+		inputTokens = llm.MaxJSONAttempts*inputTokens + (llm.MaxJSONAttempts-1)*outputTokens
+		outputTokens *= llm.MaxJSONAttempts
+	}
+	return EstimateCost(ctx, Receipt{
+		UserID:       userID,
+		ServiceName:  prompt.Model,
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		TotalTokens:  inputTokens + outputTokens,
+	})
+}
+
+// EstimateCost returns the Ditto token cost of the receipt
+// for its ServiceName, as it would be charged now.
+func EstimateCost(ctx context.Context, r Receipt) (int64, error) {
+	name := r.ServiceName
+	if Price != nil {
+		service := Service{Name: string(name)}
+		if err := service.GetByName(ctx); err != nil {
+			return 0, fmt.Errorf("failed to estimate cost for %s: %w", name, err)
+		}
+		perDollar, err := tokensPerDollar(ctx, D)
+		if err != nil {
+			return 0, err
+		}
+		return Price(r, service, perDollar), nil
+	}
+	var cost int64
+	err := D.QueryRowContext(ctx, `
+		SELECT CAST(MAX(1, ROUND(
+			(COALESCE(base_cost_per_call, 0) +
+			 COALESCE(base_cost_per_million_tokens * (? / 1000000.0), 0) +
+			 COALESCE(base_cost_per_million_input_tokens * (? / 1000000.0), 0) +
+			 COALESCE(base_cost_per_million_output_tokens * (? / 1000000.0), 0) +
+			 COALESCE(base_cost_per_image * ?, 0) +
+			 COALESCE(base_cost_per_search * ?, 0)
+			) * tpu.count * (1 + profit_margin_percentage / 100.0)
+		)) AS INTEGER)
+		FROM services, tokens_per_unit AS tpu
+		WHERE services.name = ? AND tpu.name = 'dollar'`,
+		r.TotalTokens, r.InputTokens, r.OutputTokens, r.NumImages, r.NumSearches, name).Scan(&cost)
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate cost for %s: %w", name, err)
+	}
+	return cost, nil
+}
+
+// Place reserves the hold's amount if the user's balance, less their other
+// active holds, covers it, and it keeps the user within their spending limits.
+// Both are checked in the insert, so concurrent holds cannot together
+// overdraw the balance or exceed a limit.
+// It returns ErrLimitExceeded, with the reason, if a limit would be exceeded,
+// and ErrInsufficientBalance otherwise.
+// It updates the Hold's ID from the database.
+func (h *Hold) Place(ctx context.Context) error {
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	res, err := D.ExecContext(ctx, `
+		INSERT INTO balance_holds (user_id, service_id, amount, expires_at)
+		SELECT u.id, services.id, ?, datetime('now', ?)
+		FROM (
+			SELECT users.id, users.balance,
+				(SELECT COALESCE(SUM(amount), 0) FROM balance_holds
+				 WHERE user_id = users.id AND released_at IS NULL AND expires_at > CURRENT_TIMESTAMP) AS held,
+				(SELECT COALESCE(SUM(ditto_token_cost), 0) FROM receipts
+				 WHERE user_id = users.id AND timestamp >= ?) AS spent_today,
+				(SELECT COALESCE(SUM(ditto_token_cost), 0) FROM receipts
+				 WHERE user_id = users.id AND timestamp >= ?) AS spent_this_month
+			FROM users WHERE users.id = ?
+		) AS u
+		JOIN services ON services.name = ?
+		LEFT JOIN user_limits AS l ON l.user_id = u.id
+		WHERE u.balance - u.held >= ?
+			AND (l.per_request_limit IS NULL OR ? <= l.per_request_limit)
+			AND (l.daily_limit IS NULL OR u.spent_today + u.held + ? <= l.daily_limit)
+			AND (l.monthly_limit IS NULL OR u.spent_this_month + u.held + ? <= l.monthly_limit)`,
+		h.Amount, fmt.Sprintf("+%d seconds", int(HoldTTL.Seconds())),
+		day.Format(receiptTimeFormat), month.Format(receiptTimeFormat), h.UserID, h.ServiceName,
+		h.Amount, h.Amount, h.Amount, h.Amount)
+	if err != nil {
+		return fmt.Errorf("failed to place hold: %w", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		// Find which check refused the hold, for the error's reason.
+		if err := CheckLimits(ctx, h.UserID, h.Amount); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: a hold of %d tokens is needed", ErrInsufficientBalance, h.Amount)
+	}
+	h.ID, err = res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get last insert id: %w", err)
+	}
+	return nil
+}
+
+// Reestimate re-estimates the hold for the model that served the prompt,
+// such as a fallback, which may cost more or less than the model requested.
+// It leaves the hold as it was and returns ErrLimitExceeded if the new amount
+// would exceed the user's spending limits, or ErrInsufficientBalance if the
+// user's balance, less their other active holds, cannot cover it.
+func (h *Hold) Reestimate(ctx context.Context, prompt rq.PromptV1, served llm.ServiceName) error {
+	if h.ID == 0 || served == h.ServiceName {
+		return nil
+	}
+	prompt.Model = served
+	amount, err := estimatePrompt(ctx, h.UserID, prompt)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	res, err := D.ExecContext(ctx, `
+		UPDATE balance_holds
+		SET service_id = (SELECT id FROM services WHERE name = ?), amount = ?
+		FROM (
+			SELECT users.id, users.balance,
+				(SELECT COALESCE(SUM(other.amount), 0) FROM balance_holds AS other
+				 WHERE other.user_id = users.id AND other.id != ?
+					AND other.released_at IS NULL AND other.expires_at > CURRENT_TIMESTAMP) AS held,
+				(SELECT COALESCE(SUM(ditto_token_cost), 0) FROM receipts
+				 WHERE user_id = users.id AND timestamp >= ?) AS spent_today,
+				(SELECT COALESCE(SUM(ditto_token_cost), 0) FROM receipts
+				 WHERE user_id = users.id AND timestamp >= ?) AS spent_this_month
+			FROM users WHERE users.id = (SELECT user_id FROM balance_holds WHERE id = ?)
+		) AS u
+		LEFT JOIN user_limits AS l ON l.user_id = u.id
+		WHERE balance_holds.id = ? AND balance_holds.released_at IS NULL
+			AND u.id = balance_holds.user_id
+			AND u.balance - u.held >= ?
+			AND (l.per_request_limit IS NULL OR ? <= l.per_request_limit)
+			AND (l.daily_limit IS NULL OR u.spent_today + u.held + ? <= l.daily_limit)
+			AND (l.monthly_limit IS NULL OR u.spent_this_month + u.held + ? <= l.monthly_limit)`,
+		served, amount, h.ID, day.Format(receiptTimeFormat), month.Format(receiptTimeFormat),
+		h.ID, h.ID, amount, amount, amount, amount)
+	if err != nil {
+		return fmt.Errorf("failed to re-estimate hold %d: %w", h.ID, err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		// Find which check refused the new amount, for the error's reason.
+		if err := checkLimits(ctx, h.UserID, amount, h.Amount); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: a hold of %d tokens is needed for %s", ErrInsufficientBalance, amount, served)
+	}
+	h.ServiceName = served
+	h.Amount = amount
+	return nil
+}
+
+// Release releases a hold that will not be settled by a receipt,
+// such as when the prompt fails. Releasing a zero Hold does nothing.
+func (h *Hold) Release(ctx context.Context) error {
+	if h.ID == 0 {
+		return nil
+	}
+	_, err := D.ExecContext(ctx,
+		"UPDATE balance_holds SET released_at = CURRENT_TIMESTAMP WHERE id = ? AND released_at IS NULL", h.ID)
+	if err != nil {
+		return fmt.Errorf("failed to release hold %d: %w", h.ID, err)
+	}
+	return nil
+}
+
+// Settled returns the cost of the receipt that settled the hold,
+// or 0 if no receipt has settled it yet.
+func (h *Hold) Settled(ctx context.Context) (int64, error) {
+	if h.ID == 0 {
+		return 0, nil
+	}
+	var settled sql.NullInt64
+	err := D.QueryRowContext(ctx, "SELECT settled_amount FROM balance_holds WHERE id = ?", h.ID).Scan(&settled)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get settled amount of hold %d: %w", h.ID, err)
+	}
+	return settled.Int64, nil
+}
+
+// ReleaseLogged releases a hold that its receipt will not settle, logging
+// any failure. It runs even if ctx is canceled, such as by a client that
+// disconnected, since the hold would otherwise reserve the balance until it expires.
+func (h *Hold) ReleaseLogged(ctx context.Context) {
+	if err := h.Release(context.WithoutCancel(ctx)); err != nil {
+		slog.Error("failed to release balance hold", "holdID", h.ID, "error", err)
+	}
+}
+
+// ReleaseExpiredHolds releases every expired hold that was never settled,
+// returning how many were released.
+// Expired holds no longer reserve any balance, so this only tidies the table.
+func ReleaseExpiredHolds(ctx context.Context) (int64, error) {
+	res, err := D.ExecContext(ctx, `
+		UPDATE balance_holds SET released_at = CURRENT_TIMESTAMP
+		WHERE released_at IS NULL AND expires_at <= CURRENT_TIMESTAMP`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release expired holds: %w", err)
+	}
+	return res.RowsAffected()
+}
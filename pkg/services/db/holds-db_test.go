@@ -0,0 +1,152 @@
+package db_test
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"testing"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/dbtest"
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/types/rq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUser inserts a user with the balance, returning its ID.
+func newUser(t *testing.T, balance int64) int64 {
+	t.Helper()
+	res, err := db.D.ExecContext(context.Background(),
+		"INSERT INTO users (uid, balance) VALUES (?, ?)", rand.Text(), balance)
+	require.NoError(t, err)
+	id, err := res.LastInsertId()
+	require.NoError(t, err)
+	return id
+}
+
+// heldAmount returns the amount of the hold, or 0 if it was released.
+func heldAmount(t *testing.T, id int64) int64 {
+	t.Helper()
+	var amount int64
+	err := db.D.QueryRowContext(context.Background(),
+		"SELECT CASE WHEN released_at IS NULL THEN amount ELSE 0 END FROM balance_holds WHERE id = ?", id).
+		Scan(&amount)
+	require.NoError(t, err)
+	return amount
+}
+
+func TestHoldPrompt(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	prompt := rq.PromptV1{UserPrompt: "Hello", Model: llm.ModelClaude35Haiku}
+
+	t.Run("response schema holds every attempt", func(t *testing.T) {
+		userID := newUser(t, 1_000_000_000_000)
+		plain, err := db.HoldPrompt(ctx, userID, prompt)
+		require.NoError(t, err)
+		withSchema := prompt
+		withSchema.ResponseSchema = []byte(`{"type":"object"}`)
+		json, err := db.HoldPrompt(ctx, userID, withSchema)
+		require.NoError(t, err)
+		assert.Greater(t, json.Amount, llm.MaxJSONAttempts*plain.Amount)
+	})
+
+	t.Run("fallback re-estimates the hold", func(t *testing.T) {
+		userID := newUser(t, 1_000_000_000_000)
+		hold, err := db.HoldPrompt(ctx, userID, prompt)
+		require.NoError(t, err)
+		requested := hold.Amount
+		require.NoError(t, hold.Reestimate(ctx, prompt, llm.ModelClaude35Sonnet))
+		assert.Equal(t, llm.ModelClaude35Sonnet, hold.ServiceName)
+		assert.Greater(t, hold.Amount, requested)
+		assert.Equal(t, hold.Amount, heldAmount(t, hold.ID))
+	})
+
+	t.Run("fallback the balance cannot cover", func(t *testing.T) {
+		sonnet := prompt
+		sonnet.Model = llm.ModelClaude35Sonnet
+		fallback, err := db.HoldPrompt(ctx, newUser(t, 1_000_000_000_000), sonnet)
+		require.NoError(t, err)
+		userID := newUser(t, fallback.Amount-1)
+		hold, err := db.HoldPrompt(ctx, userID, prompt)
+		require.NoError(t, err)
+		requested := hold.Amount
+		err = hold.Reestimate(ctx, prompt, llm.ModelClaude35Sonnet)
+		assert.ErrorIs(t, err, db.ErrInsufficientBalance)
+		assert.Equal(t, requested, hold.Amount)
+		assert.Equal(t, requested, heldAmount(t, hold.ID))
+		require.NoError(t, hold.Release(ctx))
+		assert.Zero(t, heldAmount(t, hold.ID))
+	})
+
+	t.Run("receipt settles a tool call's hold", func(t *testing.T) {
+		userID := newUser(t, 1_000_000_000_000)
+		search := db.Receipt{UserID: userID, ServiceName: llm.SearchEngineGoogle, NumSearches: 1}
+		hold, err := db.HoldReceipt(ctx, search)
+		require.NoError(t, err)
+		assert.Positive(t, hold.Amount)
+		assert.Equal(t, hold.Amount, heldAmount(t, hold.ID))
+		settled, err := hold.Settled(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, settled)
+		// A cheaper search engine may serve the search.
+		search.ServiceName = llm.SearchEngineBrave
+		search.HoldID = hold.ID
+		require.NoError(t, search.Insert(ctx))
+		assert.Zero(t, heldAmount(t, hold.ID))
+		settled, err = hold.Settled(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, search.DittoTokenCost, settled)
+	})
+}
+
+func TestPlaceEnforcesLimits(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	search := db.Receipt{ServiceName: llm.SearchEngineGoogle, NumSearches: 1}
+	cost, err := db.EstimateCost(ctx, search)
+	require.NoError(t, err)
+
+	t.Run("daily limit counts active holds", func(t *testing.T) {
+		search := search
+		search.UserID = newUser(t, 1_000_000_000_000)
+		limits := db.UserLimits{UserID: search.UserID, Daily: sql.NullInt64{Int64: 2 * cost, Valid: true}}
+		require.NoError(t, limits.Save(ctx))
+		for range 2 {
+			_, err := db.HoldReceipt(ctx, search)
+			require.NoError(t, err)
+		}
+		_, err := db.HoldReceipt(ctx, search)
+		assert.ErrorIs(t, err, db.ErrLimitExceeded)
+	})
+
+	t.Run("per-request limit", func(t *testing.T) {
+		search := search
+		search.UserID = newUser(t, 1_000_000_000_000)
+		limits := db.UserLimits{UserID: search.UserID, PerRequest: sql.NullInt64{Int64: cost - 1, Valid: true}}
+		require.NoError(t, limits.Save(ctx))
+		_, err := db.HoldReceipt(ctx, search)
+		assert.ErrorIs(t, err, db.ErrLimitExceeded)
+	})
+
+	t.Run("fallback over the monthly limit", func(t *testing.T) {
+		userID := newUser(t, 1_000_000_000_000)
+		prompt := rq.PromptV1{UserPrompt: "Hello", Model: llm.ModelClaude35Haiku}
+		hold, err := db.HoldPrompt(ctx, userID, prompt)
+		require.NoError(t, err)
+		limits := db.UserLimits{UserID: userID, Monthly: sql.NullInt64{Int64: hold.Amount, Valid: true}}
+		require.NoError(t, limits.Save(ctx))
+		requested := hold.Amount
+		err = hold.Reestimate(ctx, prompt, llm.ModelClaude35Sonnet)
+		assert.ErrorIs(t, err, db.ErrLimitExceeded)
+		assert.Equal(t, requested, heldAmount(t, hold.ID))
+	})
+
+	t.Run("insufficient balance", func(t *testing.T) {
+		search := search
+		search.UserID = newUser(t, cost-1)
+		_, err := db.HoldReceipt(ctx, search)
+		assert.ErrorIs(t, err, db.ErrInsufficientBalance)
+	})
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+
+	"github.com/ditto-assistant/backend/pkg/services/pubsub"
+)
+
+// LedgerType is the kind of a ledger transfer, which names the system account
+// the tokens came from or went to.
+type LedgerType string
+
+const (
+	LedgerPurchase LedgerType = "purchase"
+	LedgerAirdrop  LedgerType = "airdrop"
+	LedgerUsage    LedgerType = "usage"
+	LedgerAdmin    LedgerType = "admin"
+	LedgerRefund   LedgerType = "refund"
+	LedgerPromo    LedgerType = "promo"
+)
+
+// Execer executes statements, such as a *sql.DB or *sql.Tx.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// PostTransfer posts both entries of a transfer between the user's account and
+// the system account of its type, crediting the user if amount is positive.
+// The ledger trigger updates the user's balance.
+// A transfer with the same type and referenceID can only be posted once.
+//
+// Purchases, receipts, airdrop grants and token grants are posted by their
+// triggers, so only transfers without a row of their own are posted here.
+func PostTransfer(ctx context.Context, q Execer, userID int64, typ LedgerType, referenceID string, amount int64, memo string) error {
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO ledger_entries (user_id, account, type, reference_id, amount, memo)
+		VALUES (?, 'user', ?, ?, ?, ?), (?, 'system', ?, ?, ?, ?)`,
+		userID, typ, referenceID, amount, sql.NullString{String: memo, Valid: memo != ""},
+		userID, typ, referenceID, -amount, sql.NullString{String: memo, Valid: memo != ""})
+	if err != nil {
+		return fmt.Errorf("failed to post %s transfer %s: %w", typ, referenceID, err)
+	}
+	return nil
+}
+
+// SetBalance sets the user's balance by posting an admin transfer of the difference,
+// returning the difference.
+func SetBalance(ctx context.Context, d *sql.DB, userID, balance int64, memo string) (int64, error) {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	var current int64
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM users WHERE id = ?", userID).Scan(&current)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get balance: %w", err)
+	}
+	delta := balance - current
+	if delta == 0 {
+		return 0, nil
+	}
+	if err := PostTransfer(ctx, tx, userID, LedgerAdmin, rand.Text(), delta, memo); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit balance: %w", err)
+	}
+	pubsub.PublishBalance(ctx, userID, pubsub.ReasonAdmin)
+	return delta, nil
+}
+
+// Drift is a user whose balance is not the sum of their ledger entries.
+type Drift struct {
+	UserID  int64
+	UID     string
+	Balance int64
+	Ledger  int64
+}
+
+// Unbalanced is a transfer whose entries do not sum to zero.
+type Unbalanced struct {
+	Type        LedgerType
+	ReferenceID string
+	Sum         int64
+}
+
+// Reconciliation is the drift between the users' balances and the ledger.
+type Reconciliation struct {
+	Drifts     []Drift
+	Unbalanced []Unbalanced
+}
+
+// Reconcile compares every user's balance with the sum of their ledger entries,
+// and checks that every transfer sums to zero.
+func Reconcile(ctx context.Context) (Reconciliation, error) {
+	var rec Reconciliation
+	rows, err := D.QueryContext(ctx, `
+		SELECT users.id, users.uid, users.balance, COALESCE(ledger.amount, 0)
+		FROM users
+		LEFT JOIN (
+			SELECT user_id, SUM(amount) AS amount FROM ledger_entries
+			WHERE account = 'user' GROUP BY user_id
+		) AS ledger ON ledger.user_id = users.id
+		WHERE users.balance != COALESCE(ledger.amount, 0)
+		ORDER BY users.id`)
+	if err != nil {
+		return rec, fmt.Errorf("failed to query drift: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d Drift
+		if err := rows.Scan(&d.UserID, &d.UID, &d.Balance, &d.Ledger); err != nil {
+			return rec, fmt.Errorf("failed to scan drift: %w", err)
+		}
+		rec.Drifts = append(rec.Drifts, d)
+	}
+	if err := rows.Err(); err != nil {
+		return rec, fmt.Errorf("failed to iterate drift: %w", err)
+	}
+
+	rows, err = D.QueryContext(ctx, `
+		SELECT type, reference_id, SUM(amount) FROM ledger_entries
+		GROUP BY type, reference_id
+		HAVING SUM(amount) != 0`)
+	if err != nil {
+		return rec, fmt.Errorf("failed to query unbalanced transfers: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u Unbalanced
+		if err := rows.Scan(&u.Type, &u.ReferenceID, &u.Sum); err != nil {
+			return rec, fmt.Errorf("failed to scan unbalanced transfer: %w", err)
+		}
+		rec.Unbalanced = append(rec.Unbalanced, u)
+	}
+	if err := rows.Err(); err != nil {
+		return rec, fmt.Errorf("failed to iterate unbalanced transfers: %w", err)
+	}
+	return rec, nil
+}
+
+// ResetBalance sets the user's balance to the sum of their ledger entries,
+// which is the source of truth.
+func ResetBalance(ctx context.Context, userID int64) error {
+	_, err := D.ExecContext(ctx, `
+		UPDATE users SET balance = (
+			SELECT COALESCE(SUM(amount), 0) FROM ledger_entries
+			WHERE user_id = users.id AND account = 'user'
+		)
+		WHERE id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to reset balance of user %d: %w", userID, err)
+	}
+	return nil
+}
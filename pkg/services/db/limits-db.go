@@ -0,0 +1,165 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
+)
+
+// ErrLimitExceeded is returned when a charge would exceed one of the
+// user's spending limits. The wrapping error gives the reason.
+var ErrLimitExceeded = errors.New("spending limit exceeded")
+
+// DefaultAlertPercentage is the share of a daily or monthly limit
+// at which the user is alerted, unless they set their own.
+const DefaultAlertPercentage = 80
+
+// UserLimits are a user's spending caps, in Ditto tokens.
+// An invalid cap is no limit.
+type UserLimits struct {
+	UserID          int64
+	Daily           sql.NullInt64
+	Monthly         sql.NullInt64
+	PerRequest      sql.NullInt64
+	AlertPercentage int64
+}
+
+// Spend is what a user has spent against their daily and monthly limits.
+// It includes the active holds of prompts in progress.
+type Spend struct {
+	Today     int64
+	ThisMonth int64
+}
+
+// GetUserLimits returns the user's limits, which have no caps if they never set any.
+func GetUserLimits(ctx context.Context, userID int64) (UserLimits, error) {
+	limits := UserLimits{UserID: userID, AlertPercentage: DefaultAlertPercentage}
+	err := D.QueryRowContext(ctx, `
+		SELECT daily_limit, monthly_limit, per_request_limit, alert_percentage
+		FROM user_limits WHERE user_id = ?`, userID).
+		Scan(&limits.Daily, &limits.Monthly, &limits.PerRequest, &limits.AlertPercentage)
+	if errors.Is(err, sql.ErrNoRows) {
+		return limits, nil
+	}
+	if err != nil {
+		return UserLimits{}, fmt.Errorf("failed to get user limits: %w", err)
+	}
+	return limits, nil
+}
+
+// Save inserts or replaces the user's limits.
+func (l *UserLimits) Save(ctx context.Context) error {
+	_, err := D.ExecContext(ctx, `
+		INSERT INTO user_limits (user_id, daily_limit, monthly_limit, per_request_limit, alert_percentage)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			daily_limit = excluded.daily_limit,
+			monthly_limit = excluded.monthly_limit,
+			per_request_limit = excluded.per_request_limit,
+			alert_percentage = excluded.alert_percentage,
+			updated_at = CURRENT_TIMESTAMP`,
+		l.UserID, l.Daily, l.Monthly, l.PerRequest, l.AlertPercentage)
+	if err != nil {
+		return fmt.Errorf("failed to save user limits: %w", err)
+	}
+	return nil
+}
+
+// DeleteUserLimits removes all of the user's limits.
+func DeleteUserLimits(ctx context.Context, userID int64) error {
+	_, err := D.ExecContext(ctx, "DELETE FROM user_limits WHERE user_id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user limits: %w", err)
+	}
+	return nil
+}
+
+// HasCaps reports whether any cap is set.
+func (l UserLimits) HasCaps() bool {
+	return l.Daily.Valid || l.Monthly.Valid || l.PerRequest.Valid
+}
+
+// Alerts returns the periods, "daily" or "monthly",
+// whose spend has reached the alert percentage of its cap.
+func (l UserLimits) Alerts(spend Spend) []string {
+	var alerts []string
+	if l.Daily.Valid && spend.Today*100 >= l.Daily.Int64*l.AlertPercentage {
+		alerts = append(alerts, "daily")
+	}
+	if l.Monthly.Valid && spend.ThisMonth*100 >= l.Monthly.Int64*l.AlertPercentage {
+		alerts = append(alerts, "monthly")
+	}
+	return alerts
+}
+
+// GetSpend sums the user's receipts since the start of the UTC month and day,
+// and adds their active holds to both.
+func GetSpend(ctx context.Context, userID int64, now time.Time) (Spend, error) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var spend Spend
+	var held int64
+	err := D.QueryRowContext(ctx, `
+		SELECT
+			COALESCE(SUM(CASE WHEN timestamp >= ? THEN ditto_token_cost END), 0),
+			COALESCE(SUM(ditto_token_cost), 0),
+			(SELECT COALESCE(SUM(amount), 0) FROM balance_holds
+			 WHERE user_id = ? AND released_at IS NULL AND expires_at > CURRENT_TIMESTAMP)
+		FROM receipts
+		WHERE user_id = ? AND timestamp >= ?`,
+		day.Format(receiptTimeFormat), userID, userID, month.Format(receiptTimeFormat)).
+		Scan(&spend.Today, &spend.ThisMonth, &held)
+	if err != nil {
+		return Spend{}, fmt.Errorf("failed to get user spend: %w", err)
+	}
+	spend.Today += held
+	spend.ThisMonth += held
+	return spend, nil
+}
+
+// CheckLimits returns ErrLimitExceeded, with the reason,
+// if a charge of cost would exceed any of the user's limits.
+// It only reads the user's spend; Hold.Place enforces the limits
+// when it reserves a charge.
+func CheckLimits(ctx context.Context, userID, cost int64) error {
+	return checkLimits(ctx, userID, cost, 0)
+}
+
+// checkLimits is CheckLimits for a charge that replaces an active hold
+// of the replaced amount, which is not counted in the spend.
+func checkLimits(ctx context.Context, userID, cost, replaced int64) error {
+	limits, err := GetUserLimits(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !limits.HasCaps() {
+		return nil
+	}
+	if limits.PerRequest.Valid && cost > limits.PerRequest.Int64 {
+		return fmt.Errorf("%w: this request may cost up to %s tokens, over your per-request limit of %s",
+			ErrLimitExceeded, numfmt.LargeNumber(cost), numfmt.LargeNumber(limits.PerRequest.Int64))
+	}
+	if !limits.Daily.Valid && !limits.Monthly.Valid {
+		return nil
+	}
+	spend, err := GetSpend(ctx, userID, time.Now())
+	if err != nil {
+		return err
+	}
+	spend.Today -= replaced
+	spend.ThisMonth -= replaced
+	if limits.Daily.Valid && spend.Today+cost > limits.Daily.Int64 {
+		return fmt.Errorf("%w: you have spent %s of your daily limit of %s tokens",
+			ErrLimitExceeded, numfmt.LargeNumber(spend.Today), numfmt.LargeNumber(limits.Daily.Int64))
+	}
+	if limits.Monthly.Valid && spend.ThisMonth+cost > limits.Monthly.Int64 {
+		return fmt.Errorf("%w: you have spent %s of your monthly limit of %s tokens",
+			ErrLimitExceeded, numfmt.LargeNumber(spend.ThisMonth), numfmt.LargeNumber(limits.Monthly.Int64))
+	}
+	return nil
+}
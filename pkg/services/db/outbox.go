@@ -0,0 +1,330 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ReceiptOutbox, if set, records receipts locally before they are inserted,
+// so that Save never loses one if the database or the server fails.
+var ReceiptOutbox *Outbox
+
+const (
+	// outboxFlushInterval is how often the outbox checks for due receipts.
+	outboxFlushInterval = 10 * time.Second
+	// outboxSendGrace is how long a new receipt is left to Send before
+	// Run retries it, so they do not insert it at the same time.
+	outboxSendGrace = time.Minute
+	// outboxBaseBackoff is the wait after a receipt's first failed insert,
+	// which doubles on each failure up to outboxMaxBackoff.
+	outboxBaseBackoff = 5 * time.Second
+	outboxMaxBackoff  = 10 * time.Minute
+	// outboxBatchSize is the most receipts flushed at once.
+	outboxBatchSize = 100
+	// outboxStatsInterval is how often Run logs the outbox's stats
+	// while receipts are pending.
+	outboxStatsInterval = 5 * time.Minute
+)
+
+// Outbox is a queue of receipts in a local libsql file,
+// flushed to the main database with retries and backoff.
+// Receipts are idempotent, so flushing one twice never charges twice.
+type Outbox struct {
+	d      *sql.DB
+	insert func(ctx context.Context, r *Receipt) error
+
+	flushed  atomic.Int64
+	failures atomic.Int64
+}
+
+type OutboxOption func(*Outbox)
+
+// WithOutboxInsert sets how receipts are flushed, which is Receipt.Insert by default.
+func WithOutboxInsert(insert func(ctx context.Context, r *Receipt) error) OutboxOption {
+	return func(o *Outbox) {
+		o.insert = insert
+	}
+}
+
+// OpenOutbox opens the outbox in the libsql file at path, creating it if needed.
+// The file must outlive the server for pending receipts to be replayed.
+func OpenOutbox(path string, opts ...OutboxOption) (*Outbox, error) {
+	d, err := sql.Open("libsql", "file:"+path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening outbox: %w", err)
+	}
+	// A single connection serializes writes to the file.
+	d.SetMaxOpenConns(1)
+	_, err = d.Exec(`
+		CREATE TABLE IF NOT EXISTS outbox_receipts (
+			id INTEGER PRIMARY KEY,
+			idempotency_key TEXT NOT NULL UNIQUE,
+			receipt TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			created_at INTEGER NOT NULL,
+			next_attempt_at INTEGER NOT NULL
+		)`)
+	if err != nil {
+		d.Close()
+		return nil, fmt.Errorf("error creating outbox table: %w", err)
+	}
+	o := &Outbox{
+		d: d,
+		insert: func(ctx context.Context, r *Receipt) error {
+			return r.Insert(ctx)
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o, nil
+}
+
+// Close closes the outbox file. Pending receipts stay in it.
+func (o *Outbox) Close() error {
+	return o.d.Close()
+}
+
+// Send records the receipt in the outbox, then inserts it.
+// If the insert fails, the receipt stays in the outbox for Run to retry.
+// It returns an error only if the receipt could not be recorded.
+func (o *Outbox) Send(ctx context.Context, r *Receipt) error {
+	r.prepare()
+	id, err := o.add(ctx, r)
+	if err != nil {
+		return err
+	}
+	if err := o.insert(ctx, r); err != nil {
+		o.failed(context.WithoutCancel(ctx), id, 0, err)
+		return nil
+	}
+	o.flushed.Add(1)
+	if err := o.remove(context.WithoutCancel(ctx), id); err != nil {
+		slog.Error("failed to remove flushed receipt from outbox", "key", r.IdempotencyKey, "error", err)
+	}
+	return nil
+}
+
+func (o *Outbox) add(ctx context.Context, r *Receipt) (int64, error) {
+	receipt, err := json.Marshal(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode receipt: %w", err)
+	}
+	now := time.Now()
+	var id int64
+	err = o.d.QueryRowContext(ctx, `
+		INSERT INTO outbox_receipts (idempotency_key, receipt, created_at, next_attempt_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (idempotency_key) DO UPDATE SET receipt = excluded.receipt
+		RETURNING id`,
+		r.IdempotencyKey, string(receipt), now.Unix(), now.Add(outboxSendGrace).Unix()).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add receipt to outbox: %w", err)
+	}
+	return id, nil
+}
+
+func (o *Outbox) remove(ctx context.Context, id int64) error {
+	_, err := o.d.ExecContext(ctx, "DELETE FROM outbox_receipts WHERE id = ?", id)
+	return err
+}
+
+// failed records a failed insert, backing off before the next retry.
+func (o *Outbox) failed(ctx context.Context, id int64, attempts int, cause error) {
+	o.failures.Add(1)
+	backoff := min(outboxBaseBackoff<<min(attempts, 10), outboxMaxBackoff)
+	_, err := o.d.ExecContext(ctx, `
+		UPDATE outbox_receipts
+		SET attempts = attempts + 1, last_error = ?, next_attempt_at = ?
+		WHERE id = ?`,
+		cause.Error(), time.Now().Add(backoff).Unix(), id)
+	if err != nil {
+		slog.Error("failed to record outbox failure", "id", id, "error", err)
+	}
+	slog.Warn("failed to flush receipt from outbox", "id", id, "attempts", attempts+1, "retryIn", backoff, "error", cause)
+}
+
+// Run replays the outbox, then flushes receipts as they become due until ctx is done.
+// It logs the outbox's stats every outboxStatsInterval while receipts are pending.
+func (o *Outbox) Run(ctx context.Context) {
+	if n, err := o.Replay(ctx); err != nil {
+		slog.Error("failed to replay outbox", "error", err)
+	} else if n > 0 {
+		slog.Info("replayed receipts from outbox", "count", n)
+	}
+	ticker := time.NewTicker(outboxFlushInterval)
+	defer ticker.Stop()
+	statsTicker := time.NewTicker(outboxStatsInterval)
+	defer statsTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-statsTicker.C:
+			o.logStats(ctx)
+			continue
+		case <-ticker.C:
+		}
+		if _, err := o.flush(ctx, false); err != nil {
+			slog.Error("failed to flush outbox", "error", err)
+		}
+	}
+}
+
+// logStats logs the outbox's stats if any receipts are pending.
+func (o *Outbox) logStats(ctx context.Context) {
+	stats, err := o.Stats(ctx)
+	if err != nil {
+		slog.Error("failed to get outbox stats", "error", err)
+		return
+	}
+	if stats.Pending == 0 {
+		return
+	}
+	slog.Warn("receipts pending in outbox",
+		"pending", stats.Pending,
+		"failing", stats.Failing,
+		"oldestPendingAt", stats.OldestPendingAt,
+		"flushed", stats.Flushed,
+		"failures", stats.Failures,
+	)
+}
+
+// Replay inserts every pending receipt, even if its retry is not due,
+// such as those left by a previous server. It returns how many were inserted.
+func (o *Outbox) Replay(ctx context.Context) (int, error) {
+	return o.flush(ctx, true)
+}
+
+// Flush inserts every pending receipt whose retry is due,
+// returning how many were inserted.
+func (o *Outbox) Flush(ctx context.Context) (int, error) {
+	return o.flush(ctx, false)
+}
+
+func (o *Outbox) flush(ctx context.Context, all bool) (int, error) {
+	var flushed int
+	for {
+		n, more, err := o.flushBatch(ctx, all)
+		flushed += n
+		if err != nil || !more {
+			return flushed, err
+		}
+	}
+}
+
+// flushBatch flushes up to outboxBatchSize receipts,
+// reporting whether a full batch was due.
+func (o *Outbox) flushBatch(ctx context.Context, all bool) (int, bool, error) {
+	type entry struct {
+		id       int64
+		receipt  string
+		attempts int
+	}
+	due := time.Now().Unix()
+	if all {
+		due = 1<<63 - 1
+	}
+	rows, err := o.d.QueryContext(ctx, `
+		SELECT id, receipt, attempts FROM outbox_receipts
+		WHERE next_attempt_at <= ?
+		ORDER BY id LIMIT ?`, due, outboxBatchSize)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.id, &e.receipt, &e.attempts); err != nil {
+			rows.Close()
+			return 0, false, fmt.Errorf("failed to scan outbox receipt: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, false, fmt.Errorf("failed to iterate outbox: %w", err)
+	}
+
+	var flushed int
+	var failed bool
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return flushed, false, err
+		}
+		var r Receipt
+		err := json.Unmarshal([]byte(e.receipt), &r)
+		if err == nil {
+			if string(r.Metadata) == "null" {
+				r.Metadata = nil
+			}
+			err = o.insert(ctx, &r)
+		}
+		if err != nil {
+			o.failed(ctx, e.id, e.attempts, err)
+			failed = true
+			continue
+		}
+		o.flushed.Add(1)
+		flushed++
+		if err := o.remove(ctx, e.id); err != nil {
+			return flushed, false, fmt.Errorf("failed to remove receipt %d from outbox: %w", e.id, err)
+		}
+	}
+	// Failed receipts are retried later, not in this flush.
+	return flushed, len(entries) == outboxBatchSize && !failed, nil
+}
+
+// OutboxStats describe the outbox's backlog, and its flushes since it was opened.
+type OutboxStats struct {
+	// Pending is the number of receipts not yet inserted.
+	Pending int64 `json:"pending"`
+	// Failing is the number of pending receipts whose insert has failed.
+	Failing int64 `json:"failing"`
+	// OldestPendingAt is when the oldest pending receipt was added.
+	OldestPendingAt *time.Time `json:"oldestPendingAt,omitempty"`
+	// Flushed is the number of receipts inserted.
+	Flushed int64 `json:"flushed"`
+	// Failures is the number of failed inserts.
+	Failures int64 `json:"failures"`
+}
+
+// Stats returns the outbox's backlog and failure counts.
+func (o *Outbox) Stats(ctx context.Context) (OutboxStats, error) {
+	stats := OutboxStats{
+		Flushed:  o.flushed.Load(),
+		Failures: o.failures.Load(),
+	}
+	var oldest sql.NullInt64
+	err := o.d.QueryRowContext(ctx, `
+		SELECT COUNT(*), COUNT(CASE WHEN attempts > 0 THEN 1 END), MIN(created_at)
+		FROM outbox_receipts`).Scan(&stats.Pending, &stats.Failing, &oldest)
+	if err != nil {
+		return OutboxStats{}, fmt.Errorf("failed to get outbox stats: %w", err)
+	}
+	if oldest.Valid {
+		t := time.Unix(oldest.Int64, 0).UTC()
+		stats.OldestPendingAt = &t
+	}
+	return stats, nil
+}
+
+// HandleStats serves the outbox's stats as JSON.
+// It is not authenticated, so it must only be served on a private listener.
+func (o *Outbox) HandleStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := o.Stats(r.Context())
+	if err != nil {
+		slog.Error("failed to get outbox stats", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
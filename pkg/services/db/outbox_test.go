@@ -0,0 +1,134 @@
+package db_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDB records inserted receipts by idempotency key, failing while down.
+type fakeDB struct {
+	mu       sync.Mutex
+	down     bool
+	receipts map[string]db.Receipt
+}
+
+func (f *fakeDB) insert(ctx context.Context, r *db.Receipt) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errors.New("database unavailable")
+	}
+	if f.receipts == nil {
+		f.receipts = make(map[string]db.Receipt)
+	}
+	f.receipts[r.IdempotencyKey] = *r
+	return nil
+}
+
+func (f *fakeDB) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func openOutbox(t *testing.T, path string, fake *fakeDB) *db.Outbox {
+	t.Helper()
+	outbox, err := db.OpenOutbox(path, db.WithOutboxInsert(fake.insert))
+	require.NoError(t, err)
+	t.Cleanup(func() { outbox.Close() })
+	return outbox
+}
+
+func TestOutboxSend(t *testing.T) {
+	ctx := context.Background()
+	var fake fakeDB
+	outbox := openOutbox(t, filepath.Join(t.TempDir(), "outbox.db"), &fake)
+
+	receipt := db.Receipt{UserID: 1, ServiceName: llm.ModelGPT4oMini, InputTokens: 100}
+	require.NoError(t, outbox.Send(ctx, &receipt))
+	assert.NotEmpty(t, receipt.IdempotencyKey)
+	assert.False(t, receipt.Timestamp.IsZero())
+	assert.Contains(t, fake.receipts, receipt.IdempotencyKey)
+
+	stats, err := outbox.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, db.OutboxStats{Flushed: 1}, stats)
+}
+
+func TestOutboxReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	fake := fakeDB{down: true}
+	outbox := openOutbox(t, path, &fake)
+
+	receipts := []db.Receipt{
+		{UserID: 1, ServiceName: llm.ModelGPT4oMini, InputTokens: 100, OutputTokens: 20},
+		{UserID: 2, ServiceName: llm.ModelGPT4oMini, NumSearches: 1, IdempotencyKey: "client-key"},
+	}
+	for i := range receipts {
+		require.NoError(t, outbox.Send(ctx, &receipts[i]), "a failed insert stays in the outbox")
+	}
+	stats, err := outbox.Stats(ctx)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, stats.Pending)
+	assert.EqualValues(t, 2, stats.Failing)
+	assert.EqualValues(t, 2, stats.Failures)
+	assert.NotNil(t, stats.OldestPendingAt)
+
+	// The retries are backing off, so nothing is due yet.
+	fake.setDown(false)
+	n, err := outbox.Flush(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// A new server replays every pending receipt from the file.
+	require.NoError(t, outbox.Close())
+	restarted := openOutbox(t, path, &fake)
+	n, err = restarted.Replay(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	require.Len(t, fake.receipts, 2)
+	for _, want := range receipts {
+		got := fake.receipts[want.IdempotencyKey]
+		assert.Equal(t, want.UserID, got.UserID)
+		assert.Equal(t, want.InputTokens, got.InputTokens)
+		assert.Equal(t, want.NumSearches, got.NumSearches)
+		assert.True(t, want.Timestamp.Equal(got.Timestamp), "the replayed receipt keeps its timestamp")
+		assert.Nil(t, got.Metadata)
+	}
+	stats, err = restarted.Stats(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, stats.Pending)
+	assert.EqualValues(t, 2, stats.Flushed)
+}
+
+func TestOutboxHandleStats(t *testing.T) {
+	ctx := context.Background()
+	fake := fakeDB{down: true}
+	outbox := openOutbox(t, filepath.Join(t.TempDir(), "outbox.db"), &fake)
+	receipt := db.Receipt{UserID: 1, ServiceName: llm.ModelGPT4oMini, InputTokens: 100}
+	require.NoError(t, outbox.Send(ctx, &receipt))
+
+	rec := httptest.NewRecorder()
+	outbox.HandleStats(rec, httptest.NewRequest(http.MethodGet, "/outbox/stats", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var stats db.OutboxStats
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&stats))
+	assert.EqualValues(t, 1, stats.Pending)
+	assert.EqualValues(t, 1, stats.Failing)
+	assert.EqualValues(t, 1, stats.Failures)
+	assert.NotNil(t, stats.OldestPendingAt)
+}
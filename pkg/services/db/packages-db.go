@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/omniaura/mapcache"
+)
+
+var (
+	// ErrNoPackages is returned when there are no active token packages to sell.
+	ErrNoPackages = errors.New("no active token packages")
+	// ErrNoPackageForAmount is returned when no package, or whole number of
+	// the cheapest package, costs an amount.
+	ErrNoPackageForAmount = errors.New("no token package for amount")
+)
+
+// TokenPackage is an amount of tokens sold for a one-time payment.
+type TokenPackage struct {
+	ID int64
+	// StripePriceID is the one-time Stripe price to check out, if any.
+	// Packages without one are checked out at USD dollars.
+	StripePriceID string
+	USD           int64
+	// Tokens are credited for each purchase, including the bonus.
+	Tokens       int64
+	BonusPercent int64
+	IsActive     bool
+	CreatedAt    time.Time
+}
+
+// Insert inserts a new active package.
+// It updates the TokenPackage's ID with the ID from the database.
+// New packages are sold within a minute, when the cache of active packages expires.
+func (p *TokenPackage) Insert(ctx context.Context) error {
+	if p.USD <= 0 {
+		return errors.New("usd must be positive")
+	}
+	if p.Tokens <= 0 {
+		return errors.New("tokens must be positive")
+	}
+	err := D.QueryRowContext(ctx, `
+		INSERT INTO token_packages (stripe_price_id, usd, tokens, bonus_percent)
+		VALUES (NULLIF(?, ''), ?, ?, ?)
+		RETURNING id, is_active`,
+		p.StripePriceID, p.USD, p.Tokens, p.BonusPercent).Scan(&p.ID, &p.IsActive)
+	if err != nil {
+		return fmt.Errorf("failed to insert token package: %w", err)
+	}
+	return nil
+}
+
+// DeactivatePackage stops selling the package with the given ID.
+func DeactivatePackage(ctx context.Context, id int64) error {
+	res, err := D.ExecContext(ctx, "UPDATE token_packages SET is_active = 0 WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to deactivate token package %d: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("no token package %d", id)
+	}
+	return nil
+}
+
+// ListPackages returns every package, active or not, by amount.
+func ListPackages(ctx context.Context) ([]TokenPackage, error) {
+	return queryPackages(ctx, false)
+}
+
+var cachePackages, _ = mapcache.New[string, []TokenPackage](mapcache.WithTTL(time.Minute))
+
+// ActivePackages returns the packages for sale, cheapest first.
+func ActivePackages(ctx context.Context) ([]TokenPackage, error) {
+	return cachePackages.Get("active", func() ([]TokenPackage, error) {
+		return queryPackages(ctx, true)
+	})
+}
+
+// GetPackage returns the package with the given ID, active or not.
+func GetPackage(ctx context.Context, id int64) (TokenPackage, error) {
+	p := TokenPackage{ID: id}
+	err := D.QueryRowContext(ctx, `
+		SELECT COALESCE(stripe_price_id, ''), usd, tokens, bonus_percent, is_active, created_at
+		FROM token_packages
+		WHERE id = ?`, id).
+		Scan(&p.StripePriceID, &p.USD, &p.Tokens, &p.BonusPercent, &p.IsActive, &p.CreatedAt)
+	if err != nil {
+		return TokenPackage{}, fmt.Errorf("failed to get token package %d: %w", id, err)
+	}
+	return p, nil
+}
+
+func queryPackages(ctx context.Context, activeOnly bool) ([]TokenPackage, error) {
+	rows, err := D.QueryContext(ctx, `
+		SELECT id, COALESCE(stripe_price_id, ''), usd, tokens, bonus_percent, is_active, created_at
+		FROM token_packages
+		WHERE is_active OR NOT ?
+		ORDER BY usd, id`, activeOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query token packages: %w", err)
+	}
+	defer rows.Close()
+	var packages []TokenPackage
+	for rows.Next() {
+		var p TokenPackage
+		err := rows.Scan(&p.ID, &p.StripePriceID, &p.USD, &p.Tokens, &p.BonusPercent, &p.IsActive, &p.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan token package: %w", err)
+		}
+		packages = append(packages, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate token packages: %w", err)
+	}
+	return packages, nil
+}
+
+// PackageForUSD returns the package to check out for an amount in dollars, and
+// how many of it to buy. An amount no package matches is bought as that many
+// of the cheapest package, if it is a multiple of its price.
+// Otherwise it returns ErrNoPackageForAmount.
+func PackageForUSD(ctx context.Context, usd int64) (TokenPackage, int64, error) {
+	if usd <= 0 {
+		return TokenPackage{}, 0, fmt.Errorf("%w: $%d", ErrNoPackageForAmount, usd)
+	}
+	packages, err := ActivePackages(ctx)
+	if err != nil {
+		return TokenPackage{}, 0, err
+	}
+	if len(packages) == 0 {
+		return TokenPackage{}, 0, ErrNoPackages
+	}
+	for _, p := range packages {
+		if p.USD == usd {
+			return p, 1, nil
+		}
+	}
+	base := packages[0]
+	if usd%base.USD != 0 {
+		return TokenPackage{}, 0, fmt.Errorf("%w: $%d is not a multiple of the $%d package", ErrNoPackageForAmount, usd, base.USD)
+	}
+	return base, usd / base.USD, nil
+}
+
+// TokensForCents returns the tokens credited for a payment of cents, which is
+// those of the package for that amount, or else the rate of the cheapest package.
+// It is only used for payments whose metadata does not name their package.
+func TokensForCents(ctx context.Context, cents int64) (int64, error) {
+	packages, err := ActivePackages(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(packages) == 0 {
+		return 0, ErrNoPackages
+	}
+	for _, p := range packages {
+		if p.USD*100 == cents {
+			return p.Tokens, nil
+		}
+	}
+	base := packages[0]
+	return base.Tokens * cents / (base.USD * 100), nil
+}
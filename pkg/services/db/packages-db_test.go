@@ -0,0 +1,46 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/dbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageForUSD(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	// Active packages are cached, so the $1 package the migration seeds is
+	// deactivated before they are first read, leaving $10 as the cheapest.
+	_, err := db.D.ExecContext(ctx, "UPDATE token_packages SET is_active = 0 WHERE usd = 1")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		usd      int64
+		wantUSD  int64
+		quantity int64
+	}{
+		{name: "package", usd: 25, wantUSD: 25, quantity: 1},
+		{name: "multiple of the cheapest", usd: 20, wantUSD: 10, quantity: 2},
+		{name: "not a multiple", usd: 15},
+		{name: "below the cheapest", usd: 5},
+		{name: "zero", usd: 0},
+		{name: "negative", usd: -10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkg, quantity, err := db.PackageForUSD(ctx, tt.usd)
+			if tt.quantity == 0 {
+				assert.ErrorIs(t, err, db.ErrNoPackageForAmount)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantUSD, pkg.USD)
+			assert.Equal(t, tt.quantity, quantity)
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/pubsub"
+)
+
+var (
+	// ErrPromoCodeNotFound is returned when no promo or referral code matches.
+	ErrPromoCodeNotFound = errors.New("promo code not found")
+	// ErrCannotRedeem is returned when a code exists but the user cannot redeem it.
+	// The wrapping error gives the reason.
+	ErrCannotRedeem = errors.New("cannot redeem code")
+)
+
+type PromoKind string
+
+const (
+	PromoKindPromo    PromoKind = "promo"
+	PromoKindReferral PromoKind = "referral"
+)
+
+const (
+	// ReferralTokens are granted to a user who redeems a referral code.
+	ReferralTokens = 100_000_000
+	// ReferrerTokens are granted to the owner of a referral code
+	// when a user who redeemed it first pays for tokens.
+	ReferrerTokens = 100_000_000
+	// referralCodeLength is the length of generated referral codes.
+	referralCodeLength = 8
+)
+
+type PromoCode struct {
+	ID     int64
+	Code   string
+	Kind   PromoKind
+	Tokens int64
+	// ReferrerID owns a referral code, and is granted ReferrerTokens
+	// for each user who redeems it and then pays for tokens.
+	ReferrerID     sql.NullInt64
+	ReferrerTokens int64
+	// MaxRedemptions is the most users who can redeem the code, or unlimited if invalid.
+	MaxRedemptions sql.NullInt64
+	Redemptions    int64
+	ExpiresAt      sql.NullTime
+	CreatedAt      time.Time
+}
+
+// Redemption is a redeemed code, and the tokens it granted.
+type Redemption struct {
+	ID     int64
+	Code   string
+	Kind   PromoKind
+	UserID int64
+	Tokens int64
+	// ReferrerID and ReferrerTokens are set when a referral code was redeemed.
+	// The referrer is granted the tokens when the user first pays.
+	ReferrerID     sql.NullInt64
+	ReferrerTokens int64
+}
+
+// Insert inserts a new promo code.
+// It updates the PromoCode's ID with the ID from the database.
+func (p *PromoCode) Insert(ctx context.Context) error {
+	if p.Code == "" {
+		return errors.New("code is required")
+	}
+	if p.Tokens <= 0 {
+		return errors.New("tokens must be positive")
+	}
+	if p.MaxRedemptions.Valid && p.MaxRedemptions.Int64 <= 0 {
+		return errors.New("max redemptions must be positive")
+	}
+	if p.Kind == "" {
+		p.Kind = PromoKindPromo
+	}
+	var expiresAt sql.NullString
+	if p.ExpiresAt.Valid {
+		expiresAt = sql.NullString{String: p.ExpiresAt.Time.UTC().Format(receiptTimeFormat), Valid: true}
+	}
+	res, err := D.ExecContext(ctx, `
+		INSERT INTO promo_codes (code, kind, tokens, referrer_id, referrer_tokens, max_redemptions, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		p.Code, p.Kind, p.Tokens, p.ReferrerID, p.ReferrerTokens, p.MaxRedemptions, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert promo code: %w", err)
+	}
+	p.ID, err = res.LastInsertId()
+	return err
+}
+
+const promoCodeColumns = `id, code, kind, tokens, referrer_id, referrer_tokens,
+	max_redemptions, redemptions, expires_at, created_at`
+
+func scanPromoCode(row interface{ Scan(...any) error }) (PromoCode, error) {
+	var p PromoCode
+	err := row.Scan(&p.ID, &p.Code, &p.Kind, &p.Tokens, &p.ReferrerID, &p.ReferrerTokens,
+		&p.MaxRedemptions, &p.Redemptions, &p.ExpiresAt, &p.CreatedAt)
+	return p, err
+}
+
+// ListPromoCodes returns every promo code, newest first. Referral codes are not included.
+func ListPromoCodes(ctx context.Context) ([]PromoCode, error) {
+	rows, err := D.QueryContext(ctx, `
+		SELECT `+promoCodeColumns+` FROM promo_codes
+		WHERE kind = ? ORDER BY id DESC`, PromoKindPromo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query promo codes: %w", err)
+	}
+	defer rows.Close()
+	var codes []PromoCode
+	for rows.Next() {
+		p, err := scanPromoCode(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan promo code: %w", err)
+		}
+		codes = append(codes, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate promo codes: %w", err)
+	}
+	return codes, nil
+}
+
+// GetReferralCode returns the user's referral code, creating it if they have none.
+func GetReferralCode(ctx context.Context, userID int64) (PromoCode, error) {
+	row := D.QueryRowContext(ctx, `
+		SELECT `+promoCodeColumns+` FROM promo_codes WHERE referrer_id = ?`, userID)
+	code, err := scanPromoCode(row)
+	if err == nil {
+		return code, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return PromoCode{}, fmt.Errorf("failed to get referral code: %w", err)
+	}
+	code = PromoCode{
+		Code:           rand.Text()[:referralCodeLength],
+		Kind:           PromoKindReferral,
+		Tokens:         ReferralTokens,
+		ReferrerID:     sql.NullInt64{Int64: userID, Valid: true},
+		ReferrerTokens: ReferrerTokens,
+	}
+	// If another request created the code first, return that one.
+	_, err = D.ExecContext(ctx, `
+		INSERT INTO promo_codes (code, kind, tokens, referrer_id, referrer_tokens)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (referrer_id) WHERE referrer_id IS NOT NULL DO NOTHING`,
+		code.Code, code.Kind, code.Tokens, code.ReferrerID, code.ReferrerTokens)
+	if err != nil {
+		return PromoCode{}, fmt.Errorf("failed to create referral code: %w", err)
+	}
+	row = D.QueryRowContext(ctx, `
+		SELECT `+promoCodeColumns+` FROM promo_codes WHERE referrer_id = ?`, userID)
+	code, err = scanPromoCode(row)
+	if err != nil {
+		return PromoCode{}, fmt.Errorf("failed to get referral code: %w", err)
+	}
+	return code, nil
+}
+
+// RedeemPromoCode redeems a promo or referral code for the user, granting its
+// tokens to them. The owner of a referral code is granted their tokens by the
+// purchases trigger, when the user first pays.
+// Codes are not case sensitive.
+func RedeemPromoCode(ctx context.Context, userID int64, code string) (Redemption, error) {
+	code = strings.TrimSpace(code)
+	tx, err := D.BeginTx(ctx, nil)
+	if err != nil {
+		return Redemption{}, fmt.Errorf("failed to begin redemption: %w", err)
+	}
+	defer tx.Rollback()
+
+	p, err := scanPromoCode(tx.QueryRowContext(ctx, `
+		SELECT `+promoCodeColumns+` FROM promo_codes WHERE code = ?`, code))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Redemption{}, ErrPromoCodeNotFound
+	}
+	if err != nil {
+		return Redemption{}, fmt.Errorf("failed to get promo code: %w", err)
+	}
+	if p.ExpiresAt.Valid && !time.Now().Before(p.ExpiresAt.Time) {
+		return Redemption{}, fmt.Errorf("%w: the code has expired", ErrCannotRedeem)
+	}
+	if p.ReferrerID.Valid && p.ReferrerID.Int64 == userID {
+		return Redemption{}, fmt.Errorf("%w: you cannot redeem your own referral code", ErrCannotRedeem)
+	}
+	var redeemed, referred bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT
+			EXISTS (SELECT 1 FROM promo_redemptions WHERE code_id = ? AND user_id = ?),
+			EXISTS (SELECT 1 FROM promo_redemptions WHERE user_id = ? AND kind = ?)`,
+		p.ID, userID, userID, PromoKindReferral).Scan(&redeemed, &referred)
+	if err != nil {
+		return Redemption{}, fmt.Errorf("failed to check redemptions: %w", err)
+	}
+	if redeemed {
+		return Redemption{}, fmt.Errorf("%w: you have already redeemed this code", ErrCannotRedeem)
+	}
+	if referred && p.Kind == PromoKindReferral {
+		return Redemption{}, fmt.Errorf("%w: you have already redeemed a referral code", ErrCannotRedeem)
+	}
+	res, err := tx.ExecContext(ctx, `
+		UPDATE promo_codes SET redemptions = redemptions + 1
+		WHERE id = ? AND (max_redemptions IS NULL OR redemptions < max_redemptions)`, p.ID)
+	if err != nil {
+		return Redemption{}, fmt.Errorf("failed to count redemption: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Redemption{}, err
+	} else if n == 0 {
+		return Redemption{}, fmt.Errorf("%w: the code has no redemptions left", ErrCannotRedeem)
+	}
+
+	r := Redemption{
+		Code:   p.Code,
+		Kind:   p.Kind,
+		UserID: userID,
+		Tokens: p.Tokens,
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO promo_redemptions (code_id, user_id, kind) VALUES (?, ?, ?)
+		RETURNING id`, p.ID, userID, p.Kind).Scan(&r.ID)
+	if err != nil {
+		return Redemption{}, fmt.Errorf("failed to record redemption: %w", err)
+	}
+	if err := grantTokens(ctx, tx, userID, p.Tokens, string(p.Kind), r.ID); err != nil {
+		return Redemption{}, err
+	}
+	if p.Kind == PromoKindReferral && p.ReferrerID.Valid && p.ReferrerTokens > 0 {
+		r.ReferrerID = p.ReferrerID
+		r.ReferrerTokens = p.ReferrerTokens
+	}
+	if err := tx.Commit(); err != nil {
+		return Redemption{}, fmt.Errorf("failed to commit redemption: %w", err)
+	}
+	pubsub.PublishBalance(ctx, userID, pubsub.ReasonPromo)
+	return r, nil
+}
+
+// grantTokens records a grant in token_grants, whose trigger adds it to the user's balance.
+func grantTokens(ctx context.Context, tx *sql.Tx, userID, tokens int64, reason string, redemptionID int64) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO token_grants (user_id, tokens, reason, redemption_id) VALUES (?, ?, ?, ?)`,
+		userID, tokens, reason, redemptionID)
+	if err != nil {
+		return fmt.Errorf("failed to grant %s tokens: %w", reason, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/dbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferrerRewardedOnFirstPurchase(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	balance := func(userID int64) int64 {
+		t.Helper()
+		var balance int64
+		err := db.D.QueryRowContext(ctx, "SELECT balance FROM users WHERE id = ?", userID).Scan(&balance)
+		require.NoError(t, err)
+		return balance
+	}
+	referrerID := newUser(t, 0)
+	userID := newUser(t, 0)
+	code, err := db.GetReferralCode(ctx, referrerID)
+	require.NoError(t, err)
+
+	_, err = db.RedeemPromoCode(ctx, userID, code.Code)
+	require.NoError(t, err)
+	assert.EqualValues(t, db.ReferralTokens, balance(userID))
+	assert.Zero(t, balance(referrerID), "the referrer waits for the user to pay")
+
+	var uid string
+	require.NoError(t, db.D.QueryRowContext(ctx, "SELECT uid FROM users WHERE id = ?", userID).Scan(&uid))
+	for _, paymentID := range []string{"pi_first", "pi_second"} {
+		purchase := db.Purchase{PaymentID: paymentID, Cents: 500, Tokens: 1_000_000_000}
+		require.NoError(t, purchase.Insert(ctx, db.D, uid))
+	}
+	assert.EqualValues(t, db.ReferrerTokens, balance(referrerID), "rewarded once")
+}
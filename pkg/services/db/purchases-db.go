@@ -3,7 +3,13 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/pubsub"
 )
 
 type Purchase struct {
@@ -15,22 +21,106 @@ type Purchase struct {
 	CreatedAt time.Time
 }
 
+// ErrPurchaseExists is returned when inserting a purchase whose payment was already recorded.
+var ErrPurchaseExists = errors.New("purchase already exists")
+
+// Insert inserts a purchase by the user with the given uid, whose tokens the trigger credits.
+// It returns ErrPurchaseExists if the payment was already recorded.
 func (p *Purchase) Insert(ctx context.Context, d *sql.DB, uid string) error {
-	res, err := d.ExecContext(ctx, `
+	err := d.QueryRowContext(ctx, `
 		WITH user_lookup AS (
 			SELECT id FROM users WHERE uid = ?
 		)
 		INSERT INTO purchases (payment_id, user_id, cents, tokens) 
 		SELECT ?, id, ?, ?
-		FROM user_lookup`,
+		FROM user_lookup
+		WHERE true -- lets SQLite parse the ON CONFLICT clause after a SELECT
+		ON CONFLICT (payment_id) DO NOTHING
+		RETURNING id, user_id`,
 		uid,
 		p.PaymentID,
 		p.Cents,
 		p.Tokens,
-	)
+	).Scan(&p.ID, &p.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		var exists bool
+		err := d.QueryRowContext(ctx,
+			"SELECT EXISTS (SELECT 1 FROM purchases WHERE payment_id = ?)", p.PaymentID).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check purchase %s: %w", p.PaymentID, err)
+		}
+		if exists {
+			return ErrPurchaseExists
+		}
+		return fmt.Errorf("failed to insert purchase %s: no user %q", p.PaymentID, uid)
+	}
 	if err != nil {
 		return err
 	}
-	p.ID, err = res.LastInsertId()
-	return err
+	pubsub.PublishBalance(ctx, p.UserID, pubsub.ReasonPurchase)
+	return nil
+}
+
+// PurchaseRecord is a purchase as the user's purchase history lists it.
+type PurchaseRecord struct {
+	Purchase
+	// PaymentIntentID is the Stripe payment intent that paid for the purchase.
+	PaymentIntentID string
+	SubscriptionID  sql.NullInt64
+	// RefundedCents is the cents refunded, and ReversedTokens the tokens
+	// that refunds and disputes took back, net of any restored.
+	RefundedCents, ReversedTokens int64
+}
+
+// GetPurchases lists the user's purchases, newest first, and the cursor of the next page.
+// The cursor is the ID of the last purchase on the previous page.
+func GetPurchases(ctx context.Context, userID int64, limit int, cursor string) ([]PurchaseRecord, string, error) {
+	where := "WHERE purchases.user_id = ?"
+	args := []any{userID}
+	if cursor != "" {
+		id, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %w", err)
+		}
+		where += " AND purchases.id < ?"
+		args = append(args, id)
+	}
+	rows, err := D.QueryContext(ctx, `
+		SELECT purchases.id, purchases.payment_id, purchases.user_id, purchases.cents, purchases.tokens,
+			purchases.created_at, COALESCE(purchases.payment_intent_id, ''), purchases.subscription_id,
+			COALESCE(SUM(purchase_adjustments.cents) FILTER (WHERE kind = 'refund'), 0),
+			COALESCE(-SUM(purchase_adjustments.tokens), 0)
+		FROM purchases
+		LEFT JOIN purchase_adjustments ON purchase_adjustments.purchase_id = purchases.id
+		`+where+`
+		GROUP BY purchases.id
+		ORDER BY purchases.id DESC
+		LIMIT ?`, append(args, limit+1)...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query purchases: %w", err)
+	}
+	defer rows.Close()
+	purchases := make([]PurchaseRecord, 0, limit)
+	for rows.Next() {
+		var p PurchaseRecord
+		err := rows.Scan(&p.ID, &p.PaymentID, &p.UserID, &p.Cents, &p.Tokens,
+			&p.CreatedAt, &p.PaymentIntentID, &p.SubscriptionID,
+			&p.RefundedCents, &p.ReversedTokens)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan purchase: %w", err)
+		}
+		// One-time purchases are recorded by their payment intent.
+		if p.PaymentIntentID == "" && strings.HasPrefix(p.PaymentID, "pi_") {
+			p.PaymentIntentID = p.PaymentID
+		}
+		purchases = append(purchases, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to iterate purchases: %w", err)
+	}
+	if len(purchases) <= limit {
+		return purchases, "", nil
+	}
+	purchases = purchases[:limit]
+	return purchases, strconv.FormatInt(purchases[len(purchases)-1].ID, 10), nil
 }
@@ -2,11 +2,16 @@ package db
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/pkg/services/pubsub"
 )
 
 type Receipt struct {
@@ -28,32 +33,419 @@ type Receipt struct {
 	NumAPICalls         int64
 	DittoTokenCost      int64
 	Metadata            json.RawMessage
+	// HoldID is the balance hold this receipt settles, if any.
+	HoldID int64
+	// IdempotencyKey is unique to the charge. A receipt with the key of one
+	// already recorded is not inserted again. Insert generates one if it is empty.
+	IdempotencyKey string
 }
 
-// Insert inserts a new receipt into the database.
-// It updates the Receipt's ID with the ID from the database.
+// PriceFunc returns the Ditto token cost of a receipt for a service.
+type PriceFunc func(r Receipt, s Service, tokensPerDollar int64) int64
+
+// Price prices receipts as they are inserted, if set.
+// Otherwise the receipt trigger prices them.
+var Price PriceFunc
+
+// receiptTimeFormat is how SQLite's CURRENT_TIMESTAMP stores receipt timestamps,
+// so they compare correctly as text.
+const receiptTimeFormat = time.DateTime
+
+// ClientIdempotencyKey scopes an idempotency key sent by a client to the user,
+// so clients cannot collide with each other or with server-generated keys.
+// It returns an empty string for an empty key.
+func ClientIdempotencyKey(userID int64, key string) string {
+	if key == "" {
+		return ""
+	}
+	return fmt.Sprintf("user:%d:%s", userID, key)
+}
+
+// ErrDuplicateRequest is returned by ClaimIdempotencyKey when a request with
+// the key is in progress or was already served.
+var ErrDuplicateRequest = errors.New("request with this Idempotency-Key was already processed or is in progress")
+
+// ClaimTTL is how long a request's claim on its idempotency key lasts
+// if the request never finishes, after which the client may retry it.
+const ClaimTTL = HoldTTL
+
+// Claim is a request's claim on its idempotency key.
+type Claim struct {
+	Key string
+}
+
+// ClaimIdempotencyKey claims the key for a request before it is served.
+// It returns ErrDuplicateRequest if another request holds the key,
+// or has saved its receipt. An empty key claims nothing.
+func ClaimIdempotencyKey(ctx context.Context, userID int64, key string) (Claim, error) {
+	if key == "" {
+		return Claim{}, nil
+	}
+	res, err := D.ExecContext(ctx, `
+		INSERT INTO idempotency_claims (idempotency_key, user_id, expires_at)
+		VALUES (?, ?, datetime('now', ?))
+		ON CONFLICT (idempotency_key) DO UPDATE SET
+			user_id = excluded.user_id,
+			created_at = CURRENT_TIMESTAMP,
+			expires_at = excluded.expires_at
+		WHERE idempotency_claims.expires_at <= CURRENT_TIMESTAMP`,
+		key, userID, fmt.Sprintf("+%d seconds", int(ClaimTTL.Seconds())))
+	if err != nil {
+		return Claim{}, fmt.Errorf("failed to claim idempotency key %s: %w", key, err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return Claim{}, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return Claim{}, ErrDuplicateRequest
+	}
+	return Claim{Key: key}, nil
+}
+
+// Complete keeps the claim once the request's receipt is saved,
+// so that the request is never served again.
+// Completing a zero Claim does nothing.
+func (c Claim) Complete(ctx context.Context) error {
+	if c.Key == "" {
+		return nil
+	}
+	_, err := D.ExecContext(ctx,
+		"UPDATE idempotency_claims SET expires_at = NULL WHERE idempotency_key = ?", c.Key)
+	if err != nil {
+		return fmt.Errorf("failed to complete claim %s: %w", c.Key, err)
+	}
+	return nil
+}
+
+// Release gives up the claim of a request that failed before its receipt
+// was saved, so the client can retry it. A completed claim is kept.
+// Releasing a zero Claim does nothing.
+func (c Claim) Release(ctx context.Context) error {
+	if c.Key == "" {
+		return nil
+	}
+	_, err := D.ExecContext(ctx,
+		"DELETE FROM idempotency_claims WHERE idempotency_key = ? AND expires_at IS NOT NULL", c.Key)
+	if err != nil {
+		return fmt.Errorf("failed to release claim %s: %w", c.Key, err)
+	}
+	return nil
+}
+
+// ReceiptExists reports whether a receipt with the idempotency key is recorded.
+func ReceiptExists(ctx context.Context, idempotencyKey string) (bool, error) {
+	var exists bool
+	err := D.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM receipts WHERE idempotency_key = ?)", idempotencyKey).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check receipt %s: %w", idempotencyKey, err)
+	}
+	return exists, nil
+}
+
+// Insert inserts a new receipt into the database, settling its hold in the same
+// transaction. The receipts trigger debits its cost through the ledger.
+// It updates the Receipt's ID and DittoTokenCost, and sets a zero Timestamp
+// and an empty IdempotencyKey.
+// If a receipt with the same IdempotencyKey is already recorded,
+// nothing is charged and the Receipt is updated from that one.
 func (r *Receipt) Insert(ctx context.Context) error {
+	r.prepare()
+	if Price == nil {
+		return r.insertForTrigger(ctx)
+	}
+	tx, err := D.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The service name, not the ID, is set by the caller.
+	service := Service{Name: string(r.ServiceName)}
+	if err := service.getByName(ctx, tx); err != nil {
+		return fmt.Errorf("failed to get service %s: %w", r.ServiceName, err)
+	}
+	perDollar, err := tokensPerDollar(ctx, tx)
+	if err != nil {
+		return err
+	}
+	r.ServiceID = service.ID
+	r.DittoTokenCost = Price(*r, service, perDollar)
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO receipts (user_id, service_id, timestamp, input_tokens, output_tokens, total_tokens,
+			call_duration_seconds, data_processed_bytes, data_stored_bytes, num_images, num_searches,
+			num_api_calls, ditto_token_cost, metadata, hold_id, idempotency_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (idempotency_key) DO NOTHING`,
+		r.UserID, r.ServiceID, r.Timestamp.UTC().Format(receiptTimeFormat), r.InputTokens, r.OutputTokens, r.TotalTokens,
+		r.CallDurationSeconds, r.DataProcessedBytes, r.DataStoredBytes, r.NumImages, r.NumSearches,
+		r.NumAPICalls, r.DittoTokenCost, r.Metadata, sql.NullInt64{Int64: r.HoldID, Valid: r.HoldID != 0},
+		r.IdempotencyKey,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert receipt: %w", err)
+	}
+	inserted, err := r.inserted(ctx, tx, res)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		if err := r.releaseHold(ctx, tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if r.HoldID != 0 {
+		// Settle the hold the receipt was charged against, releasing the remainder.
+		_, err = tx.ExecContext(ctx, `
+			UPDATE balance_holds SET settled_amount = ?, released_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND released_at IS NULL`, r.DittoTokenCost, r.HoldID)
+		if err != nil {
+			return fmt.Errorf("failed to settle hold %d: %w", r.HoldID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit receipt: %w", err)
+	}
+	pubsub.PublishBalance(ctx, r.UserID, pubsub.ReasonReceipt)
+	return nil
+}
+
+// prepare sets a zero Timestamp to now and generates an empty IdempotencyKey,
+// so that every attempt to record the receipt is the same charge.
+func (r *Receipt) prepare() {
+	if r.IdempotencyKey == "" {
+		r.IdempotencyKey = rand.Text()
+	}
+	if r.Timestamp.IsZero() {
+		r.Timestamp = time.Now().UTC().Truncate(time.Second)
+	}
+}
+
+// insertForTrigger inserts the receipt without a cost,
+// for the receipt trigger to price it and debit the balance.
+func (r *Receipt) insertForTrigger(ctx context.Context) error {
 	// The service name, not the ID, is set by the caller.
 	err := D.QueryRowContext(ctx, "SELECT id FROM services WHERE name = ?", r.ServiceName).Scan(&r.ServiceID)
 	if err != nil {
 		return fmt.Errorf("failed to get service id for %s: %w", r.ServiceName, err)
 	}
 	res, err := D.ExecContext(ctx,
-		`INSERT INTO receipts (user_id, service_id, input_tokens, output_tokens, total_tokens,
+		`INSERT INTO receipts (user_id, service_id, timestamp, input_tokens, output_tokens, total_tokens,
 			call_duration_seconds, data_processed_bytes, data_stored_bytes, num_images, num_searches,
-			num_api_calls, metadata)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		r.UserID, r.ServiceID, r.InputTokens, r.OutputTokens, r.TotalTokens,
+			num_api_calls, metadata, hold_id, idempotency_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (idempotency_key) DO NOTHING`,
+		r.UserID, r.ServiceID, r.Timestamp.UTC().Format(receiptTimeFormat), r.InputTokens, r.OutputTokens, r.TotalTokens,
 		r.CallDurationSeconds, r.DataProcessedBytes, r.DataStoredBytes, r.NumImages, r.NumSearches,
-		r.NumAPICalls, r.Metadata,
+		r.NumAPICalls, r.Metadata, sql.NullInt64{Int64: r.HoldID, Valid: r.HoldID != 0},
+		r.IdempotencyKey,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to insert receipt: %w", err)
 	}
-	id, err := res.LastInsertId()
+	inserted, err := r.inserted(ctx, D, res)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return r.releaseHold(ctx, D)
+	}
+	err = D.QueryRowContext(ctx, "SELECT COALESCE(ditto_token_cost, 0) FROM receipts WHERE id = ?", r.ID).Scan(&r.DittoTokenCost)
 	if err != nil {
-		return fmt.Errorf("failed to get last insert id: %w", err)
+		return fmt.Errorf("failed to get receipt cost: %w", err)
 	}
-	r.ID = id
+	pubsub.PublishBalance(ctx, r.UserID, pubsub.ReasonReceipt)
 	return nil
 }
+
+// inserted sets the Receipt's ID from the result of its insert.
+// If the insert conflicted with a recorded receipt, it updates the Receipt
+// from that one instead, and reports false.
+func (r *Receipt) inserted(ctx context.Context, q queryer, res sql.Result) (bool, error) {
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		err := q.QueryRowContext(ctx,
+			"SELECT id, COALESCE(ditto_token_cost, 0) FROM receipts WHERE idempotency_key = ?", r.IdempotencyKey).
+			Scan(&r.ID, &r.DittoTokenCost)
+		if err != nil {
+			return false, fmt.Errorf("failed to get recorded receipt %s: %w", r.IdempotencyKey, err)
+		}
+		return false, nil
+	}
+	r.ID, err = res.LastInsertId()
+	if err != nil {
+		return false, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+	return true, nil
+}
+
+// releaseHold releases the hold of a receipt that was already recorded,
+// which the recorded receipt settled or will never settle.
+func (r *Receipt) releaseHold(ctx context.Context, e execer) error {
+	if r.HoldID == 0 {
+		return nil
+	}
+	_, err := e.ExecContext(ctx,
+		"UPDATE balance_holds SET released_at = CURRENT_TIMESTAMP WHERE id = ? AND released_at IS NULL", r.HoldID)
+	if err != nil {
+		return fmt.Errorf("failed to release hold %d of duplicate receipt: %w", r.HoldID, err)
+	}
+	return nil
+}
+
+// - MARK: retries
+
+// enqueueTimeout bounds queueing a receipt for retry,
+// which may run after the request's context is done.
+const enqueueTimeout = 10 * time.Second
+
+const (
+	// ReceiptRetryInterval is how often RetryReceipts checks for due retries.
+	ReceiptRetryInterval = time.Minute
+	// maxRetryBackoff is the longest wait between retries of a receipt.
+	maxRetryBackoff = time.Hour
+	// retryBatchSize is the most receipts retried in each check.
+	retryBatchSize = 50
+	// maxReceiptAttempts is how many times a queued receipt is retried
+	// before it is marked dead and left for an operator.
+	maxReceiptAttempts = 30
+)
+
+// Save inserts the receipt, or queues it to be retried if the insert fails,
+// so that the user is still charged for it.
+// If there is a ReceiptOutbox, the receipt is recorded there first.
+// It returns an error only if the receipt could not be queued either.
+func (r *Receipt) Save(ctx context.Context) error {
+	if ReceiptOutbox != nil {
+		err := ReceiptOutbox.Send(ctx, r)
+		if err == nil {
+			return nil
+		}
+		slog.Error("failed to send receipt to outbox", "key", r.IdempotencyKey, "error", err)
+	}
+	insertErr := r.Insert(ctx)
+	if insertErr == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), enqueueTimeout)
+	defer cancel()
+	if err := r.enqueue(ctx, insertErr); err != nil {
+		return errors.Join(insertErr, err)
+	}
+	slog.Warn("queued receipt for retry", "key", r.IdempotencyKey, "userID", r.UserID, "error", insertErr)
+	return nil
+}
+
+func (r *Receipt) enqueue(ctx context.Context, cause error) error {
+	receipt, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode receipt: %w", err)
+	}
+	_, err = D.ExecContext(ctx, `
+		INSERT INTO receipt_retries (idempotency_key, receipt, last_error)
+		VALUES (?, ?, ?)
+		ON CONFLICT (idempotency_key) DO NOTHING`,
+		r.IdempotencyKey, receipt, cause.Error())
+	if err != nil {
+		return fmt.Errorf("failed to queue receipt for retry: %w", err)
+	}
+	return nil
+}
+
+// RetryReceipts retries queued receipts every ReceiptRetryInterval until ctx is done.
+func RetryReceipts(ctx context.Context) {
+	ticker := time.NewTicker(ReceiptRetryInterval)
+	defer ticker.Stop()
+	for {
+		n, err := RetryDueReceipts(ctx)
+		if err != nil {
+			slog.Error("failed to retry receipts", "error", err)
+		} else if n > 0 {
+			slog.Info("retried receipts", "recorded", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RetryDueReceipts inserts the queued receipts that are due for a retry,
+// returning how many were recorded.
+// A receipt that fails again waits twice as long as before, up to an hour,
+// and after maxReceiptAttempts it is marked dead and no longer retried.
+func RetryDueReceipts(ctx context.Context) (int, error) {
+	type retry struct {
+		id       int64
+		receipt  []byte
+		attempts int
+	}
+	rows, err := D.QueryContext(ctx, `
+		SELECT id, receipt, attempts FROM receipt_retries
+		WHERE dead_at IS NULL AND next_attempt_at <= CURRENT_TIMESTAMP
+		ORDER BY next_attempt_at LIMIT ?`, retryBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query receipt retries: %w", err)
+	}
+	var retries []retry
+	for rows.Next() {
+		var rt retry
+		if err := rows.Scan(&rt.id, &rt.receipt, &rt.attempts); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan receipt retry: %w", err)
+		}
+		retries = append(retries, rt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate receipt retries: %w", err)
+	}
+
+	var recorded int
+	for _, rt := range retries {
+		var receipt Receipt
+		err := json.Unmarshal(rt.receipt, &receipt)
+		if err == nil {
+			if string(receipt.Metadata) == "null" {
+				receipt.Metadata = nil
+			}
+			err = receipt.Insert(ctx)
+		}
+		if err == nil {
+			if _, err := D.ExecContext(ctx, "DELETE FROM receipt_retries WHERE id = ?", rt.id); err != nil {
+				return recorded, fmt.Errorf("failed to delete receipt retry %d: %w", rt.id, err)
+			}
+			recorded++
+			continue
+		}
+		if rt.attempts+1 >= maxReceiptAttempts {
+			slog.Error("receipt retries exhausted", "retryID", rt.id, "attempts", rt.attempts+1, "error", err)
+			_, err = D.ExecContext(ctx, `
+				UPDATE receipt_retries
+				SET attempts = attempts + 1, last_error = ?, dead_at = CURRENT_TIMESTAMP
+				WHERE id = ?`,
+				err.Error(), rt.id)
+			if err != nil {
+				return recorded, fmt.Errorf("failed to mark receipt retry %d dead: %w", rt.id, err)
+			}
+			continue
+		}
+		backoff := min(ReceiptRetryInterval<<min(rt.attempts, 6), maxRetryBackoff)
+		_, err = D.ExecContext(ctx, `
+			UPDATE receipt_retries
+			SET attempts = attempts + 1, last_error = ?, next_attempt_at = datetime('now', ?)
+			WHERE id = ?`,
+			err.Error(), fmt.Sprintf("+%d seconds", int(backoff.Seconds())), rt.id)
+		if err != nil {
+			return recorded, fmt.Errorf("failed to update receipt retry %d: %w", rt.id, err)
+		}
+	}
+	return recorded, nil
+}
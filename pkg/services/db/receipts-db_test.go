@@ -0,0 +1,127 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ditto-assistant/backend/pkg/pricing"
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/dbtest"
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/types/rq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertDuplicateReceipt(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	prompt := rq.PromptV1{UserPrompt: "Hello", Model: llm.ModelClaude35Haiku}
+	for name, price := range map[string]db.PriceFunc{"trigger": nil, "go": pricing.Cost} {
+		t.Run(name, func(t *testing.T) {
+			prev := db.Price
+			db.Price = price
+			t.Cleanup(func() { db.Price = prev })
+			userID := newUser(t, 1_000_000_000_000)
+			first, err := db.HoldPrompt(ctx, userID, prompt)
+			require.NoError(t, err)
+			second, err := db.HoldPrompt(ctx, userID, prompt)
+			require.NoError(t, err)
+
+			receipt := db.Receipt{
+				UserID:         userID,
+				ServiceName:    llm.ModelClaude35Haiku,
+				InputTokens:    1000,
+				OutputTokens:   500,
+				HoldID:         first.ID,
+				IdempotencyKey: "duplicate-" + name,
+			}
+			require.NoError(t, receipt.Insert(ctx))
+			duplicate := receipt
+			duplicate.ID = 0
+			duplicate.HoldID = second.ID
+			require.NoError(t, duplicate.Insert(ctx))
+
+			assert.Equal(t, receipt.ID, duplicate.ID)
+			assert.Equal(t, receipt.DittoTokenCost, duplicate.DittoTokenCost)
+			assert.Zero(t, heldAmount(t, first.ID))
+			assert.Zero(t, heldAmount(t, second.ID), "the duplicate's hold is released")
+			var balance int64
+			err = db.D.QueryRowContext(ctx, "SELECT balance FROM users WHERE id = ?", userID).Scan(&balance)
+			require.NoError(t, err)
+			assert.Equal(t, 1_000_000_000_000-receipt.DittoTokenCost, balance, "charged once")
+		})
+	}
+}
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	userID := newUser(t, 0)
+
+	t.Run("concurrent duplicate", func(t *testing.T) {
+		claim, err := db.ClaimIdempotencyKey(ctx, userID, "concurrent")
+		require.NoError(t, err)
+		_, err = db.ClaimIdempotencyKey(ctx, userID, "concurrent")
+		assert.ErrorIs(t, err, db.ErrDuplicateRequest)
+		require.NoError(t, claim.Release(ctx))
+		_, err = db.ClaimIdempotencyKey(ctx, userID, "concurrent")
+		assert.NoError(t, err, "a released key can be claimed again")
+	})
+
+	t.Run("completed", func(t *testing.T) {
+		claim, err := db.ClaimIdempotencyKey(ctx, userID, "completed")
+		require.NoError(t, err)
+		require.NoError(t, claim.Complete(ctx))
+		require.NoError(t, claim.Release(ctx))
+		_, err = db.ClaimIdempotencyKey(ctx, userID, "completed")
+		assert.ErrorIs(t, err, db.ErrDuplicateRequest)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		_, err := db.ClaimIdempotencyKey(ctx, userID, "expired")
+		require.NoError(t, err)
+		_, err = db.D.ExecContext(ctx,
+			"UPDATE idempotency_claims SET expires_at = datetime('now', '-1 second') WHERE idempotency_key = 'expired'")
+		require.NoError(t, err)
+		_, err = db.ClaimIdempotencyKey(ctx, userID, "expired")
+		assert.NoError(t, err)
+	})
+
+	t.Run("no key", func(t *testing.T) {
+		claim, err := db.ClaimIdempotencyKey(ctx, userID, "")
+		require.NoError(t, err)
+		assert.Zero(t, claim)
+	})
+}
+
+func TestRetryDueReceiptsMarksDead(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	// A receipt for an unknown service fails every insert.
+	receipt := db.Receipt{UserID: newUser(t, 0), ServiceName: "unknown-service", IdempotencyKey: "dead"}
+	require.NoError(t, receipt.Save(ctx))
+	_, err := db.D.ExecContext(ctx, "UPDATE receipt_retries SET attempts = 100 WHERE idempotency_key = 'dead'")
+	require.NoError(t, err)
+
+	n, err := db.RetryDueReceipts(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	var dead bool
+	err = db.D.QueryRowContext(ctx,
+		"SELECT dead_at IS NOT NULL FROM receipt_retries WHERE idempotency_key = 'dead'").Scan(&dead)
+	require.NoError(t, err)
+	assert.True(t, dead)
+
+	// A dead receipt is not retried again, even once it is due.
+	_, err = db.D.ExecContext(ctx,
+		"UPDATE receipt_retries SET next_attempt_at = datetime('now', '-1 second') WHERE idempotency_key = 'dead'")
+	require.NoError(t, err)
+	var attempts int
+	_, err = db.RetryDueReceipts(ctx)
+	require.NoError(t, err)
+	err = db.D.QueryRowContext(ctx,
+		"SELECT attempts FROM receipt_retries WHERE idempotency_key = 'dead'").Scan(&attempts)
+	require.NoError(t, err)
+	assert.Equal(t, 101, attempts)
+}
@@ -2,7 +2,13 @@ package db
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/omniaura/mapcache"
 )
 
 type Service struct {
@@ -38,22 +44,41 @@ type Service struct {
 	IsActive                       bool
 }
 
-// GetServiceByName retrieves a service from the database by its name.
+// queryer is a *sql.DB or *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// execer is a *sql.DB or *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// GetByName retrieves a service from the database by its name.
+// Unset costs and limits are zero.
 func (s *Service) GetByName(ctx context.Context) error {
-	err := D.QueryRowContext(ctx, `
-		SELECT id, description, version, service_type, provider,
-			base_cost_per_call, base_cost_per_million_tokens, base_cost_per_million_input_tokens, base_cost_per_million_output_tokens,
-			base_cost_per_image, base_cost_per_search, max_input_tokens, max_output_tokens, max_total_tokens,
-			base_cost_per_second, base_cost_per_gb_processed, base_cost_per_gb_stored,
-			supports_batching, batch_size_limit, base_cost_per_batch,
-			rate_limit_per_minute, rate_limit_per_day,
-			profit_margin_percentage, minimum_profit_amount,
-			peak_hours_multiplier, volume_discount_threshold, volume_discount_percentage,
-			currency, is_active
+	return s.getByName(ctx, D)
+}
+
+func (s *Service) getByName(ctx context.Context, q queryer) error {
+	err := q.QueryRowContext(ctx, `
+		SELECT id, COALESCE(description, ''), COALESCE(version, ''), COALESCE(service_type, ''), COALESCE(provider, ''),
+			COALESCE(base_cost_per_call, 0), COALESCE(base_cost_per_million_tokens, 0),
+			COALESCE(base_cost_per_million_input_tokens, 0), COALESCE(base_cost_per_million_output_tokens, 0),
+			COALESCE(base_cost_per_image, 0), COALESCE(base_cost_per_search, 0),
+			COALESCE(max_input_tokens, 0), COALESCE(max_output_tokens, 0), COALESCE(max_total_tokens, 0),
+			COALESCE(base_cost_per_second, 0), COALESCE(base_cost_per_gb_processed, 0), COALESCE(base_cost_per_gb_stored, 0),
+			COALESCE(supports_batching, FALSE), COALESCE(batch_size_limit, 0), COALESCE(base_cost_per_batch, 0),
+			COALESCE(rate_limit_per_minute, 0), COALESCE(rate_limit_per_day, 0),
+			COALESCE(profit_margin_percentage, 0), COALESCE(minimum_profit_amount, 0),
+			COALESCE(peak_hours_multiplier, 0), COALESCE(volume_discount_threshold, 0), COALESCE(volume_discount_percentage, 0),
+			COALESCE(currency, ''), COALESCE(is_active, FALSE)
 		FROM services WHERE name = ?`, s.Name).Scan(
 		&s.ID, &s.Description, &s.Version, &s.ServiceType, &s.Provider,
-		&s.BaseCostPerCall, &s.BaseCostPerMillionTokens, &s.BaseCostPerMillionInputTokens, &s.BaseCostPerMillionOutputTokens,
-		&s.BaseCostPerImage, &s.BaseCostPerSearch, &s.MaxInputTokens, &s.MaxOutputTokens, &s.MaxTotalTokens,
+		&s.BaseCostPerCall, &s.BaseCostPerMillionTokens,
+		&s.BaseCostPerMillionInputTokens, &s.BaseCostPerMillionOutputTokens,
+		&s.BaseCostPerImage, &s.BaseCostPerSearch,
+		&s.MaxInputTokens, &s.MaxOutputTokens, &s.MaxTotalTokens,
 		&s.BaseCostPerSecond, &s.BaseCostPerGBProcessed, &s.BaseCostPerGBStored,
 		&s.SupportsBatching, &s.BatchSizeLimit, &s.BaseCostPerBatch,
 		&s.RateLimitPerMinute, &s.RateLimitPerDay,
@@ -65,3 +90,31 @@ func (s *Service) GetByName(ctx context.Context) error {
 	}
 	return nil
 }
+
+// tokensPerDollar returns the Ditto tokens in a dollar.
+func tokensPerDollar(ctx context.Context, q queryer) (int64, error) {
+	var count int64
+	err := q.QueryRowContext(ctx, "SELECT count FROM tokens_per_unit WHERE name = 'dollar'").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get tokens per dollar: %w", err)
+	}
+	return count, nil
+}
+
+var maxOutputTokensCache, _ = mapcache.New[llm.ServiceName, int](mapcache.WithTTL(5 * time.Minute))
+
+// MaxOutputTokens returns the max_output_tokens of the named service.
+// It returns 0 if the service has no limit set or does not exist.
+func MaxOutputTokens(ctx context.Context, name llm.ServiceName) (int, error) {
+	return maxOutputTokensCache.Get(name, func() (int, error) {
+		var limit sql.NullInt64
+		err := D.QueryRowContext(ctx, "SELECT max_output_tokens FROM services WHERE name = ?", name).Scan(&limit)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to get max output tokens for %s: %w", name, err)
+		}
+		return int(limit.Int64), nil
+	})
+}
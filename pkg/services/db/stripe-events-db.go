@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrEventProcessed is returned when claiming an event that already succeeded.
+	ErrEventProcessed = errors.New("stripe event already processed")
+	// ErrEventInProgress is returned when claiming an event that another delivery is processing.
+	ErrEventInProgress = errors.New("stripe event in progress")
+)
+
+type StripeEventStatus string
+
+const (
+	StripeEventProcessing StripeEventStatus = "processing"
+	StripeEventSucceeded  StripeEventStatus = "succeeded"
+	StripeEventFailed     StripeEventStatus = "failed"
+)
+
+// stripeEventTimeout is how long an event can be processing before another
+// delivery may claim it, in case the server processing it stopped.
+const stripeEventTimeout = 5 * time.Minute
+
+// StripeEvent is a Stripe webhook event and how processing it went.
+type StripeEvent struct {
+	ID        string
+	Type      string
+	Payload   []byte
+	Status    StripeEventStatus
+	Attempts  int64
+	LastError sql.NullString
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ClaimStripeEvent records the event as processing, so that no other delivery processes it.
+// An event can be claimed if it is new, failed, or has been processing for too long.
+// Otherwise it returns ErrEventProcessed or ErrEventInProgress.
+func ClaimStripeEvent(ctx context.Context, id, typ string, payload []byte) error {
+	err := D.QueryRowContext(ctx, `
+		INSERT INTO stripe_events (id, type, payload) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			status = 'processing',
+			attempts = attempts + 1,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE stripe_events.status = 'failed'
+			OR (stripe_events.status = 'processing' AND stripe_events.updated_at < ?)
+		RETURNING id`,
+		id, typ, string(payload),
+		time.Now().Add(-stripeEventTimeout).UTC().Format(receiptTimeFormat)).Scan(&id)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to claim stripe event %s: %w", id, err)
+	}
+	var status StripeEventStatus
+	err = D.QueryRowContext(ctx, "SELECT status FROM stripe_events WHERE id = ?", id).Scan(&status)
+	if err != nil {
+		return fmt.Errorf("failed to get stripe event %s: %w", id, err)
+	}
+	if status == StripeEventSucceeded {
+		return ErrEventProcessed
+	}
+	return ErrEventInProgress
+}
+
+// FinishStripeEvent marks a claimed event as succeeded, or as failed if processing it returned an error.
+func FinishStripeEvent(ctx context.Context, id string, processErr error) error {
+	status := StripeEventSucceeded
+	var lastError sql.NullString
+	if processErr != nil {
+		status = StripeEventFailed
+		lastError = sql.NullString{String: processErr.Error(), Valid: true}
+	}
+	_, err := D.ExecContext(ctx, `
+		UPDATE stripe_events SET status = ?, last_error = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`, status, lastError, id)
+	if err != nil {
+		return fmt.Errorf("failed to finish stripe event %s: %w", id, err)
+	}
+	return nil
+}
+
+const stripeEventColumns = `id, type, payload, status, attempts, last_error, created_at, updated_at`
+
+func scanStripeEvent(row interface{ Scan(...any) error }) (StripeEvent, error) {
+	var e StripeEvent
+	var payload string
+	err := row.Scan(&e.ID, &e.Type, &payload, &e.Status, &e.Attempts, &e.LastError, &e.CreatedAt, &e.UpdatedAt)
+	e.Payload = []byte(payload)
+	return e, err
+}
+
+// GetStripeEvent returns the event with the given ID, or sql.ErrNoRows.
+func GetStripeEvent(ctx context.Context, id string) (StripeEvent, error) {
+	e, err := scanStripeEvent(D.QueryRowContext(ctx, `
+		SELECT `+stripeEventColumns+` FROM stripe_events WHERE id = ?`, id))
+	if err != nil {
+		return e, fmt.Errorf("failed to get stripe event %s: %w", id, err)
+	}
+	return e, nil
+}
+
+// ListStripeEvents returns the events with the given status, oldest first.
+func ListStripeEvents(ctx context.Context, status StripeEventStatus) ([]StripeEvent, error) {
+	rows, err := D.QueryContext(ctx, `
+		SELECT `+stripeEventColumns+` FROM stripe_events
+		WHERE status = ? ORDER BY created_at, id`, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stripe events: %w", err)
+	}
+	defer rows.Close()
+	var events []StripeEvent
+	for rows.Next() {
+		e, err := scanStripeEvent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan stripe event: %w", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate stripe events: %w", err)
+	}
+	return events, nil
+}
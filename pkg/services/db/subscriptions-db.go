@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/pubsub"
+)
+
+// ErrPlanNotFound is returned when no active plan has the given name.
+var ErrPlanNotFound = errors.New("subscription plan not found")
+
+// SubscriptionPlan is a monthly plan, sold as a Stripe subscription to its price.
+type SubscriptionPlan struct {
+	ID            int64
+	Name          string
+	StripePriceID string
+	// MonthlyTokens are granted each time a billing period is paid.
+	MonthlyTokens int64
+	IsActive      bool
+	CreatedAt     time.Time
+	// Subscribers is the number of current subscriptions, set by ListSubscriptionPlans.
+	Subscribers int64
+}
+
+// Insert inserts a new active plan.
+// It updates the SubscriptionPlan's ID with the ID from the database.
+func (p *SubscriptionPlan) Insert(ctx context.Context) error {
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	if p.StripePriceID == "" {
+		return errors.New("stripe price ID is required")
+	}
+	if p.MonthlyTokens <= 0 {
+		return errors.New("monthly tokens must be positive")
+	}
+	err := D.QueryRowContext(ctx, `
+		INSERT INTO subscription_plans (name, stripe_price_id, monthly_tokens)
+		VALUES (?, ?, ?)
+		RETURNING id, is_active`,
+		p.Name, p.StripePriceID, p.MonthlyTokens).Scan(&p.ID, &p.IsActive)
+	if err != nil {
+		return fmt.Errorf("failed to insert subscription plan: %w", err)
+	}
+	return nil
+}
+
+// GetSubscriptionPlan returns the active plan with the given name.
+func GetSubscriptionPlan(ctx context.Context, name string) (SubscriptionPlan, error) {
+	var p SubscriptionPlan
+	err := D.QueryRowContext(ctx, `
+		SELECT id, name, stripe_price_id, monthly_tokens, is_active, created_at
+		FROM subscription_plans WHERE name = ? AND is_active`, name).
+		Scan(&p.ID, &p.Name, &p.StripePriceID, &p.MonthlyTokens, &p.IsActive, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, ErrPlanNotFound
+	}
+	if err != nil {
+		return p, fmt.Errorf("failed to get subscription plan: %w", err)
+	}
+	return p, nil
+}
+
+// ListSubscriptionPlans returns every plan and its number of subscribers.
+func ListSubscriptionPlans(ctx context.Context) ([]SubscriptionPlan, error) {
+	rows, err := D.QueryContext(ctx, `
+		SELECT subscription_plans.id, name, stripe_price_id, monthly_tokens, is_active,
+			subscription_plans.created_at, COUNT(subscriptions.id)
+		FROM subscription_plans
+		LEFT JOIN subscriptions ON subscriptions.plan_id = subscription_plans.id
+			AND subscriptions.status IN `+currentSubscriptionStatuses+`
+		GROUP BY subscription_plans.id
+		ORDER BY subscription_plans.id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query subscription plans: %w", err)
+	}
+	defer rows.Close()
+	var plans []SubscriptionPlan
+	for rows.Next() {
+		var p SubscriptionPlan
+		err := rows.Scan(&p.ID, &p.Name, &p.StripePriceID, &p.MonthlyTokens, &p.IsActive,
+			&p.CreatedAt, &p.Subscribers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription plan: %w", err)
+		}
+		plans = append(plans, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate subscription plans: %w", err)
+	}
+	return plans, nil
+}
+
+// currentSubscriptionStatuses are the Stripe statuses of a subscription the user still has.
+// A past_due subscription is current until Stripe gives up and cancels it.
+const currentSubscriptionStatuses = `('active', 'trialing', 'past_due')`
+
+// Subscription is a user's Stripe subscription to a plan.
+type Subscription struct {
+	ID                   int64
+	StripeSubscriptionID string
+	UserID               int64
+	PlanID               int64
+	// Status is the Stripe subscription status.
+	Status            string
+	CurrentPeriodEnd  sql.NullTime
+	CancelAtPeriodEnd bool
+}
+
+// Upsert records the state of a Stripe subscription, which belongs to the user
+// with the given uid and is to the plan with the given Stripe price.
+// A canceled subscription stays canceled, even if an older update arrives late.
+// It updates the Subscription's ID, UserID and PlanID from the database.
+func (s *Subscription) Upsert(ctx context.Context, uid, priceID string) error {
+	var periodEnd sql.NullString
+	if s.CurrentPeriodEnd.Valid {
+		periodEnd = sql.NullString{String: s.CurrentPeriodEnd.Time.UTC().Format(receiptTimeFormat), Valid: true}
+	}
+	err := D.QueryRowContext(ctx, `
+		INSERT INTO subscriptions (stripe_subscription_id, user_id, plan_id, status, current_period_end, cancel_at_period_end)
+		SELECT ?, users.id, subscription_plans.id, ?, ?, ?
+		FROM users, subscription_plans
+		WHERE users.uid = ? AND subscription_plans.stripe_price_id = ?
+		ON CONFLICT (stripe_subscription_id) DO UPDATE SET
+			plan_id = excluded.plan_id,
+			status = CASE WHEN subscriptions.status = 'canceled' THEN 'canceled' ELSE excluded.status END,
+			current_period_end = COALESCE(excluded.current_period_end, subscriptions.current_period_end),
+			cancel_at_period_end = excluded.cancel_at_period_end,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING id, user_id, plan_id, status`,
+		s.StripeSubscriptionID, s.Status, periodEnd, s.CancelAtPeriodEnd, uid, priceID).
+		Scan(&s.ID, &s.UserID, &s.PlanID, &s.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to record subscription %s: no user %q or plan with price %q",
+			s.StripeSubscriptionID, uid, priceID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record subscription %s: %w", s.StripeSubscriptionID, err)
+	}
+	pubsub.PublishBalance(ctx, s.UserID, pubsub.ReasonSubscription)
+	return nil
+}
+
+// GrantAllowance grants the monthly tokens of a subscription's plan for a paid invoice,
+// recording it as a purchase of the invoice and the payment intent that paid it, if any.
+// It returns false if the invoice was already granted.
+func GrantAllowance(ctx context.Context, stripeSubscriptionID, invoiceID, paymentIntentID string, cents int64) (Purchase, bool, error) {
+	p := Purchase{PaymentID: invoiceID, Cents: cents}
+	err := D.QueryRowContext(ctx, `
+		INSERT INTO purchases (payment_id, user_id, cents, tokens, subscription_id, payment_intent_id)
+		SELECT ?, subscriptions.user_id, ?, subscription_plans.monthly_tokens, subscriptions.id, ?
+		FROM subscriptions
+		JOIN subscription_plans ON subscription_plans.id = subscriptions.plan_id
+		WHERE subscriptions.stripe_subscription_id = ?
+		ON CONFLICT (payment_id) DO NOTHING
+		RETURNING id, user_id, tokens, created_at`,
+		invoiceID, cents, sql.NullString{String: paymentIntentID, Valid: paymentIntentID != ""},
+		stripeSubscriptionID).
+		Scan(&p.ID, &p.UserID, &p.Tokens, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		var exists bool
+		err := D.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM purchases WHERE payment_id = ?)`, invoiceID).Scan(&exists)
+		if err != nil {
+			return p, false, fmt.Errorf("failed to check allowance of invoice %s: %w", invoiceID, err)
+		}
+		if !exists {
+			return p, false, fmt.Errorf("failed to grant allowance of invoice %s: no subscription %s",
+				invoiceID, stripeSubscriptionID)
+		}
+		return p, false, nil
+	}
+	if err != nil {
+		return p, false, fmt.Errorf("failed to grant allowance of invoice %s: %w", invoiceID, err)
+	}
+	pubsub.PublishBalance(ctx, p.UserID, pubsub.ReasonPurchase)
+	return p, true, nil
+}
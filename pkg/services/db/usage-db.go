@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
+	"github.com/ditto-assistant/backend/types/rp"
+	"github.com/ditto-assistant/backend/types/rq"
+)
+
+// usageGroupKeys are the SQL expressions receipts are grouped by.
+var usageGroupKeys = map[rq.UsageGroup]string{
+	rq.UsageGroupService:     "services.name",
+	rq.UsageGroupServiceType: "services.service_type",
+	rq.UsageGroupDay:         "date(receipts.timestamp)",
+}
+
+// usageSums are the summed columns of a usage group or total.
+const usageSums = `
+	COUNT(*),
+	COALESCE(SUM(receipts.input_tokens), 0),
+	COALESCE(SUM(receipts.output_tokens), 0),
+	COALESCE(SUM(receipts.total_tokens), 0),
+	COALESCE(SUM(receipts.num_images), 0),
+	COALESCE(SUM(receipts.num_searches), 0),
+	COALESCE(SUM(receipts.ditto_token_cost), 0)`
+
+// GetUsage returns a page of the user's receipts, newest first,
+// or of their sums grouped as requested,
+// along with the total usage over the requested date range.
+// The filters match the idx_receipts_user_timestamp index.
+func GetUsage(ctx context.Context, userID int64, req rq.UsageV1) (rp.UsageV1, error) {
+	where := "WHERE receipts.user_id = ?"
+	args := []any{userID}
+	if !req.From.IsZero() {
+		where += " AND receipts.timestamp >= ?"
+		args = append(args, req.From.UTC().Format(receiptTimeFormat))
+	}
+	if !req.To.IsZero() {
+		where += " AND receipts.timestamp < ?"
+		args = append(args, req.To.UTC().Format(receiptTimeFormat))
+	}
+
+	var usage rp.UsageV1
+	var tokensPerDollar float64
+	err := D.QueryRowContext(ctx, `
+		SELECT `+usageSums+`,
+			(SELECT count FROM tokens_per_unit WHERE name = 'dollar')
+		FROM receipts `+where, args...).
+		Scan(&usage.Total.Calls, &usage.Total.InputTokens, &usage.Total.OutputTokens, &usage.Total.TotalTokens,
+			&usage.Total.Images, &usage.Total.Searches, &usage.Total.DittoTokenCost, &tokensPerDollar)
+	if err != nil {
+		return rp.UsageV1{}, fmt.Errorf("failed to get usage total: %w", err)
+	}
+	if tokensPerDollar == 0 {
+		return rp.UsageV1{}, errors.New("tokens per dollar is not set")
+	}
+
+	if req.GroupBy == rq.UsageGroupNone {
+		usage.Items, usage.NextCursor, err = getReceipts(ctx, where, args, req)
+	} else {
+		usage.Items, usage.NextCursor, err = getUsageGroups(ctx, where, args, req)
+	}
+	if err != nil {
+		return rp.UsageV1{}, err
+	}
+	formatUsage(&usage.Total, tokensPerDollar)
+	for i := range usage.Items {
+		formatUsage(&usage.Items[i], tokensPerDollar)
+	}
+	return usage, nil
+}
+
+// getReceipts lists receipts individually.
+// The cursor is the timestamp and ID of the last receipt on the previous page.
+func getReceipts(ctx context.Context, where string, args []any, req rq.UsageV1) ([]rp.UsageItemV1, string, error) {
+	if req.Cursor != "" {
+		cursor, err := rq.ParseReceiptCursor(req.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where += " AND (receipts.timestamp, receipts.id) < (?, ?)"
+		args = append(args, cursor.Timestamp.Format(receiptTimeFormat), cursor.ID)
+	}
+	rows, err := D.QueryContext(ctx, `
+		SELECT receipts.id, receipts.timestamp, services.name, COALESCE(services.service_type, ''),
+			COALESCE(receipts.input_tokens, 0),
+			COALESCE(receipts.output_tokens, 0),
+			COALESCE(receipts.total_tokens, 0),
+			COALESCE(receipts.num_images, 0),
+			COALESCE(receipts.num_searches, 0),
+			COALESCE(receipts.ditto_token_cost, 0)
+		FROM receipts
+		JOIN services ON services.id = receipts.service_id
+		`+where+`
+		ORDER BY receipts.timestamp DESC, receipts.id DESC
+		LIMIT ?`, append(args, req.Limit+1)...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query receipts: %w", err)
+	}
+	defer rows.Close()
+	items := make([]rp.UsageItemV1, 0, req.Limit)
+	for rows.Next() {
+		item := rp.UsageItemV1{Calls: 1}
+		var ts time.Time
+		err := rows.Scan(&item.ID, &ts, &item.Service, &item.ServiceType,
+			&item.InputTokens, &item.OutputTokens, &item.TotalTokens,
+			&item.Images, &item.Searches, &item.DittoTokenCost)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan receipt: %w", err)
+		}
+		item.Timestamp = &ts
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to iterate receipts: %w", err)
+	}
+	if len(items) <= req.Limit {
+		return items, "", nil
+	}
+	items = items[:req.Limit]
+	last := items[len(items)-1]
+	return items, rq.ReceiptCursor{Timestamp: *last.Timestamp, ID: last.ID}.String(), nil
+}
+
+// getUsageGroups sums receipts by the requested group.
+// Days are listed newest first, and services by cost.
+// The cursor is the number of groups on the previous pages.
+func getUsageGroups(ctx context.Context, where string, args []any, req rq.UsageV1) ([]rp.UsageItemV1, string, error) {
+	key, ok := usageGroupKeys[req.GroupBy]
+	if !ok {
+		return nil, "", fmt.Errorf("invalid usage group: %q", req.GroupBy)
+	}
+	var offset int
+	if req.Cursor != "" {
+		var err error
+		offset, err = strconv.Atoi(req.Cursor)
+		if err != nil || offset < 0 {
+			return nil, "", fmt.Errorf("invalid cursor: %q", req.Cursor)
+		}
+	}
+	orderBy := "8 DESC, 1"
+	if req.GroupBy == rq.UsageGroupDay {
+		orderBy = "1 DESC"
+	}
+	rows, err := D.QueryContext(ctx, `
+		SELECT COALESCE(`+key+`, ''), `+usageSums+`
+		FROM receipts
+		JOIN services ON services.id = receipts.service_id
+		`+where+`
+		GROUP BY 1
+		ORDER BY `+orderBy+`
+		LIMIT ? OFFSET ?`, append(args, req.Limit+1, offset)...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query usage by %s: %w", req.GroupBy, err)
+	}
+	defer rows.Close()
+	items := make([]rp.UsageItemV1, 0, req.Limit)
+	for rows.Next() {
+		var item rp.UsageItemV1
+		err := rows.Scan(&item.Group, &item.Calls, &item.InputTokens, &item.OutputTokens, &item.TotalTokens,
+			&item.Images, &item.Searches, &item.DittoTokenCost)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan usage group: %w", err)
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to iterate usage groups: %w", err)
+	}
+	if len(items) <= req.Limit {
+		return items, "", nil
+	}
+	return items[:req.Limit], strconv.Itoa(offset + req.Limit), nil
+}
+
+func formatUsage(item *rp.UsageItemV1, tokensPerDollar float64) {
+	item.Cost = numfmt.LargeNumber(item.DittoTokenCost)
+	item.USD = numfmt.USD(float64(item.DittoTokenCost) / tokensPerDollar)
+}
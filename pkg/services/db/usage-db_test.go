@@ -0,0 +1,51 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/dbtest"
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/types/rq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUsagePages(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	userID := newUser(t, 1_000_000_000)
+	start := time.Date(2025, time.March, 1, 10, 0, 0, 0, time.UTC)
+	// The last receipt is recorded late, between the other two.
+	var ids []int64
+	for _, hours := range []int{0, 2, 1} {
+		receipt := db.Receipt{
+			UserID:       userID,
+			ServiceName:  llm.ModelClaude35Haiku,
+			Timestamp:    start.Add(time.Duration(hours) * time.Hour),
+			InputTokens:  100,
+			OutputTokens: 100,
+			TotalTokens:  200,
+		}
+		require.NoError(t, receipt.Insert(ctx))
+		ids = append(ids, receipt.ID)
+	}
+
+	var got []int64
+	req := rq.UsageV1{Limit: 1}
+	for {
+		usage, err := db.GetUsage(ctx, userID, req)
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, usage.Total.Calls)
+		for _, item := range usage.Items {
+			got = append(got, item.ID)
+		}
+		if usage.NextCursor == "" {
+			break
+		}
+		req.Cursor = usage.NextCursor
+	}
+	assert.Equal(t, []int64{ids[1], ids[2], ids[0]}, got)
+}
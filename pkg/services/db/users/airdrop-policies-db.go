@@ -0,0 +1,245 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omniaura/mapcache"
+)
+
+type AirdropKind string
+
+const (
+	// AirdropInitial drops once, when the user is created.
+	AirdropInitial AirdropKind = "initial"
+	// AirdropRecurring drops once every period. A new user's first period starts at signup.
+	AirdropRecurring AirdropKind = "recurring"
+	// AirdropOnce drops the first time an eligible user checks their balance.
+	AirdropOnce AirdropKind = "once"
+)
+
+func (k AirdropKind) Valid() bool {
+	switch k {
+	case AirdropInitial, AirdropRecurring, AirdropOnce:
+		return true
+	}
+	return false
+}
+
+// AirdropPolicy is an airdrop campaign, and who is eligible for it.
+type AirdropPolicy struct {
+	ID     int64
+	Name   string
+	Kind   AirdropKind
+	Amount int64
+	// Period is how often a recurring policy drops.
+	Period               time.Duration
+	RequireEmail         bool
+	RequireVerifiedEmail bool
+	// Platforms are the eligible platforms, or all of them if empty.
+	Platforms []Platform
+	StartsAt  sql.NullTime
+	EndsAt    sql.NullTime
+	IsActive  bool
+	CreatedAt time.Time
+
+	// Grants and Granted are the number and sum of the policy's airdrops,
+	// set by ListAirdropPolicies.
+	Grants  int64
+	Granted int64
+}
+
+// Validate checks the policy can be inserted.
+func (p *AirdropPolicy) Validate() error {
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	if !p.Kind.Valid() {
+		return fmt.Errorf("invalid kind %q: must be initial, recurring or once", p.Kind)
+	}
+	if p.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	if p.Kind == AirdropRecurring && p.Period < time.Minute {
+		return errors.New("a recurring policy needs a period of at least a minute")
+	}
+	if p.StartsAt.Valid && p.EndsAt.Valid && !p.EndsAt.Time.After(p.StartsAt.Time) {
+		return errors.New("the policy must end after it starts")
+	}
+	return nil
+}
+
+// Insert inserts a new, active airdrop policy.
+// It updates the AirdropPolicy's ID with the ID from the database.
+func (p *AirdropPolicy) Insert(ctx context.Context, d *sql.DB) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	res, err := d.ExecContext(ctx, `
+		INSERT INTO airdrop_policies (
+			name, kind, amount, period_seconds, require_email,
+			require_verified_email, platforms, starts_at, ends_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.Name, p.Kind, p.Amount, int64(p.Period.Seconds()), p.RequireEmail,
+		p.RequireVerifiedEmail, formatPlatforms(p.Platforms), formatPolicyTime(p.StartsAt), formatPolicyTime(p.EndsAt))
+	if err != nil {
+		return fmt.Errorf("failed to insert airdrop policy: %w", err)
+	}
+	p.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	p.IsActive = true
+	return nil
+}
+
+// ListAirdropPolicies returns every airdrop policy, active or not,
+// with the number and sum of its grants.
+func ListAirdropPolicies(ctx context.Context, d *sql.DB) ([]AirdropPolicy, error) {
+	return queryAirdropPolicies(ctx, d, `
+		SELECT p.id, p.name, p.kind, p.amount, p.period_seconds, p.require_email,
+			p.require_verified_email, p.platforms, p.starts_at, p.ends_at, p.is_active, p.created_at,
+			COUNT(g.id), COALESCE(SUM(g.amount), 0)
+		FROM airdrop_policies p
+		LEFT JOIN airdrop_grants g ON g.policy_id = p.id AND g.amount > 0
+		GROUP BY p.id
+		ORDER BY p.id`)
+}
+
+var cacheAirdropPolicies, _ = mapcache.New[string, []AirdropPolicy](mapcache.WithTTL(time.Minute))
+
+// activeAirdropPolicies returns the policies that are active, whether or not they have started.
+// Changes to policies take up to a minute to reach the server.
+func activeAirdropPolicies(ctx context.Context, d *sql.DB) ([]AirdropPolicy, error) {
+	return cacheAirdropPolicies.Get("active", func() ([]AirdropPolicy, error) {
+		return queryAirdropPolicies(ctx, d, `
+			SELECT id, name, kind, amount, period_seconds, require_email,
+				require_verified_email, platforms, starts_at, ends_at, is_active, created_at, 0, 0
+			FROM airdrop_policies
+			WHERE is_active = 1
+			ORDER BY id`)
+	})
+}
+
+func queryAirdropPolicies(ctx context.Context, d *sql.DB, query string) ([]AirdropPolicy, error) {
+	rows, err := d.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query airdrop policies: %w", err)
+	}
+	defer rows.Close()
+	var policies []AirdropPolicy
+	for rows.Next() {
+		var p AirdropPolicy
+		var periodSeconds int64
+		var platforms sql.NullString
+		err := rows.Scan(&p.ID, &p.Name, &p.Kind, &p.Amount, &periodSeconds, &p.RequireEmail,
+			&p.RequireVerifiedEmail, &platforms, &p.StartsAt, &p.EndsAt, &p.IsActive, &p.CreatedAt,
+			&p.Grants, &p.Granted)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan airdrop policy: %w", err)
+		}
+		p.Period = time.Duration(periodSeconds) * time.Second
+		p.Platforms, err = parsePlatforms(platforms.String)
+		if err != nil {
+			return nil, fmt.Errorf("airdrop policy %s: %w", p.Name, err)
+		}
+		policies = append(policies, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate airdrop policies: %w", err)
+	}
+	return policies, nil
+}
+
+// SetAirdropOverride replaces the policy's amount for the user with the given UID.
+// An amount of 0 excludes the user from the policy.
+func SetAirdropOverride(ctx context.Context, d *sql.DB, policyName, uid string, amount int64) error {
+	if amount < 0 {
+		return errors.New("amount must not be negative")
+	}
+	res, err := d.ExecContext(ctx, `
+		INSERT INTO airdrop_policy_overrides (policy_id, user_id, amount)
+		SELECT p.id, u.id, ? FROM airdrop_policies p, users u
+		WHERE p.name = ? AND u.uid = ?
+		ON CONFLICT (policy_id, user_id) DO UPDATE SET amount = excluded.amount`,
+		amount, policyName, uid)
+	if err != nil {
+		return fmt.Errorf("failed to set airdrop override: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no airdrop policy %q or user %q", policyName, uid)
+	}
+	return nil
+}
+
+// Live reports whether the policy is active and within its start and end dates.
+func (p AirdropPolicy) Live(now time.Time) bool {
+	if !p.IsActive {
+		return false
+	}
+	if p.StartsAt.Valid && now.Before(p.StartsAt.Time) {
+		return false
+	}
+	if p.EndsAt.Valid && !now.Before(p.EndsAt.Time) {
+		return false
+	}
+	return true
+}
+
+// eligible reports whether a user with the given email and platform may receive the policy.
+func (p AirdropPolicy) eligible(email string, emailVerified bool, platform Platform) bool {
+	if p.RequireEmail && email == "" {
+		return false
+	}
+	if p.RequireVerifiedEmail && (email == "" || !emailVerified) {
+		return false
+	}
+	if len(p.Platforms) > 0 && !slices.Contains(p.Platforms, platform) {
+		return false
+	}
+	return true
+}
+
+func formatPlatforms(platforms []Platform) sql.NullString {
+	if len(platforms) == 0 {
+		return sql.NullString{}
+	}
+	s := make([]string, len(platforms))
+	for i, p := range platforms {
+		s[i] = strconv.Itoa(int(p))
+	}
+	return sql.NullString{String: strings.Join(s, ","), Valid: true}
+}
+
+func parsePlatforms(s string) ([]Platform, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var platforms []Platform
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform %q", field)
+		}
+		platforms = append(platforms, Platform(n))
+	}
+	return platforms, nil
+}
+
+// formatPolicyTime formats t like CURRENT_TIMESTAMP, so the two compare as text.
+func formatPolicyTime(t sql.NullTime) sql.NullString {
+	if !t.Valid {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.Time.UTC().Format(time.DateTime), Valid: true}
+}
@@ -0,0 +1,72 @@
+package users_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db/users"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAirdropPolicyLive(t *testing.T) {
+	now := time.Date(2025, time.March, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) sql.NullTime {
+		return sql.NullTime{Time: now.Add(d), Valid: true}
+	}
+	tests := []struct {
+		name     string
+		policy   users.AirdropPolicy
+		expected bool
+	}{
+		{"no dates", users.AirdropPolicy{IsActive: true}, true},
+		{"inactive", users.AirdropPolicy{}, false},
+		{"started", users.AirdropPolicy{IsActive: true, StartsAt: at(-time.Hour)}, true},
+		{"not started", users.AirdropPolicy{IsActive: true, StartsAt: at(time.Hour)}, false},
+		{"ending", users.AirdropPolicy{IsActive: true, EndsAt: at(time.Hour)}, true},
+		{"ended", users.AirdropPolicy{IsActive: true, EndsAt: at(0)}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.policy.Live(now))
+		})
+	}
+}
+
+func TestAirdropPolicyValidate(t *testing.T) {
+	policy := users.AirdropPolicy{Name: "launch", Kind: users.AirdropOnce, Amount: 100_000_000}
+	require.NoError(t, policy.Validate())
+
+	recurring := policy
+	recurring.Kind = users.AirdropRecurring
+	assert.Error(t, recurring.Validate(), "a recurring policy needs a period")
+	recurring.Period = 7 * 24 * time.Hour
+	assert.NoError(t, recurring.Validate())
+
+	unknown := policy
+	unknown.Kind = "weekly"
+	assert.Error(t, unknown.Validate())
+
+	backwards := policy
+	backwards.StartsAt = sql.NullTime{Time: time.Now(), Valid: true}
+	backwards.EndsAt = sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}
+	assert.Error(t, backwards.Validate())
+}
+
+func TestParsePlatform(t *testing.T) {
+	for input, expected := range map[string]users.Platform{
+		"web":     users.PlatformWeb,
+		"iOS":     users.PlatformiOS,
+		"android": users.PlatformAndroid,
+		"6":       users.PlatformWindows,
+	} {
+		platform, err := users.ParsePlatform(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, expected, platform, input)
+	}
+	_, err := users.ParsePlatform("playstation")
+	assert.Error(t, err)
+	_, err = users.ParsePlatform("7")
+	assert.Error(t, err)
+}
@@ -7,41 +7,10 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/ditto-assistant/backend/pkg/services/pubsub"
 	"github.com/ditto-assistant/backend/types/rq"
 )
 
-// Aidrop tokens every 24 hours when the user logs in
-const airdropTokens = 20_000_000
-const initialAirdropTokens = 250_000_000
-
-type airdropConfig struct {
-	Period        time.Duration // How often airdrops can occur
-	Amount        int64         // How many tokens to airdrop
-	InitialAmount int64         // How many tokens to airdrop when the user is created
-}
-
-type airdropOption func(*airdropConfig)
-
-func defaultAirdropConfig() airdropConfig {
-	return airdropConfig{
-		Period:        time.Hour * 24,
-		Amount:        airdropTokens,
-		InitialAmount: initialAirdropTokens,
-	}
-}
-
-func withPeriod(period time.Duration) airdropOption {
-	return func(cfg *airdropConfig) {
-		cfg.Period = period
-	}
-}
-
-func withAmount(amount int64) airdropOption {
-	return func(cfg *airdropConfig) {
-		cfg.Amount = amount
-	}
-}
-
 type resultAirdrop struct {
 	ID         int64
 	DropAmount int64
@@ -51,70 +20,169 @@ func handleAirdrop(
 	ctx context.Context,
 	d *sql.DB,
 	req rq.BalanceV1,
-	opts ...airdropOption,
 ) (*resultAirdrop, error) {
-	cfg := defaultAirdropConfig()
-	for _, opt := range opts {
-		opt(&cfg)
-	}
 	var q User
+	var created bool
 	err := d.QueryRowContext(ctx, `
 		SELECT id, uid, email, last_airdrop_at FROM users WHERE email = ? OR uid = ?`, req.Email, req.UserID).
 		Scan(&q.ID, &q.UID, &q.Email, &q.LastAirdropAt)
 	if err == sql.ErrNoRows {
-		// New user - create account with airdrop
-		amt := cfg.InitialAmount
-		if req.Email == "" {
-			amt = 0
+		q = User{
+			UID:   req.UserID,
+			Email: sql.NullString{String: req.Email, Valid: req.Email != ""},
 		}
-		user := User{
-			UID:                   req.UserID,
-			Email:                 sql.NullString{String: req.Email, Valid: req.Email != ""},
-			Balance:               amt,
-			TotalTokensAirdropped: amt,
-		}
-		if err := user.Insert(ctx, d); err != nil {
+		if err := q.Insert(ctx, d); err != nil {
 			return nil, fmt.Errorf("failed to insert new user: %w", err)
 		}
-		return &resultAirdrop{ID: user.ID, DropAmount: amt}, nil
+		created = true
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	} else if err := updateIdentity(ctx, d, q, req); err != nil {
+		return nil, err
 	}
+
+	amount, err := airdrop(ctx, d, q.ID, req, created)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user: %w", err)
+		return nil, err
 	}
+	return &resultAirdrop{ID: q.ID, DropAmount: amount}, nil
+}
+
+// updateIdentity updates the user's UID or email if either changed.
+func updateIdentity(ctx context.Context, d *sql.DB, q User, req rq.BalanceV1) error {
 	if !q.Email.Valid && req.Email == "" {
-		return &resultAirdrop{ID: q.ID}, nil
+		return nil
 	}
-
 	if q.Email.Valid &&
 		q.Email.String == req.Email &&
 		q.UID != req.UserID { // Email is the same but userID is different
-		_, err = d.ExecContext(ctx, `
+		_, err := d.ExecContext(ctx, `
 			UPDATE users SET uid = ? WHERE id = ?`, req.UserID, q.ID)
 		if err != nil {
-			return nil, fmt.Errorf("failed to update user UID: %w", err)
+			return fmt.Errorf("failed to update user UID: %w", err)
 		}
 		slog.Info("user deleted and recreated account", "uid", req.UserID, "email", req.Email)
 	} else if q.UID == req.UserID &&
 		(!q.Email.Valid || q.Email.String != req.Email) { // Email changed or not set
-		_, err = d.ExecContext(ctx, `
+		_, err := d.ExecContext(ctx, `
 			UPDATE users SET email = ? WHERE id = ?`, req.Email, q.ID)
 		if err != nil {
-			return nil, fmt.Errorf("failed to update user email: %w", err)
+			return fmt.Errorf("failed to update user email: %w", err)
 		}
 		slog.Info("updated user email", "uid", req.UserID, "email", req.Email)
 	}
+	return nil
+}
+
+// airdrop grants the user every live policy they are eligible for, returning the total dropped.
+func airdrop(ctx context.Context, d *sql.DB, userID int64, req rq.BalanceV1, created bool) (int64, error) {
+	policies, err := activeAirdropPolicies(ctx, d)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var due []AirdropPolicy
+	for _, p := range policies {
+		if !p.Live(now) || !p.eligible(req.Email, req.EmailVerified, Platform(req.Platform)) {
+			continue
+		}
+		if p.Kind == AirdropInitial && !created {
+			continue
+		}
+		due = append(due, p)
+	}
+	if len(due) == 0 {
+		return 0, nil
+	}
 
-	if q.LastAirdropAt.Valid && time.Since(q.LastAirdropAt.Time) < cfg.Period {
-		return &resultAirdrop{ID: q.ID}, nil
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin airdrop: %w", err)
+	}
+	defer tx.Rollback()
+	overrides, err := airdropOverrides(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, p := range due {
+		amount := p.Amount
+		if override, ok := overrides[p.ID]; ok {
+			if override == 0 {
+				continue
+			}
+			amount = override
+		}
+		// A new user's first recurring period starts at signup.
+		if p.Kind == AirdropRecurring && created {
+			amount = 0
+		}
+		granted, err := grantAirdrop(ctx, tx, p, userID, amount, now)
+		if err != nil {
+			return 0, err
+		}
+		if granted {
+			total += amount
+		}
 	}
-	_, err = d.ExecContext(ctx, `
+	if total > 0 {
+		// The grants' trigger credits the balance through the ledger.
+		_, err = tx.ExecContext(ctx, `
 			UPDATE users SET
-				balance = balance + ?,
 				total_tokens_airdropped = total_tokens_airdropped + ?,
 				last_airdrop_at = CURRENT_TIMESTAMP
-			WHERE id = ?`, cfg.Amount, cfg.Amount, q.ID)
+			WHERE id = ?`, total, userID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to airdrop tokens: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit airdrop: %w", err)
+	}
+	if total > 0 {
+		pubsub.PublishBalance(ctx, userID, pubsub.ReasonAirdrop)
+	}
+	return total, nil
+}
+
+func airdropOverrides(ctx context.Context, tx *sql.Tx, userID int64) (map[int64]int64, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT policy_id, amount FROM airdrop_policy_overrides WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get airdrop overrides: %w", err)
+	}
+	defer rows.Close()
+	overrides := make(map[int64]int64)
+	for rows.Next() {
+		var policyID, amount int64
+		if err := rows.Scan(&policyID, &amount); err != nil {
+			return nil, fmt.Errorf("failed to scan airdrop override: %w", err)
+		}
+		overrides[policyID] = amount
+	}
+	return overrides, rows.Err()
+}
+
+// grantAirdrop records a grant of the policy, unless the user already had one
+// this period, or ever if the policy does not recur. It reports whether it was granted.
+func grantAirdrop(ctx context.Context, tx *sql.Tx, p AirdropPolicy, userID, amount int64, now time.Time) (bool, error) {
+	var since string
+	if p.Kind == AirdropRecurring {
+		since = now.UTC().Add(-p.Period).Format(time.DateTime)
+	}
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO airdrop_grants (policy_id, user_id, amount)
+		SELECT ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM airdrop_grants
+			WHERE user_id = ? AND policy_id = ? AND granted_at > ?
+		)`, p.ID, userID, amount, userID, p.ID, since)
+	if err != nil {
+		return false, fmt.Errorf("failed to grant airdrop %s: %w", p.Name, err)
+	}
+	n, err := res.RowsAffected()
 	if err != nil {
-		return nil, fmt.Errorf("failed to airdrop tokens: %w", err)
+		return false, err
 	}
-	return &resultAirdrop{ID: q.ID, DropAmount: cfg.Amount}, nil
+	return n > 0, nil
 }
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
@@ -28,24 +30,38 @@ const (
 	PlatformWindows
 )
 
-var cacheBalance, _ = mapcache.New[rq.BalanceV1, rp.BalanceV1](mapcache.WithTTL(10 * time.Second))
+// ParsePlatform parses a platform from its number or its name, such as "ios".
+func ParsePlatform(s string) (Platform, error) {
+	if n, err := strconv.Atoi(s); err == nil && n >= int(PlatformWeb) && n <= int(PlatformWindows) {
+		return Platform(n), nil
+	}
+	for p := PlatformWeb; p <= PlatformWindows; p++ {
+		if strings.EqualFold(strings.TrimPrefix(p.String(), "Platform"), s) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown platform %q", s)
+}
+
+var cacheBalance, _ = mapcache.New[rq.BalanceV1, cached[rp.BalanceV1]](mapcache.WithTTL(10 * time.Second))
 
 // GetBalance manages the entire balance check flow including airdrops
 func GetBalance(r *http.Request, d *sql.DB, req rq.BalanceV1) (rp.BalanceV1, error) {
-	return cacheBalance.Get(req, func() (rp.BalanceV1, error) {
+	return getFresh(cacheBalance, req, func() (cached[rp.BalanceV1], error) {
 		ctx := r.Context()
+		at := time.Now()
 		res, err := handleAirdrop(ctx, d, req)
 		if err != nil {
-			return rp.BalanceV1{}, fmt.Errorf("failed to handle airdrop: %w", err)
+			return cached[rp.BalanceV1]{}, fmt.Errorf("failed to handle airdrop: %w", err)
 		}
 		if err := handleDeviceID(r, d, req, res.ID); err != nil {
-			return rp.BalanceV1{}, err
+			return cached[rp.BalanceV1]{}, err
 		}
 		balance, err := getBalance(ctx, d, res)
 		if err != nil {
-			return rp.BalanceV1{}, fmt.Errorf("failed to get user balance: %w", err)
+			return cached[rp.BalanceV1]{}, fmt.Errorf("failed to get user balance: %w", err)
 		}
-		return balance, nil
+		return cached[rp.BalanceV1]{V: balance, UserID: res.ID, At: at}, nil
 	})
 }
 
@@ -97,11 +113,20 @@ func handleDeviceID(r *http.Request, d *sql.DB, req rq.BalanceV1, id int64) erro
 	return nil
 }
 
+// Balance returns the user's balance, without checking for airdrops.
+func Balance(ctx context.Context, d *sql.DB, userID int64) (rp.BalanceV1, error) {
+	return getBalance(ctx, d, &resultAirdrop{ID: userID})
+}
+
 func getBalance(ctx context.Context, d *sql.DB, airdrop *resultAirdrop) (rp.BalanceV1, error) {
 	var q struct {
 		Balance, TotalAirdropped  int64
 		Images, Searches, Dollars float64
 		LastAirdropAt             sql.NullTime
+		Plan, PlanStatus          sql.NullString
+		PlanTokens                sql.NullInt64
+		PlanPeriodEnd             sql.NullTime
+		PlanCanceling             sql.NullBool
 	}
 	err := d.QueryRowContext(ctx, `
 		SELECT users.balance,
@@ -109,9 +134,20 @@ func getBalance(ctx context.Context, d *sql.DB, airdrop *resultAirdrop) (rp.Bala
 			   users.last_airdrop_at,
 			   CAST(users.balance AS FLOAT) / (SELECT CAST(count AS FLOAT) FROM tokens_per_unit WHERE name = 'dollar'),
 			   (users.balance / (SELECT count FROM tokens_per_unit WHERE name = 'image')),
-			   (users.balance / (SELECT count FROM tokens_per_unit WHERE name = 'search'))
-		FROM users WHERE id = ?`, airdrop.ID).
-		Scan(&q.Balance, &q.TotalAirdropped, &q.LastAirdropAt, &q.Dollars, &q.Images, &q.Searches)
+			   (users.balance / (SELECT count FROM tokens_per_unit WHERE name = 'search')),
+			   subscription_plans.name,
+			   subscription_plans.monthly_tokens,
+			   subscriptions.status,
+			   subscriptions.current_period_end,
+			   subscriptions.cancel_at_period_end
+		FROM users
+		LEFT JOIN subscriptions ON subscriptions.user_id = users.id
+			AND subscriptions.status IN ('active', 'trialing', 'past_due')
+		LEFT JOIN subscription_plans ON subscription_plans.id = subscriptions.plan_id
+		WHERE users.id = ?
+		ORDER BY subscriptions.id DESC`, airdrop.ID).
+		Scan(&q.Balance, &q.TotalAirdropped, &q.LastAirdropAt, &q.Dollars, &q.Images, &q.Searches,
+			&q.Plan, &q.PlanTokens, &q.PlanStatus, &q.PlanPeriodEnd, &q.PlanCanceling)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return rp.BalanceV1{}.Zeroes(), nil
@@ -138,5 +174,15 @@ func getBalance(ctx context.Context, d *sql.DB, airdrop *resultAirdrop) (rp.Bala
 	if q.LastAirdropAt.Valid {
 		rsp.LastAirdropAt = &q.LastAirdropAt.Time
 	}
+	if q.Plan.Valid {
+		rsp.Plan = q.Plan.String
+		rsp.PlanTokensRaw = q.PlanTokens.Int64
+		rsp.PlanTokens = numfmt.LargeNumber(q.PlanTokens.Int64)
+		rsp.PlanStatus = q.PlanStatus.String
+		rsp.PlanCanceling = q.PlanCanceling.Bool
+		if q.PlanPeriodEnd.Valid {
+			rsp.PlanRenewsAt = &q.PlanPeriodEnd.Time
+		}
+	}
 	return rsp, nil
 }
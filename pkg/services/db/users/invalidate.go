@@ -0,0 +1,64 @@
+package users
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/pubsub"
+	"github.com/omniaura/mapcache"
+)
+
+// changedAt is when each user's balance last changed, by user ID.
+// Cached users and balances loaded before then are stale.
+var changedAt sync.Map
+
+// cached is a cached value and when it started loading.
+type cached[T any] struct {
+	V      T
+	UserID int64
+	At     time.Time
+}
+
+// getFresh gets the cached value of key, reloading it if the user's balance
+// changed after it was loaded.
+func getFresh[K comparable, V any](c *mapcache.MapCache[K, cached[V]], key K, up func() (cached[V], error)) (V, error) {
+	v, err := c.Get(key, up)
+	if err == nil && changedSince(v.UserID, v.At) {
+		v, err = c.Get(key, up, mapcache.WithTTL(time.Nanosecond))
+	}
+	return v.V, err
+}
+
+func changedSince(userID int64, at time.Time) bool {
+	t, ok := changedAt.Load(userID)
+	return ok && !t.(time.Time).Before(at)
+}
+
+// changeTTL is how long a change is remembered, which is the longest TTL of the
+// caches it invalidates.
+const changeTTL = time.Minute
+
+// InvalidateOnChange invalidates the cached user and balance of each user whose
+// balance changes, until ctx is done.
+func InvalidateOnChange(ctx context.Context, broker pubsub.Broker) {
+	events, unsubscribe := broker.Subscribe(0)
+	defer unsubscribe()
+	ticker := time.NewTicker(changeTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			changedAt.Store(e.UserID, time.Now())
+		case now := <-ticker.C:
+			changedAt.Range(func(userID, t any) bool {
+				if now.Sub(t.(time.Time)) > changeTTL {
+					changedAt.Delete(userID)
+				}
+				return true
+			})
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/ditto-assistant/backend/pkg/services/db"
 	"github.com/omniaura/mapcache"
 )
 
@@ -18,12 +19,13 @@ type User struct {
 	TotalTokensAirdropped int64
 }
 
-// Insert inserts a new user into the database.
+// Insert inserts a new user into the database, with a balance of zero.
+// Tokens are credited through the ledger, as InitBalance does.
 // It updates the User's ID with the ID from the database.
 func (u *User) Insert(ctx context.Context, d *sql.DB) error {
 	res, err := d.ExecContext(ctx,
-		"INSERT INTO users (uid, email, balance, total_tokens_airdropped, last_airdrop_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
-		u.UID, u.Email, u.Balance, u.TotalTokensAirdropped)
+		"INSERT INTO users (uid, email, total_tokens_airdropped, last_airdrop_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
+		u.UID, u.Email, u.TotalTokensAirdropped)
 	if err != nil {
 		return err
 	}
@@ -35,21 +37,22 @@ func (u *User) Insert(ctx context.Context, d *sql.DB) error {
 	return nil
 }
 
-var userCache, _ = mapcache.New[string, User](mapcache.WithTTL(time.Minute))
+var userCache, _ = mapcache.New[string, cached[User]](mapcache.WithTTL(time.Minute))
 
 // GetByUID gets a user id, balance, and email by their UID.
 // If the user does not exist, it creates a new user.
 func (u *User) GetByUID(ctx context.Context, d *sql.DB) (err error) {
-	*u, err = userCache.Get(u.UID, func() (User, error) {
+	*u, err = getFresh(userCache, u.UID, func() (cached[User], error) {
 		usr := User{UID: u.UID}
+		at := time.Now()
 		err := d.QueryRowContext(ctx,
 			"SELECT id, balance, email FROM users WHERE uid = ?", u.UID).
 			Scan(&usr.ID, &usr.Balance, &usr.Email)
 		if err != nil {
-			return usr, err
+			return cached[User]{V: usr}, err
 		}
 		slog.Debug("got user", "uid", usr.UID, "id", usr.ID, "balance", usr.Balance, "email", usr.Email.String)
-		return usr, nil
+		return cached[User]{V: usr, UserID: usr.ID, At: at}, nil
 	})
 	return err
 }
@@ -59,14 +62,13 @@ func (u *User) GetByUID(ctx context.Context, d *sql.DB) (err error) {
 func (u *User) InitBalance(ctx context.Context, d *sql.DB) error {
 	err := d.QueryRowContext(ctx, "SELECT id FROM users WHERE uid = ?", u.UID).Scan(&u.ID)
 	if err == sql.ErrNoRows { // User doesn't exist, create a new one
-		return u.Insert(ctx, d)
+		if err := u.Insert(ctx, d); err != nil {
+			return err
+		}
 	} else if err != nil {
 		return err
 	}
-	// User exists, update the balance
-	_, err = d.ExecContext(ctx, "UPDATE users SET balance = ? WHERE id = ?", u.Balance, u.ID)
-	if err != nil {
-		return err
-	}
-	return nil
+	// Post the difference to the ledger
+	_, err = db.SetBalance(ctx, d, u.ID, u.Balance, "init balance")
+	return err
 }
@@ -1,8 +1,13 @@
 package filestorage
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -80,6 +85,77 @@ func (cl *Client) PresignURL(ctx context.Context, userID, urlStr string) (string
 	})
 }
 
+// SaveGeneratedImage copies a generated image from the provider's temporary URL
+// to the user's generated-images folder, where PresignURL can find it later.
+func (cl *Client) SaveGeneratedImage(ctx context.Context, userID, urlStr string) (key string, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create image request: %w", err)
+	}
+	imgResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download image: %w", err)
+	}
+	defer imgResp.Body.Close()
+	imgData, err := io.ReadAll(imgResp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image data: %w", err)
+	}
+	urlParts := strings.Split(urlStr, "?")
+	filename := strings.TrimPrefix(urlParts[0], envs.DALL_E_PREFIX)
+	key = fmt.Sprintf("%s/generated-images/%s", userID, filename)
+	_, err = cl.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: cl.contentBucket,
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(imgData),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to copy to S3: %w", err)
+	}
+	return key, nil
+}
+
+// ErrForbidden is returned for an object in the content bucket that belongs to another user.
+var ErrForbidden = errors.New("object belongs to another user")
+
+// OpenImage reads an object from the user's folder of the content bucket,
+// such as an image they uploaded, without going through its public or presigned URL.
+// ok is false if urlStr is not in the content bucket.
+// Objects outside the user's folder return ErrForbidden, since they are read
+// with the server's credentials.
+func (cl *Client) OpenImage(ctx context.Context, userID, urlStr string) (body io.ReadCloser, ok bool, err error) {
+	key, ok, err := contentKey(userID, urlStr)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	out, err := cl.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: cl.contentBucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to get object %s: %w", key, err)
+	}
+	return out.Body, true, nil
+}
+
+// contentKey returns the object key of a URL in the content bucket,
+// if the object is in the user's folder.
+// ok is false if urlStr is not in the content bucket.
+func contentKey(userID, urlStr string) (key string, ok bool, err error) {
+	if envs.DITTO_CONTENT_PREFIX == "" || !strings.HasPrefix(urlStr, envs.DITTO_CONTENT_PREFIX) {
+		return "", false, nil
+	}
+	path, _, _ := strings.Cut(strings.TrimPrefix(urlStr, envs.DITTO_CONTENT_PREFIX), "?")
+	key, err = url.PathUnescape(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return "", true, fmt.Errorf("failed to parse object key: %w", err)
+	}
+	if userID == "" || !strings.HasPrefix(key, userID+"/") || slices.Contains(strings.Split(key, "/"), "..") {
+		return "", true, fmt.Errorf("%w: %s", ErrForbidden, key)
+	}
+	return key, true, nil
+}
+
 func checkAzureStillValid(urlStr string) (bool, error) {
 	parsedURL, err := url.Parse(urlStr)
 	if err != nil {
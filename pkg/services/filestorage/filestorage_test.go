@@ -0,0 +1,51 @@
+package filestorage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ditto-assistant/backend/cfg/envs"
+)
+
+func TestOpenImageForeignKey(t *testing.T) {
+	prefix := envs.DITTO_CONTENT_PREFIX
+	envs.DITTO_CONTENT_PREFIX = "https://content.example.com/"
+	defer func() { envs.DITTO_CONTENT_PREFIX = prefix }()
+
+	tests := []struct {
+		name    string
+		userID  string
+		url     string
+		key     string
+		ok      bool
+		wantErr error
+	}{
+		{name: "own image", userID: "alice", url: "https://content.example.com/alice/image.png?sig=abc", key: "alice/image.png", ok: true},
+		{name: "escaped key", userID: "alice", url: "https://content.example.com/alice/my%20image.png", key: "alice/my image.png", ok: true},
+		{name: "outside bucket", userID: "alice", url: "https://example.com/bob/image.png"},
+		{name: "foreign key", userID: "alice", url: "https://content.example.com/bob/image.png", ok: true, wantErr: ErrForbidden},
+		{name: "user ID prefix", userID: "alice", url: "https://content.example.com/alice2/image.png", ok: true, wantErr: ErrForbidden},
+		{name: "parent directory", userID: "alice", url: "https://content.example.com/alice/../bob/image.png", ok: true, wantErr: ErrForbidden},
+		{name: "escaped parent directory", userID: "alice", url: "https://content.example.com/alice/%2E%2E/bob/image.png", ok: true, wantErr: ErrForbidden},
+		{name: "no user", url: "https://content.example.com/alice/image.png", ok: true, wantErr: ErrForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok, err := contentKey(tt.userID, tt.url)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("contentKey() error = %v, want %v", err, tt.wantErr)
+			}
+			if ok != tt.ok || key != tt.key {
+				t.Errorf("contentKey() = %q, %v, want %q, %v", key, ok, tt.key, tt.ok)
+			}
+		})
+	}
+
+	// A foreign key is refused before the bucket is read.
+	var cl Client
+	_, ok, err := cl.OpenImage(context.Background(), "alice", "https://content.example.com/bob/image.png")
+	if !ok || !errors.Is(err, ErrForbidden) {
+		t.Errorf("OpenImage() = %v, %v, want true, ErrForbidden", ok, err)
+	}
+}
@@ -60,8 +60,10 @@ type Request struct {
 	Messages    []Message `json:"messages"`
 	Stream      bool      `json:"stream"`
 	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Temperature float64   `json:"temperature,omitempty"`
+	Temperature float64   `json:"temperature"`
 	TopP        float64   `json:"top_p,omitempty"`
+	Stop        []string  `json:"stop,omitempty"`
+	Seed        *int      `json:"seed,omitempty"`
 }
 
 type StreamResponse struct {
@@ -84,31 +86,36 @@ type StreamResponse struct {
 }
 
 func (s *Service) Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
-	if prompt.ImageURL != "" {
+	if prompt.HasImages() {
 		return errors.New("image input not supported for Cerebras models")
 	}
 	key, err := s.setupKey(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to setup api key: %w", err)
 	}
-	messages := make([]Message, 0, 2)
+	conv := prompt.Conversation()
+	messages := make([]Message, 0, len(conv)+1)
 	if prompt.SystemPrompt != "" {
 		messages = append(messages, Message{
 			Role:    "system",
 			Content: prompt.SystemPrompt,
 		})
 	}
-	messages = append(messages, Message{
-		Role:    "user",
-		Content: prompt.UserPrompt,
-	})
+	for _, m := range conv {
+		messages = append(messages, Message{
+			Role:    string(m.Role),
+			Content: m.Content,
+		})
+	}
 	req := Request{
 		Model:       string(prompt.Model),
 		Messages:    messages,
 		Stream:      true,
-		MaxTokens:   1024,
-		Temperature: 0.2,
-		TopP:        1.0,
+		MaxTokens:   prompt.MaxOutputTokensOr(1024),
+		Temperature: prompt.TemperatureOr(0.2),
+		TopP:        prompt.TopPOr(1.0),
+		Stop:        prompt.StopSequences,
+		Seed:        prompt.Seed,
 	}
 	var buf bytes.Buffer
 	err = json.NewEncoder(&buf).Encode(req)
@@ -149,7 +156,8 @@ func (s *Service) Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.Strea
 				if choice.Delta.Content != "" {
 					tokenChan <- llm.Token{Ok: choice.Delta.Content}
 				}
-				if choice.FinishReason == "stop" {
+				if choice.FinishReason != "" {
+					rsp.FinishReason = llm.OpenAIFinishReason(choice.FinishReason)
 					rsp.InputTokens = streamResp.Usage.PromptTokens
 					rsp.OutputTokens = streamResp.Usage.CompletionTokens
 				}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/ditto-assistant/backend/cfg/envs"
 	"github.com/ditto-assistant/backend/pkg/services/llm"
@@ -29,6 +30,21 @@ type Content struct {
 	Type   string            `json:"type"`
 	Text   string            `json:"text,omitempty"`
 	Source map[string]string `json:"source,omitempty"`
+
+	// tool_use fields
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result fields
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
 }
 
 type Request struct {
@@ -37,6 +53,11 @@ type Request struct {
 	Stream           bool      `json:"stream"`
 	AnthropicVersion string    `json:"anthropic_version"`
 	System           string    `json:"system,omitempty"`
+	Tools            []Tool    `json:"tools,omitempty"`
+	Temperature      *float64  `json:"temperature,omitempty"`
+	TopP             *float64  `json:"top_p,omitempty"`
+	TopK             *int      `json:"top_k,omitempty"`
+	StopSequences    []string  `json:"stop_sequences,omitempty"`
 }
 
 // event: message_start
@@ -70,23 +91,60 @@ type EvMsgStart struct {
 	} `json:"message"`
 }
 
+// event: content_block_start
+// data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_01T1x1fJ34qAmk2tNTrN7Up6","name":"get_weather","input":{}}}
+
+// event: content_block_delta
+// data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"location\": \"San Fra"}}
+
+type EvContentBlockStart struct {
+	Type         string `json:"type"`
+	Index        int    `json:"index"`
+	ContentBlock struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"content_block"`
+}
+
 type EvContentBlockDelta struct {
 	Type  string `json:"type"`
 	Index int    `json:"index"`
 	Delta struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
 	} `json:"delta"`
 }
 
+type EvContentBlockStop struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+}
+
 type EvMsgDelta struct {
 	Type  string `json:"type"`
+	Delta struct {
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
 	Usage struct {
 		OutputTokens int `json:"output_tokens"`
 	} `json:"usage"`
 }
 
-// TODO: Add Prompt options, such as message array, last message role is assistant, etc.
+// finishReason normalizes Claude's stop_reason.
+func finishReason(stopReason string) llm.FinishReason {
+	switch stopReason {
+	case "end_turn", "stop_sequence":
+		return llm.FinishStop
+	case "max_tokens":
+		return llm.FinishMaxTokens
+	case "tool_use":
+		return llm.FinishToolCalls
+	default:
+		return llm.FinishOther
+	}
+}
 
 func Prompt(ctx context.Context, bod rq.PromptV1, rsp *llm.StreamResponse) error {
 	switch bod.Model {
@@ -100,44 +158,28 @@ func Prompt(ctx context.Context, bod rq.PromptV1, rsp *llm.StreamResponse) error
 		bod.Model = llm.ModelClaude35SonnetV2_20241022
 	}
 	requestUrl = fmt.Sprintf(baseURL, envs.GCLOUD_PROJECT, bod.Model)
-	messages := make([]Message, 0, 1)
-	userContentCount := 1
-	if bod.ImageURL != "" {
-		userContentCount++
-	}
-	userMessage := Message{Role: "user", Content: make([]Content, 0, userContentCount)}
-	if bod.ImageURL != "" {
-		imageData, err := img.GetImageData(ctx, bod.ImageURL)
-		if err != nil {
-			return fmt.Errorf("error getting image data: %w", err)
-		}
-		userMessage.Content = append(userMessage.Content, Content{
-			Type: "image",
-			Source: map[string]string{
-				"type":       "base64",
-				"media_type": imageData.MimeType,
-				"data":       imageData.Base64,
-			},
-		})
-	}
-	userMessage.Content = append(userMessage.Content, Content{
-		Type: "text",
-		Text: bod.UserPrompt,
-	})
-	messages = append(messages, userMessage)
+	messages, err := buildMessages(ctx, bod.UserID, bod.Conversation())
+	if err != nil {
+		return err
+	}
 	maxTokens := 8192
 	if bod.Model == llm.ModelClaude3Haiku || bod.Model == llm.ModelClaude3Haiku_20240307 {
 		maxTokens = 4096
 	}
 	req := Request{
 		Messages:         messages,
-		MaxTokens:        maxTokens,
+		MaxTokens:        bod.MaxOutputTokensOr(maxTokens),
 		Stream:           true,
 		AnthropicVersion: "vertex-2023-10-16",
 		System:           bod.SystemPrompt,
+		Tools:            buildTools(bod.Tools),
+		Temperature:      bod.Temperature,
+		TopP:             bod.TopP,
+		TopK:             bod.TopK,
+		StopSequences:    bod.StopSequences,
 	}
 	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(req)
+	err = json.NewEncoder(&buf).Encode(req)
 	if err != nil {
 		return fmt.Errorf("error encoding request: %w", err)
 	}
@@ -179,6 +221,8 @@ func Prompt(ctx context.Context, bod rq.PromptV1, rsp *llm.StreamResponse) error
 		defer resp.Body.Close()
 		defer close(tokenChan)
 
+		// Tool calls stream their input as partial JSON, keyed by content block index.
+		toolCalls := make(map[int]*toolCall)
 		scanner := bufio.NewScanner(resp.Body)
 		for scanner.Scan() {
 			line := scanner.Bytes()
@@ -188,7 +232,7 @@ func Prompt(ctx context.Context, bod rq.PromptV1, rsp *llm.StreamResponse) error
 
 			eventType := string(bytes.TrimPrefix(line, eventPrefix))
 			switch eventType {
-			case "message_start", "content_block_delta", "message_delta":
+			case "message_start", "content_block_start", "content_block_delta", "content_block_stop", "message_delta":
 				if !scanner.Scan() {
 					tokenChan <- llm.Token{Err: fmt.Errorf("unexpected end of stream after event: %s", eventType)}
 					return
@@ -210,14 +254,44 @@ func Prompt(ctx context.Context, bod rq.PromptV1, rsp *llm.StreamResponse) error
 					rsp.InputTokens += msgStart.Message.Usage.InputTokens
 					rsp.OutputTokens += msgStart.Message.Usage.OutputTokens
 
+				case "content_block_start":
+					var blockStart EvContentBlockStart
+					if err := json.Unmarshal(data, &blockStart); err != nil {
+						tokenChan <- llm.Token{Err: fmt.Errorf("error parsing content_block_start event: %w", err)}
+						return
+					}
+					if blockStart.ContentBlock.Type == "tool_use" {
+						toolCalls[blockStart.Index] = &toolCall{
+							id:   blockStart.ContentBlock.ID,
+							name: blockStart.ContentBlock.Name,
+						}
+					}
+
 				case "content_block_delta":
 					var contentDelta EvContentBlockDelta
 					if err := json.Unmarshal(data, &contentDelta); err != nil {
 						tokenChan <- llm.Token{Err: fmt.Errorf("error parsing content_block_delta event: %w", err)}
 						return
 					}
+					if contentDelta.Delta.Type == "input_json_delta" {
+						if tc, ok := toolCalls[contentDelta.Index]; ok {
+							tc.input.WriteString(contentDelta.Delta.PartialJSON)
+						}
+						continue
+					}
 					tokenChan <- llm.Token{Ok: contentDelta.Delta.Text}
 
+				case "content_block_stop":
+					var blockStop EvContentBlockStop
+					if err := json.Unmarshal(data, &blockStop); err != nil {
+						tokenChan <- llm.Token{Err: fmt.Errorf("error parsing content_block_stop event: %w", err)}
+						return
+					}
+					if tc, ok := toolCalls[blockStop.Index]; ok {
+						rsp.ToolCalls = append(rsp.ToolCalls, tc.result())
+						delete(toolCalls, blockStop.Index)
+					}
+
 				case "message_delta":
 					var msgDelta EvMsgDelta
 					if err := json.Unmarshal(data, &msgDelta); err != nil {
@@ -225,6 +299,9 @@ func Prompt(ctx context.Context, bod rq.PromptV1, rsp *llm.StreamResponse) error
 						return
 					}
 					rsp.OutputTokens += msgDelta.Usage.OutputTokens
+					if msgDelta.Delta.StopReason != "" {
+						rsp.FinishReason = finishReason(msgDelta.Delta.StopReason)
+					}
 				}
 
 			default:
@@ -241,5 +318,87 @@ func Prompt(ctx context.Context, bod rq.PromptV1, rsp *llm.StreamResponse) error
 	return nil
 }
 
+type toolCall struct {
+	id, name string
+	input    strings.Builder
+}
+
+func (tc *toolCall) result() llm.ToolCall {
+	input := tc.input.String()
+	if input == "" {
+		input = "{}"
+	}
+	return llm.ToolCall{ID: tc.id, Name: tc.name, Arguments: json.RawMessage(input)}
+}
+
+func buildTools(tools []rq.Tool) []Tool {
+	if len(tools) == 0 {
+		return nil
+	}
+	out := make([]Tool, len(tools))
+	for i, t := range tools {
+		out[i] = Tool{Name: t.Name, Description: t.Description, InputSchema: t.Schema()}
+	}
+	return out
+}
+
+// Claude accepts images of up to 5 MB, and scales down any with a side
+// longer than 1568 pixels, so larger images are scaled down before sending.
+const (
+	maxImageBytes     = 5 << 20
+	maxImageDimension = 1568
+)
+
+// buildMessages converts the conversation to Claude messages.
+// Images and tool results are placed before the text of their message,
+// and tool calls after it.
+// If the last message is from the assistant, Claude continues it.
+// Images in the content bucket are only read from the user's folder.
+func buildMessages(ctx context.Context, userID string, conv []rq.Message) ([]Message, error) {
+	images, err := img.GetAll(ctx, rq.ImageURLs(conv), img.WithUserID(userID),
+		img.WithMaxBytes(maxImageBytes), img.WithDownscale(maxImageDimension))
+	if err != nil {
+		return nil, fmt.Errorf("error getting image data: %w", err)
+	}
+	messages := make([]Message, 0, len(conv))
+	for _, m := range conv {
+		msg := Message{Role: string(m.Role), Content: make([]Content, 0, len(m.Images)+len(m.ToolResults)+len(m.ToolCalls)+1)}
+		for _, tr := range m.ToolResults {
+			msg.Content = append(msg.Content, Content{
+				Type:      "tool_result",
+				ToolUseID: tr.ToolCallID,
+				Content:   tr.Content,
+			})
+		}
+		for _, url := range m.Images {
+			imageData := images[url]
+			msg.Content = append(msg.Content, Content{
+				Type: "image",
+				Source: map[string]string{
+					"type":       "base64",
+					"media_type": imageData.MimeType,
+					"data":       imageData.Base64,
+				},
+			})
+		}
+		if m.Content != "" {
+			msg.Content = append(msg.Content, Content{
+				Type: "text",
+				Text: m.Content,
+			})
+		}
+		for _, tc := range m.ToolCalls {
+			msg.Content = append(msg.Content, Content{
+				Type:  "tool_use",
+				ID:    tc.ID,
+				Name:  tc.Name,
+				Input: tc.Arguments,
+			})
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
 var dataPrefix = []byte("data: ")
 var eventPrefix = []byte("event: ")
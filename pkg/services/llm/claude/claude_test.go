@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/ditto-assistant/backend/pkg/services/llm"
@@ -142,3 +143,31 @@ func TestImage(t *testing.T) {
 		})
 	}
 }
+
+func TestConversation(t *testing.T) {
+	ctx := context.Background()
+	var rsp llm.StreamResponse
+	err := claude.Prompt(ctx, rq.PromptV1{
+		Model: llm.ModelClaude35Haiku,
+		Messages: []rq.Message{
+			{Role: rq.RoleUser, Content: "My name is Hat. Remember it."},
+			{Role: rq.RoleAssistant, Content: "Got it, Hat."},
+		},
+		UserPrompt: "What is my name? Respond with only the name.",
+	}, &rsp)
+	if err != nil {
+		t.Fatalf("Error calling Prompt: %v", err)
+	}
+
+	var b strings.Builder
+	for token := range rsp.Text {
+		if token.Err != nil {
+			t.Fatalf("Error in response: %v", token.Err)
+		}
+		b.WriteString(token.Ok)
+	}
+	if !strings.Contains(b.String(), "Hat") {
+		t.Fatalf("expected response to contain Hat, got: %s", b.String())
+	}
+	t.Logf("InputTokens: %d, OutputTokens: %d", rsp.InputTokens, rsp.OutputTokens)
+}
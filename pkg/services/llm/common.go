@@ -2,6 +2,7 @@ package llm
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,10 +15,59 @@ type StreamResponse struct {
 	Text         <-chan Token
 	InputTokens  int
 	OutputTokens int
+	// Model is the model that served the response.
+	// It differs from the requested model if a fallback was used.
+	Model ServiceName
+	// ToolCalls are the tools the model asked to call.
+	// Like the token counts, they are set before Text is closed.
+	ToolCalls []ToolCall
+	// FinishReason is why the model stopped generating.
+	FinishReason FinishReason
+}
+
+// FinishReason is why a model stopped generating, normalized across providers.
+type FinishReason string
+
+const (
+	FinishStop          FinishReason = "stop"
+	FinishMaxTokens     FinishReason = "max_tokens"
+	FinishToolCalls     FinishReason = "tool_calls"
+	FinishContentFilter FinishReason = "content_filter"
+	FinishOther         FinishReason = "other"
+)
+
+// MaxJSONAttempts is the most times a model is prompted for a response
+// that matches a response schema, so such a prompt may cost that many calls.
+const MaxJSONAttempts = 3
+
+// OpenAIFinishReason normalizes an OpenAI-compatible finish_reason,
+// as returned by OpenAI, Mistral, Cerebras and Llama on Vertex AI.
+func OpenAIFinishReason(reason string) FinishReason {
+	switch reason {
+	case "stop":
+		return FinishStop
+	case "length", "model_length":
+		return FinishMaxTokens
+	case "tool_calls", "function_call":
+		return FinishToolCalls
+	case "content_filter":
+		return FinishContentFilter
+	default:
+		return FinishOther
+	}
 }
 
 type Token = ty.Result[string]
 
+// ToolCall is a model's request to call a tool.
+type ToolCall struct {
+	// ID links the call to its result in the next turn.
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Arguments is a JSON object matching the tool's parameters.
+	Arguments json.RawMessage `json:"arguments"`
+}
+
 func GetAccessToken(ctx context.Context) (string, error) {
 	tokenSource, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
 	if err != nil {
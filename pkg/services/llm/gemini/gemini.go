@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"slices"
 
 	"github.com/ditto-assistant/backend/cfg/envs"
 	"github.com/ditto-assistant/backend/pkg/services/llm"
@@ -44,8 +45,30 @@ func init() {
 }
 
 type Part struct {
-	Text       string      `json:"text,omitempty"`
-	InlineData *InlineData `json:"inlineData,omitempty"`
+	Text             string            `json:"text,omitempty"`
+	InlineData       *InlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type FunctionCall struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type FunctionResponse struct {
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type Tool struct {
+	FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations"`
+}
+
+type FunctionDeclaration struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
 }
 
 type InlineData struct {
@@ -63,13 +86,19 @@ type Request struct {
 	GenerationConfig  GenerationConfig `json:"generationConfig,omitempty"`
 	SafetySettings    []SafetySetting  `json:"safetySettings,omitempty"`
 	SystemInstruction *Content         `json:"systemInstruction,omitempty"`
+	Tools             []Tool           `json:"tools,omitempty"`
 }
 
 type GenerationConfig struct {
-	Temperature     float64 `json:"temperature,omitempty"`
-	TopP            float64 `json:"topP,omitempty"`
-	TopK            int     `json:"topK,omitempty"`
-	MaxOutputTokens int     `json:"maxOutputTokens,omitempty"`
+	Temperature     float64  `json:"temperature"`
+	TopP            float64  `json:"topP,omitempty"`
+	TopK            int      `json:"topK,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+	Seed            *int     `json:"seed,omitempty"`
+	// ResponseMimeType is "application/json" when ResponseSchema is set.
+	ResponseMimeType string          `json:"responseMimeType,omitempty"`
+	ResponseSchema   json.RawMessage `json:"responseSchema,omitempty"`
 }
 
 type SafetySetting struct {
@@ -104,9 +133,22 @@ type SafetyRating struct {
 	SeverityScore    float64 `json:"severityScore"`
 }
 
+// finishReason normalizes Gemini's FinishReason.
+func finishReason(reason string) llm.FinishReason {
+	switch reason {
+	case "STOP":
+		return llm.FinishStop
+	case "MAX_TOKENS":
+		return llm.FinishMaxTokens
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return llm.FinishContentFilter
+	default:
+		return llm.FinishOther
+	}
+}
+
 func (m Model) Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
 	requestURL = fmt.Sprintf(baseURL, envs.GCLOUD_PROJECT, m)
-	contents := []Content{}
 
 	// Handle system instruction as a Content type
 	var systemInstruction *Content
@@ -117,34 +159,23 @@ func (m Model) Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamRe
 		}
 	}
 
-	// Add user prompt to contents
-	contents = append(contents, Content{
-		Role:  "user",
-		Parts: []Part{{Text: prompt.UserPrompt}},
-	})
-
-	if prompt.ImageURL != "" {
-		imageData, err := img.GetImageData(ctx, prompt.ImageURL)
-		if err != nil {
-			return fmt.Errorf("error getting image data: %w", err)
-		}
-		contents[len(contents)-1].Parts = append(contents[len(contents)-1].Parts, Part{
-			InlineData: &InlineData{
-				MimeType: imageData.MimeType,
-				Data:     imageData.Base64,
-			},
-		})
+	contents, err := buildContents(ctx, prompt.UserID, prompt.Conversation())
+	if err != nil {
+		return err
 	}
 
 	req := Request{
 		Contents: contents,
 		GenerationConfig: GenerationConfig{
-			Temperature:     0.95, // Increased for more creativity
-			TopK:            40,   // Increased for more diverse options
-			TopP:            0.95, // Slightly reduced for more focused yet creative responses
-			MaxOutputTokens: 8192,
+			Temperature:     prompt.TemperatureOr(0.95), // Increased for more creativity
+			TopK:            prompt.TopKOr(40),          // Increased for more diverse options
+			TopP:            prompt.TopPOr(0.95),        // Slightly reduced for more focused yet creative responses
+			MaxOutputTokens: prompt.MaxOutputTokensOr(8192),
+			StopSequences:   prompt.StopSequences,
+			Seed:            prompt.Seed,
 		},
 		SystemInstruction: systemInstruction,
+		Tools:             buildTools(prompt.Tools),
 		SafetySettings: []SafetySetting{
 			{
 				Category:  "HARM_CATEGORY_DANGEROUS_CONTENT",
@@ -153,8 +184,17 @@ func (m Model) Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamRe
 		},
 	}
 
+	if len(prompt.ResponseSchema) > 0 {
+		schema, err := responseSchema(prompt.ResponseSchema)
+		if err != nil {
+			return fmt.Errorf("error converting response schema: %w", err)
+		}
+		req.GenerationConfig.ResponseMimeType = "application/json"
+		req.GenerationConfig.ResponseSchema = schema
+	}
+
 	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(req)
+	err = json.NewEncoder(&buf).Encode(req)
 	if err != nil {
 		return fmt.Errorf("error encoding request: %w", err)
 	}
@@ -191,10 +231,25 @@ func (m Model) Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamRe
 			// slog.Debug("Decoded response", "response", response)
 
 			for _, candidate := range response.Candidates {
+				if candidate.FinishReason != "" {
+					rsp.FinishReason = finishReason(candidate.FinishReason)
+				}
 				for _, part := range candidate.Content.Parts {
 					if part.Text != "" {
 						tokenChan <- llm.Token{Ok: part.Text}
 					}
+					if fc := part.FunctionCall; fc != nil {
+						// Gemini doesn't assign call IDs; results are matched by name.
+						args := fc.Args
+						if len(args) == 0 {
+							args = json.RawMessage("{}")
+						}
+						rsp.ToolCalls = append(rsp.ToolCalls, llm.ToolCall{
+							ID:        fmt.Sprintf("call_%d", len(rsp.ToolCalls)),
+							Name:      fc.Name,
+							Arguments: args,
+						})
+					}
 				}
 			}
 
@@ -213,11 +268,150 @@ func (m Model) Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamRe
 
 		rsp.InputTokens = totalInputTokens
 		rsp.OutputTokens = totalOutputTokens
+		// Gemini stops with STOP after function calls.
+		if rsp.FinishReason == llm.FinishStop && len(rsp.ToolCalls) > 0 {
+			rsp.FinishReason = llm.FinishToolCalls
+		}
 	}()
 
 	return nil
 }
 
+func buildTools(tools []rq.Tool) []Tool {
+	if len(tools) == 0 {
+		return nil
+	}
+	decls := make([]FunctionDeclaration, len(tools))
+	for i, t := range tools {
+		decls[i] = FunctionDeclaration{Name: t.Name, Description: t.Description, Parameters: t.Schema()}
+	}
+	return []Tool{{FunctionDeclarations: decls}}
+}
+
+// responseSchema converts a JSON Schema to the OpenAPI subset Gemini accepts.
+// Nullable type lists, such as ["string", "null"], and null branches of anyOf
+// become nullable types, and keywords Gemini rejects, such as additionalProperties, are removed.
+func responseSchema(raw json.RawMessage) (json.RawMessage, error) {
+	var schema map[string]any
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, err
+	}
+	toOpenAPI(schema)
+	return json.Marshal(schema)
+}
+
+func toOpenAPI(schema map[string]any) {
+	delete(schema, "$schema")
+	delete(schema, "additionalProperties")
+	if types, ok := schema["type"].([]any); ok {
+		var rest []any
+		for _, t := range types {
+			if t == "null" {
+				schema["nullable"] = true
+			} else {
+				rest = append(rest, t)
+			}
+		}
+		if len(rest) == 1 {
+			schema["type"] = rest[0]
+		} else {
+			schema["type"] = rest
+		}
+	}
+	if props, ok := schema["properties"].(map[string]any); ok {
+		for _, p := range props {
+			if ps, ok := p.(map[string]any); ok {
+				toOpenAPI(ps)
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		toOpenAPI(items)
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		// Gemini has no null type, so a null branch makes the value nullable.
+		branches := make([]any, 0, len(anyOf))
+		for _, sub := range anyOf {
+			ss, ok := sub.(map[string]any)
+			if !ok {
+				branches = append(branches, sub)
+				continue
+			}
+			if isNullType(ss["type"]) {
+				schema["nullable"] = true
+				continue
+			}
+			toOpenAPI(ss)
+			branches = append(branches, ss)
+		}
+		schema["anyOf"] = branches
+	}
+}
+
+// isNullType reports whether a schema's type is only null.
+func isNullType(typ any) bool {
+	switch t := typ.(type) {
+	case string:
+		return t == "null"
+	case []any:
+		return len(t) > 0 && !slices.ContainsFunc(t, func(v any) bool { return v != "null" })
+	}
+	return false
+}
+
+// Vertex AI accepts inline images of up to 7 MB.
+// Larger images, or those with a side longer than 3072 pixels, are scaled down.
+const (
+	maxImageBytes     = 7 << 20
+	maxImageDimension = 3072
+)
+
+// buildContents converts the conversation to Gemini contents.
+// Gemini calls the assistant role "model".
+// Images in the content bucket are only read from the user's folder.
+func buildContents(ctx context.Context, userID string, conv []rq.Message) ([]Content, error) {
+	images, err := img.GetAll(ctx, rq.ImageURLs(conv), img.WithUserID(userID),
+		img.WithMaxBytes(maxImageBytes), img.WithDownscale(maxImageDimension))
+	if err != nil {
+		return nil, fmt.Errorf("error getting image data: %w", err)
+	}
+	contents := make([]Content, 0, len(conv))
+	for _, m := range conv {
+		role := "user"
+		if m.Role == rq.RoleAssistant {
+			role = "model"
+		}
+		c := Content{Role: role, Parts: make([]Part, 0, len(m.Images)+len(m.ToolResults)+len(m.ToolCalls)+1)}
+		for _, tr := range m.ToolResults {
+			c.Parts = append(c.Parts, Part{
+				FunctionResponse: &FunctionResponse{
+					Name:     tr.Name,
+					Response: map[string]any{"content": tr.Content},
+				},
+			})
+		}
+		if m.Content != "" {
+			c.Parts = append(c.Parts, Part{Text: m.Content})
+		}
+		for _, tc := range m.ToolCalls {
+			c.Parts = append(c.Parts, Part{
+				FunctionCall: &FunctionCall{Name: tc.Name, Args: tc.Arguments},
+			})
+		}
+		for _, url := range m.Images {
+			imageData := images[url]
+			c.Parts = append(c.Parts, Part{
+				InlineData: &InlineData{
+					MimeType: imageData.MimeType,
+					Data:     imageData.Base64,
+				},
+			})
+		}
+		contents = append(contents, c)
+	}
+	return contents, nil
+}
+
 // Helper function to get raw JSON for debugging
 func debugGetRawJSON(decoder *json.Decoder) string {
 	var raw json.RawMessage
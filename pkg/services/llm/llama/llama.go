@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/ditto-assistant/backend/cfg/envs"
@@ -61,6 +62,8 @@ type Request struct {
 	TopK        int       `json:"top_k"`
 	TopP        float64   `json:"top_p"`
 	N           int       `json:"n"`
+	Stop        []string  `json:"stop,omitempty"`
+	Seed        *int      `json:"seed,omitempty"`
 }
 
 type StreamResponse struct {
@@ -90,17 +93,17 @@ func init() {
 	requestURL = fmt.Sprintf(baseURL, region, envs.GCLOUD_PROJECT, region)
 }
 
-func ModelCompat(model llm.ServiceName, imageURL string) (llm.ServiceName, error) {
+func ModelCompat(model llm.ServiceName, hasImages bool) (llm.ServiceName, error) {
 	switch model {
 	case llm.ModelLlama32:
-		if imageURL != "" {
+		if hasImages {
 			// Allow the user to use gpt-4o-mini for image understanding for now, as llama32 is broken
 			return llm.ModelGPT4oMini, nil
 		} else {
 			return llm.ModelLlama33_70bInstruct, nil // free text only model
 		}
 	case llm.ModelLlama33_70bInstruct:
-		if imageURL != "" {
+		if hasImages {
 			return "", errors.New("llama 3.3 70b instruct does not support images")
 		}
 		return model, nil
@@ -109,14 +112,22 @@ func ModelCompat(model llm.ServiceName, imageURL string) (llm.ServiceName, error
 	}
 }
 
+// Llama vision models see images at up to 1120 pixels a side,
+// so larger images are scaled down before sending.
+const (
+	maxImageBytes     = 10 << 20
+	maxImageDimension = 1120
+)
+
 func Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
-	if prompt.Model == llm.ModelLlama33_70bInstruct && prompt.ImageURL != "" {
+	if prompt.Model == llm.ModelLlama33_70bInstruct && prompt.HasImages() {
 		return errors.New("llama 3.3 70b instruct does not support images")
 	}
-	messages := make([]Message, 0, 2)
+	conv := prompt.Conversation()
+	messages := make([]Message, 0, len(conv)+1)
 	if prompt.SystemPrompt != "" {
 		// Llama 3.2 does not support system prompts if there is an image.
-		if prompt.ImageURL == "" {
+		if !prompt.HasImages() {
 			messages = append(messages, Message{
 				Role: "system",
 				Content: []Content{{
@@ -124,56 +135,62 @@ func Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) er
 					Text: prompt.SystemPrompt,
 				}},
 			})
-		} else {
-			prompt.UserPrompt = prompt.SystemPrompt + "\n\n" + prompt.UserPrompt
+		} else if len(conv) > 0 {
+			conv = slices.Clone(conv)
+			conv[0].Content = prompt.SystemPrompt + "\n\n" + conv[0].Content
 		}
 	}
 
-	contents := []Content{{
-		Type: "text",
-		Text: prompt.UserPrompt,
-	}}
-
-	if prompt.ImageURL != "" {
-		imageData, err := img.GetImageData(ctx, prompt.ImageURL)
-		if err != nil {
-			return fmt.Errorf("error getting image data: %w", err)
+	images, err := img.GetAll(ctx, rq.ImageURLs(conv), img.WithUserID(prompt.UserID),
+		img.WithMaxBytes(maxImageBytes), img.WithDownscale(maxImageDimension))
+	if err != nil {
+		return fmt.Errorf("error getting image data: %w", err)
+	}
+	for _, m := range conv {
+		contents := make([]Content, 0, len(m.Images)+1)
+		for _, url := range m.Images {
+			imageData := images[url]
+
+			// Create a data URL from the base64 data
+			var b strings.Builder
+			b.Grow(len(imageData.Base64) + len(imageData.MimeType) + 13)
+			b.WriteString("data:")
+			b.WriteString(imageData.MimeType)
+			b.WriteString(";base64,")
+			b.WriteString(imageData.Base64)
+			dataURL := b.String()
+
+			contents = append(contents, Content{
+				Type: "image_url",
+				ImageURL: &ImageURL{
+					URL: dataURL,
+				},
+			})
 		}
-
-		// Create a data URL from the base64 data
-		var b strings.Builder
-		b.Grow(len(imageData.Base64) + len(imageData.MimeType) + 13)
-		b.WriteString("data:")
-		b.WriteString(imageData.MimeType)
-		b.WriteString(";base64,")
-		b.WriteString(imageData.Base64)
-		dataURL := b.String()
-
-		contents = append([]Content{{
-			Type: "image_url",
-			ImageURL: &ImageURL{
-				URL: dataURL,
-			},
-		}}, contents...)
+		contents = append(contents, Content{
+			Type: "text",
+			Text: m.Content,
+		})
+		messages = append(messages, Message{
+			Role:    string(m.Role),
+			Content: contents,
+		})
 	}
-
-	messages = append(messages, Message{
-		Role:    "user",
-		Content: contents,
-	})
 	req := Request{
 		Model:       "meta/llama-3.3-70b-instruct-maas",
 		Messages:    messages,
 		Stream:      true,
-		MaxTokens:   8192,
-		Temperature: 0.7,
-		TopK:        10,
-		TopP:        0.95,
+		MaxTokens:   prompt.MaxOutputTokensOr(8192),
+		Temperature: prompt.TemperatureOr(0.7),
+		TopK:        prompt.TopKOr(10),
+		TopP:        prompt.TopPOr(0.95),
 		N:           1,
+		Stop:        prompt.StopSequences,
+		Seed:        prompt.Seed,
 	}
 
 	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(req)
+	err = json.NewEncoder(&buf).Encode(req)
 	if err != nil {
 		return fmt.Errorf("error encoding request: %w", err)
 	}
@@ -211,7 +228,8 @@ func Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) er
 				if choice.Delta.Content != "" {
 					tokenChan <- llm.Token{Ok: choice.Delta.Content}
 				}
-				if choice.FinishReason == "stop" {
+				if choice.FinishReason != "" {
+					rsp.FinishReason = llm.OpenAIFinishReason(choice.FinishReason)
 					rsp.InputTokens = streamResp.Usage.PromptTokens
 					rsp.OutputTokens = streamResp.Usage.CompletionTokens
 				}
@@ -49,6 +49,10 @@ type Request struct {
 	Model       string    `json:"model"`
 	Messages    []Message `json:"messages"`
 	Temperature float64   `json:"temperature"`
+	TopP        float64   `json:"top_p,omitempty"`
+	MaxTokens   int       `json:"max_tokens,omitempty"`
+	Stop        []string  `json:"stop,omitempty"`
+	RandomSeed  *int      `json:"random_seed,omitempty"`
 	Stream      bool      `json:"stream"`
 }
 
@@ -80,20 +84,26 @@ func init() {
 
 func Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
 	requestURL = fmt.Sprintf(baseURL, region, envs.GCLOUD_PROJECT, region, prompt.Model, Version)
-	messages := make([]Message, 0, 2)
+	if prompt.HasImages() {
+		return fmt.Errorf("image not supported")
+	}
+	conv := prompt.Conversation()
+	messages := make([]Message, 0, len(conv)+1)
 	if prompt.SystemPrompt != "" {
-		messages = append([]Message{{Role: "system", Content: prompt.SystemPrompt}}, messages...)
+		messages = append(messages, Message{Role: "system", Content: prompt.SystemPrompt})
 	}
-	messages = append(messages, Message{Role: "user", Content: prompt.UserPrompt})
-
-	if prompt.ImageURL != "" {
-		return fmt.Errorf("image not supported")
+	for _, m := range conv {
+		messages = append(messages, Message{Role: string(m.Role), Content: m.Content})
 	}
 
 	req := Request{
 		Model:       string(prompt.Model),
 		Messages:    messages,
-		Temperature: 0.7,
+		Temperature: prompt.TemperatureOr(0.7),
+		TopP:        prompt.TopPOr(0),
+		MaxTokens:   prompt.MaxOutputTokens,
+		Stop:        prompt.StopSequences,
+		RandomSeed:  prompt.Seed,
 		Stream:      true,
 	}
 
@@ -160,7 +170,8 @@ func Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) er
 				if choice.Delta.Content != "" {
 					tokenChan <- llm.Token{Ok: choice.Delta.Content}
 				}
-				if choice.FinishReason == "stop" {
+				if choice.FinishReason != "" {
+					rsp.FinishReason = llm.OpenAIFinishReason(choice.FinishReason)
 					rsp.InputTokens = streamResp.Usage.PromptTokens
 					rsp.OutputTokens = streamResp.Usage.CompletionTokens
 				}
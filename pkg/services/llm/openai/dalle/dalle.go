@@ -75,8 +75,9 @@ type ReqDalle struct {
 	Style string `json:"style,omitempty"`
 }
 
-// Prompt sends an image generation request to DALL-E
-func (c *Client) Prompt(ctx context.Context, r *rq.GenerateImageV1) (string, error) {
+// newRequest builds the DALL-E request for r, returning the model
+// variant for its size and quality, which its receipt is priced on.
+func newRequest(r rq.GenerateImageV1) (ReqDalle, llm.ServiceName, error) {
 	req := ReqDalle{
 		Prompt: r.Prompt,
 		Model:  r.Model,
@@ -84,11 +85,28 @@ func (c *Client) Prompt(ctx context.Context, r *rq.GenerateImageV1) (string, err
 		Width:  r.Width,
 		Height: r.Height,
 	}
-	var err error
-	r.Model, err = req.Build()
+	receiptModel, err := req.Build()
 	if err != nil {
-		return "", fmt.Errorf("validation error: %w", err)
+		return ReqDalle{}, "", fmt.Errorf("validation error: %w", err)
+	}
+	return req, receiptModel, nil
+}
+
+// ReceiptModel returns the model variant the image's receipt is priced on,
+// such as dall-e-3-wide, as Prompt sets it.
+func ReceiptModel(r rq.GenerateImageV1) (llm.ServiceName, error) {
+	_, receiptModel, err := newRequest(r)
+	return receiptModel, err
+}
+
+// Prompt sends an image generation request to DALL-E.
+// It sets r.Model to the model variant the image's receipt is priced on.
+func (c *Client) Prompt(ctx context.Context, r *rq.GenerateImageV1) (string, error) {
+	req, receiptModel, err := newRequest(*r)
+	if err != nil {
+		return "", err
 	}
+	r.Model = receiptModel
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(req); err != nil {
 		return "", fmt.Errorf("failed to encode request: %w", err)
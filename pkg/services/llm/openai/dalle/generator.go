@@ -0,0 +1,72 @@
+package dalle
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/users"
+	"github.com/ditto-assistant/backend/types/rq"
+	"github.com/ditto-assistant/backend/types/ty"
+)
+
+// ImageStore saves generated images to a user's folder.
+type ImageStore interface {
+	SaveGeneratedImage(ctx context.Context, userID, urlStr string) (key string, err error)
+}
+
+// Generator generates images for users and bills each with a receipt.
+type Generator struct {
+	client *Client
+	store  ImageStore
+	sd     ty.ShutdownContext
+}
+
+func NewGenerator(client *Client, store ImageStore, sd ty.ShutdownContext) *Generator {
+	return &Generator{client: client, store: store, sd: sd}
+}
+
+// Generate holds the cost of the image, generates it and returns its URL and
+// what the user was charged for it. The image's receipt settles the hold once
+// it is generated, and the image is saved to the user's folder in the background.
+// It returns db.ErrInsufficientBalance or db.ErrLimitExceeded if the user
+// cannot pay for the image.
+func (g *Generator) Generate(ctx context.Context, user users.User, req *rq.GenerateImageV1) (string, int64, error) {
+	// The hold is placed on the variant for the image's size and quality,
+	// which its receipt is priced on.
+	model, err := ReceiptModel(*req)
+	if err != nil {
+		return "", 0, err
+	}
+	hold, err := db.HoldReceipt(ctx, db.Receipt{UserID: user.ID, ServiceName: model, NumImages: 1})
+	if err != nil {
+		return "", 0, err
+	}
+	url, err := g.client.Prompt(ctx, req)
+	if err != nil {
+		hold.ReleaseLogged(ctx)
+		return "", 0, err
+	}
+	slog.Debug("image receipt", "url", url)
+	receipt := db.Receipt{
+		UserID:      user.ID,
+		NumImages:   1,
+		ServiceName: req.Model,
+		HoldID:      hold.ID,
+	}
+	// The image is charged even if the client has disconnected.
+	if err := receipt.Save(context.WithoutCancel(ctx)); err != nil {
+		// The receipt could not be queued either, so nothing will settle the hold.
+		slog.Error("failed to insert receipt", "error", err)
+		hold.ReleaseLogged(ctx)
+	}
+	g.sd.Run(func(ctx context.Context) {
+		key, err := g.store.SaveGeneratedImage(ctx, user.UID, url)
+		if err != nil {
+			slog.Error("failed to save generated image", "userID", user.UID, "error", err)
+			return
+		}
+		slog.Debug("uploaded image to S3", "key", key)
+	})
+	return url, receipt.DittoTokenCost, nil
+}
@@ -0,0 +1,103 @@
+package dalle_test
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/dbtest"
+	"github.com/ditto-assistant/backend/pkg/services/db/users"
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/pkg/services/llm/openai/dalle"
+	"github.com/ditto-assistant/backend/types/rq"
+	"github.com/ditto-assistant/backend/types/ty"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOpenAI answers every request with an image URL, counting them.
+type fakeOpenAI struct {
+	requests int
+}
+
+func (f *fakeOpenAI) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.requests++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"data":[{"url":"https://images.example.com/image.png"}]}`)),
+		Request:    req,
+	}, nil
+}
+
+type fakeStore struct{}
+
+func (fakeStore) SaveGeneratedImage(ctx context.Context, userID, urlStr string) (string, error) {
+	return userID + "/generated-images/image.png", nil
+}
+
+func newGenerator(t *testing.T) (*dalle.Generator, *fakeOpenAI, *sync.WaitGroup) {
+	t.Helper()
+	api := &fakeOpenAI{}
+	var wg sync.WaitGroup
+	sd := ty.ShutdownContext{Background: context.Background(), WaitGroup: &wg, ShutdownDuration: time.Minute}
+	client := dalle.NewClient("test-key", &http.Client{Transport: api})
+	return dalle.NewGenerator(client, fakeStore{}, sd), api, &wg
+}
+
+func newUser(t *testing.T, balance int64) users.User {
+	t.Helper()
+	user := users.User{UID: rand.Text()}
+	res, err := db.D.ExecContext(context.Background(),
+		"INSERT INTO users (uid, balance) VALUES (?, ?)", user.UID, balance)
+	require.NoError(t, err)
+	user.ID, err = res.LastInsertId()
+	require.NoError(t, err)
+	return user
+}
+
+func balance(t *testing.T, userID int64) int64 {
+	t.Helper()
+	var balance int64
+	err := db.D.QueryRowContext(context.Background(), "SELECT balance FROM users WHERE id = ?", userID).Scan(&balance)
+	require.NoError(t, err)
+	return balance
+}
+
+func TestGenerateHoldsSizeVariant(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	standard, err := db.EstimateCost(ctx, db.Receipt{ServiceName: llm.ModelDalle3, NumImages: 1})
+	require.NoError(t, err)
+	wide, err := db.EstimateCost(ctx, db.Receipt{ServiceName: llm.ModelDalle3Wide, NumImages: 1})
+	require.NoError(t, err)
+	require.Greater(t, wide, standard)
+
+	t.Run("cannot cover the variant", func(t *testing.T) {
+		gen, api, _ := newGenerator(t)
+		user := newUser(t, standard)
+		_, _, err := gen.Generate(ctx, user, &rq.GenerateImageV1{Prompt: "a lighthouse", Model: llm.ModelDalle3, Size: "1792x1024"})
+		assert.ErrorIs(t, err, db.ErrInsufficientBalance)
+		assert.Zero(t, api.requests, "the image is not generated")
+	})
+
+	t.Run("charged for the variant", func(t *testing.T) {
+		gen, api, wg := newGenerator(t)
+		user := newUser(t, wide)
+		req := rq.GenerateImageV1{Prompt: "a lighthouse", Model: llm.ModelDalle3, Size: "1792x1024"}
+		url, cost, err := gen.Generate(ctx, user, &req)
+		require.NoError(t, err)
+		wg.Wait()
+		assert.Equal(t, wide, cost)
+		assert.Equal(t, "https://images.example.com/image.png", url)
+		assert.Equal(t, 1, api.requests)
+		assert.Equal(t, llm.ModelDalle3Wide, req.Model)
+		assert.Zero(t, balance(t, user.ID))
+	})
+}
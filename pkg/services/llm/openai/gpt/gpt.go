@@ -30,6 +30,30 @@ type ImageURL struct {
 type Message struct {
 	Role    string    `json:"role"`
 	Content []Content `json:"content,omitempty"`
+	// ToolCalls are the calls made in an assistant message.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID is the call a tool message answers.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// ToolCall is a function call made by the model.
+type ToolCall struct {
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name string `json:"name,omitempty"`
+	// Arguments is a JSON object, streamed in fragments
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// ToolCallDelta is a fragment of a tool call in a streamed chunk.
+type ToolCallDelta struct {
+	// Index identifies the call across streamed chunks
+	Index int `json:"index"`
+	ToolCall
 }
 
 // Request represents a chat completion request to the OpenAI API
@@ -125,6 +149,15 @@ type ResponseFormat struct {
 	JSONSchema interface{} `json:"json_schema,omitempty"`
 }
 
+// JSONSchema is the json_schema of a "json_schema" ResponseFormat.
+type JSONSchema struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	// Strict mode only accepts a subset of JSON Schema, so it is left off
+	// and the response is validated by the caller instead.
+	Strict bool `json:"strict"`
+}
+
 // Tool represents a function the model can call
 type Tool struct {
 	// Type of tool (currently only "function" is supported)
@@ -180,6 +213,8 @@ type StreamResponse struct {
 		Delta struct {
 			// The text content of this chunk
 			Content string `json:"content"`
+			// Fragments of tool calls, keyed by index
+			ToolCalls []ToolCallDelta `json:"tool_calls"`
 		} `json:"delta"`
 
 		// The reason the model stopped generating
@@ -221,7 +256,7 @@ func Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) er
 	if prompt.Model == "" {
 		return fmt.Errorf("model is required")
 	}
-	messages := make([]Message, 0, 2)
+	messages := make([]Message, 0, len(prompt.Messages)+2)
 	if prompt.SystemPrompt != "" {
 		messages = append(messages, Message{
 			Role: "system",
@@ -232,53 +267,56 @@ func Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) er
 		})
 	}
 
-	userContent := []Content{{
-		Type: "text",
-		Text: prompt.UserPrompt,
-	}}
-
-	if prompt.ImageURL != "" {
-		// Only GPT-4o and GPT-4o-1120 support images
-		if IsO1Model(prompt.Model) {
-			return fmt.Errorf("image input not supported for model %s", prompt.Model)
+	if IsO1Model(prompt.Model) && prompt.HasImages() {
+		return fmt.Errorf("image input not supported for model %s", prompt.Model)
+	}
+	conv := prompt.Conversation()
+	images, err := img.GetAll(ctx, rq.ImageURLs(conv), img.WithUserID(prompt.UserID),
+		img.WithMaxBytes(maxImageBytes), img.WithDownscale(maxImageDimension))
+	if err != nil {
+		return fmt.Errorf("error getting image data: %w", err)
+	}
+	for _, m := range conv {
+		// Tool results are separate messages that precede the user's reply.
+		for _, tr := range m.ToolResults {
+			messages = append(messages, Message{
+				Role:       "tool",
+				Content:    []Content{{Type: "text", Text: tr.Content}},
+				ToolCallID: tr.ToolCallID,
+			})
 		}
-
-		imageData, err := img.GetImageData(ctx, prompt.ImageURL)
-		if err != nil {
-			return fmt.Errorf("error getting image data: %w", err)
+		if len(m.ToolResults) > 0 && m.Content == "" && len(m.Images) == 0 {
+			continue
 		}
-
-		// Create a data URL from the base64 data
-		var b strings.Builder
-		b.WriteString("data:")
-		b.WriteString(imageData.MimeType)
-		b.WriteString(";base64,")
-		b.WriteString(imageData.Base64)
-		dataURL := b.String()
-
-		userContent = append([]Content{{
-			Type: "image_url",
-			ImageURL: &ImageURL{
-				URL: dataURL,
-			},
-		}}, userContent...)
+		messages = append(messages, buildMessage(m, images))
 	}
 
-	messages = append(messages, Message{
-		Role:    "user",
-		Content: userContent,
-	})
-
 	reqBody := Request{
 		Model:               string(prompt.Model),
 		Messages:            messages,
 		Stream:              true,
 		StreamOptions:       &StreamOptions{IncludeUsage: true},
-		MaxCompletionTokens: 8192,
+		MaxCompletionTokens: prompt.MaxOutputTokensOr(8192),
+		Tools:               buildTools(prompt.Tools),
+		Seed:                prompt.Seed,
+	}
+	// o1 models only support the default sampling parameters.
+	if !IsO1Model(prompt.Model) {
+		reqBody.Temperature = prompt.Temperature
+		reqBody.TopP = prompt.TopPOr(0)
+		reqBody.Stop = prompt.StopSequences
+	}
+	// o1 models do not support response_format, so their responses are only
+	// checked against the schema, and retried, by the caller.
+	if len(prompt.ResponseSchema) > 0 && !IsO1Model(prompt.Model) {
+		reqBody.ResponseFormat = &ResponseFormat{
+			Type:       "json_schema",
+			JSONSchema: JSONSchema{Name: "response", Schema: prompt.ResponseSchema},
+		}
 	}
 
 	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(reqBody)
+	err = json.NewEncoder(&buf).Encode(reqBody)
 	if err != nil {
 		return fmt.Errorf("error encoding request: %w", err)
 	}
@@ -299,6 +337,7 @@ func Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) er
 		defer resp.Body.Close()
 		defer close(tokenChan)
 
+		var toolCalls []ToolCall
 		scanner := bufio.NewScanner(resp.Body)
 		for scanner.Scan() {
 			line := scanner.Text()
@@ -320,6 +359,20 @@ func Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) er
 				if choice.Delta.Content != "" {
 					tokenChan <- llm.Token{Ok: choice.Delta.Content}
 				}
+				for _, delta := range choice.Delta.ToolCalls {
+					for len(toolCalls) <= delta.Index {
+						toolCalls = append(toolCalls, ToolCall{})
+					}
+					tc := &toolCalls[delta.Index]
+					if delta.ID != "" {
+						tc.ID = delta.ID
+					}
+					tc.Function.Name += delta.Function.Name
+					tc.Function.Arguments += delta.Function.Arguments
+				}
+				if choice.FinishReason != "" {
+					rsp.FinishReason = llm.OpenAIFinishReason(choice.FinishReason)
+				}
 			}
 			if streamResp.Usage != nil {
 				rsp.InputTokens = streamResp.Usage.PromptTokens
@@ -329,12 +382,91 @@ func Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) er
 
 		if err := scanner.Err(); err != nil {
 			tokenChan <- llm.Token{Err: fmt.Errorf("error reading stream: %w", err)}
+			return
+		}
+		for _, tc := range toolCalls {
+			args := tc.Function.Arguments
+			if args == "" {
+				args = "{}"
+			}
+			rsp.ToolCalls = append(rsp.ToolCalls, llm.ToolCall{
+				ID:        tc.ID,
+				Name:      tc.Function.Name,
+				Arguments: json.RawMessage(args),
+			})
 		}
 	}()
 
 	return nil
 }
 
+// OpenAI accepts images of up to 20 MB, and scales down any with a side
+// longer than 2048 pixels, so larger images are scaled down before sending.
+const (
+	maxImageBytes     = 20 << 20
+	maxImageDimension = 2048
+)
+
+// buildMessage converts a conversation message to an OpenAI message.
+// Images, fetched beforehand, are sent as data URLs before the text.
+func buildMessage(m rq.Message, images map[string]*img.ImageData) Message {
+	content := make([]Content, 0, len(m.Images)+1)
+	for _, url := range m.Images {
+		imageData := images[url]
+
+		// Create a data URL from the base64 data
+		var b strings.Builder
+		b.WriteString("data:")
+		b.WriteString(imageData.MimeType)
+		b.WriteString(";base64,")
+		b.WriteString(imageData.Base64)
+		dataURL := b.String()
+
+		content = append(content, Content{
+			Type: "image_url",
+			ImageURL: &ImageURL{
+				URL: dataURL,
+			},
+		})
+	}
+	if m.Content != "" || len(m.ToolCalls) == 0 {
+		content = append(content, Content{
+			Type: "text",
+			Text: m.Content,
+		})
+	}
+	msg := Message{Role: string(m.Role), Content: content}
+	for _, tc := range m.ToolCalls {
+		msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+			ID:   tc.ID,
+			Type: "function",
+			Function: ToolCallFunction{
+				Name:      tc.Name,
+				Arguments: string(tc.Arguments),
+			},
+		})
+	}
+	return msg
+}
+
+func buildTools(tools []rq.Tool) []Tool {
+	if len(tools) == 0 {
+		return nil
+	}
+	out := make([]Tool, len(tools))
+	for i, t := range tools {
+		out[i] = Tool{
+			Type: "function",
+			Function: ToolFunction{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.Schema(),
+			},
+		}
+	}
+	return out
+}
+
 func IsO1Model(m llm.ServiceName) bool {
 	return m == llm.ModelO1Preview ||
 		m == llm.ModelO1Mini ||
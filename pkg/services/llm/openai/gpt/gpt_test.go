@@ -2,8 +2,12 @@ package gpt_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"testing"
 
@@ -188,3 +192,52 @@ func TestImageUnsupportedModel(t *testing.T) {
 		t.Fatalf("Expected error '%s', got: %v", expectedErr, err)
 	}
 }
+
+// captureTransport records each request's body and fails the request.
+type captureTransport struct {
+	bodies [][]byte
+}
+
+func (c *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.bodies = append(c.bodies, body)
+	return nil, errors.New("request captured")
+}
+
+func TestResponseFormat(t *testing.T) {
+	tests := []struct {
+		model llm.ServiceName
+		want  bool
+	}{
+		{llm.ModelGPT4oMini, true},
+		{llm.ModelO1Mini, false},
+		{llm.ModelO1Preview, false},
+	}
+	prev := llm.HttpClient
+	t.Cleanup(func() { llm.HttpClient = prev })
+	for _, tt := range tests {
+		t.Run(string(tt.model), func(t *testing.T) {
+			capture := &captureTransport{}
+			llm.HttpClient = &http.Client{Transport: capture}
+			var rsp llm.StreamResponse
+			gpt.Prompt(context.Background(), rq.PromptV1{
+				Model:          tt.model,
+				UserPrompt:     "Name a color.",
+				ResponseSchema: []byte(`{"type": "object", "properties": {"color": {"type": "string"}}}`),
+			}, &rsp)
+			if len(capture.bodies) != 1 {
+				t.Fatalf("expected 1 request, got %d", len(capture.bodies))
+			}
+			var req map[string]any
+			if err := json.Unmarshal(capture.bodies[0], &req); err != nil {
+				t.Fatalf("failed to decode request: %v", err)
+			}
+			if _, got := req["response_format"]; got != tt.want {
+				t.Errorf("response_format sent = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
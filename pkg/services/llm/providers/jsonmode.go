@@ -0,0 +1,118 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/pkg/utils/jsonschema"
+	"github.com/ditto-assistant/backend/types/rq"
+)
+
+// promptJSON dispatches a prompt with a response schema.
+// The response is buffered, so that the client never sees invalid JSON,
+// and the model is re-prompted with the validation error until it responds
+// with valid JSON, which is then sent as a single token.
+// Models with JSON mode are constrained to the schema, so they rarely need a retry.
+// Token usage covers every attempt.
+func (r *Registry) promptJSON(ctx context.Context, m Model, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+	schema, err := jsonschema.Parse(prompt.ResponseSchema)
+	if err != nil {
+		return fmt.Errorf("%w: responseSchema: %w", ErrInvalidPrompt, err)
+	}
+	prompt.SystemPrompt = jsonInstructions(prompt.SystemPrompt, prompt.ResponseSchema)
+	var attempt llm.StreamResponse
+	if err := r.dispatch(ctx, m, prompt, &attempt); err != nil {
+		return err
+	}
+	served := r.models[attempt.Model]
+	prompt.Model = served.Name
+	text := make(chan llm.Token)
+	rsp.Text = text
+	rsp.Model = served.Name
+	go func() {
+		defer close(text)
+		for i := 1; ; i++ {
+			out, err := collectText(attempt.Text)
+			rsp.InputTokens += attempt.InputTokens
+			rsp.OutputTokens += attempt.OutputTokens
+			rsp.FinishReason = attempt.FinishReason
+			if err != nil {
+				text <- llm.Token{Err: err}
+				return
+			}
+			out = trimCodeFence(out)
+			verr := schema.Validate([]byte(out))
+			if verr == nil {
+				text <- llm.Token{Ok: out}
+				return
+			}
+			if i == llm.MaxJSONAttempts {
+				text <- llm.Token{Err: fmt.Errorf("response does not match responseSchema after %d attempts: %w", i, verr)}
+				return
+			}
+			slog.Warn("Retrying prompt with invalid JSON response", "model", served.Name, "error", verr, "try", i)
+			prompt = jsonRetry(prompt, out, verr)
+			attempt = llm.StreamResponse{}
+			if err := r.try(ctx, served, prompt, &attempt); err != nil {
+				text <- llm.Token{Err: err}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// jsonInstructions appends the response schema to the system prompt.
+// Models with JSON mode are constrained to the schema anyway,
+// but the instructions help them fill it in.
+func jsonInstructions(systemPrompt string, schema []byte) string {
+	instructions := "Respond with only a JSON value matching this JSON Schema, " +
+		"without markdown or any other text:\n" + string(schema)
+	if systemPrompt == "" {
+		return instructions
+	}
+	return systemPrompt + "\n\n" + instructions
+}
+
+// jsonRetry adds the invalid response and its validation error to the conversation.
+func jsonRetry(prompt rq.PromptV1, response string, verr error) rq.PromptV1 {
+	msgs := slices.Clone(prompt.Conversation())
+	msgs = append(msgs,
+		rq.Message{Role: rq.RoleAssistant, Content: response},
+		rq.Message{Role: rq.RoleUser, Content: fmt.Sprintf(
+			"Your response does not match the JSON Schema: %s. "+
+				"Respond again with only the corrected JSON.", verr)},
+	)
+	prompt.Messages = msgs
+	prompt.ClearFinalMessage()
+	return prompt
+}
+
+// collectText reads the whole stream, returning the first token error.
+func collectText(text <-chan llm.Token) (string, error) {
+	var sb strings.Builder
+	var err error
+	for token := range text {
+		if token.Err != nil && err == nil {
+			err = token.Err
+		}
+		sb.WriteString(token.Ok)
+	}
+	return sb.String(), err
+}
+
+// trimCodeFence removes the markdown code fence models often wrap JSON in.
+func trimCodeFence(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "```") {
+		return s
+	}
+	s = strings.TrimPrefix(s, "```")
+	s = strings.TrimPrefix(s, "json")
+	s = strings.TrimSuffix(s, "```")
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,357 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/ditto-assistant/backend/cfg/secr"
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/pkg/services/llm/cerebras"
+	"github.com/ditto-assistant/backend/pkg/services/llm/claude"
+	"github.com/ditto-assistant/backend/pkg/services/llm/gemini"
+	"github.com/ditto-assistant/backend/pkg/services/llm/llama"
+	"github.com/ditto-assistant/backend/pkg/services/llm/mistral"
+	"github.com/ditto-assistant/backend/pkg/services/llm/openai/gpt"
+	"github.com/ditto-assistant/backend/types/rq"
+	"github.com/ditto-assistant/backend/types/ty"
+)
+
+// Provider streams a prompt response from a text model.
+type Provider interface {
+	Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error
+}
+
+// ProviderFunc adapts a plain prompt function, such as claude.Prompt, to a Provider.
+type ProviderFunc func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error
+
+func (f ProviderFunc) Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+	return f(ctx, prompt, rsp)
+}
+
+// Capabilities describes what a model accepts.
+type Capabilities struct {
+	// Vision is true if the model accepts image input.
+	Vision bool
+	// MaxImages is the most images a vision model accepts in one conversation.
+	// If 0, there is no limit.
+	MaxImages int
+	// SystemPrompt is true if the model accepts a system prompt.
+	// If false, the system prompt is prepended to the user prompt.
+	SystemPrompt bool
+	// Tools is true if the model supports native tool calling.
+	Tools bool
+	// MaxOutputTokens is the most tokens the model can generate.
+	// The services table's max_output_tokens takes precedence, if set.
+	MaxOutputTokens int
+	// MaxTemperature is the highest temperature the model accepts.
+	// If 0, it accepts the full range rq.PromptV1 allows.
+	MaxTemperature float64
+}
+
+// temperatureOK reports whether the model accepts the prompt's temperature.
+func (c Capabilities) temperatureOK(prompt rq.PromptV1) bool {
+	return c.MaxTemperature == 0 || prompt.Temperature == nil || *prompt.Temperature <= c.MaxTemperature
+}
+
+// Model is a registered model: the provider that serves it and what it can do.
+type Model struct {
+	Name     llm.ServiceName
+	Provider Provider
+	Capabilities
+}
+
+var (
+	ErrUnsupportedModel   = errors.New("unsupported model")
+	ErrVisionNotSupported = errors.New("image input not supported")
+	ErrInvalidPrompt      = errors.New("invalid prompt")
+	ErrToolsNotSupported  = errors.New("tool calling not supported")
+)
+
+// IsBadRequest reports whether err was caused by the request rather than the provider.
+func IsBadRequest(err error) bool {
+	return errors.Is(err, ErrUnsupportedModel) ||
+		errors.Is(err, ErrVisionNotSupported) ||
+		errors.Is(err, ErrInvalidPrompt) ||
+		errors.Is(err, ErrToolsNotSupported)
+}
+
+type Registry struct {
+	models      map[llm.ServiceName]Model
+	fallbacks   map[llm.ServiceName][]llm.ServiceName
+	tokenLimits TokenLimitFunc
+}
+
+// TokenLimitFunc returns the most tokens a model can generate, or 0 if it is unknown.
+type TokenLimitFunc func(ctx context.Context, name llm.ServiceName) (int, error)
+
+type Option func(*Registry)
+
+// WithModel registers a provider for the given service names.
+// Aliases, such as claude-3-5-sonnet and claude-3-5-sonnet@20240620, share one registration.
+func WithModel(p Provider, caps Capabilities, names ...llm.ServiceName) Option {
+	return func(r *Registry) {
+		for _, name := range names {
+			r.models[name] = Model{Name: name, Provider: p, Capabilities: caps}
+		}
+	}
+}
+
+// WithFallbacks sets the models to try, in order, when the given models fail
+// before streaming any tokens.
+func WithFallbacks(fallbacks []llm.ServiceName, names ...llm.ServiceName) Option {
+	return func(r *Registry) {
+		for _, name := range names {
+			r.fallbacks[name] = fallbacks
+		}
+	}
+}
+
+// WithTokenLimits looks up each model's output token limit,
+// such as from the services table, instead of using its capabilities.
+func WithTokenLimits(f TokenLimitFunc) Option {
+	return func(r *Registry) {
+		r.tokenLimits = f
+	}
+}
+
+func NewRegistry(opts ...Option) *Registry {
+	r := &Registry{
+		models:    make(map[llm.ServiceName]Model),
+		fallbacks: make(map[llm.ServiceName][]llm.ServiceName),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// NewDefault creates a registry with every text model Ditto serves.
+func NewDefault(sd *ty.ShutdownContext, secr *secr.Client) *Registry {
+	return NewRegistry(
+		WithTokenLimits(db.MaxOutputTokens),
+		WithModel(ProviderFunc(claude.Prompt),
+			Capabilities{Vision: true, MaxImages: 20, SystemPrompt: true, Tools: true, MaxOutputTokens: 4096, MaxTemperature: 1},
+			llm.ModelClaude3Haiku, llm.ModelClaude3Haiku_20240307,
+		),
+		WithModel(ProviderFunc(claude.Prompt),
+			Capabilities{Vision: true, MaxImages: 20, SystemPrompt: true, Tools: true, MaxOutputTokens: 8192, MaxTemperature: 1},
+			llm.ModelClaude35Sonnet, llm.ModelClaude35Sonnet_20240620,
+			llm.ModelClaude35SonnetV2, llm.ModelClaude35SonnetV2_20241022,
+			llm.ModelClaude35Haiku, llm.ModelClaude35Haiku_20241022,
+		),
+		WithModel(gemini.ModelGemini15Flash,
+			Capabilities{Vision: true, MaxImages: 16, SystemPrompt: true, Tools: true, MaxOutputTokens: 8192},
+			llm.ModelGemini15Flash,
+		),
+		WithModel(gemini.ModelGemini15Pro,
+			Capabilities{Vision: true, MaxImages: 16, SystemPrompt: true, Tools: true, MaxOutputTokens: 8192},
+			llm.ModelGemini15Pro,
+		),
+		WithModel(ProviderFunc(mistral.Prompt),
+			Capabilities{SystemPrompt: true, MaxOutputTokens: 8192, MaxTemperature: 1.5},
+			llm.ModelMistralNemo, llm.ModelMistralLarge,
+		),
+		WithModel(ProviderFunc(llama.Prompt),
+			Capabilities{SystemPrompt: true, MaxOutputTokens: 8192},
+			llm.ModelLlama33_70bInstruct,
+		),
+		WithModel(ProviderFunc(gpt.Prompt),
+			Capabilities{Vision: true, MaxImages: 10, SystemPrompt: true, Tools: true, MaxOutputTokens: 16384},
+			llm.ModelGPT4oMini, llm.ModelGPT4oMini_20240718,
+			llm.ModelGPT4o, llm.ModelGPT4o_1120,
+		),
+		WithModel(ProviderFunc(gpt.Prompt),
+			Capabilities{MaxOutputTokens: 32768},
+			llm.ModelO1Mini, llm.ModelO1Mini_20240912,
+			llm.ModelO1Preview, llm.ModelO1Preview_20240912,
+		),
+		WithModel(cerebras.NewService(sd, secr),
+			Capabilities{SystemPrompt: true, MaxOutputTokens: 8192, MaxTemperature: 1.5},
+			llm.ModelCerebrasLlama8B, llm.ModelCerebrasLlama70B,
+		),
+
+		// Fallbacks are comparable models from other providers.
+		// The free Llama model has none, so users are never charged for it.
+		WithFallbacks([]llm.ServiceName{llm.ModelGPT4o, llm.ModelGemini15Pro},
+			llm.ModelClaude35Sonnet, llm.ModelClaude35Sonnet_20240620,
+			llm.ModelClaude35SonnetV2, llm.ModelClaude35SonnetV2_20241022,
+		),
+		WithFallbacks([]llm.ServiceName{llm.ModelGPT4oMini, llm.ModelGemini15Flash},
+			llm.ModelClaude3Haiku, llm.ModelClaude3Haiku_20240307,
+			llm.ModelClaude35Haiku, llm.ModelClaude35Haiku_20241022,
+		),
+		WithFallbacks([]llm.ServiceName{llm.ModelClaude35SonnetV2, llm.ModelGemini15Pro},
+			llm.ModelGPT4o, llm.ModelGPT4o_1120,
+		),
+		WithFallbacks([]llm.ServiceName{llm.ModelClaude35Haiku, llm.ModelGemini15Flash},
+			llm.ModelGPT4oMini, llm.ModelGPT4oMini_20240718,
+		),
+		WithFallbacks([]llm.ServiceName{llm.ModelClaude35SonnetV2, llm.ModelGPT4o},
+			llm.ModelGemini15Pro,
+		),
+		WithFallbacks([]llm.ServiceName{llm.ModelGPT4oMini, llm.ModelClaude35Haiku},
+			llm.ModelGemini15Flash,
+		),
+		WithFallbacks([]llm.ServiceName{llm.ModelGPT4o},
+			llm.ModelMistralLarge,
+		),
+		WithFallbacks([]llm.ServiceName{llm.ModelGPT4oMini},
+			llm.ModelMistralNemo,
+		),
+		WithFallbacks([]llm.ServiceName{llm.ModelLlama33_70bInstruct},
+			llm.ModelCerebrasLlama8B, llm.ModelCerebrasLlama70B,
+		),
+	)
+}
+
+// Get returns the registered model for the given service name.
+func (r *Registry) Get(name llm.ServiceName) (Model, error) {
+	m, ok := r.models[name]
+	if !ok {
+		return Model{}, fmt.Errorf("%w: %s", ErrUnsupportedModel, name)
+	}
+	return m, nil
+}
+
+// Prompt dispatches the prompt to the provider registered for prompt.Model.
+// It returns an error matching IsBadRequest before calling the provider
+// if the model cannot serve the request.
+//
+// If the provider fails before streaming any tokens, the model's fallbacks
+// are tried in order. rsp.Model is set to the model that served the response.
+//
+// If prompt.ResponseSchema is set, the response is JSON matching the schema,
+// or the stream ends with an error token.
+func (r *Registry) Prompt(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+	m, err := r.Get(prompt.Model)
+	if err != nil {
+		return err
+	}
+	if err := prompt.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPrompt, err)
+	}
+	if prompt.HasImages() && !m.Vision {
+		return fmt.Errorf("%w: %s", ErrVisionNotSupported, m.Name)
+	}
+	if n := prompt.ImageCount(); m.MaxImages > 0 && n > m.MaxImages {
+		return fmt.Errorf("%w: %d images exceeds the limit of %d for %s",
+			ErrInvalidPrompt, n, m.MaxImages, m.Name)
+	}
+	if prompt.UsesTools() && !m.Tools {
+		return fmt.Errorf("%w: %s", ErrToolsNotSupported, m.Name)
+	}
+	if limit := r.maxOutputTokens(ctx, m); limit > 0 && prompt.MaxOutputTokens > limit {
+		return fmt.Errorf("%w: maxOutputTokens %d exceeds the limit of %d for %s",
+			ErrInvalidPrompt, prompt.MaxOutputTokens, limit, m.Name)
+	}
+	if !m.temperatureOK(prompt) {
+		return fmt.Errorf("%w: temperature must be between 0 and %g for %s, got %g",
+			ErrInvalidPrompt, m.MaxTemperature, m.Name, *prompt.Temperature)
+	}
+	if len(prompt.ResponseSchema) > 0 {
+		return r.promptJSON(ctx, m, prompt, rsp)
+	}
+	return r.dispatch(ctx, m, prompt, rsp)
+}
+
+// dispatch tries the model, then each of its fallbacks that can serve the prompt.
+func (r *Registry) dispatch(ctx context.Context, m Model, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+	err := r.try(ctx, m, prompt, rsp)
+	if err == nil {
+		return nil
+	}
+	for i, name := range r.fallbacks[m.Name] {
+		if ctx.Err() != nil {
+			return err
+		}
+		fb, ferr := r.Get(name)
+		if ferr != nil || (prompt.HasImages() && !fb.Vision) || (prompt.UsesTools() && !fb.Tools) {
+			continue
+		}
+		if fb.MaxImages > 0 && prompt.ImageCount() > fb.MaxImages {
+			continue
+		}
+		if limit := r.maxOutputTokens(ctx, fb); limit > 0 && prompt.MaxOutputTokens > limit {
+			continue
+		}
+		if !fb.temperatureOK(prompt) {
+			continue
+		}
+		slog.Warn("Retrying prompt with fallback model",
+			"error", err, "model", m.Name, "fallback", fb.Name, "try", i+1)
+		prompt.Model = fb.Name
+		err = r.try(ctx, fb, prompt, rsp)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// maxOutputTokens returns the model's output token limit, or 0 if it has none.
+func (r *Registry) maxOutputTokens(ctx context.Context, m Model) int {
+	if r.tokenLimits != nil {
+		limit, err := r.tokenLimits(ctx, m.Name)
+		if err != nil {
+			slog.Warn("failed to get output token limit", "model", m.Name, "error", err)
+		} else if limit > 0 {
+			return limit
+		}
+	}
+	return m.MaxOutputTokens
+}
+
+// try prompts a single model and waits for its first token.
+// If it succeeds, rsp streams the full response from that model.
+func (r *Registry) try(ctx context.Context, m Model, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+	if prompt.SystemPrompt != "" && !m.SystemPrompt {
+		foldSystemPrompt(&prompt)
+	}
+	var attempt llm.StreamResponse
+	if err := m.Provider.Prompt(ctx, prompt, &attempt); err != nil {
+		return err
+	}
+	first, ok := <-attempt.Text
+	if ok && first.Err != nil {
+		go func() {
+			for range attempt.Text {
+			}
+		}()
+		return first.Err
+	}
+	text := make(chan llm.Token)
+	rsp.Text = text
+	rsp.Model = m.Name
+	go func() {
+		defer close(text)
+		if ok {
+			text <- first
+			for token := range attempt.Text {
+				text <- token
+			}
+		}
+		rsp.InputTokens = attempt.InputTokens
+		rsp.OutputTokens = attempt.OutputTokens
+		rsp.ToolCalls = attempt.ToolCalls
+		rsp.FinishReason = attempt.FinishReason
+	}()
+	return nil
+}
+
+// foldSystemPrompt moves the system prompt into the first user message.
+func foldSystemPrompt(prompt *rq.PromptV1) {
+	msgs := slices.Clone(prompt.Conversation())
+	for i := range msgs {
+		if msgs[i].Role == rq.RoleUser {
+			msgs[i].Content = prompt.SystemPrompt + "\n\n" + msgs[i].Content
+			break
+		}
+	}
+	prompt.Messages = msgs
+	prompt.ClearFinalMessage()
+	prompt.SystemPrompt = ""
+}
@@ -0,0 +1,529 @@
+package providers_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/pkg/services/llm/providers"
+	"github.com/ditto-assistant/backend/types/rq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryPrompt(t *testing.T) {
+	var got rq.PromptV1
+	fake := providers.ProviderFunc(func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+		got = prompt
+		rsp.Text = stream()
+		return nil
+	})
+	reg := providers.NewRegistry(
+		providers.WithModel(fake,
+			providers.Capabilities{Vision: true, MaxImages: 20, SystemPrompt: true, Tools: true},
+			llm.ModelClaude35Sonnet, llm.ModelClaude35Sonnet_20240620,
+		),
+		providers.WithModel(fake,
+			providers.Capabilities{},
+			llm.ModelO1Mini,
+		),
+	)
+	ctx := context.Background()
+	var rsp llm.StreamResponse
+
+	t.Run("alias", func(t *testing.T) {
+		m, err := reg.Get(llm.ModelClaude35Sonnet_20240620)
+		require.NoError(t, err)
+		assert.Equal(t, llm.ModelClaude35Sonnet_20240620, m.Name)
+		assert.True(t, m.Vision)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		err := reg.Prompt(ctx, rq.PromptV1{Model: "not-a-model", UserPrompt: "hi"}, &rsp)
+		assert.True(t, errors.Is(err, providers.ErrUnsupportedModel), err)
+	})
+
+	t.Run("vision", func(t *testing.T) {
+		err := reg.Prompt(ctx, rq.PromptV1{Model: llm.ModelO1Mini, UserPrompt: "hi", ImageURL: "https://example.com/a.png"}, &rsp)
+		assert.True(t, errors.Is(err, providers.ErrVisionNotSupported), err)
+	})
+
+	t.Run("too many images", func(t *testing.T) {
+		images := make([]string, 21)
+		for i := range images {
+			images[i] = fmt.Sprintf("https://example.com/%d.png", i)
+		}
+		err := reg.Prompt(ctx, rq.PromptV1{Model: llm.ModelClaude35Sonnet, UserPrompt: "hi", Images: images}, &rsp)
+		assert.True(t, errors.Is(err, providers.ErrInvalidPrompt), err)
+	})
+
+	t.Run("images", func(t *testing.T) {
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:      llm.ModelClaude35Sonnet,
+			UserPrompt: "compare these",
+			ImageURL:   "https://example.com/a.png",
+			Images:     []string{"https://example.com/b.png"},
+		}, &rsp)
+		require.NoError(t, err)
+		collect(t, rsp.Text)
+		assert.Equal(t, []rq.Message{{
+			Role:    rq.RoleUser,
+			Content: "compare these",
+			Images:  []string{"https://example.com/a.png", "https://example.com/b.png"},
+		}}, got.Conversation())
+	})
+
+	t.Run("system prompt folded", func(t *testing.T) {
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:        llm.ModelO1Mini,
+			SystemPrompt: "be brief",
+			UserPrompt:   "hello",
+		}, &rsp)
+		require.NoError(t, err)
+		collect(t, rsp.Text)
+		assert.Equal(t, "", got.SystemPrompt)
+		assert.Equal(t, []rq.Message{{Role: rq.RoleUser, Content: "be brief\n\nhello"}}, got.Conversation())
+	})
+
+	t.Run("system prompt folded into history", func(t *testing.T) {
+		history := []rq.Message{
+			{Role: rq.RoleUser, Content: "hi"},
+			{Role: rq.RoleAssistant, Content: "hello"},
+		}
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:        llm.ModelO1Mini,
+			SystemPrompt: "be brief",
+			UserPrompt:   "how are you?",
+			Messages:     history,
+		}, &rsp)
+		require.NoError(t, err)
+		collect(t, rsp.Text)
+		assert.Equal(t, []rq.Message{
+			{Role: rq.RoleUser, Content: "be brief\n\nhi"},
+			{Role: rq.RoleAssistant, Content: "hello"},
+			{Role: rq.RoleUser, Content: "how are you?"},
+		}, got.Conversation())
+		assert.Equal(t, "hi", history[0].Content, "caller's messages must not be modified")
+	})
+
+	t.Run("invalid role", func(t *testing.T) {
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:    llm.ModelClaude35Sonnet,
+			Messages: []rq.Message{{Role: "system", Content: "hi"}},
+		}, &rsp)
+		assert.True(t, providers.IsBadRequest(err), err)
+	})
+
+	t.Run("vision in history", func(t *testing.T) {
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:      llm.ModelO1Mini,
+			UserPrompt: "what was in that image?",
+			Messages:   []rq.Message{{Role: rq.RoleUser, Images: []string{"https://example.com/a.png"}}},
+		}, &rsp)
+		assert.True(t, errors.Is(err, providers.ErrVisionNotSupported), err)
+	})
+
+	t.Run("tools", func(t *testing.T) {
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:      llm.ModelO1Mini,
+			UserPrompt: "what's the weather?",
+			Tools:      []rq.Tool{{Name: "get_weather"}},
+		}, &rsp)
+		assert.True(t, errors.Is(err, providers.ErrToolsNotSupported), err)
+	})
+
+	t.Run("duplicate tool", func(t *testing.T) {
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:      llm.ModelClaude35Sonnet,
+			UserPrompt: "what's the weather?",
+			Tools:      []rq.Tool{{Name: "get_weather"}, {Name: "get_weather"}},
+		}, &rsp)
+		assert.True(t, providers.IsBadRequest(err), err)
+	})
+
+	t.Run("invalid params", func(t *testing.T) {
+		temp := 2.5
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:       llm.ModelClaude35Sonnet,
+			UserPrompt:  "hi",
+			Temperature: &temp,
+		}, &rsp)
+		assert.True(t, errors.Is(err, providers.ErrInvalidPrompt), err)
+	})
+
+	t.Run("system prompt kept", func(t *testing.T) {
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:        llm.ModelClaude35Sonnet,
+			SystemPrompt: "be brief",
+			UserPrompt:   "hello",
+		}, &rsp)
+		require.NoError(t, err)
+		collect(t, rsp.Text)
+		assert.Equal(t, "be brief", got.SystemPrompt)
+		assert.Equal(t, "hello", got.UserPrompt)
+	})
+}
+
+// stream returns a closed channel of the given tokens.
+func stream(tokens ...llm.Token) <-chan llm.Token {
+	ch := make(chan llm.Token, len(tokens))
+	for _, t := range tokens {
+		ch <- t
+	}
+	close(ch)
+	return ch
+}
+
+func collect(t *testing.T, text <-chan llm.Token) string {
+	t.Helper()
+	var sb strings.Builder
+	for token := range text {
+		require.NoError(t, token.Err)
+		sb.WriteString(token.Ok)
+	}
+	return sb.String()
+}
+
+func TestRegistryTokenLimits(t *testing.T) {
+	var got rq.PromptV1
+	fake := providers.ProviderFunc(func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+		got = prompt
+		rsp.Text = stream()
+		return nil
+	})
+	down := providers.ProviderFunc(func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+		return errors.New("provider down")
+	})
+	reg := providers.NewRegistry(
+		providers.WithTokenLimits(func(ctx context.Context, name llm.ServiceName) (int, error) {
+			if name == llm.ModelGPT4o {
+				return 16384, nil
+			}
+			return 0, nil
+		}),
+		providers.WithModel(fake, providers.Capabilities{MaxOutputTokens: 8192}, llm.ModelGPT4o, llm.ModelClaude35Sonnet),
+		providers.WithModel(down, providers.Capabilities{}, llm.ModelMistralLarge),
+		providers.WithFallbacks([]llm.ServiceName{llm.ModelClaude35Sonnet, llm.ModelGPT4o}, llm.ModelMistralLarge),
+	)
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		model     llm.ServiceName
+		maxTokens int
+		served    llm.ServiceName
+		wantErr   bool
+	}{
+		{name: "services table limit", model: llm.ModelGPT4o, maxTokens: 16384, served: llm.ModelGPT4o},
+		{name: "over services table limit", model: llm.ModelGPT4o, maxTokens: 16385, wantErr: true},
+		{name: "capabilities limit", model: llm.ModelClaude35Sonnet, maxTokens: 8192, served: llm.ModelClaude35Sonnet},
+		{name: "over capabilities limit", model: llm.ModelClaude35Sonnet, maxTokens: 8193, wantErr: true},
+		{name: "fallback over limit skipped", model: llm.ModelMistralLarge, maxTokens: 10000, served: llm.ModelGPT4o},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rsp llm.StreamResponse
+			err := reg.Prompt(ctx, rq.PromptV1{Model: tt.model, UserPrompt: "hi", MaxOutputTokens: tt.maxTokens}, &rsp)
+			if tt.wantErr {
+				assert.True(t, providers.IsBadRequest(err), err)
+				return
+			}
+			require.NoError(t, err)
+			collect(t, rsp.Text)
+			assert.Equal(t, tt.served, rsp.Model)
+			assert.Equal(t, tt.maxTokens, got.MaxOutputTokens)
+		})
+	}
+}
+
+func TestRegistryTemperature(t *testing.T) {
+	fake := providers.ProviderFunc(func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+		rsp.Text = stream()
+		return nil
+	})
+	down := providers.ProviderFunc(func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+		return errors.New("provider down")
+	})
+	reg := providers.NewRegistry(
+		providers.WithModel(fake, providers.Capabilities{MaxTemperature: 1}, llm.ModelClaude35Sonnet),
+		providers.WithModel(fake, providers.Capabilities{}, llm.ModelGPT4o),
+		providers.WithModel(down, providers.Capabilities{}, llm.ModelGemini15Pro),
+		providers.WithFallbacks([]llm.ServiceName{llm.ModelClaude35Sonnet, llm.ModelGPT4o}, llm.ModelGemini15Pro),
+	)
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		model       llm.ServiceName
+		temperature float64
+		served      llm.ServiceName
+		wantErr     bool
+	}{
+		{name: "within model range", model: llm.ModelClaude35Sonnet, temperature: 1, served: llm.ModelClaude35Sonnet},
+		{name: "over model range", model: llm.ModelClaude35Sonnet, temperature: 1.5, wantErr: true},
+		{name: "full range", model: llm.ModelGPT4o, temperature: 2, served: llm.ModelGPT4o},
+		{name: "over full range", model: llm.ModelGPT4o, temperature: 2.1, wantErr: true},
+		{name: "fallback over range skipped", model: llm.ModelGemini15Pro, temperature: 1.5, served: llm.ModelGPT4o},
+		{name: "fallback within range", model: llm.ModelGemini15Pro, temperature: 0.5, served: llm.ModelClaude35Sonnet},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rsp llm.StreamResponse
+			temperature := tt.temperature
+			err := reg.Prompt(ctx, rq.PromptV1{Model: tt.model, UserPrompt: "hi", Temperature: &temperature}, &rsp)
+			if tt.wantErr {
+				assert.True(t, providers.IsBadRequest(err), err)
+				return
+			}
+			require.NoError(t, err)
+			collect(t, rsp.Text)
+			assert.Equal(t, tt.served, rsp.Model)
+		})
+	}
+}
+
+func TestRegistryFailover(t *testing.T) {
+	errDown := errors.New("provider down")
+	down := providers.ProviderFunc(func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+		return errDown
+	})
+	firstTokenFails := providers.ProviderFunc(func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+		rsp.Text = stream(llm.Token{Err: errDown})
+		return nil
+	})
+	var tried []llm.ServiceName
+	up := providers.ProviderFunc(func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+		tried = append(tried, prompt.Model)
+		text := make(chan llm.Token)
+		rsp.Text = text
+		go func() {
+			defer close(text)
+			text <- llm.Token{Ok: "hello "}
+			text <- llm.Token{Ok: string(prompt.Model)}
+			rsp.InputTokens = 3
+			rsp.OutputTokens = 5
+			rsp.FinishReason = llm.FinishStop
+		}()
+		return nil
+	})
+	vision := providers.Capabilities{Vision: true, SystemPrompt: true}
+	reg := providers.NewRegistry(
+		providers.WithModel(down, vision, llm.ModelClaude35Sonnet),
+		providers.WithModel(firstTokenFails, vision, llm.ModelClaude35Haiku),
+		providers.WithModel(up, providers.Capabilities{SystemPrompt: true}, llm.ModelMistralLarge),
+		providers.WithModel(up, vision, llm.ModelGPT4o, llm.ModelGPT4oMini),
+		providers.WithFallbacks([]llm.ServiceName{llm.ModelMistralLarge, llm.ModelGPT4o}, llm.ModelClaude35Sonnet),
+		providers.WithFallbacks([]llm.ServiceName{llm.ModelGPT4oMini}, llm.ModelClaude35Haiku),
+	)
+	ctx := context.Background()
+
+	t.Run("provider error", func(t *testing.T) {
+		tried = nil
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{Model: llm.ModelClaude35Sonnet, UserPrompt: "hi"}, &rsp)
+		require.NoError(t, err)
+		assert.Equal(t, "hello mistral-large", collect(t, rsp.Text))
+		assert.Equal(t, llm.ModelMistralLarge, rsp.Model)
+		assert.Equal(t, 3, rsp.InputTokens)
+		assert.Equal(t, 5, rsp.OutputTokens)
+		assert.Equal(t, llm.FinishStop, rsp.FinishReason)
+	})
+
+	t.Run("first token error", func(t *testing.T) {
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{Model: llm.ModelClaude35Haiku, UserPrompt: "hi"}, &rsp)
+		require.NoError(t, err)
+		assert.Equal(t, "hello gpt-4o-mini", collect(t, rsp.Text))
+		assert.Equal(t, llm.ModelGPT4oMini, rsp.Model)
+	})
+
+	t.Run("skips fallback without vision", func(t *testing.T) {
+		tried = nil
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:      llm.ModelClaude35Sonnet,
+			UserPrompt: "what is this?",
+			ImageURL:   "https://example.com/a.png",
+		}, &rsp)
+		require.NoError(t, err)
+		assert.Equal(t, "hello gpt-4o", collect(t, rsp.Text))
+		assert.Equal(t, []llm.ServiceName{llm.ModelGPT4o}, tried)
+	})
+
+	t.Run("no fallbacks", func(t *testing.T) {
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{Model: llm.ModelGPT4o, UserPrompt: "hi"}, &rsp)
+		require.NoError(t, err)
+		assert.Equal(t, llm.ModelGPT4o, rsp.Model)
+		collect(t, rsp.Text)
+	})
+
+	t.Run("tool calls", func(t *testing.T) {
+		call := llm.ToolCall{ID: "call_0", Name: "get_weather", Arguments: []byte(`{"city":"Paris"}`)}
+		calls := providers.ProviderFunc(func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+			text := make(chan llm.Token)
+			rsp.Text = text
+			go func() {
+				defer close(text)
+				rsp.ToolCalls = []llm.ToolCall{call}
+			}()
+			return nil
+		})
+		tools := providers.Capabilities{SystemPrompt: true, Tools: true}
+		reg := providers.NewRegistry(
+			providers.WithModel(down, tools, llm.ModelClaude35Sonnet),
+			providers.WithModel(up, providers.Capabilities{SystemPrompt: true}, llm.ModelMistralLarge),
+			providers.WithModel(calls, tools, llm.ModelGPT4o),
+			providers.WithFallbacks([]llm.ServiceName{llm.ModelMistralLarge, llm.ModelGPT4o}, llm.ModelClaude35Sonnet),
+		)
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:      llm.ModelClaude35Sonnet,
+			UserPrompt: "what's the weather in Paris?",
+			Tools:      []rq.Tool{{Name: "get_weather"}},
+		}, &rsp)
+		require.NoError(t, err)
+		assert.Empty(t, collect(t, rsp.Text))
+		assert.Equal(t, llm.ModelGPT4o, rsp.Model, "fallback without tools must be skipped")
+		assert.Equal(t, []llm.ToolCall{call}, rsp.ToolCalls)
+	})
+
+	t.Run("all fail", func(t *testing.T) {
+		reg := providers.NewRegistry(
+			providers.WithModel(down, vision, llm.ModelClaude35Sonnet, llm.ModelGPT4o),
+			providers.WithFallbacks([]llm.ServiceName{llm.ModelGPT4o}, llm.ModelClaude35Sonnet),
+		)
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{Model: llm.ModelClaude35Sonnet, UserPrompt: "hi"}, &rsp)
+		assert.ErrorIs(t, err, errDown)
+		assert.False(t, providers.IsBadRequest(err))
+	})
+}
+
+func TestRegistryJSON(t *testing.T) {
+	const schema = `{"type": "object", "properties": {"n": {"type": "integer"}}, "required": ["n"]}`
+	// replies responds with each reply in turn, recording the prompts it was sent.
+	replies := func(prompts *[]rq.PromptV1, replies ...string) providers.Provider {
+		return providers.ProviderFunc(func(ctx context.Context, prompt rq.PromptV1, rsp *llm.StreamResponse) error {
+			reply := replies[min(len(*prompts), len(replies)-1)]
+			*prompts = append(*prompts, prompt)
+			text := make(chan llm.Token)
+			rsp.Text = text
+			go func() {
+				defer close(text)
+				text <- llm.Token{Ok: reply}
+				rsp.InputTokens = 10
+				rsp.OutputTokens = 2
+				rsp.FinishReason = llm.FinishStop
+			}()
+			return nil
+		})
+	}
+	ctx := context.Background()
+
+	t.Run("retries invalid output", func(t *testing.T) {
+		var prompts []rq.PromptV1
+		reg := providers.NewRegistry(providers.WithModel(
+			replies(&prompts, `{"n": "one"}`, "```json\n{\"n\": 1}\n```"),
+			providers.Capabilities{SystemPrompt: true}, llm.ModelMistralLarge,
+		))
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:          llm.ModelMistralLarge,
+			UserPrompt:     "count",
+			ResponseSchema: json.RawMessage(schema),
+		}, &rsp)
+		require.NoError(t, err)
+		assert.Equal(t, `{"n": 1}`, collect(t, rsp.Text))
+		assert.Equal(t, 20, rsp.InputTokens)
+		assert.Equal(t, 4, rsp.OutputTokens)
+		require.Len(t, prompts, 2)
+		assert.Contains(t, prompts[0].SystemPrompt, schema)
+		conv := prompts[1].Conversation()
+		require.Len(t, conv, 3)
+		assert.Equal(t, rq.Message{Role: rq.RoleAssistant, Content: `{"n": "one"}`}, conv[1])
+		assert.Contains(t, conv[2].Content, "$.n: expected integer")
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		var prompts []rq.PromptV1
+		reg := providers.NewRegistry(providers.WithModel(
+			replies(&prompts, "not json"),
+			providers.Capabilities{SystemPrompt: true}, llm.ModelMistralLarge,
+		))
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:          llm.ModelMistralLarge,
+			UserPrompt:     "count",
+			ResponseSchema: json.RawMessage(schema),
+		}, &rsp)
+		require.NoError(t, err)
+		var last llm.Token
+		for token := range rsp.Text {
+			last = token
+		}
+		assert.Error(t, last.Err)
+		assert.Len(t, prompts, 3)
+	})
+
+	t.Run("native", func(t *testing.T) {
+		var prompts []rq.PromptV1
+		reg := providers.NewRegistry(providers.WithModel(
+			replies(&prompts, `{"n": 1}`),
+			providers.Capabilities{SystemPrompt: true}, llm.ModelGPT4o,
+		))
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:          llm.ModelGPT4o,
+			UserPrompt:     "count",
+			ResponseSchema: json.RawMessage(schema),
+		}, &rsp)
+		require.NoError(t, err)
+		assert.Equal(t, `{"n": 1}`, collect(t, rsp.Text))
+		assert.Len(t, prompts, 1)
+		assert.JSONEq(t, schema, string(prompts[0].ResponseSchema))
+	})
+
+	t.Run("native invalid", func(t *testing.T) {
+		var prompts []rq.PromptV1
+		reg := providers.NewRegistry(providers.WithModel(
+			replies(&prompts, `{"n": 1.5}`),
+			providers.Capabilities{SystemPrompt: true}, llm.ModelGPT4o,
+		))
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:          llm.ModelGPT4o,
+			UserPrompt:     "count",
+			ResponseSchema: json.RawMessage(schema),
+		}, &rsp)
+		require.NoError(t, err)
+		var tokens []llm.Token
+		for token := range rsp.Text {
+			tokens = append(tokens, token)
+		}
+		require.Len(t, tokens, 1, "invalid JSON must not be streamed")
+		assert.Empty(t, tokens[0].Ok)
+		assert.Error(t, tokens[0].Err)
+		assert.Len(t, prompts, 3)
+	})
+
+	t.Run("invalid schema", func(t *testing.T) {
+		var prompts []rq.PromptV1
+		reg := providers.NewRegistry(providers.WithModel(
+			replies(&prompts, `{}`),
+			providers.Capabilities{SystemPrompt: true}, llm.ModelMistralLarge,
+		))
+		var rsp llm.StreamResponse
+		err := reg.Prompt(ctx, rq.PromptV1{
+			Model:          llm.ModelMistralLarge,
+			UserPrompt:     "count",
+			ResponseSchema: json.RawMessage(`{"type": "date"}`),
+		}, &rsp)
+		assert.True(t, providers.IsBadRequest(err), err)
+		assert.Empty(t, prompts)
+	})
+}
@@ -0,0 +1,105 @@
+// Package pubsub notifies subscribers when a user's balance changes.
+//
+// Local delivers events within one server. A distributed Broker, such as one
+// backed by Redis or Cloud Pub/Sub, can replace it by setting Balances at
+// startup, so that every server hears about changes made by the others.
+package pubsub
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Reason is what changed a user's balance.
+type Reason string
+
+const (
+	ReasonReceipt  Reason = "receipt"
+	ReasonPurchase Reason = "purchase"
+	ReasonAirdrop  Reason = "airdrop"
+	ReasonPromo    Reason = "promo"
+	ReasonAdmin    Reason = "admin"
+	ReasonRefund   Reason = "refund"
+	// ReasonSubscription is a change to the user's plan, which is part of their balance.
+	ReasonSubscription Reason = "subscription"
+)
+
+// BalanceEvent is published after a change to a user's balance is committed.
+type BalanceEvent struct {
+	UserID int64     `json:"userID"`
+	Reason Reason    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+type Broker interface {
+	// Publish delivers the event to the subscribers of its user, and of every user.
+	Publish(ctx context.Context, e BalanceEvent) error
+	// Subscribe returns the events of the user, or of every user if userID is 0,
+	// until the returned function is called, which closes the channel.
+	// Events may be dropped if the subscriber falls behind,
+	// so subscribers should reload the balance rather than count events.
+	Subscribe(userID int64) (<-chan BalanceEvent, func())
+}
+
+// Balances is the broker that balance changes are published to.
+var Balances Broker = NewLocal()
+
+// PublishBalance publishes a change to the user's balance to Balances, logging any error.
+func PublishBalance(ctx context.Context, userID int64, reason Reason) {
+	e := BalanceEvent{UserID: userID, Reason: reason, At: time.Now()}
+	if err := Balances.Publish(ctx, e); err != nil {
+		slog.Error("failed to publish balance event", "userID", userID, "reason", reason, "error", err)
+	}
+}
+
+// subscriberBuffer is how many events a subscriber can fall behind before they are dropped.
+const subscriberBuffer = 16
+
+// Local is a Broker for the subscribers of one process.
+type Local struct {
+	mu   sync.Mutex
+	subs map[int64]map[chan BalanceEvent]struct{}
+}
+
+func NewLocal() *Local {
+	return &Local{subs: make(map[int64]map[chan BalanceEvent]struct{})}
+}
+
+func (l *Local) Publish(ctx context.Context, e BalanceEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, userID := range []int64{e.UserID, 0} {
+		for ch := range l.subs[userID] {
+			select {
+			case ch <- e:
+			default:
+				slog.Debug("dropped balance event for slow subscriber", "userID", e.UserID)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *Local) Subscribe(userID int64) (<-chan BalanceEvent, func()) {
+	ch := make(chan BalanceEvent, subscriberBuffer)
+	l.mu.Lock()
+	if l.subs[userID] == nil {
+		l.subs[userID] = make(map[chan BalanceEvent]struct{})
+	}
+	l.subs[userID][ch] = struct{}{}
+	l.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.subs[userID], ch)
+			if len(l.subs[userID]) == 0 {
+				delete(l.subs, userID)
+			}
+			close(ch)
+		})
+	}
+}
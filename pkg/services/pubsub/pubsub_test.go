@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	broker := NewLocal()
+	user, cancelUser := broker.Subscribe(1)
+	all, cancelAll := broker.Subscribe(0)
+	defer cancelAll()
+
+	broker.Publish(ctx, BalanceEvent{UserID: 1, Reason: ReasonReceipt})
+	broker.Publish(ctx, BalanceEvent{UserID: 2, Reason: ReasonPurchase})
+
+	if e := <-user; e.UserID != 1 || e.Reason != ReasonReceipt {
+		t.Errorf("user subscriber got %+v; expected the receipt of user 1", e)
+	}
+	select {
+	case e := <-user:
+		t.Errorf("user subscriber got %+v; expected only events of user 1", e)
+	default:
+	}
+	for _, expected := range []int64{1, 2} {
+		if e := <-all; e.UserID != expected {
+			t.Errorf("subscriber of every user got user %d; expected %d", e.UserID, expected)
+		}
+	}
+
+	cancelUser()
+	cancelUser()
+	if _, ok := <-user; ok {
+		t.Error("expected the channel to be closed")
+	}
+	broker.Publish(ctx, BalanceEvent{UserID: 1, Reason: ReasonAirdrop})
+}
+
+func TestLocalSlowSubscriber(t *testing.T) {
+	ctx := context.Background()
+	broker := NewLocal()
+	events, cancel := broker.Subscribe(1)
+	defer cancel()
+	for range subscriberBuffer + 5 {
+		broker.Publish(ctx, BalanceEvent{UserID: 1, Reason: ReasonReceipt})
+	}
+	if len(events) != subscriberBuffer {
+		t.Errorf("got %d buffered events; expected %d, with the rest dropped", len(events), subscriberBuffer)
+	}
+}
@@ -15,20 +15,18 @@ import (
 	"github.com/ditto-assistant/backend/pkg/services/db"
 	"github.com/ditto-assistant/backend/pkg/services/llm"
 	"github.com/ditto-assistant/backend/pkg/services/search"
-	"github.com/ditto-assistant/backend/types/ty"
 )
 
 type Service struct {
 	mu     sync.RWMutex
 	apiKey string
 	secr   *secr.Client
-	sd     ty.ShutdownContext
 }
 
 var _ search.Service = (*Service)(nil)
 
-func NewService(sd ty.ShutdownContext, secr *secr.Client) *Service {
-	return &Service{sd: sd, secr: secr}
+func NewService(secr *secr.Client) *Service {
+	return &Service{secr: secr}
 }
 
 const basedURL = "https://api.search.brave.com/res/v1/web/search"
@@ -81,24 +79,25 @@ func (s *Service) Search(ctx context.Context, req search.Request) (search.Result
 	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
-	s.sd.Run(func(ctx context.Context) {
-		receipt := db.Receipt{
-			UserID:      req.User.ID,
-			NumSearches: 1,
-			ServiceName: llm.SearchEngineBrave,
-		}
-		if err := receipt.Insert(ctx); err != nil {
-			slog.Error("failed to insert receipt for brave search", "error", err)
-		}
-		slog.Debug("brave search completed",
-			"user_id", req.User.ID,
-			"balance", req.User.Balance,
-			"service", llm.SearchEngineBrave,
-			"receipt_id", receipt.ID,
-			"service_id", receipt.ServiceID,
-			"num_searches", receipt.NumSearches,
-		)
-	})
+	// The receipt is saved before the results are returned, so that the
+	// caller can report what the search cost.
+	receipt := db.Receipt{
+		UserID:      req.User.ID,
+		NumSearches: 1,
+		HoldID:      req.HoldID,
+		ServiceName: llm.SearchEngineBrave,
+	}
+	if err := receipt.Save(context.WithoutCancel(ctx)); err != nil {
+		slog.Error("failed to insert receipt for brave search", "error", err)
+	}
+	slog.Debug("brave search completed",
+		"user_id", req.User.ID,
+		"balance", req.User.Balance,
+		"service", llm.SearchEngineBrave,
+		"receipt_id", receipt.ID,
+		"service_id", receipt.ServiceID,
+		"num_searches", receipt.NumSearches,
+	)
 	return results, nil
 }
 
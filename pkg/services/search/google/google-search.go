@@ -70,24 +70,25 @@ func (s *Service) Search(ctx context.Context, req search.Request) (results searc
 	if err != nil {
 		return nil, fmt.Errorf("failed to search: %w", err)
 	}
-	s.sd.Run(func(ctx context.Context) {
-		receipt := db.Receipt{
-			UserID:      req.User.ID,
-			NumSearches: 1,
-			ServiceName: llm.SearchEngineGoogle,
-		}
-		if err := receipt.Insert(ctx); err != nil {
-			slog.Error("failed to insert receipt for google search", "error", err)
-		}
-		slog.Debug("google search completed",
-			"user_id", req.User.ID,
-			"balance", req.User.Balance,
-			"service", llm.SearchEngineGoogle,
-			"receipt_id", receipt.ID,
-			"service_id", receipt.ServiceID,
-			"num_searches", receipt.NumSearches,
-		)
-	})
+	// The receipt is saved before the results are returned, so that the
+	// caller can report what the search cost.
+	receipt := db.Receipt{
+		UserID:      req.User.ID,
+		NumSearches: 1,
+		HoldID:      req.HoldID,
+		ServiceName: llm.SearchEngineGoogle,
+	}
+	if err := receipt.Save(context.WithoutCancel(ctx)); err != nil {
+		slog.Error("failed to insert receipt for google search", "error", err)
+	}
+	slog.Debug("google search completed",
+		"user_id", req.User.ID,
+		"balance", req.User.Balance,
+		"service", llm.SearchEngineGoogle,
+		"receipt_id", receipt.ID,
+		"service_id", receipt.ServiceID,
+		"num_searches", receipt.NumSearches,
+	)
 	return &Results{Items: ser.Items}, nil
 }
 
@@ -16,6 +16,8 @@ type Request struct {
 	User       users.User
 	Query      string
 	NumResults int
+	// HoldID is the balance hold the search's receipt settles, if any.
+	HoldID int64
 }
 
 type Results interface {
@@ -2,14 +2,16 @@ package stripe
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"net/http"
 	"strconv"
 	"sync"
 
-	"github.com/ditto-assistant/backend/cfg/envs"
 	"github.com/ditto-assistant/backend/cfg/secr"
 	"github.com/ditto-assistant/backend/pkg/services/authfirebase"
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
 	"github.com/stripe/stripe-go/v80"
 	"github.com/stripe/stripe-go/v80/checkout/session"
 )
@@ -17,6 +19,7 @@ import (
 func (cl *Client) Routes(mux *http.ServeMux) {
 	mux.HandleFunc("POST /v1/stripe/checkout-session", cl.CreateCheckoutSession)
 	mux.HandleFunc("POST /v1/stripe/webhook", cl.HandleWebhook)
+	mux.HandleFunc("GET /v1/purchases", cl.Purchases)
 }
 
 type Client struct {
@@ -24,10 +27,12 @@ type Client struct {
 	auth          *authfirebase.Client
 	mu            sync.RWMutex
 	webhookSecret string
+	events        eventStore
+	process       func(context.Context, stripe.Event) error
 }
 
 func NewClient(secr *secr.Client, auth *authfirebase.Client) *Client {
-	return &Client{secr: secr, auth: auth}
+	return &Client{secr: secr, auth: auth, events: dbEvents{}, process: ProcessEvent}
 }
 
 type requestCreateCheckoutSession struct {
@@ -78,8 +83,12 @@ func (cl *Client) CreateCheckoutSession(w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
+	if plan := r.FormValue("plan"); plan != "" {
+		cl.createSubscriptionSession(w, r, userID, plan)
+		return
+	}
 	usd, err := strconv.ParseInt(r.FormValue("usd"), 10, 64)
-	if err != nil {
+	if err != nil || usd <= 0 {
 		http.Error(w, "invalid USD amount", http.StatusBadRequest)
 		return
 	}
@@ -91,48 +100,45 @@ func (cl *Client) CreateCheckoutSession(w http.ResponseWriter, r *http.Request)
 		USD:        usd,
 	}
 
-	var priceID string
-	quantity := int64(1)
-	if bod.USD < 10 {
-		priceID = envs.PRICE_ID_TOKENS_1B
-		quantity = bod.USD
-	} else if bod.USD == 10 {
-		priceID = envs.PRICE_ID_TOKENS_11B
-	} else if bod.USD == 25 {
-		priceID = envs.PRICE_ID_TOKENS_30B
-	} else if bod.USD == 50 {
-		priceID = envs.PRICE_ID_TOKENS_30B
-		quantity = 2
-	} else if bod.USD == 75 {
-		priceID = envs.PRICE_ID_TOKENS_100B
-	} else if bod.USD == 100 {
-		priceID = envs.PRICE_ID_TOKENS_150B
-	} else {
-		priceID = envs.PRICE_ID_TOKENS_1B
-		quantity = bod.USD
+	pkg, quantity, err := db.PackageForUSD(r.Context(), bod.USD)
+	if errors.Is(err, db.ErrNoPackageForAmount) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
+	// The quantity is fixed, since the webhook credits the package and quantity
+	// in the payment's metadata rather than the amount paid, which includes tax.
+	item := &stripe.CheckoutSessionLineItemParams{Quantity: stripe.Int64(quantity)}
+	if pkg.StripePriceID != "" {
+		item.Price = stripe.String(pkg.StripePriceID)
+	} else {
+		item.PriceData = &stripe.CheckoutSessionLineItemPriceDataParams{
+			Currency:   stripe.String(string(stripe.CurrencyUSD)),
+			UnitAmount: stripe.Int64(pkg.USD * 100),
+			ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+				Name: stripe.String(numfmt.LargeNumber(pkg.Tokens) + " Ditto Tokens"),
+			},
+		}
+	}
 	params := &stripe.CheckoutSessionParams{
 		Metadata: map[string]string{
 			"userID": bod.UserID,
 		},
 		CustomerEmail: bod.Email,
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				Quantity: stripe.Int64(quantity),
-				AdjustableQuantity: &stripe.CheckoutSessionLineItemAdjustableQuantityParams{
-					Enabled: stripe.Bool(true),
-				},
-				Price: stripe.String(priceID),
-			},
-		},
-		Mode:         stripe.String(string(stripe.CheckoutSessionModePayment)),
-		SuccessURL:   bod.SuccessURL,
-		CancelURL:    bod.CancelURL,
-		AutomaticTax: &stripe.CheckoutSessionAutomaticTaxParams{Enabled: stripe.Bool(true)},
+		LineItems:     []*stripe.CheckoutSessionLineItemParams{item},
+		Mode:          stripe.String(string(stripe.CheckoutSessionModePayment)),
+		SuccessURL:    bod.SuccessURL,
+		CancelURL:     bod.CancelURL,
+		AutomaticTax:  &stripe.CheckoutSessionAutomaticTaxParams{Enabled: stripe.Bool(true)},
 		PaymentIntentData: &stripe.CheckoutSessionPaymentIntentDataParams{
 			Metadata: map[string]string{
-				"userID": bod.UserID,
+				"userID":    bod.UserID,
+				"packageID": strconv.FormatInt(pkg.ID, 10),
+				"quantity":  strconv.FormatInt(quantity, 10),
 			},
 		},
 	}
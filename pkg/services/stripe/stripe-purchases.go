@@ -0,0 +1,112 @@
+package stripe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/users"
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
+	"github.com/ditto-assistant/backend/types/rp"
+	"github.com/ditto-assistant/backend/types/rq"
+	"github.com/omniaura/mapcache"
+	"github.com/stripe/stripe-go/v80"
+	"github.com/stripe/stripe-go/v80/paymentintent"
+	"golang.org/x/sync/errgroup"
+)
+
+// Purchases lists the user's purchases, with the Stripe receipt of each payment.
+func (cl *Client) Purchases(w http.ResponseWriter, r *http.Request) {
+	tok, err := cl.auth.VerifyToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var bod rq.PurchasesV1
+	if err := bod.FromQuery(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = tok.Check(bod.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	if err := cl.setupCheckoutSession(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user := users.User{UID: bod.UserID}
+	if err := user.GetByUID(ctx, db.D); err != nil {
+		slog.Error("failed to get user", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	purchases, next, err := db.GetPurchases(ctx, user.ID, bod.Limit, bod.Cursor)
+	if err != nil {
+		slog.Error("failed to get purchases", "uid", bod.UserID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rsp := rp.PurchasesV1{Items: make([]rp.PurchaseV1, len(purchases)), NextCursor: next}
+	// A receipt that can't be fetched is left out rather than failing the page.
+	var g errgroup.Group
+	g.SetLimit(8)
+	for i, p := range purchases {
+		rsp.Items[i] = rp.PurchaseV1{
+			ID:             p.ID,
+			CreatedAt:      p.CreatedAt,
+			Cents:          p.Cents,
+			USD:            numfmt.USD(float64(p.Cents) / 100),
+			TokensRaw:      p.Tokens,
+			Tokens:         numfmt.LargeNumber(p.Tokens),
+			Subscription:   p.SubscriptionID.Valid,
+			RefundedCents:  p.RefundedCents,
+			ReversedTokens: p.ReversedTokens,
+		}
+		if p.PaymentIntentID == "" {
+			continue
+		}
+		g.Go(func() error {
+			url, err := receiptURL(ctx, p.PaymentIntentID)
+			if err != nil && !errors.Is(err, errNoReceipt) {
+				slog.Error("failed to get receipt", "payment_id", p.PaymentIntentID, "error", err)
+			}
+			rsp.Items[i].ReceiptURL = url
+			return nil
+		})
+	}
+	g.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rsp)
+}
+
+// errNoReceipt is returned for a payment intent that has not been charged.
+var errNoReceipt = errors.New("payment has no receipt")
+
+// A charge's receipt URL doesn't change, so it is kept for as long as the user
+// is likely to page through their purchases again.
+var cacheReceipts, _ = mapcache.New[string, string](mapcache.WithTTL(24 * time.Hour))
+
+// receiptURL returns the receipt URL of the latest charge of the payment intent.
+// stripe.Key must be set.
+func receiptURL(ctx context.Context, paymentIntentID string) (string, error) {
+	return cacheReceipts.Get(paymentIntentID, func() (string, error) {
+		params := &stripe.PaymentIntentParams{Params: stripe.Params{Context: ctx}}
+		params.AddExpand("latest_charge")
+		pi, err := paymentintent.Get(paymentIntentID, params)
+		if err != nil {
+			return "", fmt.Errorf("failed to get payment intent %s: %w", paymentIntentID, err)
+		}
+		if pi.LatestCharge == nil || pi.LatestCharge.ReceiptURL == "" {
+			return "", errNoReceipt
+		}
+		return pi.LatestCharge.ReceiptURL, nil
+	})
+}
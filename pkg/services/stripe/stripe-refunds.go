@@ -0,0 +1,81 @@
+package stripe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// handleChargeRefunded takes back the tokens of a refunded purchase.
+func handleChargeRefunded(ctx context.Context, event stripe.Event) error {
+	var charge stripe.Charge
+	if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+		return fmt.Errorf("error parsing charge: %w", err)
+	}
+	if charge.PaymentIntent == nil {
+		slog.Warn("ignoring refund of charge without a payment intent", "charge", charge.ID)
+		return nil
+	}
+	a, applied, err := db.RefundPurchase(ctx, charge.PaymentIntent.ID, charge.ID, charge.AmountRefunded)
+	return logAdjustment(event, a, applied, err)
+}
+
+// handleDispute takes back the tokens of a disputed purchase when the dispute is opened,
+// and restores them if the dispute closes in our favor.
+func handleDispute(ctx context.Context, event stripe.Event) error {
+	var dispute stripe.Dispute
+	if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+		return fmt.Errorf("error parsing dispute: %w", err)
+	}
+	if dispute.PaymentIntent == nil {
+		slog.Warn("ignoring dispute without a payment intent", "dispute", dispute.ID)
+		return nil
+	}
+	var a db.Adjustment
+	var applied bool
+	var err error
+	switch {
+	case event.Type == "charge.dispute.created":
+		a, applied, err = db.DisputePurchase(ctx, dispute.PaymentIntent.ID, dispute.ID, dispute.Amount)
+	case dispute.Status == stripe.DisputeStatusWon || dispute.Status == stripe.DisputeStatusWarningClosed:
+		a, applied, err = db.WinDispute(ctx, dispute.PaymentIntent.ID, dispute.ID)
+	default:
+		slog.Info("dispute lost", "dispute", dispute.ID, "status", dispute.Status)
+		return nil
+	}
+	return logAdjustment(event, a, applied, err)
+}
+
+// logAdjustment logs the result of an adjustment. Every payment Stripe reports
+// becomes a purchase, so one without a purchase has not been recorded yet. The
+// event fails so that Stripe retries it, or it can be replayed, once it has.
+func logAdjustment(event stripe.Event, a db.Adjustment, applied bool, err error) error {
+	if errors.Is(err, db.ErrPurchaseNotFound) {
+		slog.Warn("purchase not recorded yet, adjustment will be retried", "event", event.Type, "error", err)
+		return fmt.Errorf("error adjusting purchase: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	if !applied {
+		slog.Info("adjustment already applied", "event", event.Type, "reference", a.ReferenceID)
+		return nil
+	}
+	slog.Info("purchase adjusted",
+		"event", event.Type,
+		"kind", a.Kind,
+		"purchaseID", a.PurchaseID,
+		"userID", a.UserID,
+		"cents", a.Cents,
+		"tokens", numfmt.LargeNumber(a.Tokens),
+		"balance", numfmt.LargeNumber(a.BalanceAfter),
+		"flagged", a.Flagged,
+	)
+	return nil
+}
@@ -0,0 +1,121 @@
+package stripe
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
+	"github.com/stripe/stripe-go/v80"
+	"github.com/stripe/stripe-go/v80/checkout/session"
+)
+
+// createSubscriptionSession redirects to a checkout session that subscribes the user to the plan.
+func (cl *Client) createSubscriptionSession(w http.ResponseWriter, r *http.Request, userID, planName string) {
+	plan, err := db.GetSubscriptionPlan(r.Context(), planName)
+	if errors.Is(err, db.ErrPlanNotFound) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	metadata := map[string]string{
+		"userID": userID,
+	}
+	params := &stripe.CheckoutSessionParams{
+		Metadata:      metadata,
+		CustomerEmail: ptr(r.FormValue("email")),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Quantity: stripe.Int64(1),
+				Price:    stripe.String(plan.StripePriceID),
+			},
+		},
+		Mode:         stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		SuccessURL:   ptr(r.FormValue("successURL")),
+		CancelURL:    ptr(r.FormValue("cancelURL")),
+		AutomaticTax: &stripe.CheckoutSessionAutomaticTaxParams{Enabled: stripe.Bool(true)},
+		// Invoices copy the subscription's metadata, so the webhook knows whose they are.
+		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+			Metadata: metadata,
+		},
+	}
+	s, err := session.New(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, s.URL, http.StatusSeeOther)
+}
+
+// handleSubscription records a created, updated or deleted subscription.
+func handleSubscription(ctx context.Context, event stripe.Event) error {
+	var s stripe.Subscription
+	if err := json.Unmarshal(event.Data.Raw, &s); err != nil {
+		return fmt.Errorf("error parsing subscription: %w", err)
+	}
+	if s.Items == nil || len(s.Items.Data) == 0 || s.Items.Data[0].Price == nil {
+		return fmt.Errorf("subscription %s has no price", s.ID)
+	}
+	sub := db.Subscription{
+		StripeSubscriptionID: s.ID,
+		Status:               string(s.Status),
+		CancelAtPeriodEnd:    s.CancelAtPeriodEnd,
+	}
+	if s.CurrentPeriodEnd > 0 {
+		sub.CurrentPeriodEnd = sql.NullTime{Time: time.Unix(s.CurrentPeriodEnd, 0), Valid: true}
+	}
+	if err := sub.Upsert(ctx, s.Metadata["userID"], s.Items.Data[0].Price.ID); err != nil {
+		return err
+	}
+	slog.Info("subscription recorded",
+		"event", event.Type,
+		"subscription", s.ID,
+		"userID", sub.UserID,
+		"status", sub.Status,
+		"cancelAtPeriodEnd", sub.CancelAtPeriodEnd,
+	)
+	return nil
+}
+
+// handleInvoicePaid grants the monthly allowance of a paid subscription invoice.
+// If the subscription has not been recorded yet, it returns an error so that
+// Stripe retries the event after the subscription's own event.
+func handleInvoicePaid(ctx context.Context, event stripe.Event) error {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
+		return fmt.Errorf("error parsing invoice: %w", err)
+	}
+	if inv.Subscription == nil {
+		slog.Debug("ignoring paid invoice without a subscription", "invoice", inv.ID)
+		return nil
+	}
+	var paymentIntentID string
+	if inv.PaymentIntent != nil {
+		paymentIntentID = inv.PaymentIntent.ID
+	}
+	p, granted, err := db.GrantAllowance(ctx, inv.Subscription.ID, inv.ID, paymentIntentID, inv.AmountPaid)
+	if err != nil {
+		return err
+	}
+	if !granted {
+		slog.Info("allowance already granted", "invoice", inv.ID)
+		return nil
+	}
+	slog.Info("allowance granted",
+		"invoice", inv.ID,
+		"subscription", inv.Subscription.ID,
+		"userID", p.UserID,
+		"cents", p.Cents,
+		"tokens", numfmt.LargeNumber(p.Tokens),
+	)
+	return nil
+}
@@ -3,11 +3,13 @@ package stripe
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/ditto-assistant/backend/pkg/services/db"
 	"github.com/ditto-assistant/backend/pkg/utils/numfmt"
@@ -15,25 +17,6 @@ import (
 	"github.com/stripe/stripe-go/v80/webhook"
 )
 
-// calculateTokens determines the number of tokens based on payment amount in cents
-func calculateTokens(cents int64) int64 {
-	switch cents {
-	case 1000: // $10
-		return 11_000_000_000 // 11B tokens (10% bonus)
-	case 2500: // $25
-		return 30_000_000_000 // 30B tokens (20% bonus)
-	case 5000: // $50
-		return 65_000_000_000 // 65B tokens (30% bonus)
-	case 7500: // $75
-		return 100_000_000_000 // 100B tokens (33% bonus)
-	case 10000: // $100
-		return 150_000_000_000 // 150B tokens (50% bonus)
-	default:
-		// Default: $1 per 1B tokens
-		return (cents / 100) * 1_000_000_000
-	}
-}
-
 const webhookSecretId = "STRIPE_WEBHOOK_SECRET"
 
 func (cl *Client) setupWebhook(ctx context.Context) error {
@@ -90,40 +73,142 @@ func (cl *Client) HandleWebhook(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	err = handleEvent(r.Context(), cl.events, cl.process, event, payload)
+	switch {
+	case errors.Is(err, db.ErrEventProcessed):
+		slog.Info("ignoring duplicate event", "event", event.ID, "type", event.Type)
+	case errors.Is(err, db.ErrEventInProgress):
+		// Stripe retries the delivery later, in case this one fails.
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		slog.Error("error handling event", "event", event.ID, "type", event.Type, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// eventStore records which webhook events have been processed.
+type eventStore interface {
+	Claim(ctx context.Context, id, typ string, payload []byte) error
+	Finish(ctx context.Context, id string, processErr error) error
+}
+
+// dbEvents is the eventStore of the stripe_events table.
+type dbEvents struct{}
+
+func (dbEvents) Claim(ctx context.Context, id, typ string, payload []byte) error {
+	return db.ClaimStripeEvent(ctx, id, typ, payload)
+}
+
+func (dbEvents) Finish(ctx context.Context, id string, processErr error) error {
+	return db.FinishStripeEvent(ctx, id, processErr)
+}
+
+// handleEvent claims the event, processes it, and records whether it succeeded.
+// It returns db.ErrEventProcessed or db.ErrEventInProgress if the event cannot be claimed.
+func handleEvent(ctx context.Context, events eventStore, process func(context.Context, stripe.Event) error, event stripe.Event, payload []byte) error {
+	if err := events.Claim(ctx, event.ID, string(event.Type), payload); err != nil {
+		return err
+	}
+	err := process(ctx, event)
+	if finishErr := events.Finish(ctx, event.ID, err); finishErr != nil {
+		slog.Error("failed to record stripe event", "event", event.ID, "error", finishErr)
+	}
+	return err
+}
+
+// ReplayEvent processes a recorded event again, unless it succeeded or is being processed.
+func ReplayEvent(ctx context.Context, e db.StripeEvent) error {
+	var event stripe.Event
+	if err := json.Unmarshal(e.Payload, &event); err != nil {
+		return fmt.Errorf("error parsing event %s: %w", e.ID, err)
+	}
+	return handleEvent(ctx, dbEvents{}, ProcessEvent, event, e.Payload)
+}
+
+// ProcessEvent applies a verified webhook event.
+// Events that are not handled are ignored.
+func ProcessEvent(ctx context.Context, event stripe.Event) error {
 	switch event.Type {
 	case "payment_intent.succeeded":
-		var paymentIntent stripe.PaymentIntent
-		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
-		if err != nil {
-			slog.Error("error parsing webhook JSON", "error", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		uid := paymentIntent.Metadata["userID"]
-		id := paymentIntent.ID
-		tokens := calculateTokens(paymentIntent.Amount)
-		slog.Info("successful payment",
-			"amount", paymentIntent.Amount,
-			"userID", uid,
-			"payment_id", id,
-			"tokens", tokens,
-		)
-		p := db.Purchase{
-			PaymentID: id,
-			Cents:     paymentIntent.Amount,
-			Tokens:    tokens,
-		}
-		err = p.Insert(r.Context(), db.D, uid)
-		if err != nil {
-			slog.Error("error inserting purchase", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		slog.Info("purchase inserted", "id", p.ID, "tokens", numfmt.LargeNumber(p.Tokens))
-
+		return handlePaymentIntentSucceeded(ctx, event)
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		return handleSubscription(ctx, event)
+	case "invoice.paid":
+		return handleInvoicePaid(ctx, event)
+	case "charge.refunded":
+		return handleChargeRefunded(ctx, event)
+	case "charge.dispute.created", "charge.dispute.closed":
+		return handleDispute(ctx, event)
 	default:
 		slog.Debug("unhandled event type", "type", event.Type)
+		return nil
 	}
+}
 
-	w.WriteHeader(http.StatusOK)
+// purchasedTokens returns the tokens a one-time payment bought, which are those
+// of the package and quantity checkout wrote into the payment's metadata.
+func purchasedTokens(ctx context.Context, paymentIntent stripe.PaymentIntent) (int64, error) {
+	packageID, ok := paymentIntent.Metadata["packageID"]
+	if !ok {
+		// Checkouts opened before packages were written into the metadata.
+		slog.Warn("payment has no package, crediting by amount", "payment_id", paymentIntent.ID)
+		return db.TokensForCents(ctx, paymentIntent.Amount)
+	}
+	id, err := strconv.ParseInt(packageID, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid package ID %q: %w", packageID, err)
+	}
+	quantity, err := strconv.ParseInt(paymentIntent.Metadata["quantity"], 10, 64)
+	if err != nil || quantity <= 0 {
+		return 0, fmt.Errorf("invalid package quantity %q", paymentIntent.Metadata["quantity"])
+	}
+	pkg, err := db.GetPackage(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	return pkg.Tokens * quantity, nil
+}
+
+// handlePaymentIntentSucceeded records a one-time purchase.
+func handlePaymentIntentSucceeded(ctx context.Context, event stripe.Event) error {
+	var paymentIntent stripe.PaymentIntent
+	if err := json.Unmarshal(event.Data.Raw, &paymentIntent); err != nil {
+		return fmt.Errorf("error parsing payment intent: %w", err)
+	}
+	if paymentIntent.Invoice != nil {
+		// Subscription payments are granted by invoice.paid.
+		slog.Debug("ignoring invoice payment", "payment_id", paymentIntent.ID)
+		return nil
+	}
+	uid := paymentIntent.Metadata["userID"]
+	id := paymentIntent.ID
+	tokens, err := purchasedTokens(ctx, paymentIntent)
+	if err != nil {
+		return err
+	}
+	slog.Info("successful payment",
+		"amount", paymentIntent.Amount,
+		"userID", uid,
+		"payment_id", id,
+		"tokens", tokens,
+	)
+	p := db.Purchase{
+		PaymentID: id,
+		Cents:     paymentIntent.Amount,
+		Tokens:    tokens,
+	}
+	err = p.Insert(ctx, db.D, uid)
+	if errors.Is(err, db.ErrPurchaseExists) {
+		slog.Info("purchase already inserted", "payment_id", id)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error inserting purchase: %w", err)
+	}
+	slog.Info("purchase inserted", "id", p.ID, "tokens", numfmt.LargeNumber(p.Tokens))
+	return nil
 }
@@ -0,0 +1,201 @@
+package stripe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/ditto-assistant/backend/pkg/services/db"
+	"github.com/ditto-assistant/backend/pkg/services/db/dbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v80"
+	"github.com/stripe/stripe-go/v80/webhook"
+)
+
+const testSecret = "whsec_test"
+
+// fakeEvents is an eventStore that mirrors the stripe_events table.
+type fakeEvents struct {
+	mu     sync.Mutex
+	status map[string]db.StripeEventStatus
+}
+
+func (f *fakeEvents) Claim(ctx context.Context, id, typ string, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status == nil {
+		f.status = make(map[string]db.StripeEventStatus)
+	}
+	switch f.status[id] {
+	case db.StripeEventSucceeded:
+		return db.ErrEventProcessed
+	case db.StripeEventProcessing:
+		return db.ErrEventInProgress
+	}
+	f.status[id] = db.StripeEventProcessing
+	return nil
+}
+
+func (f *fakeEvents) Finish(ctx context.Context, id string, processErr error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status[id] = db.StripeEventSucceeded
+	if processErr != nil {
+		f.status[id] = db.StripeEventFailed
+	}
+	return nil
+}
+
+// testClient returns a client whose process function counts events by ID,
+// failing while fail is set.
+func testClient(fail *bool) (*Client, *fakeEvents, map[string]int) {
+	events := &fakeEvents{}
+	processed := make(map[string]int)
+	cl := &Client{
+		webhookSecret: testSecret,
+		events:        events,
+		process: func(ctx context.Context, event stripe.Event) error {
+			processed[event.ID]++
+			if *fail {
+				return errors.New("database unavailable")
+			}
+			return nil
+		},
+	}
+	return cl, events, processed
+}
+
+// deliver posts the event to the webhook, signed with secret.
+func deliver(t *testing.T, cl *Client, id, secret string) int {
+	t.Helper()
+	payload, err := json.Marshal(map[string]any{
+		"id":          id,
+		"object":      "event",
+		"type":        "payment_intent.succeeded",
+		"api_version": stripe.APIVersion,
+		"data": map[string]any{
+			"object": map[string]any{"id": "pi_test", "object": "payment_intent", "amount": 1000},
+		},
+	})
+	require.NoError(t, err)
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secret})
+	req := httptest.NewRequest(http.MethodPost, "/v1/stripe/webhook", bytes.NewReader(signed.Payload))
+	req.Header.Set("Stripe-Signature", signed.Header)
+	rec := httptest.NewRecorder()
+	cl.HandleWebhook(rec, req)
+	return rec.Code
+}
+
+func TestWebhookDuplicateDelivery(t *testing.T) {
+	var fail bool
+	cl, events, processed := testClient(&fail)
+	assert.Equal(t, http.StatusOK, deliver(t, cl, "evt_1", testSecret))
+	assert.Equal(t, http.StatusOK, deliver(t, cl, "evt_1", testSecret))
+	assert.Equal(t, 1, processed["evt_1"], "a duplicate delivery must not be processed again")
+	assert.Equal(t, db.StripeEventSucceeded, events.status["evt_1"])
+
+	assert.Equal(t, http.StatusOK, deliver(t, cl, "evt_2", testSecret))
+	assert.Equal(t, 1, processed["evt_2"])
+}
+
+func TestWebhookRetriesFailedEvent(t *testing.T) {
+	fail := true
+	cl, events, processed := testClient(&fail)
+	assert.Equal(t, http.StatusInternalServerError, deliver(t, cl, "evt_1", testSecret))
+	assert.Equal(t, db.StripeEventFailed, events.status["evt_1"])
+
+	fail = false
+	assert.Equal(t, http.StatusOK, deliver(t, cl, "evt_1", testSecret))
+	assert.Equal(t, 2, processed["evt_1"])
+	assert.Equal(t, db.StripeEventSucceeded, events.status["evt_1"])
+}
+
+func TestWebhookEventInProgress(t *testing.T) {
+	var fail bool
+	cl, events, processed := testClient(&fail)
+	require.NoError(t, events.Claim(context.Background(), "evt_1", "payment_intent.succeeded", nil))
+	assert.Equal(t, http.StatusConflict, deliver(t, cl, "evt_1", testSecret))
+	assert.Zero(t, processed["evt_1"])
+}
+
+func TestWebhookRejectsBadSignature(t *testing.T) {
+	var fail bool
+	cl, events, processed := testClient(&fail)
+	assert.Equal(t, http.StatusBadRequest, deliver(t, cl, "evt_1", "whsec_wrong"))
+	assert.Zero(t, processed["evt_1"])
+	assert.NotContains(t, events.status, "evt_1")
+}
+
+func TestPurchasedTokens(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	pkg, quantity, err := db.PackageForUSD(ctx, 25)
+	require.NoError(t, err, "the migration seeds the packages")
+	require.Equal(t, int64(1), quantity)
+
+	t.Run("from metadata", func(t *testing.T) {
+		// The amount includes tax, which is not credited.
+		tokens, err := purchasedTokens(ctx, stripe.PaymentIntent{Amount: 5300, Metadata: map[string]string{
+			"packageID": strconv.FormatInt(pkg.ID, 10),
+			"quantity":  "2",
+		}})
+		require.NoError(t, err)
+		assert.Equal(t, 2*pkg.Tokens, tokens)
+	})
+
+	t.Run("deactivated package", func(t *testing.T) {
+		require.NoError(t, db.DeactivatePackage(ctx, pkg.ID))
+		tokens, err := purchasedTokens(ctx, stripe.PaymentIntent{Amount: 2500, Metadata: map[string]string{
+			"packageID": strconv.FormatInt(pkg.ID, 10),
+			"quantity":  "1",
+		}})
+		require.NoError(t, err)
+		assert.Equal(t, pkg.Tokens, tokens)
+	})
+
+	t.Run("no metadata", func(t *testing.T) {
+		tokens, err := purchasedTokens(ctx, stripe.PaymentIntent{Amount: 1000})
+		require.NoError(t, err)
+		assert.Equal(t, int64(11_000_000_000), tokens)
+	})
+
+	t.Run("invalid quantity", func(t *testing.T) {
+		_, err := purchasedTokens(ctx, stripe.PaymentIntent{Metadata: map[string]string{
+			"packageID": strconv.FormatInt(pkg.ID, 10),
+			"quantity":  "0",
+		}})
+		assert.Error(t, err)
+	})
+}
+
+func TestRefundBeforePurchase(t *testing.T) {
+	dbtest.Setup(t)
+	ctx := context.Background()
+	uid := "refund-before-purchase"
+	_, err := db.D.ExecContext(ctx, "INSERT INTO users (uid, balance) VALUES (?, 0)", uid)
+	require.NoError(t, err)
+	raw, err := json.Marshal(stripe.Charge{
+		ID:             "ch_early",
+		PaymentIntent:  &stripe.PaymentIntent{ID: "pi_early"},
+		AmountRefunded: 500,
+	})
+	require.NoError(t, err)
+	event := stripe.Event{Type: "charge.refunded", Data: &stripe.EventData{Raw: raw}}
+
+	err = handleChargeRefunded(ctx, event)
+	assert.ErrorIs(t, err, db.ErrPurchaseNotFound, "the event fails so that it is retried")
+
+	purchase := db.Purchase{PaymentID: "pi_early", Cents: 500, Tokens: 1_000_000_000}
+	require.NoError(t, purchase.Insert(ctx, db.D, uid))
+	require.NoError(t, handleChargeRefunded(ctx, event))
+	var balance int64
+	require.NoError(t, db.D.QueryRowContext(ctx, "SELECT balance FROM users WHERE uid = ?", uid).Scan(&balance))
+	assert.Zero(t, balance, "the retried refund takes back the purchase")
+}
@@ -0,0 +1,109 @@
+package img
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+// downscaleQuality is the JPEG quality of downscaled images.
+const downscaleQuality = 85
+
+// maxDownscaleSteps is how many times downscale shrinks an image
+// that is still larger than maxBytes before giving up.
+const maxDownscaleSteps = 5
+
+// maxDecodePixels is the most pixels downscale decodes, about that of a
+// 50 megapixel photo. A small file can declare far larger dimensions,
+// and decoding it would allocate memory for every pixel.
+const maxDecodePixels = 50_000_000
+
+// needsDownscale reports whether the image is larger than maxBytes
+// or has a side longer than maxDimension.
+func needsDownscale(data []byte, maxDimension int, maxBytes int64) bool {
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return true
+	}
+	if maxDimension <= 0 {
+		return false
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	return max(cfg.Width, cfg.Height) > maxDimension
+}
+
+// downscale shrinks the image so its longest side is at most maxDimension,
+// if set, and re-encodes it as a JPEG of at most maxBytes, if set.
+// Transparent areas become white.
+func downscale(data []byte, maxDimension int, maxBytes int64) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxDecodePixels {
+		return nil, fmt.Errorf("%w: %dx%d is more than %d megapixels",
+			ErrTooLarge, cfg.Width, cfg.Height, maxDecodePixels/1_000_000)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	b := src.Bounds()
+	scale := 1.0
+	if longest := max(b.Dx(), b.Dy()); maxDimension > 0 && longest > maxDimension {
+		scale = float64(maxDimension) / float64(longest)
+	}
+	for range maxDownscaleSteps {
+		w := max(1, int(float64(b.Dx())*scale))
+		h := max(1, int(float64(b.Dy())*scale))
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resize(src, w, h), &jpeg.Options{Quality: downscaleQuality}); err != nil {
+			return nil, fmt.Errorf("error encoding image: %w", err)
+		}
+		if maxBytes <= 0 || int64(buf.Len()) <= maxBytes {
+			return buf.Bytes(), nil
+		}
+		scale *= 0.75
+	}
+	return nil, fmt.Errorf("%w: still larger than %d MB after downscaling", ErrTooLarge, maxBytes>>20)
+}
+
+// resize scales src to w by h by averaging the source pixels under each
+// destination pixel, which suits the large reductions of photos and screenshots.
+func resize(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		y0 := b.Min.Y + y*sh/h
+		y1 := max(y0+1, b.Min.Y+(y+1)*sh/h)
+		for x := range w {
+			x0 := b.Min.X + x*sw/w
+			x1 := max(x0+1, b.Min.X+(x+1)*sw/w)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// The colors are premultiplied, so adding the missing alpha
+			// composites the pixel onto white.
+			white := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + white),
+				G: uint16(g/n + white),
+				B: uint16(bl/n + white),
+				A: 0xffff,
+			})
+		}
+	}
+	return dst
+}
@@ -3,8 +3,15 @@ package img
 import (
 	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
 )
 
 type ImageData struct {
@@ -13,32 +20,192 @@ type ImageData struct {
 	MediaType string
 }
 
-func GetImageData(ctx context.Context, url string) (*ImageData, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
+// Bucket reads images stored in Ditto's own content bucket.
+type Bucket interface {
+	// OpenImage opens the object at url, if it belongs to the user.
+	// ok is false if url is not in the bucket.
+	OpenImage(ctx context.Context, userID, url string) (body io.ReadCloser, ok bool, err error)
+}
+
+// ContentBucket, if set, is used instead of a public GET for images it stores.
+var ContentBucket Bucket
+
+var (
+	// ErrTooLarge is returned for an image larger than the allowed size.
+	ErrTooLarge = errors.New("image too large")
+	// ErrUnsupportedType is returned for content that is not an allowed image type.
+	ErrUnsupportedType = errors.New("unsupported image type")
+)
+
+// AllowedTypes are the image types every vision provider accepts.
+var AllowedTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+const (
+	// DefaultMaxBytes is the largest image fetched if no limit is given.
+	DefaultMaxBytes = 20 << 20
+	// maxDownloadBytes is the most read from any image URL,
+	// even if the image will be downscaled to fit.
+	maxDownloadBytes = 32 << 20
+)
+
+// maxConcurrentFetches is the most images GetAll fetches at once.
+const maxConcurrentFetches = 4
+
+type options struct {
+	maxBytes     int64
+	downscale    bool
+	maxDimension int
+	userID       string
+}
+
+type Option func(*options)
+
+// WithMaxBytes sets the largest image accepted, which defaults to DefaultMaxBytes.
+func WithMaxBytes(n int64) Option {
+	return func(o *options) {
+		o.maxBytes = n
+	}
+}
+
+// WithUserID sets the user whose images in the ContentBucket may be read.
+// Without it, no image in the ContentBucket is read.
+func WithUserID(userID string) Option {
+	return func(o *options) {
+		o.userID = userID
+	}
+}
+
+// WithDownscale shrinks images larger than the byte limit, or with a side
+// longer than maxDimension if it is positive, instead of rejecting them.
+// Downscaled images are re-encoded as JPEG. WebP images cannot be downscaled.
+func WithDownscale(maxDimension int) Option {
+	return func(o *options) {
+		o.downscale = true
+		o.maxDimension = maxDimension
+	}
+}
+
+// GetImageData fetches a single image.
+// Only public http and https URLs and the user's images in the ContentBucket
+// are fetched, and only AllowedTypes are accepted.
+func GetImageData(ctx context.Context, url string, opts ...Option) (*ImageData, error) {
+	o := options{maxBytes: DefaultMaxBytes}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return getImageData(ctx, url, o)
+}
+
+// GetAll fetches the images concurrently, as GetImageData does, returning them by URL.
+func GetAll(ctx context.Context, urls []string, opts ...Option) (map[string]*ImageData, error) {
+	o := options{maxBytes: DefaultMaxBytes}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	images := make(map[string]*ImageData, len(urls))
+	if len(urls) == 0 {
+		return images, nil
+	}
+	results := make([]*ImageData, len(urls))
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(maxConcurrentFetches)
+	for i, url := range urls {
+		if _, ok := images[url]; ok {
+			continue
+		}
+		images[url] = nil
+		group.Go(func() error {
+			data, err := getImageData(ctx, url, o)
+			if err != nil {
+				return fmt.Errorf("image %d: %w", i+1, err)
+			}
+			results[i] = data
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	for i, url := range urls {
+		if results[i] != nil {
+			images[url] = results[i]
+		}
+	}
+	return images, nil
+}
+
+func getImageData(ctx context.Context, url string, o options) (*ImageData, error) {
+	body, err := open(ctx, url, o.userID)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer body.Close()
 
-	// Read the response body
-	img, err := io.ReadAll(resp.Body)
+	// Read at most one byte past the limit, to tell if the image is over it.
+	limit := o.maxBytes
+	if o.downscale {
+		limit = maxDownloadBytes
+	}
+	img, err := io.ReadAll(io.LimitReader(body, limit+1))
 	if err != nil {
 		return nil, err
 	}
+	if int64(len(img)) > limit {
+		return nil, fmt.Errorf("%w: the limit is %d MB", ErrTooLarge, limit>>20)
+	}
 
-	// Detect content type
 	contentType := http.DetectContentType(img)
-
-	// Determine media type (e.g., "image/jpeg" -> "jpeg")
-	mediaType := contentType[6:] // Remove "image/" prefix
+	if !slices.Contains(AllowedTypes, contentType) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, contentType)
+	}
+	if o.downscale && contentType != "image/webp" && needsDownscale(img, o.maxDimension, o.maxBytes) {
+		img, err = downscale(img, o.maxDimension, o.maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		contentType = "image/jpeg"
+	}
+	if int64(len(img)) > o.maxBytes {
+		return nil, fmt.Errorf("%w: the limit is %d MB", ErrTooLarge, o.maxBytes>>20)
+	}
 
 	return &ImageData{
 		Base64:    base64.StdEncoding.EncodeToString(img),
 		MimeType:  contentType,
-		MediaType: mediaType,
+		MediaType: strings.TrimPrefix(contentType, "image/"),
 	}, nil
 }
+
+// open reads the image from the content bucket if it is stored there,
+// or fetches it otherwise.
+func open(ctx context.Context, urlStr, userID string) (io.ReadCloser, error) {
+	if ContentBucket != nil {
+		body, ok, err := ContentBucket.OpenImage(ctx, userID, urlStr)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return body, nil
+		}
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid image URL: unsupported scheme %q", u.Scheme)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error fetching image: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,236 @@
+package img
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type fakeBucket struct {
+	prefix string
+	data   []byte
+	// userID is the only user whose images may be read.
+	userID string
+}
+
+func (b fakeBucket) OpenImage(ctx context.Context, userID, url string) (io.ReadCloser, bool, error) {
+	if !strings.HasPrefix(url, b.prefix) {
+		return nil, false, nil
+	}
+	if userID != b.userID {
+		return nil, true, errors.New("forbidden")
+	}
+	return io.NopCloser(bytes.NewReader(b.data)), true, nil
+}
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// bombPNG returns a small PNG whose header declares it is w by h pixels.
+func bombPNG(t *testing.T, w, h uint32) []byte {
+	t.Helper()
+	data := encodePNG(t, 8, 8)
+	// The IHDR chunk follows the 8-byte signature: its length, type,
+	// width and height, then the rest of its data and a CRC of its type and data.
+	binary.BigEndian.PutUint32(data[16:], w)
+	binary.BigEndian.PutUint32(data[20:], h)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestGetAll(t *testing.T) {
+	pngData := encodePNG(t, 8, 8)
+	largePNG := encodePNG(t, 400, 300)
+	bomb := bombPNG(t, 100_000, 100_000)
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/missing.png":
+			http.NotFound(w, r)
+		case "/large.png":
+			w.Write(make([]byte, 2048))
+		case "/page.html":
+			w.Write([]byte("<html><body>hello</body></html>"))
+		case "/photo.png":
+			w.Write(largePNG)
+		case "/bomb.png":
+			w.Write(bomb)
+		default:
+			w.Write(pngData)
+		}
+	}))
+	defer srv.Close()
+	// The test server is on loopback, which the default client refuses.
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = newHTTPClient(func(netip.Addr) bool { return true })
+	ctx := context.Background()
+
+	t.Run("fetches each URL once", func(t *testing.T) {
+		requests.Store(0)
+		urls := []string{srv.URL + "/a.png", srv.URL + "/b.png", srv.URL + "/a.png"}
+		images, err := GetAll(ctx, urls, WithMaxBytes(1024))
+		if err != nil {
+			t.Fatalf("GetAll() error = %v", err)
+		}
+		if len(images) != 2 {
+			t.Errorf("len(images) = %d, want 2", len(images))
+		}
+		if got := images[urls[1]].MimeType; got != "image/png" {
+			t.Errorf("MimeType = %q, want image/png", got)
+		}
+		if got := requests.Load(); got != 2 {
+			t.Errorf("requests = %d, want 2", got)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		_, err := GetAll(ctx, []string{srv.URL + "/a.png", srv.URL + "/large.png"}, WithMaxBytes(1024))
+		if !errors.Is(err, ErrTooLarge) {
+			t.Errorf("GetAll() error = %v, want ErrTooLarge", err)
+		}
+	})
+
+	t.Run("not an image", func(t *testing.T) {
+		_, err := GetAll(ctx, []string{srv.URL + "/page.html"})
+		if !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("GetAll() error = %v, want ErrUnsupportedType", err)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := GetAll(ctx, []string{srv.URL + "/missing.png"})
+		if err == nil {
+			t.Error("GetAll() error = nil, want an error")
+		}
+	})
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		_, err := GetImageData(ctx, "file:///etc/passwd")
+		if err == nil {
+			t.Error("GetImageData() error = nil, want an error")
+		}
+	})
+
+	t.Run("too many pixels to downscale", func(t *testing.T) {
+		_, err := GetAll(ctx, []string{srv.URL + "/bomb.png"}, WithDownscale(100))
+		if !errors.Is(err, ErrTooLarge) {
+			t.Errorf("GetAll() error = %v, want ErrTooLarge", err)
+		}
+	})
+
+	t.Run("downscale", func(t *testing.T) {
+		url := srv.URL + "/photo.png"
+		images, err := GetAll(ctx, []string{url}, WithDownscale(100))
+		if err != nil {
+			t.Fatalf("GetAll() error = %v", err)
+		}
+		if got := images[url].MimeType; got != "image/jpeg" {
+			t.Errorf("MimeType = %q, want image/jpeg", got)
+		}
+		data, err := base64.StdEncoding.DecodeString(images[url].Base64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != 100 || cfg.Height != 75 {
+			t.Errorf("size = %dx%d, want 100x75", cfg.Width, cfg.Height)
+		}
+	})
+
+	t.Run("small images kept", func(t *testing.T) {
+		url := srv.URL + "/a.png"
+		images, err := GetAll(ctx, []string{url}, WithDownscale(100))
+		if err != nil {
+			t.Fatalf("GetAll() error = %v", err)
+		}
+		if got := images[url].MimeType; got != "image/png" {
+			t.Errorf("MimeType = %q, want image/png", got)
+		}
+	})
+
+	t.Run("content bucket", func(t *testing.T) {
+		requests.Store(0)
+		ContentBucket = fakeBucket{prefix: "https://content.example.com/", data: pngData, userID: "user"}
+		defer func() { ContentBucket = nil }()
+		url := "https://content.example.com/user/image.png?sig=abc"
+		if _, err := GetAll(ctx, []string{url}); err == nil {
+			t.Error("GetAll() without a user read from the content bucket")
+		}
+		images, err := GetAll(ctx, []string{url}, WithUserID("user"))
+		if err != nil {
+			t.Fatalf("GetAll() error = %v", err)
+		}
+		if images[url] == nil {
+			t.Fatal("image missing from result")
+		}
+		if got := requests.Load(); got != 0 {
+			t.Errorf("requests = %d, want 0", got)
+		}
+	})
+}
+
+func TestBlockedAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the loopback server")
+	}))
+	defer srv.Close()
+	_, err := GetImageData(context.Background(), srv.URL+"/a.png")
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("GetImageData() error = %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"fd00:ec2::254", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+		{"64:ff9b::a00:1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := isPublic(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("isPublic(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package img
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// fetchTimeout is the longest an image fetch may take, including redirects.
+const fetchTimeout = 30 * time.Second
+
+// maxRedirects is the most redirects followed when fetching an image.
+const maxRedirects = 5
+
+// ErrBlockedAddress is returned for an image URL that resolves to an address
+// the server must not fetch from, such as a private network or cloud metadata.
+var ErrBlockedAddress = errors.New("image URL is not publicly routable")
+
+// blockedPrefixes are special-purpose ranges not covered by the netip methods below.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, which can reach IPv4 private ranges
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("fd00:ec2::/32"),  // AWS IPv6 metadata, also covered by IsPrivate
+	netip.MustParsePrefix("2002::/16"),      // 6to4, which can embed private IPv4
+	netip.MustParsePrefix("2001::/32"),      // Teredo, likewise
+}
+
+// isPublic reports whether addr is a globally routable unicast address.
+// Link-local covers 169.254.169.254, the cloud metadata server.
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() ||
+		addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified() {
+		return false
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// newHTTPClient returns a client that only connects to addresses allowed by allow.
+// The check runs on the resolved address of every connection, including
+// redirects, so a hostname cannot be pointed at an internal address.
+func newHTTPClient(allow func(netip.Addr) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, address)
+			}
+			if !allow(ap.Addr()) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, ap.Addr())
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		// Proxies would bypass the address check.
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   fetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: redirect to %s URL", ErrBlockedAddress, req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// httpClient fetches user-supplied image URLs.
+var httpClient = newHTTPClient(isPublic)
@@ -0,0 +1,259 @@
+// Package jsonschema validates JSON documents against the subset of JSON Schema
+// used for structured model output: type, properties, required,
+// additionalProperties, items, enum, anyOf, nullable and the basic numeric,
+// string and array bounds. Other keywords, such as description, are ignored.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Schema is a parsed JSON Schema.
+type Schema struct {
+	// Type is one or more of object, array, string, number, integer, boolean and null.
+	Type       []string
+	Properties map[string]*Schema
+	Required   []string
+	// AdditionalProperties is false if an object may only have the listed properties.
+	AdditionalProperties *bool
+	Items                *Schema
+	Enum                 []any
+	AnyOf                []*Schema
+	// Nullable is the OpenAPI form of allowing null, as used by Gemini.
+	Nullable bool
+
+	Minimum   *float64
+	Maximum   *float64
+	MinLength *int
+	MaxLength *int
+	MinItems  *int
+	MaxItems  *int
+}
+
+var validTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// Parse parses a JSON Schema object.
+// A schema whose only type is null is rejected, since not every provider
+// supports it, except as a branch of anyOf, which makes the value nullable.
+func Parse(data []byte) (*Schema, error) {
+	return parse(data, false)
+}
+
+func parse(data []byte, anyOfBranch bool) (*Schema, error) {
+	var raw struct {
+		Type                 json.RawMessage            `json:"type"`
+		Properties           map[string]json.RawMessage `json:"properties"`
+		Required             []string                   `json:"required"`
+		AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+		Items                json.RawMessage            `json:"items"`
+		Enum                 []any                      `json:"enum"`
+		AnyOf                []json.RawMessage          `json:"anyOf"`
+		Nullable             bool                       `json:"nullable"`
+		Minimum              *float64                   `json:"minimum"`
+		Maximum              *float64                   `json:"maximum"`
+		MinLength            *int                       `json:"minLength"`
+		MaxLength            *int                       `json:"maxLength"`
+		MinItems             *int                       `json:"minItems"`
+		MaxItems             *int                       `json:"maxItems"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("schema must be a JSON object: %w", err)
+	}
+	s := &Schema{
+		Required:  raw.Required,
+		Enum:      raw.Enum,
+		Nullable:  raw.Nullable,
+		Minimum:   raw.Minimum,
+		Maximum:   raw.Maximum,
+		MinLength: raw.MinLength,
+		MaxLength: raw.MaxLength,
+		MinItems:  raw.MinItems,
+		MaxItems:  raw.MaxItems,
+	}
+	if len(raw.Type) > 0 {
+		var one string
+		if err := json.Unmarshal(raw.Type, &one); err == nil {
+			s.Type = []string{one}
+		} else if err := json.Unmarshal(raw.Type, &s.Type); err != nil {
+			return nil, errors.New("type must be a string or an array of strings")
+		}
+		for _, t := range s.Type {
+			// OpenAPI schemas, as used by Gemini, write types in upper case.
+			if !slices.Contains(validTypes, strings.ToLower(t)) {
+				return nil, fmt.Errorf("unknown type: %q", t)
+			}
+		}
+		if !anyOfBranch && !slices.ContainsFunc(s.Type, func(t string) bool { return !strings.EqualFold(t, "null") }) {
+			return nil, errors.New("type cannot be only null")
+		}
+	}
+	if len(raw.Properties) > 0 {
+		s.Properties = make(map[string]*Schema, len(raw.Properties))
+		for name, prop := range raw.Properties {
+			ps, err := parse(prop, false)
+			if err != nil {
+				return nil, fmt.Errorf("properties.%s: %w", name, err)
+			}
+			s.Properties[name] = ps
+		}
+	}
+	if len(raw.AdditionalProperties) > 0 {
+		var allowed bool
+		// A schema for additional properties is accepted but not checked.
+		if err := json.Unmarshal(raw.AdditionalProperties, &allowed); err == nil {
+			s.AdditionalProperties = &allowed
+		}
+	}
+	if len(raw.Items) > 0 {
+		items, err := parse(raw.Items, false)
+		if err != nil {
+			return nil, fmt.Errorf("items: %w", err)
+		}
+		s.Items = items
+	}
+	for i, sub := range raw.AnyOf {
+		ss, err := parse(sub, true)
+		if err != nil {
+			return nil, fmt.Errorf("anyOf[%d]: %w", i, err)
+		}
+		s.AnyOf = append(s.AnyOf, ss)
+	}
+	return s, nil
+}
+
+// Validate checks that data is a single JSON value matching the schema.
+func (s *Schema) Validate(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if dec.More() {
+		return errors.New("invalid JSON: unexpected data after the top-level value")
+	}
+	return s.validate(v, "$")
+}
+
+func (s *Schema) validate(v any, path string) error {
+	if v == nil && s.Nullable {
+		return nil
+	}
+	if len(s.Type) > 0 && !slices.ContainsFunc(s.Type, func(t string) bool { return hasType(v, strings.ToLower(t)) }) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(s.Type, " or "), typeOf(v))
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return equal(e, v) }) {
+		return fmt.Errorf("%s: value is not one of the allowed values", path)
+	}
+	if len(s.AnyOf) > 0 {
+		matched := slices.ContainsFunc(s.AnyOf, func(sub *Schema) bool { return sub.validate(v, path) == nil })
+		if !matched {
+			return fmt.Errorf("%s: value does not match any allowed schema", path)
+		}
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		for name, pv := range v {
+			ps, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := ps.validate(pv, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: expected at least %d items, got %d", path, *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: expected at most %d items, got %d", path, *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: expected at least %d characters, got %d", path, *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: expected at most %d characters, got %d", path, *s.MaxLength, n)
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s: %s is less than the minimum of %g", path, v, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s: %s is greater than the maximum of %g", path, v, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+func hasType(v any, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case []any:
+		return t == "array"
+	case map[string]any:
+		return t == "object"
+	case json.Number:
+		if t == "number" {
+			return true
+		}
+		if t == "integer" {
+			f, err := v.Float64()
+			return err == nil && f == float64(int64(f))
+		}
+	}
+	return false
+}
+
+func typeOf(v any) string {
+	for _, t := range validTypes {
+		if t != "integer" && hasType(v, t) {
+			return t
+		}
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// equal compares decoded JSON values, treating numbers by value.
+func equal(a, b any) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, _ := an.Float64()
+		bf, _ := bn.Float64()
+		return af == bf
+	}
+	ab, err1 := json.Marshal(a)
+	bb, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(ab, bb)
+}
@@ -0,0 +1,86 @@
+package jsonschema
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	const summary = `{
+		"type": "object",
+		"properties": {
+			"title": {"type": "string", "minLength": 1, "maxLength": 20},
+			"score": {"type": "integer", "minimum": 0, "maximum": 10},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"mood": {"type": "string", "enum": ["happy", "sad"]},
+			"note": {"type": ["string", "null"]}
+		},
+		"required": ["title", "score"],
+		"additionalProperties": false
+	}`
+	tests := []struct {
+		name    string
+		schema  string
+		input   string
+		wantErr bool
+	}{
+		{"valid", summary, `{"title": "Trip", "score": 7, "tags": ["a"], "mood": "happy", "note": null}`, false},
+		{"missing required", summary, `{"title": "Trip"}`, true},
+		{"wrong type", summary, `{"title": "Trip", "score": "7"}`, true},
+		{"not an integer", summary, `{"title": "Trip", "score": 7.5}`, true},
+		{"below minimum", summary, `{"title": "Trip", "score": -1}`, true},
+		{"above maximum", summary, `{"title": "Trip", "score": 11}`, true},
+		{"empty string", summary, `{"title": "", "score": 1}`, true},
+		{"too long", summary, `{"title": "aaaaaaaaaaaaaaaaaaaaa", "score": 1}`, true},
+		{"too many items", summary, `{"title": "Trip", "score": 1, "tags": ["a", "b", "c"]}`, true},
+		{"wrong item type", summary, `{"title": "Trip", "score": 1, "tags": [1]}`, true},
+		{"not in enum", summary, `{"title": "Trip", "score": 1, "mood": "angry"}`, true},
+		{"additional property", summary, `{"title": "Trip", "score": 1, "extra": true}`, true},
+		{"invalid JSON", summary, `{"title": "Trip", "score": 1`, true},
+		{"trailing data", summary, `{"title": "Trip", "score": 1} {}`, true},
+		{"markdown fence", summary, "```json\n{\"title\": \"Trip\", \"score\": 1}\n```", true},
+		{"additional allowed", `{"type": "object"}`, `{"anything": [1, 2]}`, false},
+		{"openapi upper case", `{"type": "OBJECT", "properties": {"n": {"type": "NUMBER", "nullable": true}}}`, `{"n": null}`, false},
+		{"any of", `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `3`, false},
+		{"any of mismatch", `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `true`, true},
+		{"numeric enum", `{"enum": [1, 2]}`, `2.0`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse([]byte(tt.schema))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			err = s.Validate([]byte(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate(%s) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr bool
+	}{
+		{"object", `{"type": "object", "properties": {"a": {"type": "string"}}}`, false},
+		{"type list", `{"type": ["string", "null"]}`, false},
+		{"unknown keywords ignored", `{"type": "string", "description": "a name", "format": "email"}`, false},
+		{"not an object", `"string"`, true},
+		{"unknown type", `{"type": "date"}`, true},
+		{"bad nested type", `{"type": "object", "properties": {"a": {"type": 1}}}`, true},
+		{"bad items", `{"type": "array", "items": {"type": "list"}}`, true},
+		{"only null", `{"type": "null"}`, true},
+		{"only null list", `{"type": "object", "properties": {"a": {"type": ["null"]}}}`, true},
+		{"null anyOf branch", `{"anyOf": [{"type": "string"}, {"type": "null"}]}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.schema))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse(%s) error = %v, wantErr %v", tt.schema, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"cloud.google.com/go/firestore"
 	"github.com/ditto-assistant/backend/cfg/envs"
 	"github.com/ditto-assistant/backend/pkg/services/filestorage"
+	"github.com/ditto-assistant/backend/pkg/services/llm"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -26,6 +27,17 @@ type BalanceV1 struct {
 	TotalAirdroppedRaw int64      `json:"totalAirdroppedRaw,omitempty"`
 	TotalAirdropped    string     `json:"totalAirdropped,omitempty"`
 	LastAirdropAt      *time.Time `json:"lastAirdropAt,omitempty"`
+	// RedeemedRaw and Redeemed are the tokens granted by a redeemed code.
+	RedeemedRaw int64  `json:"redeemedRaw,omitempty"`
+	Redeemed    string `json:"redeemed,omitempty"`
+	// Plan is the name of the user's subscription plan, if they have one.
+	Plan          string `json:"plan,omitempty"`
+	PlanTokensRaw int64  `json:"planTokensRaw,omitempty"`
+	PlanTokens    string `json:"planTokens,omitempty"`
+	PlanStatus    string `json:"planStatus,omitempty"`
+	// PlanRenewsAt is when the next allowance is due, or when the plan ends if PlanCanceling.
+	PlanRenewsAt  *time.Time `json:"planRenewsAt,omitempty"`
+	PlanCanceling bool       `json:"planCanceling,omitempty"`
 }
 
 func (BalanceV1) Zeroes() BalanceV1 {
@@ -40,6 +52,122 @@ func (BalanceV1) Zeroes() BalanceV1 {
 	}
 }
 
+// ToolErrorV2 is the data of the tool_error event, sent when a server tool fails.
+// The model is told of the failure in the tool's result.
+type ToolErrorV2 struct {
+	ToolCallID string `json:"toolCallId"`
+	Name       string `json:"name"`
+	Error      string `json:"error"`
+}
+
+// PromptUsageV2 is the data of the done event that ends a PromptV2 stream.
+// Token counts and cost are summed over every model step.
+type PromptUsageV2 struct {
+	FinishReason llm.FinishReason `json:"finishReason"`
+	Model        llm.ServiceName  `json:"model"`
+	InputTokens  int              `json:"inputTokens"`
+	OutputTokens int              `json:"outputTokens"`
+	// Cost is the Ditto tokens charged for the prompt,
+	// including its server tool calls.
+	Cost int64 `json:"cost"`
+	// ToolCost is the part of Cost charged for server tool calls,
+	// such as searches and generated images.
+	ToolCost int64 `json:"toolCost"`
+}
+
+// UsageV1 is a page of a user's usage, newest first.
+type UsageV1 struct {
+	Items []UsageItemV1 `json:"items"`
+	// Total sums every receipt in the date range, not just this page.
+	Total      UsageItemV1 `json:"total"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// UsageItemV1 is a single receipt, or the sum of a group of receipts.
+type UsageItemV1 struct {
+	// ID is the receipt ID, for receipts listed individually.
+	ID int64 `json:"id,omitempty"`
+	// Timestamp is when the receipt was recorded, for receipts listed individually.
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// Group is the service name, service type or YYYY-MM-DD day of a group.
+	Group       string          `json:"group,omitempty"`
+	Service     llm.ServiceName `json:"service,omitempty"`
+	ServiceType string          `json:"serviceType,omitempty"`
+	// Calls is the number of receipts summed.
+	Calls          int64  `json:"calls"`
+	InputTokens    int64  `json:"inputTokens"`
+	OutputTokens   int64  `json:"outputTokens"`
+	TotalTokens    int64  `json:"totalTokens"`
+	Images         int64  `json:"images"`
+	Searches       int64  `json:"searches"`
+	DittoTokenCost int64  `json:"dittoTokenCost"`
+	Cost           string `json:"cost"`
+	USD            string `json:"usd"`
+}
+
+// LimitsV1 are a user's spending limits, and their spend against them.
+type LimitsV1 struct {
+	Daily           *int64 `json:"daily"`
+	Monthly         *int64 `json:"monthly"`
+	PerRequest      *int64 `json:"perRequest"`
+	AlertPercentage int64  `json:"alertPercentage"`
+	// SpentToday and SpentThisMonth are in Ditto tokens since the start of the
+	// UTC day and month, including prompts in progress.
+	SpentToday     int64 `json:"spentToday"`
+	SpentThisMonth int64 `json:"spentThisMonth"`
+	// Alerts are the periods, daily or monthly,
+	// whose spend has reached the alert percentage of its cap.
+	Alerts []string `json:"alerts,omitempty"`
+}
+
+// PackageV1 is a token package for sale in the store.
+// Check out a package by posting its USD to /v1/stripe/checkout-session.
+type PackageV1 struct {
+	ID        int64  `json:"id"`
+	USD       int64  `json:"usd"`
+	TokensRaw int64  `json:"tokensRaw"`
+	Tokens    string `json:"tokens"`
+	// BonusPercent is how many more tokens the package has than the base rate.
+	BonusPercent int64 `json:"bonusPercent"`
+}
+
+// PurchasesV1 is a page of a user's purchases, newest first.
+type PurchasesV1 struct {
+	Items      []PurchaseV1 `json:"items"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// PurchaseV1 is a token purchase, or a subscription's monthly allowance.
+type PurchaseV1 struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Cents     int64     `json:"cents"`
+	USD       string    `json:"usd"`
+	// TokensRaw and Tokens are the tokens granted, before any refund.
+	TokensRaw    int64  `json:"tokensRaw"`
+	Tokens       string `json:"tokens"`
+	Subscription bool   `json:"subscription"`
+	// RefundedCents is how much of the payment was refunded, and
+	// ReversedTokens how many tokens refunds and disputes took back.
+	RefundedCents  int64 `json:"refundedCents"`
+	ReversedTokens int64 `json:"reversedTokens"`
+	// ReceiptURL is the Stripe receipt of the payment, if it has one.
+	ReceiptURL string `json:"receiptURL,omitempty"`
+}
+
+// ReferralV1 is a user's referral code, which grants tokens to the user who
+// redeems it, and to its owner once that user first pays for tokens.
+type ReferralV1 struct {
+	Code string `json:"code"`
+	// Tokens are granted to whoever redeems the code.
+	Tokens string `json:"tokens"`
+	// ReferrerTokens are granted to the owner for each user who redeems
+	// the code and then pays for tokens.
+	ReferrerTokens string `json:"referrerTokens"`
+	// Referrals is how many users have redeemed the code.
+	Referrals int64 `json:"referrals"`
+}
+
 // Memory represents a conversation memory with vector similarity
 type Memory struct {
 	ID                 string             `json:"id"`
@@ -1,12 +1,17 @@
 package rq
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/ditto-assistant/backend/pkg/services/llm"
+	"github.com/ditto-assistant/backend/pkg/utils/jsonschema"
 )
 
 type ChatV2 struct {
@@ -20,6 +25,265 @@ type PromptV1 struct {
 	Model        llm.ServiceName `json:"model,omitempty"`
 	ImageURL     string          `json:"imageURL,omitempty"`
 	Images       []string        `json:"images,omitempty"`
+	// Messages is the conversation history, oldest first.
+	// UserPrompt and ImageURL, if set, are sent as the final user message.
+	Messages []Message `json:"messages,omitempty"`
+	// Tools are functions the model may call instead of, or as well as, replying.
+	Tools []Tool `json:"tools,omitempty"`
+	// ServerTools are built-in tools, such as web_search, that the backend
+	// runs itself before continuing the response. Only PromptV2 supports them.
+	ServerTools []string `json:"serverTools,omitempty"`
+
+	// Generation parameters. If unset, each provider uses its own default.
+	// Parameters a provider does not support are ignored:
+	// TopK is ignored by OpenAI and Cerebras models, Seed by Claude,
+	// and o1 models accept only MaxOutputTokens and Seed.
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	TopK            *int     `json:"topK,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+	Seed            *int     `json:"seed,omitempty"`
+
+	// ResponseSchema is a JSON Schema the response must match.
+	// If set, the response is a single JSON value and the prompt may not use tools.
+	ResponseSchema json.RawMessage `json:"responseSchema,omitempty"`
+}
+
+// MaxStopSequences is the most stop sequences every provider accepts.
+const MaxStopSequences = 4
+
+// TemperatureOr returns Temperature, or def if it is unset.
+func (p PromptV1) TemperatureOr(def float64) float64 {
+	if p.Temperature == nil {
+		return def
+	}
+	return *p.Temperature
+}
+
+// TopPOr returns TopP, or def if it is unset.
+func (p PromptV1) TopPOr(def float64) float64 {
+	if p.TopP == nil {
+		return def
+	}
+	return *p.TopP
+}
+
+// TopKOr returns TopK, or def if it is unset.
+func (p PromptV1) TopKOr(def int) int {
+	if p.TopK == nil {
+		return def
+	}
+	return *p.TopK
+}
+
+// MaxOutputTokensOr returns MaxOutputTokens, or def if it is unset.
+func (p PromptV1) MaxOutputTokensOr(def int) int {
+	if p.MaxOutputTokens == 0 {
+		return def
+	}
+	return p.MaxOutputTokens
+}
+
+// Tool is a function the model may call.
+type Tool struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Parameters is a JSON Schema object describing the arguments.
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+// Schema returns the parameters schema, or an empty object schema if there is none.
+func (t Tool) Schema() json.RawMessage {
+	if len(t.Parameters) == 0 {
+		return json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	return t.Parameters
+}
+
+// ToolResult is the output of a tool call, sent back to the model.
+type ToolResult struct {
+	ToolCallID string `json:"toolCallId"`
+	Name       string `json:"name"`
+	Content    string `json:"content"`
+}
+
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+type Message struct {
+	Role    Role     `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+	// ToolCalls are the calls made in an assistant message.
+	ToolCalls []llm.ToolCall `json:"toolCalls,omitempty"`
+	// ToolResults answer the previous assistant message's tool calls.
+	ToolResults []ToolResult `json:"toolResults,omitempty"`
+}
+
+// Conversation returns Messages followed by the final user message built
+// from UserPrompt, ImageURL and Images.
+func (p PromptV1) Conversation() []Message {
+	if p.UserPrompt == "" && p.ImageURL == "" && len(p.Images) == 0 {
+		return p.Messages
+	}
+	msgs := make([]Message, 0, len(p.Messages)+1)
+	msgs = append(msgs, p.Messages...)
+	last := Message{Role: RoleUser, Content: p.UserPrompt}
+	if p.ImageURL != "" {
+		last.Images = append(last.Images, p.ImageURL)
+	}
+	last.Images = append(last.Images, p.Images...)
+	return append(msgs, last)
+}
+
+// ClearFinalMessage removes the final user message built from
+// UserPrompt, ImageURL and Images, leaving only Messages.
+func (p *PromptV1) ClearFinalMessage() {
+	p.UserPrompt = ""
+	p.ImageURL = ""
+	p.Images = nil
+}
+
+// HasImages reports whether any message in the conversation has an image.
+func (p PromptV1) HasImages() bool {
+	return p.ImageCount() > 0
+}
+
+// ImageCount returns the number of images in the conversation.
+func (p PromptV1) ImageCount() int {
+	var n int
+	for _, m := range p.Conversation() {
+		n += len(m.Images)
+	}
+	return n
+}
+
+// imageTokenEstimate is the most input tokens any provider charges for an image.
+const imageTokenEstimate = 1600
+
+// EstimateInputTokens returns a deliberately high estimate of the prompt's
+// input tokens, for reserving its cost before it is sent.
+// It assumes 3 characters per token, fewer than any provider's tokenizer averages.
+func (p PromptV1) EstimateInputTokens() int {
+	chars := len(p.SystemPrompt) + len(p.ResponseSchema)
+	for _, t := range p.Tools {
+		chars += len(t.Name) + len(t.Description) + len(t.Parameters)
+	}
+	var images int
+	for _, m := range p.Conversation() {
+		chars += len(m.Content)
+		images += len(m.Images)
+		for _, tc := range m.ToolCalls {
+			chars += len(tc.Name) + len(tc.Arguments)
+		}
+		for _, tr := range m.ToolResults {
+			chars += len(tr.Content)
+		}
+	}
+	return chars/3 + 1 + images*imageTokenEstimate
+}
+
+// ImageURLs returns the URLs of every image in the conversation, in order.
+func ImageURLs(conv []Message) []string {
+	var urls []string
+	for _, m := range conv {
+		urls = append(urls, m.Images...)
+	}
+	return urls
+}
+
+// UsesTools reports whether the prompt defines tools or the conversation has tool calls.
+func (p PromptV1) UsesTools() bool {
+	if len(p.Tools) > 0 {
+		return true
+	}
+	for _, m := range p.Messages {
+		if len(m.ToolCalls) > 0 || len(m.ToolResults) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the conversation is not empty and that
+// every message has a known role. Only user messages may have images
+// or tool results, and only assistant messages may have tool calls.
+func (p PromptV1) Validate() error {
+	msgs := p.Conversation()
+	if len(msgs) == 0 {
+		return errors.New("userPrompt or messages is required")
+	}
+	for i, m := range msgs {
+		switch m.Role {
+		case RoleUser:
+			if len(m.ToolCalls) > 0 {
+				return fmt.Errorf("message %d: only assistant messages may have tool calls", i)
+			}
+		case RoleAssistant:
+			if len(m.Images) > 0 {
+				return fmt.Errorf("message %d: only user messages may have images", i)
+			}
+			if len(m.ToolResults) > 0 {
+				return fmt.Errorf("message %d: only user messages may have tool results", i)
+			}
+		default:
+			return fmt.Errorf("message %d: invalid role: %q", i, m.Role)
+		}
+	}
+	names := make(map[string]bool, len(p.Tools))
+	for i, t := range p.Tools {
+		if t.Name == "" {
+			return fmt.Errorf("tool %d: name is required", i)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("tool %d: duplicate name: %q", i, t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Parameters) > 0 && !json.Valid(t.Parameters) {
+			return fmt.Errorf("tool %q: parameters must be a JSON Schema object", t.Name)
+		}
+	}
+	if len(p.ResponseSchema) > 0 {
+		if p.UsesTools() || len(p.ServerTools) > 0 {
+			return errors.New("responseSchema cannot be used with tools")
+		}
+		if _, err := jsonschema.Parse(p.ResponseSchema); err != nil {
+			return fmt.Errorf("responseSchema: %w", err)
+		}
+	}
+	return p.validateParams()
+}
+
+// validateParams checks the generation parameters against the widest ranges
+// any provider accepts. Per-model token and temperature limits are checked
+// by the caller.
+func (p PromptV1) validateParams() error {
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2, got %g", *p.Temperature)
+	}
+	if p.TopP != nil && (*p.TopP <= 0 || *p.TopP > 1) {
+		return fmt.Errorf("topP must be greater than 0 and at most 1, got %g", *p.TopP)
+	}
+	if p.TopK != nil && *p.TopK < 1 {
+		return fmt.Errorf("topK must be at least 1, got %d", *p.TopK)
+	}
+	if p.MaxOutputTokens < 0 {
+		return fmt.Errorf("maxOutputTokens must be positive, got %d", p.MaxOutputTokens)
+	}
+	if len(p.StopSequences) > MaxStopSequences {
+		return fmt.Errorf("at most %d stopSequences are allowed, got %d", MaxStopSequences, len(p.StopSequences))
+	}
+	for i, s := range p.StopSequences {
+		if s == "" {
+			return fmt.Errorf("stopSequences[%d] is empty", i)
+		}
+	}
+	return nil
 }
 
 type SearchV1 struct {
@@ -70,6 +334,8 @@ type BalanceV1 struct {
 	Version  string `json:"version"`
 	Platform int    `json:"platform"`
 	DeviceID string `json:"deviceId"`
+	// EmailVerified is set from the auth token, for airdrops that require a verified email.
+	EmailVerified bool `json:"-"`
 }
 
 func (b *BalanceV1) FromQuery(r *http.Request) error {
@@ -88,6 +354,228 @@ func (b *BalanceV1) FromQuery(r *http.Request) error {
 	return nil
 }
 
+// UsageGroup is how UsageV1 groups receipts.
+type UsageGroup string
+
+const (
+	// UsageGroupNone lists receipts individually.
+	UsageGroupNone        UsageGroup = ""
+	UsageGroupService     UsageGroup = "service"
+	UsageGroupDay         UsageGroup = "day"
+	UsageGroupServiceType UsageGroup = "serviceType"
+)
+
+const (
+	defaultUsageLimit = 50
+	maxUsageLimit     = 500
+)
+
+type UsageV1 struct {
+	UserID string
+	// From and To bound the receipt timestamps, From inclusive and To exclusive.
+	// Either may be zero for an open range.
+	From, To time.Time
+	GroupBy  UsageGroup
+	Limit    int
+	// Cursor is the nextCursor of the previous page.
+	Cursor string
+}
+
+// FromQuery parses the usage query parameters.
+// from and to are RFC 3339 timestamps or YYYY-MM-DD dates in UTC.
+// A to date includes the whole of that day.
+func (u *UsageV1) FromQuery(r *http.Request) error {
+	q := r.URL.Query()
+	u.UserID = q.Get("userID")
+	if u.UserID == "" {
+		return errors.New("userID is required")
+	}
+	var err error
+	if u.From, err = parseUsageTime(q.Get("from"), false); err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+	if u.To, err = parseUsageTime(q.Get("to"), true); err != nil {
+		return fmt.Errorf("invalid to: %w", err)
+	}
+	if !u.From.IsZero() && !u.To.IsZero() && !u.From.Before(u.To) {
+		return errors.New("from must be before to")
+	}
+	u.GroupBy = UsageGroup(q.Get("groupBy"))
+	switch u.GroupBy {
+	case UsageGroupNone, UsageGroupService, UsageGroupDay, UsageGroupServiceType:
+	default:
+		return fmt.Errorf("invalid groupBy %q: must be service, day or serviceType", u.GroupBy)
+	}
+	u.Limit = defaultUsageLimit
+	if limit := q.Get("limit"); limit != "" {
+		u.Limit, err = strconv.Atoi(limit)
+		if err != nil || u.Limit <= 0 {
+			return errors.New("limit must be a positive integer")
+		}
+		u.Limit = min(u.Limit, maxUsageLimit)
+	}
+	u.Cursor = q.Get("cursor")
+	if u.Cursor != "" {
+		if u.GroupBy == UsageGroupNone {
+			if _, err := ParseReceiptCursor(u.Cursor); err != nil {
+				return err
+			}
+		} else if n, err := strconv.ParseInt(u.Cursor, 10, 64); err != nil || n < 0 {
+			return errors.New("invalid cursor")
+		}
+	}
+	return nil
+}
+
+// ReceiptCursor is the last receipt on a page of receipts,
+// which are listed by timestamp and then ID, newest first.
+// Receipts can be inserted after others with later timestamps,
+// so the ID alone does not mark a place in that order.
+type ReceiptCursor struct {
+	Timestamp time.Time
+	ID        int64
+}
+
+// String formats the cursor as <unix seconds>_<id>.
+func (c ReceiptCursor) String() string {
+	return fmt.Sprintf("%d_%d", c.Timestamp.Unix(), c.ID)
+}
+
+// ParseReceiptCursor parses a cursor formatted by ReceiptCursor.String.
+func ParseReceiptCursor(s string) (ReceiptCursor, error) {
+	ts, id, ok := strings.Cut(s, "_")
+	if !ok {
+		return ReceiptCursor{}, errors.New("invalid cursor")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sec < 0 {
+		return ReceiptCursor{}, errors.New("invalid cursor")
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n < 0 {
+		return ReceiptCursor{}, errors.New("invalid cursor")
+	}
+	return ReceiptCursor{Timestamp: time.Unix(sec, 0).UTC(), ID: n}, nil
+}
+
+func parseUsageTime(s string, endOfDay bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("must be RFC 3339 or YYYY-MM-DD")
+	}
+	return t.UTC(), nil
+}
+
+type PurchasesV1 struct {
+	UserID string
+	Limit  int
+	// Cursor is the nextCursor of the previous page.
+	Cursor string
+}
+
+// FromQuery parses the purchases query parameters.
+// limit and cursor page through purchases as they do usage.
+func (p *PurchasesV1) FromQuery(r *http.Request) error {
+	q := r.URL.Query()
+	p.UserID = q.Get("userID")
+	if p.UserID == "" {
+		return errors.New("userID is required")
+	}
+	p.Limit = defaultUsageLimit
+	if limit := q.Get("limit"); limit != "" {
+		var err error
+		p.Limit, err = strconv.Atoi(limit)
+		if err != nil || p.Limit <= 0 {
+			return errors.New("limit must be a positive integer")
+		}
+		p.Limit = min(p.Limit, maxUsageLimit)
+	}
+	p.Cursor = q.Get("cursor")
+	if p.Cursor != "" {
+		if n, err := strconv.ParseInt(p.Cursor, 10, 64); err != nil || n < 0 {
+			return errors.New("invalid cursor")
+		}
+	}
+	return nil
+}
+
+type LimitsV1 struct {
+	UserID string `json:"userID"`
+	// Daily, Monthly and PerRequest are spending caps in Ditto tokens.
+	// A null cap is no limit.
+	Daily      *int64 `json:"daily"`
+	Monthly    *int64 `json:"monthly"`
+	PerRequest *int64 `json:"perRequest"`
+	// AlertPercentage is the share of the daily or monthly cap at which
+	// the user is alerted. It defaults to 80.
+	AlertPercentage *int64 `json:"alertPercentage,omitempty"`
+}
+
+// FromQuery reads the userID of a request for, or to delete, the limits.
+func (l *LimitsV1) FromQuery(r *http.Request) error {
+	l.UserID = r.URL.Query().Get("userID")
+	if l.UserID == "" {
+		return errors.New("userID is required")
+	}
+	return nil
+}
+
+func (l LimitsV1) Validate() error {
+	if l.UserID == "" {
+		return errors.New("userID is required")
+	}
+	if l.Daily != nil && *l.Daily < 0 {
+		return errors.New("daily must not be negative")
+	}
+	if l.Monthly != nil && *l.Monthly < 0 {
+		return errors.New("monthly must not be negative")
+	}
+	if l.PerRequest != nil && *l.PerRequest < 0 {
+		return errors.New("perRequest must not be negative")
+	}
+	if l.AlertPercentage != nil && (*l.AlertPercentage < 1 || *l.AlertPercentage > 100) {
+		return errors.New("alertPercentage must be between 1 and 100")
+	}
+	return nil
+}
+
+type RedeemV1 struct {
+	UserID string `json:"userID"`
+	// Code is a promo or referral code, which is not case sensitive.
+	Code string `json:"code"`
+}
+
+func (r RedeemV1) Validate() error {
+	if r.UserID == "" {
+		return errors.New("userID is required")
+	}
+	if strings.TrimSpace(r.Code) == "" {
+		return errors.New("code is required")
+	}
+	return nil
+}
+
+type ReferralV1 struct {
+	UserID string `json:"userID"`
+}
+
+func (r *ReferralV1) FromQuery(req *http.Request) error {
+	r.UserID = req.URL.Query().Get("userID")
+	if r.UserID == "" {
+		return errors.New("userID is required")
+	}
+	return nil
+}
+
 type PresignedURLV1 struct {
 	UserID string `json:"userID"`
 	URL    string `json:"url"`